@@ -2,6 +2,7 @@ package tools
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
@@ -928,17 +929,13 @@ func (d *Dispatcher) executeQueryCell(ctx context.Context, action Action) Result
 		timeout = time.Duration(timeoutParam) * time.Second
 	}
 
-	// Build request/response topics
+	// Build request topic; the cell replies to the request itself
 	requestTopic := projectID + ":queries"
-	responseTopic := projectID + ":query-results"
 
-	// Allow custom topics
+	// Allow custom topic
 	if reqTopic, ok := action.Params["request_topic"].(string); ok {
 		requestTopic = reqTopic
 	}
-	if respTopic, ok := action.Params["response_topic"].(string); ok {
-		responseTopic = respTopic
-	}
 
 	// Prepare query data
 	queryData := map[string]interface{}{
@@ -953,8 +950,8 @@ func (d *Dispatcher) executeQueryCell(ctx context.Context, action Action) Result
 		}
 	}
 
-	// Send query and wait for response
-	event, err := d.cellManager.PublishAndWait(requestTopic, responseTopic, queryData, timeout)
+	// Send query and wait for the reply to it
+	response, err := d.requestCell(ctx, requestTopic, queryData, timeout)
 	if err != nil {
 		return Result{
 			Action:  action,
@@ -967,8 +964,30 @@ func (d *Dispatcher) executeQueryCell(ctx context.Context, action Action) Result
 		Action:  action,
 		Success: true,
 		Message: "Query completed successfully",
-		Output:  event.Data,
+		Output:  response,
+	}
+}
+
+// requestCell sends data as a request to the agents subscribed to topic and
+// returns the payload of the reply, so concurrent requests never receive
+// each other's responses
+func (d *Dispatcher) requestCell(ctx context.Context, topic string, data interface{}, timeout time.Duration) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	reply, err := d.cellManager.Request(ctx, topic, "event", data)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload interface{}
+	if err := json.Unmarshal(reply.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("invalid reply on topic %s: %w", topic, err)
+	}
+	if response, ok := payload.(map[string]interface{}); ok {
+		return response, nil
 	}
+	return map[string]interface{}{"payload": payload}, nil
 }
 
 // executeExtractEntities extracts named entities from text using NER cell
@@ -1046,12 +1065,7 @@ func (d *Dispatcher) executeExtractEntities(ctx context.Context, action Action)
 		timeout = time.Duration(timeoutParam) * time.Second
 	}
 
-	event, err := d.cellManager.PublishAndWait(
-		"text:for-ner",
-		"entities:results",
-		nerRequest,
-		timeout,
-	)
+	response, err := d.requestCell(ctx, "text:for-ner", nerRequest, timeout)
 	if err != nil {
 		return Result{
 			Action:  action,
@@ -1064,7 +1078,7 @@ func (d *Dispatcher) executeExtractEntities(ctx context.Context, action Action)
 		Action:  action,
 		Success: true,
 		Message: "Entity extraction completed",
-		Output:  event.Data,
+		Output:  response,
 	}
 }
 
@@ -1137,12 +1151,7 @@ func (d *Dispatcher) executeAnonymizeText(ctx context.Context, action Action) Re
 		timeout = time.Duration(timeoutParam) * time.Second
 	}
 
-	nerEvent, err := d.cellManager.PublishAndWait(
-		"text:for-analysis",
-		"entities:detected",
-		nerRequest,
-		timeout,
-	)
+	nerResponse, err := d.requestCell(ctx, "text:for-analysis", nerRequest, timeout)
 	if err != nil {
 		return Result{
 			Action:  action,
@@ -1152,7 +1161,7 @@ func (d *Dispatcher) executeAnonymizeText(ctx context.Context, action Action) Re
 	}
 
 	// Extract entities from NER response
-	entities, ok := nerEvent.Data["entities"].([]interface{})
+	entities, ok := nerResponse["entities"].([]interface{})
 	if !ok || len(entities) == 0 {
 		return Result{
 			Action:  action,
@@ -1168,12 +1177,7 @@ func (d *Dispatcher) executeAnonymizeText(ctx context.Context, action Action) Re
 		"project_id": projectID,
 	}
 
-	anonEvent, err := d.cellManager.PublishAndWait(
-		"entities:detected",
-		"text:anonymized",
-		anonRequest,
-		timeout,
-	)
+	anonResponse, err := d.requestCell(ctx, "entities:detected", anonRequest, timeout)
 	if err != nil {
 		return Result{
 			Action:  action,
@@ -1186,7 +1190,7 @@ func (d *Dispatcher) executeAnonymizeText(ctx context.Context, action Action) Re
 		Action:  action,
 		Success: true,
 		Message: "Text anonymized successfully",
-		Output:  anonEvent.Data,
+		Output:  anonResponse,
 	}
 }
 
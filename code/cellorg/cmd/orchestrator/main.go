@@ -28,9 +28,12 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/tenzoki/agen/cellorg/internal/auth"
 	"github.com/tenzoki/agen/cellorg/internal/broker"
 	"github.com/tenzoki/agen/cellorg/internal/config"
 	"github.com/tenzoki/agen/cellorg/internal/deployer"
+	"github.com/tenzoki/agen/cellorg/internal/federation"
+	"github.com/tenzoki/agen/cellorg/internal/schema"
 	"github.com/tenzoki/agen/cellorg/internal/support"
 )
 
@@ -162,6 +165,12 @@ func main() {
 		log.Printf("Debug enabled for app: %s", cfg.AppName)
 	}
 
+	// TLS, agent credentials and topic ACLs shared by support and broker
+	guard, err := auth.NewGuard(cfg.Security)
+	if err != nil {
+		log.Fatalf("Invalid security configuration: %v", err)
+	}
+
 	// Initialize cancellation context for graceful shutdown coordination
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -171,6 +180,7 @@ func main() {
 	// Start Support Service first - it provides agent registry and health monitoring
 	// that other services depend on for agent discovery and lifecycle management
 	supportService := support.NewService(cfg.Support)
+	supportService.SetGuard(guard)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -184,6 +194,14 @@ func main() {
 
 	// Start Broker Service - handles message routing between agents using pub/sub
 	brokerService := broker.NewService(cfg.Broker)
+	brokerService.SetGuard(guard)
+
+	// Payload schemas declared in the cells are enforced on publish
+	schemas, err := schema.FromConfig(cfg)
+	if err != nil {
+		log.Fatalf("Invalid schema configuration: %v", err)
+	}
+	brokerService.SetSchemas(schemas)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -206,6 +224,18 @@ func main() {
 	log.Printf("Cellorg started: %s", cfg.AppName)
 	log.Printf("Support service on: %s", cfg.Support.Port)
 	log.Printf("Broker service on: %s (%s/%s)", cfg.Broker.Port, cfg.Broker.Protocol, cfg.Broker.Codec)
+	if n := schemas.Len(); n > 0 {
+		log.Printf("Payload schemas: %d versions enforced", n)
+	}
+
+	// Bridge selected topics to the brokers of other cellorg instances
+	bridges, err := federation.Start(ctx, cfg, "localhost"+cfg.Broker.Port)
+	if err != nil {
+		log.Fatalf("Invalid federation configuration: %v", err)
+	}
+	for _, bridge := range bridges {
+		log.Printf("Federation link to %s", bridge.Name())
+	}
 
 	// Wait for services to be fully ready before agent deployment
 	time.Sleep(500 * time.Millisecond)
@@ -220,6 +250,8 @@ func main() {
 
 	// Create agent deployer that manages agent lifecycle and process spawning
 	agentDeployer := deployer.NewAgentDeployer("localhost"+cfg.Support.Port, frameworkRoot, cfg.Debug)
+	agentDeployer.SetSecurity(cfg.Security)
+	agentDeployer.SetTracing(cfg.Tracing)
 
 	// Load pool configuration (agent type definitions) and register with support service
 	var poolConfig *config.PoolConfig
@@ -253,6 +285,9 @@ func main() {
 	} else if len(cellsConfig.Cells) > 0 {
 		log.Printf("Loaded %d cells from configuration", len(cellsConfig.Cells))
 
+		// Agents of cells with a health_check_interval must keep sending heartbeats
+		supportService.SetHealthChecks(cellsConfig)
+
 		// Validate configuration consistency
 		if poolConfig != nil {
 			if err := config.ValidateConfiguration(poolConfig, cellsConfig); err != nil {
@@ -0,0 +1,177 @@
+// Package auth enforces the security settings of the cellorg support and
+// broker services: TLS listeners with optional client certificates (mutual
+// TLS), agent credentials checked in "connect" and "register_agent", and
+// per-agent topic ACLs for publishing and subscribing.
+//
+// Everything is configured in the security section of cellorg.yaml. A nil
+// *Guard, like the zero configuration, enforces nothing, so services without
+// security settings behave as before.
+package auth
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+
+	"github.com/tenzoki/agen/cellorg/internal/config"
+	"github.com/tenzoki/agen/cellorg/internal/wildcard"
+)
+
+// AnyAgent is the ACL key applying to agents without their own entry.
+const AnyAgent = "*"
+
+// ErrUnauthorized is returned for agents presenting missing or wrong credentials.
+var ErrUnauthorized = errors.New("invalid credentials")
+
+// Guard holds the security settings shared by the support and broker services.
+type Guard struct {
+	tls         *tls.Config                // Server TLS settings (nil = plain TCP)
+	token       string                     // Shared token
+	credentials map[string]string          // Agent ID -> secret
+	acls        map[string]config.TopicACL // Agent ID -> allowed topics
+}
+
+// NewGuard validates the security settings and loads the server certificates.
+// Returns nil without error if nothing is configured.
+//
+// ACLs are keyed by the agent ID an agent declares in connect, so they
+// require authentication. Only agents with their own credential are bound
+// to their ID; for agents with an ACL but only the shared token, the ACL is
+// advisory (any holder of the token can claim the ID), which is logged.
+func NewGuard(cfg config.SecurityConfig) (*Guard, error) {
+	if !cfg.TLSEnabled && cfg.Token == "" && len(cfg.Credentials) == 0 && len(cfg.ACLs) == 0 {
+		return nil, nil
+	}
+
+	g := &Guard{
+		token:       cfg.Token,
+		credentials: cfg.Credentials,
+		acls:        cfg.ACLs,
+	}
+
+	if cfg.TLSEnabled {
+		tlsConfig, err := ServerTLS(cfg)
+		if err != nil {
+			return nil, err
+		}
+		g.tls = tlsConfig
+	} else if cfg.ClientAuth {
+		return nil, fmt.Errorf("security: client_auth requires tls_enabled")
+	}
+
+	for agentID, acl := range cfg.ACLs {
+		for _, pattern := range append(append([]string{}, acl.Publish...), acl.Subscribe...) {
+			if err := wildcard.Validate(pattern); err != nil {
+				return nil, fmt.Errorf("security: ACL of %s: %w", agentID, err)
+			}
+		}
+	}
+
+	if len(cfg.ACLs) > 0 && !g.AuthRequired() {
+		return nil, fmt.Errorf("security: acls require a token or credentials, agent IDs are self-declared otherwise")
+	}
+	var advisory []string
+	for agentID := range cfg.ACLs {
+		if _, bound := cfg.Credentials[agentID]; !bound && agentID != AnyAgent {
+			advisory = append(advisory, agentID)
+		}
+	}
+	if len(advisory) > 0 {
+		sort.Strings(advisory)
+		log.Printf("Warning: security: ACLs of %v are advisory: these agents have no credentials of their own, so any agent with the shared token can claim their IDs", advisory)
+	}
+
+	return g, nil
+}
+
+// Listen opens a listener, wrapped in TLS if enabled.
+func (g *Guard) Listen(network, address string) (net.Listener, error) {
+	listener, err := net.Listen(network, address)
+	if err != nil || g == nil || g.tls == nil {
+		return listener, err
+	}
+	return tls.NewListener(listener, g.tls), nil
+}
+
+// TLS reports whether connections are encrypted.
+func (g *Guard) TLS() bool {
+	return g != nil && g.tls != nil
+}
+
+// AuthRequired reports whether agents must present credentials.
+func (g *Guard) AuthRequired() bool {
+	return g != nil && (g.token != "" || len(g.credentials) > 0)
+}
+
+// Bound reports whether an agent ID has a credential of its own, so that
+// only that agent can authenticate under it.
+func (g *Guard) Bound(agentID string) bool {
+	if g == nil {
+		return false
+	}
+	_, bound := g.credentials[agentID]
+	return bound
+}
+
+// Authenticate checks the credential an agent presents. Agents listed in the
+// credentials need their own secret; all others need the shared token. With
+// per-agent credentials but no shared token, unlisted agents are rejected.
+func (g *Guard) Authenticate(agentID, token string) error {
+	if !g.AuthRequired() {
+		return nil
+	}
+	if agentID == "" {
+		return fmt.Errorf("%w: missing agent ID", ErrUnauthorized)
+	}
+
+	expected, listed := g.credentials[agentID]
+	if !listed {
+		expected = g.token
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(token)) != 1 {
+		return fmt.Errorf("%w for agent %s", ErrUnauthorized, agentID)
+	}
+	return nil
+}
+
+// CanPublish reports whether an agent may publish to a topic.
+func (g *Guard) CanPublish(agentID, topic string) bool {
+	acl, ok := g.acl(agentID)
+	return !ok || allowed(acl.Publish, topic)
+}
+
+// CanSubscribe reports whether an agent may subscribe to a topic or pattern.
+// A pattern is only allowed if the ACL covers every topic it matches.
+func (g *Guard) CanSubscribe(agentID, pattern string) bool {
+	acl, ok := g.acl(agentID)
+	return !ok || allowed(acl.Subscribe, pattern)
+}
+
+// acl returns the ACL applying to an agent, if any.
+func (g *Guard) acl(agentID string) (config.TopicACL, bool) {
+	if g == nil {
+		return config.TopicACL{}, false
+	}
+	if acl, ok := g.acls[agentID]; ok {
+		return acl, true
+	}
+	acl, ok := g.acls[AnyAgent]
+	return acl, ok
+}
+
+// allowed checks a topic against an ACL list; a nil list allows everything.
+func allowed(patterns []string, topic string) bool {
+	if patterns == nil {
+		return true
+	}
+	for _, pattern := range patterns {
+		if wildcard.Covers(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/config"
+)
+
+// writeTestCert creates a certificate signed by parent (self-signed if nil)
+// and writes it and its key as PEM files. Returns the certificate and key.
+func writeTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+// Test credential checks with a shared token and per-agent secrets
+func TestAuthenticate(t *testing.T) {
+	guard, err := NewGuard(config.SecurityConfig{
+		Token:       "shared",
+		Credentials: map[string]string{"ner-agent": "ner-secret"},
+	})
+	if err != nil {
+		t.Fatalf("NewGuard failed: %v", err)
+	}
+
+	tests := []struct {
+		agentID string
+		token   string
+		ok      bool
+	}{
+		{"text-extractor", "shared", true},
+		{"text-extractor", "wrong", false},
+		{"text-extractor", "", false},
+		{"ner-agent", "ner-secret", true},
+		{"ner-agent", "shared", false},
+		{"", "shared", false},
+	}
+	for _, tt := range tests {
+		err := guard.Authenticate(tt.agentID, tt.token)
+		if (err == nil) != tt.ok {
+			t.Errorf("Authenticate(%q, %q) = %v, want ok=%v", tt.agentID, tt.token, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("Expected ErrUnauthorized, got %v", err)
+		}
+	}
+
+	// Per-agent credentials without a shared token reject unlisted agents
+	guard, _ = NewGuard(config.SecurityConfig{Credentials: map[string]string{"ner-agent": "ner-secret"}})
+	if err := guard.Authenticate("intruder", ""); err == nil {
+		t.Error("Expected unlisted agent to be rejected")
+	}
+
+	// Without credentials everyone gets in
+	var open *Guard
+	if err := open.Authenticate("anyone", ""); err != nil || open.AuthRequired() {
+		t.Errorf("Expected nil guard to admit everyone, got %v", err)
+	}
+}
+
+// Test topic ACLs with wildcards and the "*" fallback entry
+func TestTopicACLs(t *testing.T) {
+	guard, err := NewGuard(config.SecurityConfig{
+		Credentials: map[string]string{"ner-agent": "ner-secret"},
+		ACLs: map[string]config.TopicACL{
+			"ner-agent": {Publish: []string{"ner-results"}, Subscribe: []string{"ner-requests", "project-42.#"}},
+			AnyAgent:    {Publish: []string{}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewGuard failed: %v", err)
+	}
+
+	if !guard.CanPublish("ner-agent", "ner-results") || guard.CanPublish("ner-agent", "ner-requests") {
+		t.Error("Expected ner-agent to publish to ner-results only")
+	}
+	if !guard.CanSubscribe("ner-agent", "project-42.ocr") || !guard.CanSubscribe("ner-agent", "project-42.*") {
+		t.Error("Expected ner-agent to subscribe below project-42")
+	}
+	if guard.CanSubscribe("ner-agent", "#") || guard.CanSubscribe("ner-agent", "project-7.ocr") {
+		t.Error("Expected ner-agent subscriptions outside its ACL to be denied")
+	}
+	if guard.CanPublish("text-extractor", "anything") {
+		t.Error("Expected the empty publish list of \"*\" to deny other agents")
+	}
+	if !guard.CanSubscribe("text-extractor", "anything") {
+		t.Error("Expected the missing subscribe list of \"*\" to allow other agents")
+	}
+
+	if _, err := NewGuard(config.SecurityConfig{Token: "shared", ACLs: map[string]config.TopicACL{"x": {Publish: []string{"a.#.b"}}}}); err == nil {
+		t.Error("Expected invalid ACL pattern to be rejected")
+	}
+	if _, err := NewGuard(config.SecurityConfig{ACLs: map[string]config.TopicACL{"x": {Publish: []string{"a"}}}}); err == nil {
+		t.Error("Expected ACLs without authentication to be rejected")
+	}
+}
+
+// Test that mutual TLS admits agents with a CA-signed certificate only
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "server", ca, caKey)
+	writeTestCert(t, dir, "agent", ca, caKey)
+	writeTestCert(t, dir, "rogue", nil, nil)
+
+	path := func(name string) string { return filepath.Join(dir, name) }
+	guard, err := NewGuard(config.SecurityConfig{
+		TLSEnabled: true,
+		CertFile:   path("server.pem"),
+		KeyFile:    path("server-key.pem"),
+		CAFile:     path("ca.pem"),
+		ClientAuth: true,
+	})
+	if err != nil {
+		t.Fatalf("NewGuard failed: %v", err)
+	}
+
+	listener, err := guard.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("ok"))
+			}()
+		}
+	}()
+
+	connect := func(cert, key string) error {
+		tlsConfig, err := ClientTLS(path("ca.pem"), cert, key)
+		if err != nil {
+			return err
+		}
+		conn, err := tls.Dial("tcp", listener.Addr().String(), tlsConfig)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		buf := make([]byte, 2)
+		_, err = conn.Read(buf) // TLS 1.3 reports client certificate errors on first read
+		return err
+	}
+
+	if err := connect(path("agent.pem"), path("agent-key.pem")); err != nil {
+		t.Errorf("Expected agent with CA-signed certificate to connect: %v", err)
+	}
+	if err := connect(path("rogue.pem"), path("rogue-key.pem")); err == nil {
+		t.Error("Expected agent with foreign certificate to be rejected")
+	}
+	if err := connect("", ""); err == nil {
+		t.Error("Expected agent without certificate to be rejected")
+	}
+
+	if _, err := NewGuard(config.SecurityConfig{TLSEnabled: true, CertFile: path("server.pem"), KeyFile: path("server-key.pem"), ClientAuth: true}); err == nil {
+		t.Error("Expected client_auth without ca_file to be rejected")
+	}
+}
@@ -0,0 +1,336 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// defaultVisibilityTimeout is how long a consumer may hold an unacknowledged
+// pipe delivery before the broker redelivers it.
+const defaultVisibilityTimeout = 30 * time.Second
+
+// reapInterval is how often expired in-flight deliveries are requeued.
+const reapInterval = time.Second
+
+// defaultMaxDeliveries is how often a pipe item is delivered without being
+// acked before the broker gives up on it, so a message that crashes or keeps
+// failing its consumers does not circulate forever.
+const defaultMaxDeliveries = 10
+
+// Delivery is the receive_pipe result in manual-ack mode. Exactly one of
+// Message and Envelope is set. The delivery stays in flight until the
+// consumer acks or nacks its tag, or until the visibility timeout expires.
+type Delivery struct {
+	Tag      string             `json:"delivery_tag"`       // Identifies the delivery in ack/nack
+	Attempt  int                `json:"attempt"`            // 1 for the first delivery, 2+ for redeliveries
+	Message  *Message           `json:"message,omitempty"`  // Simple message payload
+	Envelope *envelope.Envelope `json:"envelope,omitempty"` // Envelope payload
+}
+
+// inflightDelivery tracks a pipe item handed to a consumer but not yet acknowledged.
+type inflightDelivery struct {
+	tag      string
+	pipe     *Pipe
+	item     *queueItem
+	connID   string    // Consumer connection holding the delivery
+	deadline time.Time // Redelivered after this time unless acked
+}
+
+// deliveryTable holds all in-flight deliveries of the broker, keyed by tag.
+type deliveryTable struct {
+	deliveries map[string]*inflightDelivery
+	next       uint64 // Last assigned tag number
+	mux        sync.Mutex
+}
+
+// newDeliveryTable creates an empty in-flight table.
+func newDeliveryTable() *deliveryTable {
+	return &deliveryTable{deliveries: make(map[string]*inflightDelivery)}
+}
+
+// add registers an item as in flight and returns its delivery tag.
+func (t *deliveryTable) add(pipe *Pipe, item *queueItem, connID string, visibility time.Duration) string {
+	t.mux.Lock()
+	t.next++
+	tag := fmt.Sprintf("dt_%d", t.next)
+	t.deliveries[tag] = &inflightDelivery{
+		tag:      tag,
+		pipe:     pipe,
+		item:     item,
+		connID:   connID,
+		deadline: time.Now().Add(visibility),
+	}
+	t.mux.Unlock()
+
+	return tag
+}
+
+// take removes and returns an in-flight delivery held by a consumer
+// connection (nil if unknown or already settled). A delivery held by another
+// connection stays in flight and is reported as not owned.
+func (t *deliveryTable) take(tag, connID string) (d *inflightDelivery, owned bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	d = t.deliveries[tag]
+	if d == nil {
+		return nil, true
+	}
+	if d.connID != connID {
+		return nil, false
+	}
+	delete(t.deliveries, tag)
+	return d, true
+}
+
+// restore puts a delivery back in flight with a new deadline.
+func (t *deliveryTable) restore(d *inflightDelivery, deadline time.Time) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	d.deadline = deadline
+	t.deliveries[d.tag] = d
+}
+
+// takeMatching removes and returns all deliveries accepted by the filter.
+func (t *deliveryTable) takeMatching(match func(*inflightDelivery) bool) []*inflightDelivery {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	var taken []*inflightDelivery
+	for tag, d := range t.deliveries {
+		if match(d) {
+			taken = append(taken, d)
+			delete(t.deliveries, tag)
+		}
+	}
+	return taken
+}
+
+// countForPipe returns the number of in-flight deliveries of one pipe.
+func (t *deliveryTable) countForPipe(pipe *Pipe) int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	count := 0
+	for _, d := range t.deliveries {
+		if d.pipe == pipe {
+			count++
+		}
+	}
+	return count
+}
+
+// countByConsumer returns the number of in-flight deliveries of one pipe per
+// consumer connection.
+func (t *deliveryTable) countByConsumer(pipe *Pipe) map[string]int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	counts := make(map[string]int)
+	for _, d := range t.deliveries {
+		if d.pipe == pipe {
+			counts[d.connID]++
+		}
+	}
+	return counts
+}
+
+// handleAck processes acknowledgements of pipe deliveries received in manual-ack mode.
+// The delivery is settled for good: it is removed from the in-flight table and,
+// for persistent envelopes, from the write-ahead log.
+//
+// Parameters:
+//   - conn: Connection acknowledging the delivery
+//   - req: JSON-RPC request with delivery_tag parameter
+//
+// Returns:
+//   - BrokerResponse: Success confirmation, or an error for unknown or already
+//     redelivered tags and for deliveries held by another connection
+//
+// Called by: handleRequest() when method is "ack"
+func (s *Service) handleAck(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	var params struct {
+		Tag string `json:"delivery_tag"` // Tag from the receive_pipe delivery
+	}
+
+	if err := conn.unmarshal(req.Params, &params); err != nil || params.Tag == "" {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
+		}
+	}
+
+	d, owned := s.deliveries.take(params.Tag, conn.ID)
+	if !owned {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: ErrCodeForbidden, Message: fmt.Sprintf("Delivery %s belongs to another consumer", params.Tag)},
+		}
+	}
+	if d == nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Unknown delivery tag: %s", params.Tag)},
+		}
+	}
+
+	s.unlogEnvelope(d.item.Seq)
+
+	if s.debug {
+		log.Printf("Broker: %s acked delivery %s on pipe %s", conn.ID, d.tag, d.pipe.Name)
+	}
+
+	return &BrokerResponse{
+		ID:     req.ID,
+		Result: "acked",
+	}
+}
+
+// handleNack processes negative acknowledgements of pipe deliveries.
+// By default the item goes straight back into its pipe for redelivery to the
+// next consumer; with requeue=false it is discarded.
+//
+// Parameters:
+//   - conn: Connection rejecting the delivery
+//   - req: JSON-RPC request with delivery_tag and optional requeue parameters
+//
+// Returns:
+//   - BrokerResponse: Success confirmation, or an error for unknown tags and
+//     for deliveries held by another connection
+//
+// Called by: handleRequest() when method is "nack"
+func (s *Service) handleNack(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	params := struct {
+		Tag     string `json:"delivery_tag"` // Tag from the receive_pipe delivery
+		Requeue *bool  `json:"requeue"`      // Redeliver (default) or discard
+	}{}
+
+	if err := conn.unmarshal(req.Params, &params); err != nil || params.Tag == "" {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
+		}
+	}
+
+	d, owned := s.deliveries.take(params.Tag, conn.ID)
+	if !owned {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: ErrCodeForbidden, Message: fmt.Sprintf("Delivery %s belongs to another consumer", params.Tag)},
+		}
+	}
+	if d == nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Unknown delivery tag: %s", params.Tag)},
+		}
+	}
+
+	if params.Requeue != nil && !*params.Requeue {
+		s.unlogEnvelope(d.item.Seq)
+		if s.debug {
+			log.Printf("Broker: %s discarded delivery %s on pipe %s", conn.ID, d.tag, d.pipe.Name)
+		}
+		return &BrokerResponse{
+			ID:     req.ID,
+			Result: "discarded",
+		}
+	}
+
+	s.redeliver(d, "nack")
+
+	return &BrokerResponse{
+		ID:     req.ID,
+		Result: "requeued",
+	}
+}
+
+// redeliver puts an unacknowledged item back into its pipe. The original
+// enqueue time is kept so aging moves redeliveries ahead of newer work.
+// If the pipe is full the item stays in flight and is retried on the next reap.
+// Items delivered maxDeliveries times are dead-lettered instead.
+func (s *Service) redeliver(d *inflightDelivery, reason string) {
+	if s.maxDeliveries > 0 && d.item.Attempts >= s.maxDeliveries {
+		s.giveUpDelivery(d, reason)
+		return
+	}
+	if !d.pipe.queue.Push(d.item) {
+		log.Printf("Broker: pipe %s full, retrying redelivery of %s (%s)", d.pipe.Name, d.tag, reason)
+		s.deliveries.restore(d, time.Now().Add(reapInterval))
+		return
+	}
+
+	if s.debug {
+		log.Printf("Broker: requeued delivery %s on pipe %s after %s (attempt %d)", d.tag, d.pipe.Name, reason, d.item.Attempts)
+	}
+}
+
+// giveUpDelivery moves an item that reached maxDeliveries into the
+// dead-letter queue named after its pipe and removes it from the write-ahead
+// log. If the dead letter cannot be persisted the item stays in flight and is
+// retried on the next reap.
+func (s *Service) giveUpDelivery(d *inflightDelivery, reason string) {
+	dl := &DeadLetter{
+		ID:       uuid.New().String(),
+		Queue:    d.pipe.Name,
+		Error:    fmt.Sprintf("delivered %d times without ack (last: %s)", d.item.Attempts, reason),
+		Attempts: d.item.Attempts,
+		Source:   "pipe:" + d.pipe.Name,
+		FailedAt: time.Now(),
+		Message:  d.item.Message,
+		Envelope: d.item.Envelope,
+	}
+	if s.wal != nil {
+		if err := s.wal.SaveDeadLetter(dl); err != nil {
+			log.Printf("Broker: failed to dead-letter delivery %s on pipe %s: %v", d.tag, d.pipe.Name, err)
+			s.deliveries.restore(d, time.Now().Add(reapInterval))
+			return
+		}
+	}
+	s.deadLetters.add(dl)
+	s.unlogEnvelope(d.item.Seq)
+
+	log.Printf("Broker: gave up on delivery %s on pipe %s after %d attempts, dead letter %s", d.tag, d.pipe.Name, d.item.Attempts, dl.ID)
+}
+
+// requeueExpiredDeliveries redelivers all in-flight items whose visibility timeout has passed.
+func (s *Service) requeueExpiredDeliveries(now time.Time) {
+	expired := s.deliveries.takeMatching(func(d *inflightDelivery) bool {
+		return now.After(d.deadline)
+	})
+	for _, d := range expired {
+		s.redeliver(d, "visibility timeout")
+	}
+}
+
+// requeueConnectionDeliveries redelivers all in-flight items held by a closed connection.
+func (s *Service) requeueConnectionDeliveries(conn *Connection) {
+	held := s.deliveries.takeMatching(func(d *inflightDelivery) bool {
+		return d.connID == conn.ID
+	})
+	for _, d := range held {
+		s.redeliver(d, "consumer disconnect")
+	}
+}
+
+// reapDeliveries periodically requeues expired in-flight deliveries until ctx is cancelled.
+func (s *Service) reapDeliveries(ctx context.Context) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.requeueExpiredDeliveries(now)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+// receiveWithAck performs a manual-ack receive and returns the delivery
+func receiveWithAck(t *testing.T, s *Service, conn *Connection, pipe string) *Delivery {
+	t.Helper()
+
+	resp := s.handleRequest(conn, newRequest(t, "receive_pipe", map[string]interface{}{
+		"pipe":       pipe,
+		"timeout_ms": 50,
+		"ack":        true,
+	}))
+	if resp.Error != nil {
+		t.Fatalf("receive_pipe failed: %s", resp.Error.Message)
+	}
+	delivery, ok := resp.Result.(*Delivery)
+	if !ok {
+		t.Fatalf("Expected *Delivery, got %T", resp.Result)
+	}
+	return delivery
+}
+
+// sendTestMessage queues a simple message in a pipe
+func sendTestMessage(t *testing.T, s *Service, conn *Connection, pipe, id string) {
+	t.Helper()
+
+	resp := s.handleRequest(conn, newRequest(t, "send_pipe", map[string]interface{}{
+		"pipe":    pipe,
+		"message": Message{ID: id, Type: "document"},
+	}))
+	if resp.Error != nil {
+		t.Fatalf("send_pipe failed: %s", resp.Error.Message)
+	}
+}
+
+// Test that nacked deliveries are redelivered and acked ones are settled
+func TestAckNackRedelivery(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	conn := &Connection{ID: "conn_worker", AgentID: "worker"}
+	sendTestMessage(t, s, conn, "docs", "doc-1")
+
+	first := receiveWithAck(t, s, conn, "docs")
+	if first.Message == nil || first.Message.ID != "doc-1" || first.Attempt != 1 {
+		t.Fatalf("Unexpected first delivery: %+v", first)
+	}
+	if stats := s.Stats().Pipes["docs"]; stats.Depth != 0 || stats.InFlight != 1 {
+		t.Errorf("Expected 0 queued / 1 in flight, got %+v", stats)
+	}
+
+	resp := s.handleRequest(conn, newRequest(t, "nack", map[string]interface{}{"delivery_tag": first.Tag}))
+	if resp.Error != nil {
+		t.Fatalf("nack failed: %s", resp.Error.Message)
+	}
+
+	second := receiveWithAck(t, s, conn, "docs")
+	if second.Message.ID != "doc-1" || second.Attempt != 2 || second.Tag == first.Tag {
+		t.Fatalf("Expected redelivery of doc-1 as attempt 2 with new tag, got %+v", second)
+	}
+
+	resp = s.handleRequest(conn, newRequest(t, "ack", map[string]interface{}{"delivery_tag": second.Tag}))
+	if resp.Error != nil {
+		t.Fatalf("ack failed: %s", resp.Error.Message)
+	}
+	if stats := s.Stats().Pipes["docs"]; stats.Depth != 0 || stats.InFlight != 0 {
+		t.Errorf("Expected pipe settled after ack, got %+v", stats)
+	}
+
+	// Settled tags cannot be acked twice
+	resp = s.handleRequest(conn, newRequest(t, "ack", map[string]interface{}{"delivery_tag": second.Tag}))
+	if resp.Error == nil || resp.Error.Code != -32602 {
+		t.Errorf("Expected unknown tag error, got %+v", resp)
+	}
+}
+
+// Test that only the consumer holding a delivery can settle it
+func TestAckRejectsOtherConsumers(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	worker := &Connection{ID: "conn_worker", AgentID: "worker"}
+	intruder := &Connection{ID: "conn_intruder", AgentID: "intruder"}
+	sendTestMessage(t, s, worker, "docs", "doc-1")
+
+	delivery := receiveWithAck(t, s, worker, "docs")
+	for _, method := range []string{"ack", "nack"} {
+		resp := s.handleRequest(intruder, newRequest(t, method, map[string]interface{}{"delivery_tag": delivery.Tag}))
+		if resp.Error == nil || resp.Error.Code != ErrCodeForbidden {
+			t.Errorf("Expected %s by another connection to be refused, got %+v", method, resp)
+		}
+	}
+	if stats := s.Stats().Pipes["docs"]; stats.InFlight != 1 {
+		t.Errorf("Expected the delivery still in flight, got %+v", stats)
+	}
+
+	if resp := s.handleRequest(worker, newRequest(t, "ack", map[string]interface{}{"delivery_tag": delivery.Tag})); resp.Error != nil {
+		t.Errorf("Expected the holder's ack to succeed, got %s", resp.Error.Message)
+	}
+}
+
+// Test that deliveries past their visibility timeout go back to the pipe
+func TestVisibilityTimeoutRedelivery(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json", VisibilityTimeout: time.Minute})
+	conn := &Connection{ID: "conn_worker", AgentID: "worker"}
+	sendTestMessage(t, s, conn, "docs", "doc-1")
+
+	receiveWithAck(t, s, conn, "docs")
+
+	s.requeueExpiredDeliveries(time.Now())
+	if stats := s.Stats().Pipes["docs"]; stats.InFlight != 1 {
+		t.Fatalf("Delivery requeued before its visibility timeout: %+v", stats)
+	}
+
+	s.requeueExpiredDeliveries(time.Now().Add(2 * time.Minute))
+	if stats := s.Stats().Pipes["docs"]; stats.Depth != 1 || stats.InFlight != 0 {
+		t.Fatalf("Expected delivery back in pipe after timeout, got %+v", stats)
+	}
+}
+
+// Test that a disconnecting consumer's deliveries go to the next consumer
+func TestDisconnectRequeuesDeliveries(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	crashed := &Connection{ID: "conn_crashed", AgentID: "worker-1"}
+	healthy := &Connection{ID: "conn_healthy", AgentID: "worker-2"}
+	sendTestMessage(t, s, crashed, "docs", "doc-1")
+
+	receiveWithAck(t, s, crashed, "docs")
+	s.requeueConnectionDeliveries(crashed)
+
+	delivery := receiveWithAck(t, s, healthy, "docs")
+	if delivery.Message.ID != "doc-1" || delivery.Attempt != 2 {
+		t.Errorf("Expected doc-1 redelivered to healthy consumer, got %+v", delivery)
+	}
+}
+
+// Test that an item nacked or timed out max_deliveries times is dead-lettered
+func TestMaxDeliveriesDeadLetters(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json", MaxDeliveries: 2})
+	conn := &Connection{ID: "conn_worker", AgentID: "worker"}
+	sendTestMessage(t, s, conn, "docs", "poison")
+
+	first := receiveWithAck(t, s, conn, "docs")
+	s.handleRequest(conn, newRequest(t, "nack", map[string]interface{}{"delivery_tag": first.Tag}))
+	receiveWithAck(t, s, conn, "docs")
+	s.requeueExpiredDeliveries(time.Now().Add(time.Hour))
+
+	if stats := s.Stats().Pipes["docs"]; stats.Depth != 0 || stats.InFlight != 0 {
+		t.Errorf("Expected the item gone from the pipe, got %+v", stats)
+	}
+	letters := s.deadLetters.list("docs")
+	if len(letters) != 1 || letters[0].Message.ID != "poison" || letters[0].Attempts != 2 || letters[0].Source != "pipe:docs" {
+		t.Fatalf("Expected poison dead-lettered after 2 attempts, got %+v", letters)
+	}
+}
@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/codec"
+)
+
+// handshakeTestConn opens a TCP connection to the broker and sends "connect"
+// asking for the given codec. Returns the agent side, a reader positioned
+// after the handshake response, and the handshake result.
+func handshakeTestConn(t *testing.T, s *Service, requested string) (net.Conn, io.Reader, json.RawMessage) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		if server, err := listener.Accept(); err == nil {
+			s.handleConnection(server)
+		}
+	}()
+
+	agent, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial broker: %v", err)
+	}
+	agent.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if err := json.NewEncoder(agent).Encode(newRequest(t, "connect", map[string]string{
+		"agent_id": "ner-agent",
+		"codec":    requested,
+	})); err != nil {
+		t.Fatalf("Failed to send connect: %v", err)
+	}
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *BrokerError    `json:"error"`
+	}
+	dec := json.NewDecoder(agent)
+	if err := dec.Decode(&resp); err != nil || resp.Error != nil {
+		t.Fatalf("connect failed: %v %+v", err, resp.Error)
+	}
+	return agent, codec.Unread(dec, agent), resp.Result
+}
+
+// Test that a connection switches to MessagePack after the connect handshake
+func TestConnectNegotiatesMsgPack(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "msgpack"})
+	agent, reader, result := handshakeTestConn(t, s, codec.MsgPack)
+	defer agent.Close()
+
+	var connected ConnectResult
+	if err := json.Unmarshal(result, &connected); err != nil || connected.Codec != codec.MsgPack {
+		t.Fatalf("Expected msgpack to be agreed, got %s", result)
+	}
+
+	wire, _ := codec.Lookup(codec.MsgPack)
+	enc, dec := wire.NewEncoder(agent), wire.NewDecoder(reader)
+	params, _ := wire.Marshal(map[string]string{"topic": "ner-requests"})
+	if err := enc.Encode(BrokerRequest{ID: "req_2", Method: "subscribe", Params: params}); err != nil {
+		t.Fatalf("Failed to send subscribe: %v", err)
+	}
+	var resp struct {
+		ID     string       `json:"id"`
+		Result string       `json:"result"`
+		Error  *BrokerError `json:"error"`
+	}
+	if err := dec.Decode(&resp); err != nil || resp.Error != nil || resp.Result != "subscribed" {
+		t.Fatalf("Expected msgpack subscribe response, got %+v (%v)", resp, err)
+	}
+
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+	s.handleRequest(producer, newRequest(t, "publish", map[string]interface{}{
+		"topic":   "ner-requests",
+		"message": Message{ID: "msg-1", Type: "event", Payload: []byte{0x00, 0xff}, Meta: map[string]interface{}{"priority": 3}},
+	}))
+
+	var delivery struct {
+		ID      string `json:"id"`
+		Target  string `json:"target"`
+		Payload string `json:"payload"` // Base64 text from the JSON publish
+	}
+	if err := dec.Decode(&delivery); err != nil || delivery.ID != "msg-1" || delivery.Target != "pub:ner-requests" {
+		t.Errorf("Expected msgpack delivery, got %+v (%v)", delivery, err)
+	}
+}
+
+// Test that an unsupported codec leaves the connection on JSON
+func TestConnectUnsupportedCodecStaysJSON(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	agent, reader, result := handshakeTestConn(t, s, "protobuf")
+	defer agent.Close()
+
+	var connected ConnectResult
+	if err := json.Unmarshal(result, &connected); err != nil || connected.Codec != codec.JSON {
+		t.Fatalf("Expected fallback to json, got %s", result)
+	}
+
+	if err := json.NewEncoder(agent).Encode(newRequest(t, "subscribe", map[string]string{"topic": "ner-requests"})); err != nil {
+		t.Fatalf("Failed to send subscribe: %v", err)
+	}
+	var resp BrokerResponse
+	if err := json.NewDecoder(reader).Decode(&resp); err != nil || resp.Error != nil || resp.Result != "subscribed" {
+		t.Errorf("Expected JSON subscribe response, got %+v (%v)", resp, err)
+	}
+}
+
+// Test that the codec is not switched under pipe receives still in flight
+func TestConnectKeepsJSONDuringPipeReceives(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "msgpack"})
+	conn := &Connection{ID: "conn_ner"}
+	conn.receiving.Add(1)
+
+	resp := s.handleRequest(conn, newRequest(t, "connect", map[string]string{
+		"agent_id": "ner-agent",
+		"codec":    codec.MsgPack,
+	}))
+	result, ok := resp.Result.(ConnectResult)
+	if resp.Error != nil || !ok || result.Codec != codec.JSON || conn.nextCodec != nil {
+		t.Errorf("Expected the connection to stay on JSON, got %+v", resp.Result)
+	}
+}
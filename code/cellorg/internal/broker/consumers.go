@@ -0,0 +1,478 @@
+package broker
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// Pipe consumer policies decide which waiting consumer receives the next item
+// of a pipe.
+const (
+	PipeRoundRobin    = "round_robin"     // Waiting consumers take turns (default)
+	PipeLeastInFlight = "least_in_flight" // Waiting consumer with the fewest unacknowledged deliveries
+	PipeSticky        = "sticky"          // Items with the same key go to the same consumer
+)
+
+// Sticky keys: the correlation ID of an item, or one of its headers (meta
+// entries for simple messages) as "header:<name>".
+const (
+	StickyCorrelationID = "correlation_id"
+	StickyHeaderPrefix  = "header:"
+)
+
+// stickyIdle is how long a consumer keeps a sticky key after it last
+// received an item with that key.
+const stickyIdle = 5 * time.Minute
+
+// pipeConsumer is a connection receiving from a pipe.
+type pipeConsumer struct {
+	conn     *Connection
+	received uint64 // Items received
+	waiting  int    // receive_pipe calls currently waiting
+}
+
+// stickyOwner records which consumer a sticky key belongs to.
+type stickyOwner struct {
+	consumer *pipeConsumer
+	lastSeen time.Time
+}
+
+// pipeConsumers balances the items of one pipe across the connections
+// receiving from it. Consumers are registered with connect_pipe or on their
+// first receive_pipe; an item is only handed to the consumer the policy picks
+// among those currently waiting, so a long poll cannot starve the others.
+//
+// Thread Safety: All methods are safe for concurrent use.
+type pipeConsumers struct {
+	policy     string                  // PipeRoundRobin, PipeLeastInFlight or PipeSticky
+	key        string                  // Sticky key (PipeSticky only)
+	configured bool                    // Policy was set explicitly by a consumer
+	consumers  []*pipeConsumer         // In registration order
+	next       int                     // Rotation position
+	owners     map[string]*stickyOwner // Sticky key -> owning consumer
+	pruned     time.Time               // Last sweep of idle sticky keys
+	changed    chan struct{}           // Closed when the waiting consumers or the rotation change
+	mux        sync.Mutex
+}
+
+// PipeConsumerStats reports the consumers of one pipe.
+type PipeConsumerStats struct {
+	Policy    string          `json:"policy"`        // Consumer selection policy
+	Key       string          `json:"key,omitempty"` // Sticky key (sticky policy only)
+	Consumers []ConsumerStats `json:"consumers"`     // Registered consumers
+}
+
+// ConsumerStats reports one consumer of a pipe.
+type ConsumerStats struct {
+	ConnID   string `json:"conn_id"`        // Consumer connection
+	AgentID  string `json:"agent_id"`       // Agent owning the connection
+	Received uint64 `json:"received"`       // Items received
+	InFlight int    `json:"in_flight"`      // Deliveries awaiting ack
+	Waiting  int    `json:"waiting"`        // receive_pipe calls waiting
+	Keys     int    `json:"keys,omitempty"` // Sticky keys owned
+}
+
+// newPipeConsumers creates a round-robin consumer set.
+func newPipeConsumers() *pipeConsumers {
+	return &pipeConsumers{
+		policy:  PipeRoundRobin,
+		owners:  make(map[string]*stickyOwner),
+		changed: make(chan struct{}),
+	}
+}
+
+// validPipePolicy normalizes a requested policy and sticky key; an empty
+// policy means round-robin and an empty sticky key the correlation ID.
+func validPipePolicy(policy, key string) (string, string, error) {
+	switch policy {
+	case "":
+		policy = PipeRoundRobin
+	case PipeRoundRobin, PipeLeastInFlight, PipeSticky:
+	default:
+		return "", "", fmt.Errorf("unknown pipe policy %q (expected %s, %s or %s)", policy, PipeRoundRobin, PipeLeastInFlight, PipeSticky)
+	}
+
+	if policy != PipeSticky {
+		if key != "" {
+			return "", "", fmt.Errorf("key only applies to the %s policy", PipeSticky)
+		}
+		return policy, "", nil
+	}
+	switch {
+	case key == "":
+		key = StickyCorrelationID
+	case key == StickyCorrelationID:
+	case strings.HasPrefix(key, StickyHeaderPrefix) && len(key) > len(StickyHeaderPrefix):
+	default:
+		return "", "", fmt.Errorf("unknown sticky key %q (expected %s or %s<name>)", key, StickyCorrelationID, StickyHeaderPrefix)
+	}
+	return policy, key, nil
+}
+
+// configure sets the policy of the pipe. The first explicit registration
+// decides; later ones must ask for the same policy. On a conflict it reports
+// false with the policy in use.
+func (c *pipeConsumers) configure(policy, key string) (string, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.configured {
+		return c.describe(), c.policy == policy && c.key == key
+	}
+	c.policy, c.key, c.configured = policy, key, true
+	c.wake()
+	return c.describe(), true
+}
+
+// describe returns the policy with its sticky key, if any.
+// The caller must hold c.mux.
+func (c *pipeConsumers) describe() string {
+	if c.key != "" {
+		return fmt.Sprintf("%s (key %s)", c.policy, c.key)
+	}
+	return c.policy
+}
+
+// register adds a connection as consumer (no-op if it already is one).
+// The caller must hold c.mux.
+func (c *pipeConsumers) register(conn *Connection) *pipeConsumer {
+	for _, consumer := range c.consumers {
+		if consumer.conn.ID == conn.ID {
+			return consumer
+		}
+	}
+	consumer := &pipeConsumer{conn: conn}
+	c.consumers = append(c.consumers, consumer)
+	return consumer
+}
+
+// remove drops a consumer and releases its sticky keys. Reports whether the
+// connection was a consumer.
+func (c *pipeConsumers) remove(connID string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for i, consumer := range c.consumers {
+		if consumer.conn.ID != connID {
+			continue
+		}
+		c.consumers = append(c.consumers[:i], c.consumers[i+1:]...)
+		if c.next > i {
+			c.next--
+		}
+		for key, owner := range c.owners {
+			if owner.consumer == consumer {
+				delete(c.owners, key)
+			}
+		}
+		c.wake()
+		return true
+	}
+	return false
+}
+
+// wake tells waiting consumers to check again whether they are next.
+// The caller must hold c.mux.
+func (c *pipeConsumers) wake() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// choose returns the waiting consumer next in line: the first one from the
+// rotation position, or with loads the least loaded one (rotation order
+// breaks ties). The caller must hold c.mux.
+func (c *pipeConsumers) choose(loads map[string]int) *pipeConsumer {
+	n := len(c.consumers)
+	var chosen *pipeConsumer
+	for i := 0; i < n; i++ {
+		candidate := c.consumers[(c.next+i)%n]
+		if candidate.waiting == 0 {
+			continue
+		}
+		if chosen == nil || (loads != nil && loads[candidate.conn.ID] < loads[chosen.conn.ID]) {
+			chosen = candidate
+		}
+	}
+	return chosen
+}
+
+// take pops the next item of the queue meant for a waiting consumer. Without
+// one it returns the channels to wait on: the queue's push notification and
+// the change notification of the consumer set. inFlight is only called for
+// the policies that need the unacknowledged deliveries per consumer.
+func (c *pipeConsumers) take(me *pipeConsumer, queue *priorityQueue, inFlight func() map[string]int) (*queueItem, <-chan struct{}, <-chan struct{}) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	var loads map[string]int
+	if c.policy != PipeRoundRobin {
+		loads = inFlight()
+	}
+	chosen := c.choose(loads)
+	now := time.Now()
+
+	var accept func(*queueItem) bool
+	switch {
+	case c.policy == PipeSticky:
+		c.pruneOwners(now)
+		// Keyed items wait for their owner; unowned ones go to the consumer next in line
+		accept = func(item *queueItem) bool {
+			if owner, ok := c.owners[stickyKey(item, c.key)]; ok {
+				return owner.consumer == me
+			}
+			return chosen == me
+		}
+	case chosen != me:
+		accept = func(*queueItem) bool { return false }
+	}
+
+	item, notify := queue.popMatchingOrNotify(accept)
+	if item == nil {
+		return nil, notify, c.changed
+	}
+
+	key := ""
+	if c.policy == PipeSticky {
+		key = stickyKey(item, c.key)
+	}
+	if owner, ok := c.owners[key]; ok && key != "" {
+		owner.lastSeen = now
+	} else {
+		if key != "" {
+			c.owners[key] = &stickyOwner{consumer: me, lastSeen: now}
+		}
+		for i, consumer := range c.consumers {
+			if consumer == me {
+				c.next = i + 1
+				break
+			}
+		}
+	}
+	me.received++
+	c.wake()
+	return item, nil, nil
+}
+
+// pruneOwners releases the sticky keys that saw no item for stickyIdle,
+// sweeping at most once per minute. The caller must hold c.mux.
+func (c *pipeConsumers) pruneOwners(now time.Time) {
+	if now.Sub(c.pruned) < time.Minute {
+		return
+	}
+	c.pruned = now
+	for key, owner := range c.owners {
+		if now.Sub(owner.lastSeen) > stickyIdle {
+			delete(c.owners, key)
+		}
+	}
+}
+
+// stats returns a snapshot of the consumers with their in-flight deliveries.
+func (c *pipeConsumers) stats(inFlight map[string]int) PipeConsumerStats {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	keys := make(map[*pipeConsumer]int)
+	for _, owner := range c.owners {
+		keys[owner.consumer]++
+	}
+	stats := PipeConsumerStats{Policy: c.policy, Key: c.key, Consumers: make([]ConsumerStats, len(c.consumers))}
+	for i, consumer := range c.consumers {
+		stats.Consumers[i] = ConsumerStats{
+			ConnID:   consumer.conn.ID,
+			AgentID:  consumer.conn.AgentID,
+			Received: consumer.received,
+			InFlight: inFlight[consumer.conn.ID],
+			Waiting:  consumer.waiting,
+			Keys:     keys[consumer],
+		}
+	}
+	return stats
+}
+
+// len returns the number of registered consumers.
+func (c *pipeConsumers) len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.consumers)
+}
+
+// stickyKey returns the routing key of a queued item, or "" if it has none.
+// Chunks without the key are routed by their chunk group, so one consumer
+// gets all chunks of a payload.
+func stickyKey(item *queueItem, key string) string {
+	header := strings.TrimPrefix(key, StickyHeaderPrefix)
+	if env := item.Envelope; env != nil {
+		value := env.Headers[header]
+		if key == StickyCorrelationID {
+			value = env.CorrelationID
+		}
+		if value == "" {
+			value = env.Headers[envelope.HeaderChunkID]
+		}
+		return value
+	}
+	if msg := item.Message; msg != nil {
+		// Simple messages carry the key, correlation ID included, in their meta
+		value, _ := msg.Meta[header].(string)
+		if value == "" {
+			value, _ = msg.Meta[metaChunkID].(string)
+		}
+		return value
+	}
+	return ""
+}
+
+// receiveFromPipe waits up to timeout for the next item the pipe's policy
+// hands to conn, registering conn as consumer on first use. Returns nil on
+// timeout.
+//
+// Called by: handleReceivePipe()
+func (s *Service) receiveFromPipe(pipe *Pipe, conn *Connection, timeout time.Duration) *queueItem {
+	c := pipe.consumers
+	c.mux.Lock()
+	me := c.register(conn)
+	me.waiting++
+	c.wake()
+	c.mux.Unlock()
+
+	defer func() {
+		c.mux.Lock()
+		me.waiting--
+		c.wake()
+		c.mux.Unlock()
+	}()
+
+	inFlight := func() map[string]int { return s.deliveries.countByConsumer(pipe) }
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		item, notify, changed := c.take(me, pipe.queue, inFlight)
+		if item != nil {
+			return item
+		}
+		select {
+		case <-notify:
+		case <-changed:
+		case <-timer.C:
+			return nil
+		case <-conn.done:
+			return nil // Connection closed, nobody is waiting for the item
+		}
+	}
+}
+
+// handleConnectPipe registers the connection with a pipe. Consumers may set
+// the pipe's consumer policy; producers need no registration.
+//
+// Called by: handleRequest() when method is "connect_pipe"
+func (s *Service) handleConnectPipe(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	var params struct {
+		Pipe   string `json:"pipe"`             // Pipe name
+		Role   string `json:"role"`             // "consumer" or "producer"
+		Policy string `json:"policy,omitempty"` // Consumer policy (consumers only)
+		Key    string `json:"key,omitempty"`    // Sticky key (sticky policy only)
+	}
+	if err := conn.unmarshal(req.Params, &params); err != nil || params.Pipe == "" {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
+		}
+	}
+
+	switch params.Role {
+	case "producer":
+		if err := s.checkSendPipe(conn, params.Pipe); err != nil {
+			return &BrokerResponse{
+				ID:    req.ID,
+				Error: err,
+			}
+		}
+		s.getOrCreatePipe(params.Pipe)
+		return &BrokerResponse{ID: req.ID, Result: "connected"}
+	case "consumer":
+	default:
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Invalid params: unknown pipe role %q", params.Role)},
+		}
+	}
+
+	if err := s.checkReceivePipe(conn, params.Pipe); err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: err,
+		}
+	}
+
+	policy, key, err := validPipePolicy(params.Policy, params.Key)
+	if err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Invalid params: %v", err)},
+		}
+	}
+
+	pipe := s.getOrCreatePipe(params.Pipe)
+	if params.Policy != "" {
+		if current, ok := pipe.consumers.configure(policy, key); !ok {
+			return &BrokerResponse{
+				ID:    req.ID,
+				Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Pipe %s uses policy %s", params.Pipe, current)},
+			}
+		}
+	}
+	pipe.consumers.mux.Lock()
+	pipe.consumers.register(conn)
+	pipe.consumers.mux.Unlock()
+
+	if s.debug {
+		log.Printf("Broker: connection %s consumes pipe %s", conn.ID, params.Pipe)
+	}
+	return &BrokerResponse{ID: req.ID, Result: "connected"}
+}
+
+// handleDisconnectPipe removes the connection from the consumers of a pipe
+// and releases its sticky keys.
+//
+// Called by: handleRequest() when method is "disconnect_pipe"
+func (s *Service) handleDisconnectPipe(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	var params struct {
+		Pipe string `json:"pipe"` // Pipe name
+	}
+	if err := conn.unmarshal(req.Params, &params); err != nil || params.Pipe == "" {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
+		}
+	}
+
+	s.pipesMux.RLock()
+	pipe := s.pipes[params.Pipe]
+	s.pipesMux.RUnlock()
+	if pipe == nil || !pipe.consumers.remove(conn.ID) {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Not a consumer of pipe %s", params.Pipe)},
+		}
+	}
+	return &BrokerResponse{ID: req.ID, Result: "disconnected"}
+}
+
+// dropPipeConsumer removes a closed connection from the consumers of all pipes.
+//
+// Called by: handleConnection() when the connection closes
+func (s *Service) dropPipeConsumer(conn *Connection) {
+	s.pipesMux.RLock()
+	defer s.pipesMux.RUnlock()
+
+	for _, pipe := range s.pipes {
+		pipe.consumers.remove(conn.ID)
+	}
+}
@@ -0,0 +1,207 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// connectTestConsumer registers a new connection as consumer of a pipe
+func connectTestConsumer(t *testing.T, s *Service, id, pipe, policy string) *Connection {
+	t.Helper()
+
+	conn := &Connection{ID: id, AgentID: id}
+	resp := s.handleRequest(conn, newRequest(t, "connect_pipe", map[string]interface{}{
+		"pipe":   pipe,
+		"role":   "consumer",
+		"policy": policy,
+	}))
+	if resp.Error != nil {
+		t.Fatalf("connect_pipe failed: %s", resp.Error.Message)
+	}
+	return conn
+}
+
+// receiveAsync starts a receive on a pipe and returns the channel its response arrives on
+func receiveAsync(t *testing.T, s *Service, conn *Connection, pipe string, ack bool) <-chan *BrokerResponse {
+	t.Helper()
+
+	req := newRequest(t, "receive_pipe", map[string]interface{}{"pipe": pipe, "timeout_ms": 2000, "ack": ack})
+	result := make(chan *BrokerResponse, 1)
+	go func() { result <- s.handleRequest(conn, req) }()
+	return result
+}
+
+// awaitWaiting blocks until the given number of receives wait on a pipe
+func awaitWaiting(t *testing.T, s *Service, pipe string, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		waiting := 0
+		for _, consumer := range s.Stats().PipeConsumers[pipe].Consumers {
+			waiting += consumer.Waiting
+		}
+		if waiting == want {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Expected %d waiting receives on %s", want, pipe)
+}
+
+// receivedID returns the ID of the message or envelope in a receive response
+func receivedID(t *testing.T, result <-chan *BrokerResponse) string {
+	t.Helper()
+
+	resp := <-result
+	if resp.Error != nil {
+		t.Fatalf("receive_pipe failed: %s", resp.Error.Message)
+	}
+	switch item := resp.Result.(type) {
+	case *Message:
+		return item.ID
+	case *envelope.Envelope:
+		return item.ID
+	case *Delivery:
+		if item.Envelope != nil {
+			return item.Envelope.ID
+		}
+		return item.Message.ID
+	}
+	t.Fatalf("Unexpected result %T", resp.Result)
+	return ""
+}
+
+// Test that waiting consumers take turns instead of the first poller winning
+func TestPipeConsumersRoundRobin(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+	writer1 := connectTestConsumer(t, s, "writer-1", "entities", "")
+	writer2 := connectTestConsumer(t, s, "writer-2", "entities", "")
+
+	for round, want := range [][2]string{{"msg-1", "msg-2"}, {"msg-3", "msg-4"}} {
+		first := receiveAsync(t, s, writer1, "entities", false)
+		second := receiveAsync(t, s, writer2, "entities", false)
+		awaitWaiting(t, s, "entities", 2)
+		sendTestMessage(t, s, producer, "entities", want[0])
+		sendTestMessage(t, s, producer, "entities", want[1])
+
+		if id := receivedID(t, first); id != want[0] {
+			t.Errorf("Round %d: expected writer-1 to get %s, got %s", round, want[0], id)
+		}
+		if id := receivedID(t, second); id != want[1] {
+			t.Errorf("Round %d: expected writer-2 to get %s, got %s", round, want[1], id)
+		}
+	}
+
+	stats := s.Stats().PipeConsumers["entities"]
+	if stats.Policy != PipeRoundRobin || len(stats.Consumers) != 2 ||
+		stats.Consumers[0].Received != 2 || stats.Consumers[1].Received != 2 {
+		t.Errorf("Unexpected consumer stats: %+v", stats)
+	}
+
+	// Closed connections are no longer consumers
+	s.dropPipeConsumer(writer1)
+	if consumers := s.Stats().PipeConsumers["entities"].Consumers; len(consumers) != 1 || consumers[0].ConnID != "writer-2" {
+		t.Errorf("Expected writer-2 to remain, got %+v", consumers)
+	}
+}
+
+// Test that least-in-flight prefers the consumer with fewer unacked deliveries
+func TestPipeConsumersLeastInFlight(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+	idle := connectTestConsumer(t, s, "idle", "entities", PipeLeastInFlight)
+	busy := connectTestConsumer(t, s, "busy", "entities", PipeLeastInFlight)
+
+	// busy keeps two deliveries; the rotation then points at idle
+	for _, id := range []string{"msg-1", "msg-2"} {
+		sendTestMessage(t, s, producer, "entities", id)
+		receiveWithAck(t, s, busy, "entities")
+	}
+	sendTestMessage(t, s, producer, "entities", "msg-3")
+	delivery := receiveWithAck(t, s, idle, "entities")
+	if resp := s.handleRequest(idle, newRequest(t, "ack", map[string]interface{}{"delivery_tag": delivery.Tag})); resp.Error != nil {
+		t.Fatalf("ack failed: %s", resp.Error.Message)
+	}
+
+	// The rotation now points at busy, but idle has nothing in flight
+	fromIdle := receiveAsync(t, s, idle, "entities", true)
+	fromBusy := receiveAsync(t, s, busy, "entities", true)
+	awaitWaiting(t, s, "entities", 2)
+	sendTestMessage(t, s, producer, "entities", "msg-4")
+	if id := receivedID(t, fromIdle); id != "msg-4" {
+		t.Errorf("Expected idle consumer to get msg-4, got %s", id)
+	}
+	sendTestMessage(t, s, producer, "entities", "msg-5")
+	if id := receivedID(t, fromBusy); id != "msg-5" {
+		t.Errorf("Expected busy consumer to get msg-5, got %s", id)
+	}
+
+	consumers := s.Stats().PipeConsumers["entities"].Consumers
+	if consumers[0].InFlight != 1 || consumers[1].InFlight != 3 {
+		t.Errorf("Expected 1/3 in flight, got %+v", consumers)
+	}
+}
+
+// Test that sticky pipes keep items with one correlation ID on one consumer
+func TestPipeConsumersSticky(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+	collector1 := connectTestConsumer(t, s, "collector-1", "chunks", PipeSticky)
+	collector2 := connectTestConsumer(t, s, "collector-2", "chunks", "")
+
+	// The first consumer with a policy decides it
+	resp := s.handleRequest(collector2, newRequest(t, "connect_pipe", map[string]interface{}{
+		"pipe": "chunks", "role": "consumer", "policy": PipeRoundRobin,
+	}))
+	if resp.Error == nil || resp.Error.Code != -32602 {
+		t.Errorf("Expected policy conflict, got %+v", resp)
+	}
+
+	send := func(id, document string) {
+		env, _ := envelope.NewEnvelope("chunker", "pipe:chunks", "chunk", map[string]string{"text": id})
+		env.ID = id
+		env.CorrelationID = document
+		resp := s.handleRequest(producer, newRequest(t, "send_pipe_envelope", map[string]interface{}{"pipe": "chunks", "envelope": env}))
+		if resp.Error != nil {
+			t.Fatalf("send_pipe_envelope failed: %s", resp.Error.Message)
+		}
+	}
+	// receive lets both collectors wait, sends the chunks and returns what each got
+	receive := func(chunks ...[2]string) (string, string) {
+		fromFirst := receiveAsync(t, s, collector1, "chunks", false)
+		fromSecond := receiveAsync(t, s, collector2, "chunks", false)
+		awaitWaiting(t, s, "chunks", 2)
+		for _, chunk := range chunks {
+			send(chunk[0], chunk[1])
+		}
+		return receivedID(t, fromFirst), receivedID(t, fromSecond)
+	}
+
+	// New documents are spread across the collectors
+	if first, second := receive([2]string{"chunk-1", "doc-1"}, [2]string{"chunk-2", "doc-2"}); first != "chunk-1" || second != "chunk-2" {
+		t.Errorf("Expected chunk-1/chunk-2, got %s/%s", first, second)
+	}
+	// Later chunks follow their document although the rotation points at collector-1
+	if first, second := receive([2]string{"chunk-3", "doc-2"}, [2]string{"chunk-4", "doc-1"}); first != "chunk-4" || second != "chunk-3" {
+		t.Errorf("Expected chunk-4/chunk-3, got %s/%s", first, second)
+	}
+
+	stats := s.Stats().PipeConsumers["chunks"]
+	if stats.Policy != PipeSticky || stats.Key != StickyCorrelationID ||
+		stats.Consumers[0].Keys != 1 || stats.Consumers[1].Keys != 1 || stats.Consumers[1].Received != 2 {
+		t.Errorf("Unexpected consumer stats: %+v", stats)
+	}
+
+	// Disconnecting releases the keys of a consumer
+	if resp := s.handleRequest(collector1, newRequest(t, "disconnect_pipe", map[string]string{"pipe": "chunks"})); resp.Error != nil {
+		t.Fatalf("disconnect_pipe failed: %s", resp.Error.Message)
+	}
+	send("chunk-5", "doc-1")
+	if id := receivedID(t, receiveAsync(t, s, collector2, "chunks", false)); id != "chunk-5" {
+		t.Errorf("Expected collector-2 to take over doc-1, got %s", id)
+	}
+}
@@ -0,0 +1,391 @@
+package broker
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// DeadLetter is a message an agent failed to process and gave up on.
+// It keeps the original message or envelope together with the failure
+// details, so an operator can inspect it and re-inject it once the cause
+// is fixed. Exactly one of Message and Envelope is set.
+type DeadLetter struct {
+	ID       string             `json:"id"`                 // Dead letter identifier (assigned by the broker)
+	Queue    string             `json:"queue"`              // Dead-letter queue holding the record
+	AgentID  string             `json:"agent_id"`           // Agent that failed to process the message
+	Error    string             `json:"error"`              // Last processing error
+	Attempts int                `json:"attempts"`           // Delivery attempts before giving up
+	Source   string             `json:"source,omitempty"`   // Ingress the message came from ("pipe:x", "sub:y")
+	FailedAt time.Time          `json:"failed_at"`          // When the agent gave up
+	Message  *Message           `json:"message,omitempty"`  // Original simple message
+	Envelope *envelope.Envelope `json:"envelope,omitempty"` // Original envelope
+}
+
+// deadLetterStore holds all dead-letter queues of the broker.
+type deadLetterStore struct {
+	queues map[string][]*DeadLetter // Queue name -> dead letters, oldest first
+	mux    sync.Mutex
+}
+
+// newDeadLetterStore creates an empty dead-letter store.
+func newDeadLetterStore() *deadLetterStore {
+	return &deadLetterStore{queues: make(map[string][]*DeadLetter)}
+}
+
+// add inserts a dead letter into its queue, keeping the queue ordered by failure time.
+func (d *deadLetterStore) add(dl *DeadLetter) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	letters := append(d.queues[dl.Queue], dl)
+	sort.SliceStable(letters, func(i, j int) bool {
+		return letters[i].FailedAt.Before(letters[j].FailedAt)
+	})
+	d.queues[dl.Queue] = letters
+}
+
+// list returns the dead letters of one queue, or of all queues when queue is empty.
+func (d *deadLetterStore) list(queue string) []*DeadLetter {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if queue != "" {
+		return append([]*DeadLetter(nil), d.queues[queue]...)
+	}
+
+	var all []*DeadLetter
+	for _, letters := range d.queues {
+		all = append(all, letters...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].FailedAt.Before(all[j].FailedAt)
+	})
+	return all
+}
+
+// get returns a dead letter by queue and ID (nil if unknown).
+func (d *deadLetterStore) get(queue, id string) *DeadLetter {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	for _, dl := range d.queues[queue] {
+		if dl.ID == id {
+			return dl
+		}
+	}
+	return nil
+}
+
+// remove deletes and returns a dead letter (nil if unknown).
+func (d *deadLetterStore) remove(queue, id string) *DeadLetter {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	letters := d.queues[queue]
+	for i, dl := range letters {
+		if dl.ID == id {
+			letters = append(letters[:i], letters[i+1:]...)
+			if len(letters) == 0 {
+				delete(d.queues, queue)
+			} else {
+				d.queues[queue] = letters
+			}
+			return dl
+		}
+	}
+	return nil
+}
+
+// counts returns the number of dead letters per queue.
+func (d *deadLetterStore) counts() map[string]int {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	counts := make(map[string]int, len(d.queues))
+	for queue, letters := range d.queues {
+		counts[queue] = len(letters)
+	}
+	return counts
+}
+
+// deadLetterParams identifies a single dead letter in get, reinject and delete requests.
+type deadLetterParams struct {
+	Queue string `json:"queue"` // Dead-letter queue name
+	ID    string `json:"id"`    // Dead letter identifier
+}
+
+// handleDeadLetter stores a message an agent gave up on in a dead-letter queue.
+// The broker assigns the record ID and, when persistence is enabled, writes the
+// record to the data directory so it survives a restart.
+//
+// Parameters:
+//   - conn: Connection of the failing agent
+//   - req: JSON-RPC request with queue and dead_letter parameters
+//
+// Returns:
+//   - BrokerResponse: The assigned dead letter ID, or a validation error
+//
+// Called by: handleRequest() when method is "dead_letter"
+func (s *Service) handleDeadLetter(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	var params struct {
+		Queue      string      `json:"queue"`       // Dead-letter queue name
+		DeadLetter *DeadLetter `json:"dead_letter"` // Failure record with the original message
+	}
+
+	if err := conn.unmarshal(req.Params, &params); err != nil || params.Queue == "" || params.DeadLetter == nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
+		}
+	}
+
+	dl := params.DeadLetter
+	if (dl.Message == nil) == (dl.Envelope == nil) {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "Dead letter needs exactly one of message or envelope"},
+		}
+	}
+
+	dl.ID = uuid.New().String()
+	dl.Queue = params.Queue
+	if dl.AgentID == "" {
+		dl.AgentID = conn.AgentID
+	}
+	if dl.FailedAt.IsZero() {
+		dl.FailedAt = time.Now()
+	}
+
+	if s.wal != nil {
+		if err := s.wal.SaveDeadLetter(dl); err != nil {
+			return &BrokerResponse{
+				ID:    req.ID,
+				Error: &BrokerError{Code: -32603, Message: fmt.Sprintf("Failed to persist dead letter: %v", err)},
+			}
+		}
+	}
+	s.deadLetters.add(dl)
+
+	if s.debug {
+		log.Printf("Broker: dead letter %s from %s queued in %s (%d attempts): %s", dl.ID, dl.AgentID, dl.Queue, dl.Attempts, dl.Error)
+	}
+
+	return &BrokerResponse{
+		ID:     req.ID,
+		Result: dl.ID,
+	}
+}
+
+// handleListDeadLetters returns the dead letters of one queue, oldest first.
+// Without a queue parameter the dead letters of all queues are returned.
+//
+// Called by: handleRequest() when method is "list_dead_letters"
+func (s *Service) handleListDeadLetters(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	var params struct {
+		Queue string `json:"queue,omitempty"` // Optional queue filter
+	}
+
+	if len(req.Params) > 0 {
+		if err := conn.unmarshal(req.Params, &params); err != nil {
+			return &BrokerResponse{
+				ID:    req.ID,
+				Error: &BrokerError{Code: -32602, Message: "Invalid params"},
+			}
+		}
+	}
+
+	return &BrokerResponse{
+		ID:     req.ID,
+		Result: s.deadLetters.list(params.Queue),
+	}
+}
+
+// handleGetDeadLetter returns a single dead letter for inspection.
+//
+// Called by: handleRequest() when method is "get_dead_letter"
+func (s *Service) handleGetDeadLetter(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	var params deadLetterParams
+
+	if err := conn.unmarshal(req.Params, &params); err != nil || params.Queue == "" || params.ID == "" {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
+		}
+	}
+
+	dl := s.deadLetters.get(params.Queue, params.ID)
+	if dl == nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Unknown dead letter: %s/%s", params.Queue, params.ID)},
+		}
+	}
+
+	return &BrokerResponse{
+		ID:     req.ID,
+		Result: dl,
+	}
+}
+
+// handleReinjectDeadLetter sends the original message of a dead letter back
+// into the system and removes the record. The message goes to the given
+// destination ("pipe:<name>" or "pub:<topic>"), or back to the ingress it
+// originally came from when no destination is given.
+//
+// Parameters:
+//   - conn: Connection requesting the re-injection
+//   - req: JSON-RPC request with queue, id and optional destination parameters
+//
+// Returns:
+//   - BrokerResponse: Success confirmation, or an error for unknown records,
+//     unroutable destinations or full pipes (the record is kept)
+//
+// Called by: handleRequest() when method is "reinject_dead_letter"
+func (s *Service) handleReinjectDeadLetter(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	var params struct {
+		deadLetterParams
+		Destination string `json:"destination,omitempty"` // Override of the original source
+	}
+
+	if err := conn.unmarshal(req.Params, &params); err != nil || params.Queue == "" || params.ID == "" {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
+		}
+	}
+
+	// Take the record out first so concurrent re-injections cannot deliver it twice
+	dl := s.deadLetters.remove(params.Queue, params.ID)
+	if dl == nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Unknown dead letter: %s/%s", params.Queue, params.ID)},
+		}
+	}
+
+	destination := params.Destination
+	if destination == "" {
+		destination = dl.Source
+	}
+
+	if err := s.checkDestination(conn, destination); err != nil {
+		s.deadLetters.add(dl)
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: err,
+		}
+	}
+
+	if err := s.reinject(dl, destination); err != nil {
+		s.deadLetters.add(dl)
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: err,
+		}
+	}
+
+	s.unstoreDeadLetter(dl)
+
+	if s.debug {
+		log.Printf("Broker: re-injected dead letter %s from %s into %s", dl.ID, dl.Queue, destination)
+	}
+
+	return &BrokerResponse{
+		ID:     req.ID,
+		Result: "reinjected",
+	}
+}
+
+// handleDeleteDeadLetter discards a dead letter for good.
+//
+// Called by: handleRequest() when method is "delete_dead_letter"
+func (s *Service) handleDeleteDeadLetter(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	var params deadLetterParams
+
+	if err := conn.unmarshal(req.Params, &params); err != nil || params.Queue == "" || params.ID == "" {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
+		}
+	}
+
+	if !s.deleteDeadLetter(params.Queue, params.ID) {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Unknown dead letter: %s/%s", params.Queue, params.ID)},
+		}
+	}
+
+	return &BrokerResponse{
+		ID:     req.ID,
+		Result: "deleted",
+	}
+}
+
+// reinject delivers the original message of a dead letter to a pipe or topic.
+func (s *Service) reinject(dl *DeadLetter, destination string) *BrokerError {
+	kind, name, found := strings.Cut(destination, ":")
+	if !found || name == "" {
+		return &BrokerError{Code: -32602, Message: fmt.Sprintf("Cannot re-inject to destination %q", destination)}
+	}
+
+	switch kind {
+	case "pipe":
+		item := &queueItem{Message: dl.Message, Envelope: dl.Envelope}
+		if dl.Envelope != nil {
+			seq, err := s.logEnvelope(LogKindPipe, name, dl.Envelope)
+			if err != nil {
+				return &BrokerError{Code: -32603, Message: fmt.Sprintf("Failed to persist envelope: %v", err)}
+			}
+			item.Priority = dl.Envelope.Priority
+			item.Seq = seq
+		} else {
+			dl.Message.Target = destination
+			item.Priority = messagePriority(dl.Message)
+		}
+		if !s.getOrCreatePipe(name).queue.Push(item) {
+			s.unlogEnvelope(item.Seq)
+			return &BrokerError{Code: -32603, Message: "Pipe buffer full"}
+		}
+	case "pub", "sub":
+		if dl.Envelope != nil {
+			if _, err := s.publishEnvelope(nil, name, dl.Envelope, 0); err != nil {
+				return &BrokerError{Code: -32603, Message: fmt.Sprintf("Failed to persist envelope: %v", err)}
+			}
+		} else {
+			s.publishMessage(nil, name, dl.Message, 0)
+		}
+	default:
+		return &BrokerError{Code: -32602, Message: fmt.Sprintf("Cannot re-inject to destination %q", destination)}
+	}
+
+	return nil
+}
+
+// deleteDeadLetter removes a dead letter from memory and the data directory.
+// Returns false if the record is unknown.
+func (s *Service) deleteDeadLetter(queue, id string) bool {
+	dl := s.deadLetters.remove(queue, id)
+	if dl == nil {
+		return false
+	}
+	s.unstoreDeadLetter(dl)
+	return true
+}
+
+// unstoreDeadLetter removes a settled dead letter from the data directory.
+func (s *Service) unstoreDeadLetter(dl *DeadLetter) {
+	if s.wal == nil {
+		return
+	}
+	if err := s.wal.RemoveDeadLetter(dl.Queue, dl.ID); err != nil {
+		log.Printf("Broker: failed to remove dead letter %s/%s: %v", dl.Queue, dl.ID, err)
+	}
+}
@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"testing"
+)
+
+// storeDeadLetter queues a failed message in a dead-letter queue and returns its ID
+func storeDeadLetter(t *testing.T, s *Service, conn *Connection, queue string, msg *Message) string {
+	t.Helper()
+
+	resp := s.handleRequest(conn, newRequest(t, "dead_letter", map[string]interface{}{
+		"queue": queue,
+		"dead_letter": DeadLetter{
+			Error:    "parse failed",
+			Attempts: 3,
+			Source:   "pipe:docs",
+			Message:  msg,
+		},
+	}))
+	if resp.Error != nil {
+		t.Fatalf("dead_letter failed: %s", resp.Error.Message)
+	}
+	id, ok := resp.Result.(string)
+	if !ok || id == "" {
+		t.Fatalf("Expected dead letter ID, got %v", resp.Result)
+	}
+	return id
+}
+
+// Test that dead letters can be listed, inspected and re-injected into their source pipe
+func TestDeadLetterListInspectReinject(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	conn := &Connection{ID: "conn_worker", AgentID: "worker"}
+
+	id := storeDeadLetter(t, s, conn, "worker-dlq", &Message{ID: "doc-1", Type: "document"})
+
+	resp := s.handleRequest(conn, newRequest(t, "list_dead_letters", map[string]interface{}{"queue": "worker-dlq"}))
+	letters, ok := resp.Result.([]*DeadLetter)
+	if resp.Error != nil || !ok || len(letters) != 1 {
+		t.Fatalf("Expected one dead letter, got %+v", resp)
+	}
+
+	resp = s.handleRequest(conn, newRequest(t, "get_dead_letter", map[string]interface{}{"queue": "worker-dlq", "id": id}))
+	dl, ok := resp.Result.(*DeadLetter)
+	if resp.Error != nil || !ok {
+		t.Fatalf("get_dead_letter failed: %+v", resp)
+	}
+	if dl.AgentID != "worker" || dl.Attempts != 3 || dl.Error != "parse failed" || dl.Message.ID != "doc-1" {
+		t.Errorf("Unexpected dead letter: %+v", dl)
+	}
+	if got := s.Stats().DeadLetters["worker-dlq"]; got != 1 {
+		t.Errorf("Expected 1 dead letter in stats, got %d", got)
+	}
+
+	resp = s.handleRequest(conn, newRequest(t, "reinject_dead_letter", map[string]interface{}{"queue": "worker-dlq", "id": id}))
+	if resp.Error != nil {
+		t.Fatalf("reinject_dead_letter failed: %s", resp.Error.Message)
+	}
+
+	delivery := receiveWithAck(t, s, conn, "docs")
+	if delivery.Message == nil || delivery.Message.ID != "doc-1" {
+		t.Errorf("Expected doc-1 back in source pipe, got %+v", delivery)
+	}
+
+	resp = s.handleRequest(conn, newRequest(t, "get_dead_letter", map[string]interface{}{"queue": "worker-dlq", "id": id}))
+	if resp.Error == nil {
+		t.Errorf("Expected re-injected dead letter to be removed")
+	}
+}
+
+// Test that re-injection to an unroutable destination keeps the dead letter
+func TestDeadLetterReinjectInvalidDestination(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	conn := &Connection{ID: "conn_worker", AgentID: "worker"}
+
+	id := storeDeadLetter(t, s, conn, "worker-dlq", &Message{ID: "doc-1"})
+
+	resp := s.handleRequest(conn, newRequest(t, "reinject_dead_letter", map[string]interface{}{
+		"queue":       "worker-dlq",
+		"id":          id,
+		"destination": "file:/tmp/out",
+	}))
+	if resp.Error == nil || resp.Error.Code != -32602 {
+		t.Fatalf("Expected invalid destination error, got %+v", resp)
+	}
+	if got := s.Stats().DeadLetters["worker-dlq"]; got != 1 {
+		t.Errorf("Expected dead letter kept after failed re-injection, got %d", got)
+	}
+}
+
+// Test that dead letters survive a broker restart until they are deleted
+func TestDeadLettersSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	conn := &Connection{ID: "conn_worker", AgentID: "worker"}
+
+	s := newPersistentService(t, dir)
+	id := storeDeadLetter(t, s, conn, "worker-dlq", &Message{ID: "doc-1"})
+	s.wal.Close()
+
+	s = newPersistentService(t, dir)
+	resp := s.handleRequest(conn, newRequest(t, "delete_dead_letter", map[string]interface{}{"queue": "worker-dlq", "id": id}))
+	if resp.Error != nil {
+		t.Fatalf("Expected recovered dead letter, delete failed: %s", resp.Error.Message)
+	}
+	s.wal.Close()
+
+	s = newPersistentService(t, dir)
+	defer s.wal.Close()
+	if letters := s.deadLetters.list(""); len(letters) != 0 {
+		t.Errorf("Expected deleted dead letter to stay gone, got %d", len(letters))
+	}
+}
@@ -0,0 +1,172 @@
+package broker
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// HeaderIdempotencyKey names what makes an envelope a repeat. Producers set
+// it when a retry builds a new envelope (and so a new ID) for the same work,
+// e.g. the file path and modification time of an ingested file. Without it
+// the envelope ID is the key.
+const HeaderIdempotencyKey = "X-Idempotency-Key"
+
+const (
+	defaultDedupWindow   = 10 * time.Minute // How long an accepted envelope is remembered
+	defaultDedupCapacity = 10000            // Envelopes remembered at most, oldest forgotten first
+)
+
+// dedupIndex remembers the envelopes recently accepted for each destination
+// so the broker can drop repeats of them. It is bounded both in time (the
+// window) and in size (the capacity); an envelope forgotten by either is
+// accepted again. Safe for concurrent use.
+type dedupIndex struct {
+	window   time.Duration // Zero disables deduplication
+	capacity int
+
+	mux   sync.Mutex
+	seen  map[string]time.Time // Dedup key -> when it was accepted
+	order []dedupEntry         // Accepted keys, oldest first
+	hits  map[string]uint64    // Destination -> repeats dropped
+}
+
+// dedupEntry is one accepted key in acceptance order.
+type dedupEntry struct {
+	key string
+	at  time.Time
+}
+
+// DedupStats reports the broker's deduplication index.
+type DedupStats struct {
+	Window  time.Duration     `json:"window"`  // How long accepted envelopes are remembered (0 = disabled)
+	Entries int               `json:"entries"` // Envelopes currently remembered
+	Hits    map[string]uint64 `json:"hits"`    // Destination ("pub:<topic>" or "pipe:<name>") -> repeats dropped
+}
+
+// newDedupIndex creates an index remembering envelopes for window, at most
+// capacity of them. A zero window disables it.
+func newDedupIndex(window time.Duration, capacity int) *dedupIndex {
+	return &dedupIndex{
+		window:   window,
+		capacity: capacity,
+		seen:     make(map[string]time.Time),
+		hits:     make(map[string]uint64),
+	}
+}
+
+// dedupKey identifies an envelope sent to a destination. Chunks of a split
+// envelope share its headers, so their index keeps them apart.
+func dedupKey(destination string, env *envelope.Envelope) string {
+	key := env.ID
+	if idempotencyKey := env.Headers[HeaderIdempotencyKey]; idempotencyKey != "" {
+		key = "key:" + idempotencyKey
+	}
+	if index, chunked := env.Headers[envelope.HeaderChunkIndex]; chunked {
+		key += "#" + index
+	}
+	return destination + " " + key
+}
+
+// claim records an envelope sent to a destination and reports whether it is
+// new. A repeat within the window is counted as a hit and not recorded again,
+// so the window runs from the first acceptance.
+func (d *dedupIndex) claim(destination string, env *envelope.Envelope) bool {
+	if d.window <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	key := dedupKey(destination, env)
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.trim(now)
+	if _, repeat := d.seen[key]; repeat {
+		d.hits[destination]++
+		return false
+	}
+	d.record(key, now)
+	return true
+}
+
+// release forgets a claimed envelope the broker did not take after all (full
+// pipe, failed write to the log), so the producer's retry goes through.
+func (d *dedupIndex) release(destination string, env *envelope.Envelope) {
+	if d.window <= 0 {
+		return
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	delete(d.seen, dedupKey(destination, env))
+}
+
+// restore records an envelope accepted at an earlier time, e.g. one
+// recovered from the write-ahead log after a restart.
+func (d *dedupIndex) restore(destination string, env *envelope.Envelope, at time.Time) {
+	if d.window <= 0 || time.Since(at) >= d.window {
+		return
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.record(dedupKey(destination, env), at)
+}
+
+// record adds a key, forgetting the oldest ones beyond the capacity.
+// The caller must hold d.mux.
+func (d *dedupIndex) record(key string, at time.Time) {
+	d.seen[key] = at
+	d.order = append(d.order, dedupEntry{key: key, at: at})
+	for len(d.seen) > d.capacity && len(d.order) > 0 {
+		d.forgetOldest()
+	}
+}
+
+// trim forgets the keys accepted before the window. The caller must hold d.mux.
+func (d *dedupIndex) trim(now time.Time) {
+	for len(d.order) > 0 && now.Sub(d.order[0].at) >= d.window {
+		d.forgetOldest()
+	}
+}
+
+// forgetOldest drops the oldest entry of the acceptance order, and its key
+// unless it was released and claimed again since. The caller must hold d.mux.
+func (d *dedupIndex) forgetOldest() {
+	oldest := d.order[0]
+	d.order[0] = dedupEntry{}
+	d.order = d.order[1:]
+	if at, ok := d.seen[oldest.key]; ok && at.Equal(oldest.at) {
+		delete(d.seen, oldest.key)
+	}
+}
+
+// stats returns the window, the number of remembered envelopes and the hits.
+func (d *dedupIndex) stats() DedupStats {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.trim(time.Now())
+	hits := make(map[string]uint64, len(d.hits))
+	for destination, count := range d.hits {
+		hits[destination] = count
+	}
+	return DedupStats{Window: d.window, Entries: len(d.seen), Hits: hits}
+}
+
+// duplicate answers a publish or send whose envelope was dropped as a repeat.
+// It is not an error: the producer's earlier attempt went through.
+func (s *Service) duplicate(req *BrokerRequest, destination string, env *envelope.Envelope) *BrokerResponse {
+	s.metrics.duplicates.Inc(destination)
+	if s.debug {
+		log.Printf("Broker: dropped duplicate envelope %s for %s", env.ID, destination)
+	}
+	return &BrokerResponse{
+		ID:     req.ID,
+		Result: "duplicate",
+	}
+}
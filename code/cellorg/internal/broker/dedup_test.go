@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// sendDedupEnvelope publishes or sends an envelope with the given ID and
+// idempotency key and returns the broker's result
+func sendDedupEnvelope(t *testing.T, s *Service, method, target, id, key string) interface{} {
+	t.Helper()
+
+	params := map[string]interface{}{"topic": target}
+	destination := "pub:" + target
+	if method == "send_pipe_envelope" {
+		params = map[string]interface{}{"pipe": target}
+		destination = "pipe:" + target
+	}
+	env, _ := envelope.NewEnvelope("file-ingester-001", destination, "file", id)
+	env.ID = id
+	env.Persistent = true
+	if key != "" {
+		env.SetHeader(HeaderIdempotencyKey, key)
+	}
+	params["envelope"] = env
+	resp := s.handleRequest(&Connection{ID: "conn_producer", AgentID: "producer"}, newRequest(t, method, params))
+	if resp.Error != nil {
+		t.Fatalf("%s failed: %s", method, resp.Error.Message)
+	}
+	return resp.Result
+}
+
+// Test that repeated envelopes are dropped per destination by ID or idempotency key
+func TestDedupDropsRepeats(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	subscriber := subscribeTestConn(t, s, "documents")
+
+	for _, send := range []struct {
+		method, target, id, key string
+		want                    string
+	}{
+		{"publish_envelope", "documents", "env-1", "", "published"},
+		{"publish_envelope", "documents", "env-1", "", "duplicate"},
+		{"publish_envelope", "documents", "env-2", "scan.pdf@1700000000", "published"},
+		{"publish_envelope", "documents", "env-3", "scan.pdf@1700000000", "duplicate"},
+		{"publish_envelope", "archive", "env-1", "", "published"}, // Other destination
+		{"send_pipe_envelope", "ocr", "env-1", "", "sent"},
+		{"send_pipe_envelope", "ocr", "env-1", "", "duplicate"},
+	} {
+		if got := sendDedupEnvelope(t, s, send.method, send.target, send.id, send.key); got != send.want {
+			t.Errorf("%s %s to %s: expected %s, got %v", send.method, send.id, send.target, send.want, got)
+		}
+	}
+
+	if ids := outboxIDs(subscriber); len(ids) != 2 || ids[0] != "env-1" || ids[1] != "env-2" {
+		t.Errorf("Expected env-1 and env-2 once, got %v", ids)
+	}
+	if depth := s.getOrCreatePipe("ocr").queue.Len(); depth != 1 {
+		t.Errorf("Expected one queued pipe envelope, got %d", depth)
+	}
+
+	stats := s.Stats().Dedup
+	if stats.Hits["pub:documents"] != 2 || stats.Hits["pipe:ocr"] != 1 || stats.Entries != 4 || stats.Window != defaultDedupWindow {
+		t.Errorf("Unexpected dedup stats: %+v", stats)
+	}
+}
+
+// Test that the index forgets envelopes after the window, beyond the
+// capacity and when released
+func TestDedupIndexBounds(t *testing.T) {
+	env := func(id string) *envelope.Envelope {
+		return &envelope.Envelope{ID: id, Headers: map[string]string{}}
+	}
+
+	d := newDedupIndex(50*time.Millisecond, 2)
+	if !d.claim("pipe:a", env("1")) || d.claim("pipe:a", env("1")) {
+		t.Fatal("Expected the second claim to be a repeat")
+	}
+	d.release("pipe:a", env("1"))
+	if !d.claim("pipe:a", env("1")) {
+		t.Error("Expected a released envelope to be accepted again")
+	}
+
+	d.claim("pipe:a", env("2"))
+	d.claim("pipe:a", env("3"))
+	if !d.claim("pipe:a", env("1")) {
+		t.Error("Expected the oldest envelope to be forgotten beyond the capacity")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !d.claim("pipe:a", env("3")) {
+		t.Error("Expected an envelope to be forgotten after the window")
+	}
+
+	chunk := env("c")
+	chunk.Headers[HeaderIdempotencyKey] = "big.pdf"
+	chunk.Headers[envelope.HeaderChunkIndex] = "0"
+	next := env("d")
+	next.Headers[HeaderIdempotencyKey] = "big.pdf"
+	next.Headers[envelope.HeaderChunkIndex] = "1"
+	if !d.claim("pub:t", chunk) || !d.claim("pub:t", next) {
+		t.Error("Expected chunks sharing an idempotency key to be kept apart")
+	}
+
+	disabled := newDedupIndex(0, 2)
+	if !disabled.claim("pipe:a", env("1")) || !disabled.claim("pipe:a", env("1")) {
+		t.Error("Expected a disabled index to accept everything")
+	}
+}
+
+// Test that persistent envelopes recovered after a restart still count as seen
+func TestDedupSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	s := newPersistentService(t, dir)
+	sendDedupEnvelope(t, s, "send_pipe_envelope", "ocr", "env-1", "")
+	s.wal.Close()
+
+	restarted := newPersistentService(t, dir)
+	defer restarted.wal.Close()
+	if got := sendDedupEnvelope(t, restarted, "send_pipe_envelope", "ocr", "env-1", ""); got != "duplicate" {
+		t.Errorf("Expected the retry after a restart to be a duplicate, got %v", got)
+	}
+}
@@ -0,0 +1,57 @@
+package broker
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// DefaultExpiredPrefix is prepended to a topic or pipe name to form the topic
+// that receives its expired envelopes (e.g. "expired:extracted-text").
+const DefaultExpiredPrefix = "expired:"
+
+// Headers attached to envelopes routed to an expiry topic.
+const (
+	HeaderExpiredReason = "X-Expired-Reason" // Human-readable reason including TTL and age
+	HeaderExpiredFrom   = "X-Expired-From"   // Original destination ("pub:<topic>" or "pipe:<name>")
+	HeaderExpiredStage  = "X-Expired-Stage"  // ExpiryStagePublish or ExpiryStageDelivery
+	HeaderExpiredAt     = "X-Expired-At"     // RFC3339 time the broker detected the expiry
+)
+
+// Expiry stages record where the broker caught an expired envelope.
+const (
+	ExpiryStagePublish  = "publish"  // Already expired when published or sent
+	ExpiryStageDelivery = "delivery" // Expired while queued for a consumer
+)
+
+// expireEnvelope routes an expired envelope to the expiry topic of its original
+// destination. The copy carries the reason in its headers and no TTL, so it is
+// not expired again. The copy is published like any other envelope, so a
+// persistent one waits for a subscriber of the expiry topic.
+func (s *Service) expireEnvelope(env *envelope.Envelope, from, stage string) {
+	s.metrics.expired.Inc(from, stage)
+
+	name := strings.TrimPrefix(strings.TrimPrefix(from, "pub:"), "pipe:")
+	topicName := s.expiredPrefix + name
+
+	expired := env.Clone()
+	expired.TTL = 0
+	expired.Destination = fmt.Sprintf("pub:%s", topicName)
+	expired.SetHeader(HeaderExpiredReason, fmt.Sprintf("ttl of %ds exceeded at %s (age %s)",
+		env.TTL, stage, time.Since(env.Timestamp).Round(time.Millisecond)))
+	expired.SetHeader(HeaderExpiredFrom, from)
+	expired.SetHeader(HeaderExpiredStage, stage)
+	expired.SetHeader(HeaderExpiredAt, time.Now().UTC().Format(time.RFC3339))
+
+	if _, err := s.publishEnvelope(nil, topicName, expired, 0); err != nil {
+		log.Printf("Broker: failed to route expired envelope %s to %s: %v", env.ID, topicName, err)
+		return
+	}
+
+	if s.debug {
+		log.Printf("Broker: envelope %s for %s expired at %s, routed to %s", env.ID, from, stage, topicName)
+	}
+}
@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// newExpiredEnvelope creates an envelope whose TTL ran out ten seconds ago
+func newExpiredEnvelope(t *testing.T, destination string) *envelope.Envelope {
+	t.Helper()
+
+	env, err := envelope.NewEnvelope("producer", destination, "query", "stale")
+	if err != nil {
+		t.Fatalf("Failed to create envelope: %v", err)
+	}
+	env.TTL = 5
+	env.Timestamp = time.Now().Add(-15 * time.Second)
+	return env
+}
+
+// subscribeTestConn subscribes a connection with an outbox (but no writer) to a topic
+func subscribeTestConn(t *testing.T, s *Service, topic string) *Connection {
+	t.Helper()
+
+	conn := &Connection{ID: "conn_" + topic, AgentID: "watcher", outbox: newPriorityQueue(outboxCapacity, 0)}
+	resp := s.handleRequest(conn, newRequest(t, "subscribe", map[string]interface{}{"topic": topic}))
+	if resp.Error != nil {
+		t.Fatalf("subscribe failed: %s", resp.Error.Message)
+	}
+	return conn
+}
+
+// Test that an envelope published after its TTL is routed to the expiry topic
+func TestExpiredPublishRoutedToExpiryTopic(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	subscriber := subscribeTestConn(t, s, "queries")
+	watcher := subscribeTestConn(t, s, "expired:queries")
+
+	env := newExpiredEnvelope(t, "pub:queries")
+	resp := s.handleRequest(producer, newRequest(t, "publish_envelope", map[string]interface{}{
+		"topic":    "queries",
+		"envelope": env,
+	}))
+	if resp.Error != nil || resp.Result != "expired" {
+		t.Fatalf("Expected expired result, got %+v / %+v", resp.Result, resp.Error)
+	}
+
+	if item := subscriber.outbox.Pop(); item != nil {
+		t.Errorf("Expired envelope must not reach subscribers, got %+v", item.Envelope)
+	}
+
+	item := watcher.outbox.Pop()
+	if item == nil {
+		t.Fatal("Expected envelope on expiry topic")
+	}
+	expired := item.Envelope
+	if expired.ID != env.ID || expired.TTL != 0 {
+		t.Errorf("Expected copy of %s without TTL, got %s (ttl %d)", env.ID, expired.ID, expired.TTL)
+	}
+	if expired.Headers[HeaderExpiredFrom] != "pub:queries" || expired.Headers[HeaderExpiredStage] != ExpiryStagePublish {
+		t.Errorf("Unexpected expiry headers: %v", expired.Headers)
+	}
+	if expired.Headers[HeaderExpiredReason] == "" {
+		t.Error("Expected expiry reason header")
+	}
+}
+
+// Test that an envelope expiring while queued in a pipe is skipped on receive
+func TestExpiredPipeEnvelopeSkippedOnReceive(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json", ExpiredPrefix: "dead-"})
+	consumer := &Connection{ID: "conn_consumer", AgentID: "consumer"}
+	watcher := subscribeTestConn(t, s, "dead-work")
+
+	pipe := s.getOrCreatePipe("work")
+	pipe.queue.Push(&queueItem{Envelope: newExpiredEnvelope(t, "pipe:work")})
+
+	resp := s.handleRequest(consumer, newRequest(t, "receive_pipe", map[string]interface{}{
+		"pipe":       "work",
+		"timeout_ms": 50,
+	}))
+	if resp.Error == nil {
+		t.Fatalf("Expected timeout after skipping expired envelope, got %+v", resp.Result)
+	}
+
+	item := watcher.outbox.Pop()
+	if item == nil {
+		t.Fatal("Expected envelope on configured expiry topic")
+	}
+	if item.Envelope.Headers[HeaderExpiredStage] != ExpiryStageDelivery {
+		t.Errorf("Expected delivery stage, got %q", item.Envelope.Headers[HeaderExpiredStage])
+	}
+}
@@ -0,0 +1,174 @@
+package broker
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Filter is a subscription's content filter: publications it does not match
+// are not delivered to the subscriber. It is written like a URL query, e.g.
+// "message_type=chunk&headers.lang=de", and all terms must match. A term is
+// field=value, or field!=value to exclude; "|" separates alternative values
+// ("headers.lang=de|en") and values may be URL-escaped.
+//
+// Fields of envelopes:
+//   - message_type: Envelope.MessageType
+//   - source: Envelope.Source
+//   - headers.<name>: Envelope.Headers[name]
+//   - properties.<name>: Envelope.Properties[name], compared in its text form
+//
+// Simple messages match message_type against Message.Type and read source,
+// headers.<name> and properties.<name> from Message.Meta. A field that is
+// missing never equals a value, so it fails "=" and passes "!=".
+type Filter struct {
+	expr  string
+	terms []filterTerm
+}
+
+// filterTerm is one condition of a filter.
+type filterTerm struct {
+	field  string   // "message_type", "source", "headers" or "properties"
+	name   string   // Header or property name
+	values []string // Alternatives, any of which matches
+	negate bool     // "!=": matches when none of the values does
+}
+
+// ParseFilter parses a filter expression. An empty expression returns nil,
+// which matches everything.
+func ParseFilter(expr string) (*Filter, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	f := &Filter{expr: expr}
+	for _, raw := range strings.Split(expr, "&") {
+		var term filterTerm
+		key, value, found := strings.Cut(raw, "!=")
+		if found {
+			term.negate = true
+		} else if key, value, found = strings.Cut(raw, "="); !found {
+			return nil, fmt.Errorf("term %q needs field=value or field!=value", raw)
+		}
+
+		term.field, term.name, _ = strings.Cut(key, ".")
+		switch term.field {
+		case "message_type", "source":
+			if term.name != "" {
+				return nil, fmt.Errorf("field %s has no subfields", term.field)
+			}
+		case "headers", "properties":
+			if term.name == "" {
+				return nil, fmt.Errorf("field %s needs a name (%s.<name>)", term.field, term.field)
+			}
+		default:
+			return nil, fmt.Errorf("unknown field %q (expected message_type, source, headers.<name> or properties.<name>)", key)
+		}
+
+		for _, alternative := range strings.Split(value, "|") {
+			unescaped, err := url.QueryUnescape(alternative)
+			if err != nil {
+				return nil, fmt.Errorf("term %q: %w", raw, err)
+			}
+			term.values = append(term.values, unescaped)
+		}
+		f.terms = append(f.terms, term)
+	}
+	return f, nil
+}
+
+// String returns the filter expression.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+// Match reports whether a queued message or envelope passes the filter.
+// A nil filter matches everything.
+func (f *Filter) Match(item *queueItem) bool {
+	if f == nil {
+		return true
+	}
+	for _, term := range f.terms {
+		value, present := term.lookup(item)
+		matched := present && slices.Contains(term.values, value)
+		if matched == term.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the value of the term's field in a queued item.
+func (t filterTerm) lookup(item *queueItem) (string, bool) {
+	if env := item.Envelope; env != nil {
+		switch t.field {
+		case "message_type":
+			return env.MessageType, true
+		case "source":
+			return env.Source, true
+		case "headers":
+			value, ok := env.Headers[t.name]
+			return value, ok
+		default:
+			value, ok := env.Properties[t.name]
+			if !ok {
+				return "", false
+			}
+			return fmt.Sprint(value), true
+		}
+	}
+
+	msg := item.Message
+	if msg == nil {
+		return "", false
+	}
+	name := t.name
+	switch t.field {
+	case "message_type":
+		return msg.Type, true
+	case "source":
+		name = "source"
+	}
+	value, ok := msg.Meta[name]
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprint(value), true
+}
+
+// subscriberFilters collects the filters of the subscriptions through which
+// connections receive a publication, by connection ID. A connection with
+// several matching subscriptions gets the publication if any of them takes
+// it; one without a filter takes everything.
+type subscriberFilters map[string][]*Filter
+
+// add records a subscription's filter for a connection.
+func (fs subscriberFilters) add(connID string, f *Filter) {
+	filters, seen := fs[connID]
+	switch {
+	case f == nil:
+		fs[connID] = nil // Unfiltered subscription
+	case seen && filters == nil:
+		// Already unfiltered through another subscription
+	default:
+		fs[connID] = append(filters, f)
+	}
+}
+
+// accept reports whether a connection takes the item built by item.
+func (fs subscriberFilters) accept(connID string, item func() *queueItem) bool {
+	filters := fs[connID]
+	if len(filters) == 0 {
+		return true
+	}
+	for _, f := range filters {
+		if f.Match(item()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// subscribeFiltered subscribes a new connection to a topic with a content filter
+func subscribeFiltered(t *testing.T, s *Service, id, topic, group, filter string) *Connection {
+	t.Helper()
+
+	conn := &Connection{ID: id, AgentID: id, outbox: newPriorityQueue(outboxCapacity, 0)}
+	resp := s.handleRequest(conn, newRequest(t, "subscribe", map[string]interface{}{
+		"topic":  topic,
+		"group":  group,
+		"filter": filter,
+	}))
+	if resp.Error != nil {
+		t.Fatalf("subscribe failed: %s", resp.Error.Message)
+	}
+	return conn
+}
+
+// publishChunk publishes an envelope with a message type and language header
+func publishChunk(t *testing.T, s *Service, producer *Connection, topic, id, messageType, lang string) {
+	t.Helper()
+
+	env, _ := envelope.NewEnvelope("chunker-001", "pub:"+topic, messageType, map[string]string{"text": id})
+	env.ID = id
+	if lang != "" {
+		env.SetHeader("lang", lang)
+	}
+	env.SetProperty("pages", 3)
+	resp := s.handleRequest(producer, newRequest(t, "publish_envelope", map[string]interface{}{"topic": topic, "envelope": env}))
+	if resp.Error != nil {
+		t.Fatalf("publish_envelope failed: %s", resp.Error.Message)
+	}
+}
+
+// outboxIDs drains a connection's outbox and returns the IDs in it
+func outboxIDs(conn *Connection) []string {
+	var ids []string
+	for _, item := range conn.outbox.Drain() {
+		if item.Envelope != nil {
+			ids = append(ids, item.Envelope.ID)
+		} else {
+			ids = append(ids, item.Message.ID)
+		}
+	}
+	return ids
+}
+
+// Test that filter expressions are parsed and matched against envelopes and messages
+func TestFilterMatch(t *testing.T) {
+	env, _ := envelope.NewEnvelope("chunker-001", "pub:extracted-text", "chunk", "text")
+	env.SetHeader("lang", "de")
+	env.SetProperty("pages", 3)
+	chunk := &queueItem{Envelope: env}
+	msg := &queueItem{Message: &Message{Type: "chunk", Meta: map[string]interface{}{"lang": "en", "source": "ocr-001"}}}
+
+	for expr, want := range map[string][2]bool{
+		"message_type=chunk":                   {true, true},
+		"message_type=chunk&headers.lang=de":   {true, false},
+		"headers.lang=de|en":                   {true, true},
+		"headers.lang!=de":                     {false, true},
+		"headers.missing!=x":                   {true, true},
+		"properties.pages=3":                   {true, false},
+		"source=chunker-001":                   {true, false},
+		"source=ocr-001&properties.lang=en":    {false, true},
+		"headers.lang=d%65&message_type=chunk": {true, false},
+	} {
+		f, err := ParseFilter(expr)
+		if err != nil {
+			t.Fatalf("ParseFilter(%q) failed: %v", expr, err)
+		}
+		if got := f.Match(chunk); got != want[0] {
+			t.Errorf("%q on envelope: expected %v", expr, want[0])
+		}
+		if got := f.Match(msg); got != want[1] {
+			t.Errorf("%q on message: expected %v", expr, want[1])
+		}
+	}
+
+	for _, expr := range []string{"lang=de", "headers=de", "message_type.x=chunk", "headers.lang", "headers.lang=%zz"} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("Expected ParseFilter(%q) to fail", expr)
+		}
+	}
+	if f, err := ParseFilter(""); f != nil || err != nil || !f.Match(chunk) {
+		t.Errorf("Expected empty filter to match everything, got %v %v", f, err)
+	}
+}
+
+// Test that the broker only delivers what a subscription's filter matches
+func TestFilteredSubscriptions(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	german := subscribeFiltered(t, s, "ner-de", "extracted-text", "", "message_type=chunk&headers.lang=de")
+	patterns := subscribeFiltered(t, s, "ner-any", "extracted-text.#", "", "headers.lang=en")
+	all := subscribeFiltered(t, s, "auditor", "extracted-text", "", "")
+	// Replicas in a group each take the languages they handle
+	de := subscribeFiltered(t, s, "writer-de", "extracted-text", "writers", "headers.lang=de")
+	en := subscribeFiltered(t, s, "writer-en", "extracted-text", "writers", "headers.lang=en")
+
+	publishChunk(t, s, producer, "extracted-text", "chunk-de", "chunk", "de")
+	publishChunk(t, s, producer, "extracted-text", "chunk-en", "chunk", "en")
+	publishChunk(t, s, producer, "extracted-text", "summary-de", "summary", "de")
+	publishChunk(t, s, producer, "extracted-text", "chunk-fr", "chunk", "fr")
+
+	for conn, want := range map[*Connection][]string{
+		german:   {"chunk-de"},
+		patterns: {"chunk-en"},
+		all:      {"chunk-de", "chunk-en", "summary-de", "chunk-fr"},
+		de:       {"chunk-de", "summary-de"},
+		en:       {"chunk-en"},
+	} {
+		if got := outboxIDs(conn); len(got) != len(want) || (len(want) > 0 && got[0] != want[0]) {
+			t.Errorf("%s: expected %v, got %v", conn.ID, want, got)
+		}
+	}
+
+	stats := s.Stats()
+	if stats.Filters["extracted-text"]["ner-de"] != "message_type=chunk&headers.lang=de" ||
+		stats.Groups["extracted-text"]["writers"].Filters["writer-en"] != "headers.lang=en" {
+		t.Errorf("Unexpected filter stats: %+v %+v", stats.Filters, stats.Groups)
+	}
+
+	// Subscribing again without a filter takes everything
+	subscribeFiltered(t, s, "ner-de", "extracted-text", "", "")
+	publishChunk(t, s, producer, "extracted-text", "chunk-fr-2", "chunk", "fr")
+	if _, filtered := s.Stats().Filters["extracted-text"]["ner-de"]; filtered {
+		t.Error("Expected resubscribe to drop the filter")
+	}
+
+	resp := s.handleRequest(german, newRequest(t, "subscribe", map[string]interface{}{"topic": "extracted-text", "filter": "lang=de"}))
+	if resp.Error == nil || resp.Error.Code != -32602 {
+		t.Errorf("Expected invalid filter to be rejected, got %+v", resp)
+	}
+}
+
+// Test that replayed history and held-back persistent envelopes are filtered too
+func TestFilteredReplayAndPending(t *testing.T) {
+	s := newPersistentService(t, t.TempDir())
+	defer s.wal.Close()
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	for _, lang := range []string{"de", "en"} {
+		env, _ := envelope.NewEnvelope("chunker-001", "pub:chunks", "chunk", lang)
+		env.ID = "persistent-" + lang
+		env.Persistent = true
+		env.SetHeader("lang", lang)
+		if resp := s.handleRequest(producer, newRequest(t, "publish_envelope", map[string]interface{}{"topic": "chunks", "envelope": env})); resp.Error != nil {
+			t.Fatalf("publish_envelope failed: %s", resp.Error.Message)
+		}
+	}
+
+	// The filtered subscriber takes its pending envelope; the other one waits
+	german := subscribeFiltered(t, s, "ner-de", "chunks", "", "headers.lang=de")
+	if ids := outboxIDs(german); len(ids) != 1 || ids[0] != "persistent-de" {
+		t.Errorf("Expected persistent-de, got %v", ids)
+	}
+	english := subscribeFiltered(t, s, "ner-en", "chunks", "", "headers.lang=en")
+	if ids := outboxIDs(english); len(ids) != 1 || ids[0] != "persistent-en" {
+		t.Errorf("Expected persistent-en, got %v", ids)
+	}
+
+	// Replaying the retained history skips what the filter does not match
+	replayer := &Connection{ID: "replayer", AgentID: "replayer", outbox: newPriorityQueue(outboxCapacity, 0), done: make(chan struct{})}
+	resp := s.handleRequest(replayer, newRequest(t, "subscribe", map[string]interface{}{
+		"topic": "chunks", "filter": "headers.lang=en", "from_offset": 1,
+	}))
+	if resp.Error != nil {
+		t.Fatalf("subscribe failed: %s", resp.Error.Message)
+	}
+	item := replayer.outbox.PopWait(time.Second)
+	if item == nil || item.Envelope.ID != "persistent-en" || !item.Replayed {
+		t.Fatalf("Expected persistent-en to be replayed, got %+v", item)
+	}
+	if extra := replayer.outbox.PopWait(50 * time.Millisecond); extra != nil {
+		t.Errorf("Expected only one replayed entry, got %s too", extra.Envelope.ID)
+	}
+}
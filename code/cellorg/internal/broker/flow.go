@@ -0,0 +1,258 @@
+package broker
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Backpressure defaults.
+const (
+	defaultHighWatermark = 0.8                    // Queue fill ratio from which publishers are told to slow down
+	minSlowDownDelay     = 10 * time.Millisecond  // Suggested pause right at the watermark
+	maxSlowDownDelay     = 500 * time.Millisecond // Suggested pause for a full queue
+	maxBlockTimeout      = 20 * time.Second       // Upper bound for block_timeout_ms (below the client request timeout)
+)
+
+// SlowDown is attached to publish and send responses when the queue a
+// publication went to is filling up faster than its consumer drains it.
+// Publishers should pause for RetryAfterMs before sending more.
+type SlowDown struct {
+	Queue        string `json:"queue"`              // "pipe:<name>", "outbox:<connection id>", or the exceeded rate limit ("agent:<id>", "topic:<name>")
+	AgentID      string `json:"agent_id,omitempty"` // Slow subscriber (topic publications only)
+	Depth        int    `json:"depth"`              // Queued items
+	Capacity     int    `json:"capacity"`           // Maximum queued items
+	RetryAfterMs int    `json:"retry_after_ms"`     // Suggested pause before the next publication
+}
+
+// CreditStats reports the prefetch window of a connection.
+// Prefetch 0 means flow control is off and deliveries are written as fast as possible.
+type CreditStats struct {
+	Prefetch int `json:"prefetch"` // Maximum unconfirmed topic deliveries
+	Credits  int `json:"credits"`  // Deliveries that may still be written before the next grant
+}
+
+// creditWindow limits the topic deliveries written to a connection that the
+// agent has not yet finished. The agent advertises a prefetch window; every
+// delivery written uses one credit and the agent grants credits back as it
+// completes messages. Deliveries beyond the window wait in the outbox, where
+// they show up in the subscriber's queue depth.
+//
+// A zero window (the default) disables flow control.
+type creditWindow struct {
+	window    int
+	available int
+	notify    chan struct{} // Closed and replaced whenever credits are added
+	mux       sync.Mutex
+}
+
+// newCreditWindow creates a window with flow control disabled.
+func newCreditWindow() *creditWindow {
+	return &creditWindow{notify: make(chan struct{})}
+}
+
+// setWindow changes the prefetch window. Deliveries already written keep
+// their credit, so shrinking the window can leave the connection in deficit
+// until enough grants arrive.
+func (w *creditWindow) setWindow(window int) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	outstanding := 0
+	if w.window > 0 {
+		outstanding = w.window - w.available
+	}
+	w.window = window
+	w.available = window - outstanding
+	w.wake()
+}
+
+// grant returns credits for completed deliveries, up to the window size.
+func (w *creditWindow) grant(n int) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.window == 0 {
+		return
+	}
+	w.available += n
+	if w.available > w.window {
+		w.available = w.window
+	}
+	w.wake()
+}
+
+// acquire takes one credit, blocking until one is granted or done is closed.
+// Returns false if done was closed first. Always succeeds without a window.
+func (w *creditWindow) acquire(done <-chan struct{}) bool {
+	if w == nil {
+		return true
+	}
+
+	for {
+		w.mux.Lock()
+		if w.window == 0 || w.available > 0 {
+			if w.window > 0 {
+				w.available--
+			}
+			w.mux.Unlock()
+			return true
+		}
+		notify := w.notify
+		w.mux.Unlock()
+
+		select {
+		case <-notify:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// release returns a credit taken for a delivery that was not written.
+func (w *creditWindow) release() {
+	if w != nil {
+		w.grant(1)
+	}
+}
+
+// stats returns the window size and the credits left.
+func (w *creditWindow) stats() CreditStats {
+	if w == nil {
+		return CreditStats{}
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return CreditStats{Prefetch: w.window, Credits: w.available}
+}
+
+// wake releases writers waiting for credit. The caller must hold w.mux.
+func (w *creditWindow) wake() {
+	close(w.notify)
+	w.notify = make(chan struct{})
+}
+
+// slowDown returns a slow-down signal if a queue is filled beyond the high
+// watermark, or nil if it has room. The suggested pause grows linearly from
+// minSlowDownDelay at the watermark to maxSlowDownDelay for a full queue.
+func (s *Service) slowDown(queue string, q *priorityQueue) *SlowDown {
+	depth, capacity := q.Fill()
+	mark := int(float64(capacity) * s.highWatermark)
+	if capacity == 0 || depth < mark {
+		return nil
+	}
+
+	delay := maxSlowDownDelay
+	if capacity > mark {
+		delay = minSlowDownDelay + (maxSlowDownDelay-minSlowDownDelay)*time.Duration(depth-mark)/time.Duration(capacity-mark)
+	}
+	return &SlowDown{
+		Queue:        queue,
+		Depth:        depth,
+		Capacity:     capacity,
+		RetryAfterMs: int(delay / time.Millisecond),
+	}
+}
+
+// outboxSlowDown returns the slow-down signal of a subscriber's outbox, if any.
+func (s *Service) outboxSlowDown(conn *Connection) *SlowDown {
+	if conn.outbox == nil {
+		return nil
+	}
+	signal := s.slowDown(fmt.Sprintf("outbox:%s", conn.ID), conn.outbox)
+	if signal != nil {
+		signal.AgentID = conn.AgentID
+	}
+	return signal
+}
+
+// blockTimeout converts a block_timeout_ms parameter into a duration capped at maxBlockTimeout.
+func blockTimeout(ms int) time.Duration {
+	timeout := time.Duration(ms) * time.Millisecond
+	if timeout > maxBlockTimeout {
+		return maxBlockTimeout
+	}
+	return timeout
+}
+
+// handlePrefetch sets the prefetch window of the requesting connection.
+// With a window of n, at most n topic deliveries are written to the agent
+// before it grants credits back via "credit"; the rest wait in the outbox.
+// A window of 0 turns flow control off again.
+//
+// Parameters:
+//   - conn: Connection advertising its window
+//   - req: JSON-RPC request with prefetch parameter
+//
+// Returns:
+//   - BrokerResponse: CreditStats of the connection, or a parameter error
+//
+// Called by: handleRequest() when method is "prefetch"
+func (s *Service) handlePrefetch(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	var params struct {
+		Prefetch int `json:"prefetch"` // Maximum unconfirmed topic deliveries (0 = unlimited)
+	}
+
+	if err := conn.unmarshal(req.Params, &params); err != nil || params.Prefetch < 0 {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
+		}
+	}
+	if conn.credits == nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32603, Message: "Connection does not receive topic deliveries"},
+		}
+	}
+
+	conn.credits.setWindow(params.Prefetch)
+
+	if s.debug {
+		log.Printf("Broker: %s set prefetch window to %d", conn.ID, params.Prefetch)
+	}
+
+	return &BrokerResponse{
+		ID:     req.ID,
+		Result: conn.credits.stats(),
+	}
+}
+
+// handleCredit grants credits back to the requesting connection after the
+// agent finished topic deliveries, letting the outbox writer continue.
+//
+// Parameters:
+//   - conn: Connection granting credits
+//   - req: JSON-RPC request with credit parameter
+//
+// Returns:
+//   - BrokerResponse: CreditStats of the connection, or a parameter error
+//
+// Called by: handleRequest() when method is "credit"
+func (s *Service) handleCredit(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	var params struct {
+		Credit int `json:"credit"` // Number of completed deliveries
+	}
+
+	if err := conn.unmarshal(req.Params, &params); err != nil || params.Credit <= 0 {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
+		}
+	}
+	if conn.credits == nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32603, Message: "Connection does not receive topic deliveries"},
+		}
+	}
+
+	conn.credits.grant(params.Credit)
+
+	return &BrokerResponse{
+		ID:     req.ID,
+		Result: conn.credits.stats(),
+	}
+}
@@ -0,0 +1,191 @@
+package broker
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// sendTestPipeMessage sends a simple message to a pipe
+func sendTestPipeMessage(t *testing.T, s *Service, pipe string, blockMs int) *BrokerResponse {
+	t.Helper()
+
+	return s.handleRequest(&Connection{ID: "conn_producer"}, newRequest(t, "send_pipe", map[string]interface{}{
+		"pipe":             pipe,
+		"message":          Message{ID: "msg", Type: "work"},
+		"block_timeout_ms": blockMs,
+	}))
+}
+
+// Test that the outbox writer stops at the prefetch window until credits are granted
+func TestPrefetchWindowHoldsDeliveries(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	server, agent := net.Pipe()
+	defer agent.Close()
+	conn := &Connection{
+		ID:      "conn_ner",
+		AgentID: "ner-agent",
+		Conn:    server,
+		Encoder: json.NewEncoder(server),
+		outbox:  newPriorityQueue(outboxCapacity, 0),
+		credits: newCreditWindow(),
+	}
+	if resp := s.handleRequest(conn, newRequest(t, "prefetch", map[string]int{"prefetch": 2})); resp.Error != nil {
+		t.Fatalf("prefetch failed: %s", resp.Error.Message)
+	}
+	if resp := s.handleRequest(conn, newRequest(t, "subscribe", map[string]string{"topic": "ner-requests"})); resp.Error != nil {
+		t.Fatalf("subscribe failed: %s", resp.Error.Message)
+	}
+	for i := 0; i < 5; i++ {
+		publishTestMessage(t, s, producer, "ner-requests")
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.writeOutbox(conn, done)
+
+	decoder := json.NewDecoder(agent)
+	read := func() bool {
+		agent.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		var msg Message
+		return decoder.Decode(&msg) == nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if !read() {
+			t.Fatalf("Expected delivery %d within the prefetch window", i+1)
+		}
+	}
+	if read() {
+		t.Fatal("Expected no delivery beyond the prefetch window")
+	}
+	decoder = json.NewDecoder(agent) // The decoder keeps the timeout error
+	if got := conn.outbox.Len(); got != 3 {
+		t.Errorf("Expected 3 deliveries held in the outbox, got %d", got)
+	}
+
+	if resp := s.handleRequest(conn, newRequest(t, "credit", map[string]int{"credit": 1})); resp.Error != nil {
+		t.Fatalf("credit failed: %s", resp.Error.Message)
+	}
+	if !read() {
+		t.Fatal("Expected a delivery after granting a credit")
+	}
+
+	if stats := conn.credits.stats(); stats.Prefetch != 2 || stats.Credits != 0 {
+		t.Errorf("Expected window 2 with no credits left, got %+v", stats)
+	}
+}
+
+// Test that a send to a full pipe fails fast or waits for the consumer when asked to
+func TestSendPipeBlocksUntilSpace(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json", PipeCapacity: 2})
+
+	for i := 0; i < 2; i++ {
+		if resp := sendTestPipeMessage(t, s, "ner-input", 0); resp.Error != nil {
+			t.Fatalf("send %d failed: %s", i+1, resp.Error.Message)
+		}
+	}
+
+	resp := sendTestPipeMessage(t, s, "ner-input", 50)
+	if resp.Error == nil || resp.Error.Code != -32603 {
+		t.Fatalf("Expected pipe full error, got %+v", resp)
+	}
+	if resp.SlowDown == nil || resp.SlowDown.Depth != 2 || resp.SlowDown.RetryAfterMs != int(maxSlowDownDelay/time.Millisecond) {
+		t.Errorf("Expected full-pipe slow-down signal, got %+v", resp.SlowDown)
+	}
+
+	pipe := s.getOrCreatePipe("ner-input")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pipe.queue.Pop()
+	}()
+
+	if resp := sendTestPipeMessage(t, s, "ner-input", 2000); resp.Error != nil {
+		t.Fatalf("Expected blocked send to succeed once the consumer made room, got %s", resp.Error.Message)
+	}
+	if got := pipe.queue.Len(); got != 2 {
+		t.Errorf("Expected 2 queued messages, got %d", got)
+	}
+}
+
+// Test that publishers get a slow-down signal once a queue passes the high watermark
+func TestSlowDownSignal(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json", PipeCapacity: 10, HighWatermark: 0.5})
+
+	for i := 1; i <= 6; i++ {
+		resp := sendTestPipeMessage(t, s, "bulk", 0)
+		if resp.Error != nil {
+			t.Fatalf("send %d failed: %s", i, resp.Error.Message)
+		}
+		if i < 5 && resp.SlowDown != nil {
+			t.Errorf("Unexpected slow-down at depth %d: %+v", i, resp.SlowDown)
+		}
+		if i >= 5 && (resp.SlowDown == nil || resp.SlowDown.Queue != "pipe:bulk" || resp.SlowDown.Depth != i) {
+			t.Errorf("Expected slow-down at depth %d, got %+v", i, resp.SlowDown)
+		}
+	}
+
+	// Topic publications report the fullest subscriber outbox
+	slow := &Connection{ID: "conn_slow", AgentID: "ner-agent", outbox: newPriorityQueue(4, 0)}
+	s.handleRequest(slow, newRequest(t, "subscribe", map[string]string{"topic": "ner-requests"}))
+	subscribeTestConn(t, s, "ner-requests")
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	var resp *BrokerResponse
+	for i := 0; i < 3; i++ {
+		resp = publishTestMessage(t, s, producer, "ner-requests")
+	}
+	if resp.SlowDown == nil || resp.SlowDown.AgentID != "ner-agent" || resp.SlowDown.Depth != 3 {
+		t.Errorf("Expected slow-down for ner-agent's outbox, got %+v", resp.SlowDown)
+	}
+}
+
+// Test that a publish blocked on a full outbox does not hold up the topic
+func TestBlockedPublishReleasesTopic(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+	slow := &Connection{ID: "conn_slow", AgentID: "indexer", outbox: newPriorityQueue(1, 0)}
+	if resp := s.handleRequest(slow, newRequest(t, "subscribe", map[string]interface{}{"topic": "chunks"})); resp.Error != nil {
+		t.Fatalf("subscribe failed: %s", resp.Error.Message)
+	}
+
+	publish := func(id string, blockMs int) *BrokerResponse {
+		return s.handleRequest(producer, newRequest(t, "publish", map[string]interface{}{
+			"topic":            "chunks",
+			"message":          Message{ID: id, Type: "chunk"},
+			"block_timeout_ms": blockMs,
+		}))
+	}
+	if resp := publish("first", 0); resp.Error != nil {
+		t.Fatalf("publish failed: %s", resp.Error.Message)
+	}
+
+	blocked := make(chan *BrokerResponse, 1)
+	go func() { blocked <- publish("second", 2000) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// Other publishers and subscribers of the topic carry on meanwhile
+	done := make(chan struct{})
+	go func() {
+		publish("third", 0)
+		s.handleRequest(&Connection{ID: "conn_late", AgentID: "watcher"}, newRequest(t, "subscribe", map[string]interface{}{"topic": "chunks"}))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the topic to stay usable while a publish waits for outbox space")
+	}
+
+	slow.outbox.Pop()
+	resp := <-blocked
+	if resp.Error != nil {
+		t.Fatalf("Expected blocked publish to succeed once the subscriber made room, got %s", resp.Error.Message)
+	}
+	if item := slow.outbox.Pop(); item == nil || item.Message.ID != "second" {
+		t.Errorf("Expected the blocked publication queued, got %+v", item)
+	}
+}
@@ -0,0 +1,320 @@
+package broker
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Consumer group strategies decide which member of a group receives a publication.
+const (
+	GroupRoundRobin  = "round_robin"  // Members take turns (default)
+	GroupLeastLoaded = "least_loaded" // Member with the fewest undelivered items in its outbox
+)
+
+// ConsumerGroup is a set of subscribers that share a topic's stream instead of
+// each receiving every publication. Every publication goes to exactly one
+// member, so replicas of an agent stage can scale horizontally. Other groups
+// and ungrouped subscribers of the topic still get their own copy.
+type ConsumerGroup struct {
+	Name     string             // Group name given by the subscribers
+	Strategy string             // GroupRoundRobin or GroupLeastLoaded
+	Members  []*Connection      // Subscribed connections
+	next     int                // Round-robin position
+	filters  map[string]*Filter // Content filters of members, by connection ID
+	mux      sync.Mutex         // Protects Members, next and filters
+}
+
+// GroupStats reports the members of one consumer group.
+type GroupStats struct {
+	Strategy string            `json:"strategy"`          // Member selection strategy
+	Members  []string          `json:"members"`           // Connection IDs of the members
+	Filters  map[string]string `json:"filters,omitempty"` // Connection ID -> content filter of filtering members
+}
+
+// validGroupStrategy normalizes a requested strategy; empty means round-robin.
+func validGroupStrategy(strategy string) (string, error) {
+	switch strategy {
+	case "":
+		return GroupRoundRobin, nil
+	case GroupRoundRobin, GroupLeastLoaded:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown group strategy %q (expected %s or %s)", strategy, GroupRoundRobin, GroupLeastLoaded)
+	}
+}
+
+// join adds a connection to the group, or replaces the filter of a member.
+func (g *ConsumerGroup) join(conn *Connection, filter *Filter) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	if g.filters == nil {
+		g.filters = make(map[string]*Filter)
+	}
+	if filter != nil {
+		g.filters[conn.ID] = filter
+	} else {
+		delete(g.filters, conn.ID)
+	}
+
+	for _, member := range g.Members {
+		if member.ID == conn.ID {
+			return
+		}
+	}
+	g.Members = append(g.Members, conn)
+}
+
+// accepts reports whether a member's filter matches the item built by item.
+func (g *ConsumerGroup) accepts(conn *Connection, item func() *queueItem) bool {
+	g.mux.Lock()
+	filter := g.filters[conn.ID]
+	g.mux.Unlock()
+	return filter == nil || filter.Match(item())
+}
+
+// leave removes a connection from the group and reports whether the group is now empty.
+func (g *ConsumerGroup) leave(conn *Connection) bool {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	for i, member := range g.Members {
+		if member.ID == conn.ID {
+			g.Members = append(g.Members[:i], g.Members[i+1:]...)
+			break
+		}
+	}
+	delete(g.filters, conn.ID)
+	return len(g.Members) == 0
+}
+
+// candidates returns the members in the order they should be offered the
+// next publication: the strategy's choice first, then the others as fallback
+// for when an outbox is full.
+func (g *ConsumerGroup) candidates() []*Connection {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	n := len(g.Members)
+	if n == 0 {
+		return nil
+	}
+
+	ordered := make([]*Connection, 0, n)
+	switch g.Strategy {
+	case GroupLeastLoaded:
+		ordered = append(ordered, g.Members...)
+		loads := make(map[string]int, n)
+		for _, member := range ordered {
+			loads[member.ID] = member.outbox.Len()
+		}
+		// Stable insertion sort keeps join order among equally loaded members
+		for i := 1; i < n; i++ {
+			for j := i; j > 0 && loads[ordered[j].ID] < loads[ordered[j-1].ID]; j-- {
+				ordered[j], ordered[j-1] = ordered[j-1], ordered[j]
+			}
+		}
+	default:
+		start := g.next % n
+		g.next = start + 1
+		ordered = append(ordered, g.Members[start:]...)
+		ordered = append(ordered, g.Members[:start]...)
+	}
+	return ordered
+}
+
+// stats returns a snapshot of the group's members.
+func (g *ConsumerGroup) stats() GroupStats {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	members := make([]string, len(g.Members))
+	for i, member := range g.Members {
+		members[i] = member.ID
+	}
+	stats := GroupStats{Strategy: g.Strategy, Members: members}
+	if len(g.filters) > 0 {
+		stats.Filters = make(map[string]string, len(g.filters))
+		for id, filter := range g.filters {
+			stats.Filters[id] = filter.String()
+		}
+	}
+	return stats
+}
+
+// distribution is the outcome of queueing one publication for a topic's subscribers.
+type distribution struct {
+	delivered  int       // Copies queued
+	recipients int       // Ungrouped subscribers plus consumer groups whose filters match
+	slowDown   *SlowDown // Fullest recipient outbox beyond the high watermark (nil if none)
+
+	waits    []outboxWait // Copies for full outboxes, queued by awaitOutboxes
+	deadline time.Time    // How long awaitOutboxes waits for room
+	requeued int          // Persistent copies awaitOutboxes handed back to the topic
+}
+
+// outboxWait is a copy of a publication waiting for room in a full outbox.
+type outboxWait struct {
+	conn  *Connection
+	item  *queueItem
+	group string // Consumer group the copy was chosen for (empty for subscribers)
+}
+
+// queued counts a copy queued for conn, keeping the strongest slow-down signal.
+func (s *Service) queued(result *distribution, conn *Connection) {
+	result.delivered++
+	if signal := s.outboxSlowDown(conn); signal != nil &&
+		(result.slowDown == nil || signal.RetryAfterMs > result.slowDown.RetryAfterMs) {
+		result.slowDown = signal
+	}
+}
+
+// distribute queues a publication on a topic for every ungrouped subscriber
+// (of the topic and of matching wildcard subscriptions) and for one member of
+// each consumer group, skipping subscriptions whose filter does not match.
+// newItem builds the queue item for one recipient.
+// A connection receives at most one copy, and the sender none.
+// With a block timeout, copies for full outboxes are not dropped but left in
+// the result's waits, for awaitOutboxes to queue once the caller released
+// the topic; the timeout covers the whole publication.
+// The caller must hold topic.mux.
+func (s *Service) distribute(sender *Connection, topic *Topic, block time.Duration, newItem func() *queueItem) distribution {
+	subscribers, filters, groups := s.subscribersOf(topic)
+	result := distribution{deadline: time.Now().Add(block)}
+
+	// Filters look at one item built on demand, since most topics have none
+	var probe *queueItem
+	item := func() *queueItem {
+		if probe == nil {
+			probe = newItem()
+		}
+		return probe
+	}
+
+	seen := make(map[string]bool, len(subscribers))
+	if sender != nil {
+		seen[sender.ID] = true // Prevent echo to sender
+	}
+
+	for _, subscriber := range subscribers {
+		if !filters.accept(subscriber.ID, item) {
+			s.metrics.filtered.Inc(topic.Name)
+			continue
+		}
+		result.recipients++
+		if seen[subscriber.ID] {
+			continue
+		}
+		seen[subscriber.ID] = true
+
+		delivery := newItem()
+		if subscriber.deliver(delivery) {
+			s.queued(&result, subscriber)
+			continue
+		}
+		if block > 0 && subscriber.outbox != nil {
+			result.waits = append(result.waits, outboxWait{conn: subscriber, item: delivery})
+			continue
+		}
+		delivery.discard()
+		s.metrics.dropped.Inc(fmt.Sprintf("pub:%s", topic.Name), DropOutboxFull)
+		if s.debug {
+			log.Printf("Broker: outbox full, dropping publication on %s for subscriber %s", topic.Name, subscriber.ID)
+		}
+		// Continue with other subscribers even if one fails
+	}
+
+	for _, group := range groups {
+		var taken, preferred *Connection
+		filteredOut := false
+		for _, member := range group.candidates() {
+			if seen[member.ID] {
+				continue
+			}
+			if !group.accepts(member, item) {
+				filteredOut = true
+				continue
+			}
+			if preferred == nil {
+				preferred = member
+			}
+			delivery := newItem()
+			if member.deliver(delivery) {
+				taken = member
+				break
+			}
+			delivery.discard()
+		}
+		// No member that could take the publication wants it
+		if preferred == nil && filteredOut {
+			s.metrics.filtered.Inc(topic.Name)
+			continue
+		}
+		result.recipients++
+		switch {
+		case taken != nil:
+			seen[taken.ID] = true
+			s.queued(&result, taken)
+		case block > 0 && preferred != nil:
+			// All members are full: wait for the strategy's choice to make room
+			seen[preferred.ID] = true
+			result.waits = append(result.waits, outboxWait{conn: preferred, item: newItem(), group: group.Name})
+		default:
+			if preferred != nil {
+				s.metrics.dropped.Inc(fmt.Sprintf("pub:%s", topic.Name), DropNoMember)
+			}
+			if s.debug {
+				log.Printf("Broker: no member of group %s could take publication on %s", group.Name, topic.Name)
+			}
+		}
+	}
+
+	// The probe was only looked at by filters
+	if probe != nil {
+		probe.discard()
+	}
+
+	return result
+}
+
+// awaitOutboxes queues the copies distribute left waiting for full outboxes,
+// each as soon as its outbox has room, dropping those still waiting at the
+// deadline. The caller must not hold the topic's lock, so other publishers
+// and subscribers of the topic carry on meanwhile.
+//
+// A subscriber may disconnect during the wait, after its outbox was emptied;
+// copies queued for it then are taken back like the rest of its outbox, and
+// persistent ones wait on the topic for the next subscriber.
+func (s *Service) awaitOutboxes(topicName string, result *distribution) {
+	for _, wait := range result.waits {
+		if wait.conn.deliverWithin(wait.item, result.deadline) {
+			if !wait.conn.closed() {
+				s.queued(result, wait.conn)
+				continue
+			}
+			s.reclaimOutbox(wait.conn)
+			if wait.item.Seq != 0 {
+				result.requeued++
+			}
+			if s.debug {
+				log.Printf("Broker: %s disconnected while publication on %s waited for its outbox", wait.conn.ID, topicName)
+			}
+			continue
+		}
+		wait.item.discard()
+		if wait.group != "" {
+			s.metrics.dropped.Inc(fmt.Sprintf("pub:%s", topicName), DropNoMember)
+			if s.debug {
+				log.Printf("Broker: no member of group %s could take publication on %s", wait.group, topicName)
+			}
+			continue
+		}
+		s.metrics.dropped.Inc(fmt.Sprintf("pub:%s", topicName), DropOutboxFull)
+		if s.debug {
+			log.Printf("Broker: outbox full, dropping publication on %s for subscriber %s", topicName, wait.conn.ID)
+		}
+	}
+	result.waits = nil
+}
@@ -0,0 +1,97 @@
+package broker
+
+import (
+	"testing"
+)
+
+// joinTestGroup subscribes a new connection to a topic as a consumer group member
+func joinTestGroup(t *testing.T, s *Service, id, topic, group, strategy string) *Connection {
+	t.Helper()
+
+	conn := &Connection{ID: id, AgentID: id, outbox: newPriorityQueue(outboxCapacity, 0)}
+	resp := s.handleRequest(conn, newRequest(t, "subscribe", map[string]interface{}{
+		"topic":    topic,
+		"group":    group,
+		"strategy": strategy,
+	}))
+	if resp.Error != nil {
+		t.Fatalf("subscribe to group failed: %s", resp.Error.Message)
+	}
+	return conn
+}
+
+// Test that group members share a topic round-robin while other subscribers get every message
+func TestConsumerGroupRoundRobin(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	chunker1 := joinTestGroup(t, s, "chunker-1", "extracted-text", "chunkers", "")
+	chunker2 := joinTestGroup(t, s, "chunker-2", "extracted-text", "chunkers", "")
+	indexer := joinTestGroup(t, s, "indexer-1", "extracted-text", "indexers", "")
+	auditor := subscribeTestConn(t, s, "extracted-text")
+
+	for i := 0; i < 4; i++ {
+		publishTestMessage(t, s, producer, "extracted-text")
+	}
+
+	if chunker1.outbox.Len() != 2 || chunker2.outbox.Len() != 2 {
+		t.Errorf("Expected chunkers to share 2/2, got %d/%d", chunker1.outbox.Len(), chunker2.outbox.Len())
+	}
+	if indexer.outbox.Len() != 4 {
+		t.Errorf("Expected single-member group to get all 4, got %d", indexer.outbox.Len())
+	}
+	if auditor.outbox.Len() != 4 {
+		t.Errorf("Expected ungrouped subscriber to get all 4, got %d", auditor.outbox.Len())
+	}
+
+	groups := s.Stats().Groups["extracted-text"]
+	if len(groups) != 2 || len(groups["chunkers"].Members) != 2 || groups["chunkers"].Strategy != GroupRoundRobin {
+		t.Errorf("Unexpected group stats: %+v", groups)
+	}
+}
+
+// Test that least-loaded groups prefer the member with the shortest outbox
+func TestConsumerGroupLeastLoaded(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	busy := joinTestGroup(t, s, "busy", "extracted-text", "chunkers", GroupLeastLoaded)
+	idle := joinTestGroup(t, s, "idle", "extracted-text", "chunkers", GroupLeastLoaded)
+	for i := 0; i < 3; i++ {
+		busy.outbox.Push(&queueItem{Message: &Message{ID: "backlog"}})
+	}
+
+	for i := 0; i < 3; i++ {
+		publishTestMessage(t, s, producer, "extracted-text")
+	}
+
+	if busy.outbox.Len() != 3 || idle.outbox.Len() != 3 {
+		t.Errorf("Expected idle member to catch up to 3/3, got busy=%d idle=%d", busy.outbox.Len(), idle.outbox.Len())
+	}
+}
+
+// Test that a departed member no longer receives and conflicting strategies are rejected
+func TestConsumerGroupMembership(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	leaving := joinTestGroup(t, s, "chunker-1", "extracted-text", "chunkers", "")
+	staying := joinTestGroup(t, s, "chunker-2", "extracted-text", "chunkers", "")
+	s.dropSubscriber(leaving)
+
+	publishTestMessage(t, s, producer, "extracted-text")
+	publishTestMessage(t, s, producer, "extracted-text")
+	if staying.outbox.Len() != 2 {
+		t.Errorf("Expected remaining member to get both messages, got %d", staying.outbox.Len())
+	}
+
+	conn := &Connection{ID: "chunker-3", outbox: newPriorityQueue(outboxCapacity, 0)}
+	resp := s.handleRequest(conn, newRequest(t, "subscribe", map[string]interface{}{
+		"topic":    "extracted-text",
+		"group":    "chunkers",
+		"strategy": GroupLeastLoaded,
+	}))
+	if resp.Error == nil || resp.Error.Code != -32602 {
+		t.Errorf("Expected strategy conflict error, got %+v", resp)
+	}
+}
@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/metrics"
+	"github.com/tenzoki/agen/cellorg/internal/wildcard"
+)
+
+// Drop reasons reported by cellorg_broker_dropped_total.
+const (
+	DropOutboxFull = "outbox_full" // Subscriber outbox full, the copy was discarded
+	DropNoMember   = "no_member"   // No consumer group member could take the publication
+	DropPipeFull   = "pipe_full"   // Pipe full, the send was rejected
+)
+
+// brokerMetrics counts broker traffic for the metrics endpoint. Queue depths,
+// connections and dead letters are read from the broker state on every scrape.
+type brokerMetrics struct {
+	registry     *metrics.Registry
+	published    *metrics.Counter // topic
+	delivered    *metrics.Counter // topic
+	pipeSent     *metrics.Counter // pipe
+	pipeReceived *metrics.Counter // pipe
+	dropped      *metrics.Counter // destination, reason
+	expired      *metrics.Counter // destination, stage
+	filtered     *metrics.Counter // topic
+	duplicates   *metrics.Counter // destination
+	rateLimited  *metrics.Counter // limit, reason
+
+	schemaRejected *metrics.Counter // destination, message_type
+}
+
+// newBrokerMetrics registers the broker's metric families.
+func newBrokerMetrics(s *Service) *brokerMetrics {
+	r := metrics.NewRegistry()
+	m := &brokerMetrics{
+		registry:     r,
+		published:    r.Counter("cellorg_broker_published_total", "Messages and envelopes published per topic.", "topic"),
+		delivered:    r.Counter("cellorg_broker_delivered_total", "Topic deliveries written to subscribers per topic.", "topic"),
+		pipeSent:     r.Counter("cellorg_broker_pipe_sent_total", "Messages and envelopes queued per pipe.", "pipe"),
+		pipeReceived: r.Counter("cellorg_broker_pipe_received_total", "Pipe items handed to consumers, including redeliveries.", "pipe"),
+		dropped:      r.Counter("cellorg_broker_dropped_total", "Publications and sends the broker could not queue.", "destination", "reason"),
+		expired:      r.Counter("cellorg_broker_expired_total", "Envelopes routed to the expiry topic because their TTL passed.", "destination", "stage"),
+		filtered:     r.Counter("cellorg_broker_filtered_total", "Topic copies not delivered because the subscription filter did not match.", "topic"),
+		duplicates:   r.Counter("cellorg_broker_duplicates_total", "Envelopes dropped as repeats of one accepted within the dedup window.", "destination"),
+		rateLimited:  r.Counter("cellorg_broker_rate_limited_total", "Publications and sends rejected by an agent or topic rate limit.", "limit", "reason"),
+
+		schemaRejected: r.Counter("cellorg_broker_schema_rejected_total", "Publications and sends rejected because their payload did not match the schema.", "destination", "message_type"),
+	}
+
+	r.Gauge("cellorg_broker_connections", "Open agent connections.", nil, func(emit metrics.Emit) {
+		s.connMux.RLock()
+		defer s.connMux.RUnlock()
+		emit(float64(len(s.connections)))
+	})
+	r.Gauge("cellorg_broker_pipe_depth", "Items queued per pipe.", []string{"pipe"}, func(emit metrics.Emit) {
+		for name, pipe := range s.pipeSnapshot() {
+			emit(float64(pipe.queue.Len()), name)
+		}
+	})
+	r.Gauge("cellorg_broker_pipe_in_flight", "Manual-ack pipe deliveries awaiting ack per pipe.", []string{"pipe"}, func(emit metrics.Emit) {
+		for name, pipe := range s.pipeSnapshot() {
+			emit(float64(s.deliveries.countForPipe(pipe)), name)
+		}
+	})
+	r.Gauge("cellorg_broker_pipe_oldest_seconds", "Age of the longest-waiting item per pipe (0 when empty); a growing value means a stuck pipe.", []string{"pipe"}, func(emit metrics.Emit) {
+		for name, pipe := range s.pipeSnapshot() {
+			age := 0.0
+			if oldest := pipe.queue.Oldest(); !oldest.IsZero() {
+				age = time.Since(oldest).Seconds()
+			}
+			emit(age, name)
+		}
+	})
+	r.Gauge("cellorg_broker_outbox_depth", "Topic deliveries queued per subscriber connection.", []string{"connection", "agent"}, func(emit metrics.Emit) {
+		s.connMux.RLock()
+		defer s.connMux.RUnlock()
+		for id, conn := range s.connections {
+			if conn.outbox != nil {
+				emit(float64(conn.outbox.Len()), id, conn.AgentID)
+			}
+		}
+	})
+	r.Gauge("cellorg_broker_dead_letters", "Dead letters held per queue.", []string{"queue"}, func(emit metrics.Emit) {
+		for queue, count := range s.deadLetters.counts() {
+			emit(float64(count), queue)
+		}
+	})
+	r.Gauge("cellorg_broker_scheduled", "Envelopes waiting in the timer wheel for their delivery time.", nil, func(emit metrics.Emit) {
+		emit(float64(s.scheduler.len()))
+	})
+	r.Gauge("cellorg_broker_topic_retained", "Entries retained for replay per topic.", []string{"topic"}, func(emit metrics.Emit) {
+		s.topicsMux.RLock()
+		topics := make([]*Topic, 0, len(s.topics))
+		for _, topic := range s.topics {
+			topics = append(topics, topic)
+		}
+		s.topicsMux.RUnlock()
+
+		for _, topic := range topics {
+			if wildcard.IsPattern(topic.Name) {
+				continue
+			}
+			topic.mux.RLock()
+			emit(float64(len(topic.history.entries)), topic.Name)
+			topic.mux.RUnlock()
+		}
+	})
+
+	return m
+}
+
+// Metrics returns the registry served on the broker's metrics endpoint.
+func (s *Service) Metrics() *metrics.Registry {
+	return s.metrics.registry
+}
+
+// pipeSnapshot returns the current pipes by name.
+func (s *Service) pipeSnapshot() map[string]*Pipe {
+	s.pipesMux.RLock()
+	defer s.pipesMux.RUnlock()
+
+	pipes := make(map[string]*Pipe, len(s.pipes))
+	for name, pipe := range s.pipes {
+		pipes[name] = pipe
+	}
+	return pipes
+}
@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"strings"
+	"testing"
+)
+
+// scrape returns the broker's metrics in the text format
+func scrape(t *testing.T, s *Service) string {
+	t.Helper()
+
+	var out strings.Builder
+	if _, err := s.Metrics().WriteTo(&out); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	return out.String()
+}
+
+// Test that publications, pipe traffic and drops show up in the metrics
+func TestBrokerMetrics(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json", PipeCapacity: 1})
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+	subscriber := &Connection{ID: "conn_sub", AgentID: "ner-agent", outbox: newPriorityQueue(1, 0)}
+	s.connections[subscriber.ID] = subscriber
+
+	if resp := s.handleRequest(subscriber, newRequest(t, "subscribe", map[string]string{"topic": "extracted-text"})); resp.Error != nil {
+		t.Fatalf("subscribe failed: %s", resp.Error.Message)
+	}
+	publishTestMessage(t, s, producer, "extracted-text")
+	publishTestMessage(t, s, producer, "extracted-text") // Outbox holds one delivery
+
+	sendTestPipeMessage(t, s, "ner-requests", 0)
+	sendTestPipeMessage(t, s, "ner-requests", 0) // Pipe holds one item
+
+	metrics := scrape(t, s)
+	for _, line := range []string{
+		`cellorg_broker_published_total{topic="extracted-text"} 2`,
+		`cellorg_broker_dropped_total{destination="pub:extracted-text",reason="outbox_full"} 1`,
+		`cellorg_broker_dropped_total{destination="pipe:ner-requests",reason="pipe_full"} 1`,
+		`cellorg_broker_pipe_sent_total{pipe="ner-requests"} 1`,
+		`cellorg_broker_pipe_depth{pipe="ner-requests"} 1`,
+		`cellorg_broker_outbox_depth{connection="conn_sub",agent="ner-agent"} 1`,
+		`cellorg_broker_connections 1`,
+		`cellorg_broker_topic_retained{topic="extracted-text"} 2`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("Expected %s in metrics:\n%s", line, metrics)
+		}
+	}
+
+	s.handleRequest(producer, newRequest(t, "receive_pipe", map[string]interface{}{"pipe": "ner-requests", "timeout_ms": 10}))
+	if metrics := scrape(t, s); !strings.Contains(metrics, `cellorg_broker_pipe_received_total{pipe="ner-requests"} 1`) {
+		t.Errorf("Expected pipe receive to be counted:\n%s", metrics)
+	}
+}
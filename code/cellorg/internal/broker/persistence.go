@@ -0,0 +1,253 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+	"github.com/tenzoki/agen/omni/public/omnistore"
+)
+
+// Log record kinds identify which broker structure a logged envelope belongs to.
+const (
+	LogKindTopic = "topic" // Envelope published to a topic, not yet delivered
+	LogKindPipe  = "pipe"  // Envelope queued in a pipe, not yet consumed
+)
+
+// walKeyPrefix is the KV prefix under which all write-ahead log records are stored.
+// Sequence numbers are zero-padded so lexical key order equals append order.
+const walKeyPrefix = "broker/wal/"
+
+// deadLetterKeyPrefix is the KV prefix under which dead letters are stored,
+// keyed as broker/dlq/<queue>/<id>.
+const deadLetterKeyPrefix = "broker/dlq/"
+
+// scheduledKeyPrefix is the KV prefix under which scheduled envelopes wait,
+// keyed as broker/scheduled/<id>.
+const scheduledKeyPrefix = "broker/scheduled/"
+
+// LogRecord is a single write-ahead log entry for a persistent envelope.
+type LogRecord struct {
+	Seq      uint64             `json:"seq"`       // Monotonic sequence number (log position)
+	Kind     string             `json:"kind"`      // LogKindTopic or LogKindPipe
+	Name     string             `json:"name"`      // Topic or pipe name
+	Envelope *envelope.Envelope `json:"envelope"`  // Logged envelope
+	LoggedAt time.Time          `json:"logged_at"` // When the record was written
+}
+
+// MessageLog is a write-ahead log for envelopes marked Persistent.
+//
+// Persistent envelopes are appended to the log before the broker acknowledges
+// the publish or send, and removed once they have been handed to a consumer.
+// Whatever is left in the log when the broker starts is replayed into the
+// corresponding topics and pipes, so a broker crash or restart does not lose
+// in-flight work.
+//
+// The log is stored in an embedded omni KV store (BadgerDB). The same store
+// keeps the broker's dead letters, which live until they are re-injected or
+// deleted, and its scheduled envelopes, which live until they are due.
+//
+// Thread Safety: All methods are safe for concurrent use.
+type MessageLog struct {
+	store omnistore.OmniStore
+	seq   uint64     // Last assigned sequence number
+	mux   sync.Mutex // Protects seq
+}
+
+// OpenMessageLog opens (or creates) the write-ahead log in dataDir.
+// The store syncs every write to disk, so records survive a machine crash
+// or power loss, not just a broker crash.
+// The next sequence number continues after the highest record found on disk.
+func OpenMessageLog(dataDir string) (*MessageLog, error) {
+	config := omnistore.DefaultConfig()
+	config.DataDir = dataDir
+	config.Performance.SyncWrites = true
+
+	store, err := omnistore.NewOmniStore(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open message log at %s: %w", dataDir, err)
+	}
+
+	l := &MessageLog{store: store}
+
+	keys, err := store.KV().ListKeys(walKeyPrefix, 0)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to scan message log: %w", err)
+	}
+	for _, key := range keys {
+		if seq, ok := parseWALKey(key); ok && seq > l.seq {
+			l.seq = seq
+		}
+	}
+
+	return l, nil
+}
+
+// Append writes an envelope to the log and returns its sequence number.
+// Once Append returns without error the record survives a broker crash.
+func (l *MessageLog) Append(kind, name string, env *envelope.Envelope) (uint64, error) {
+	l.mux.Lock()
+	l.seq++
+	seq := l.seq
+	l.mux.Unlock()
+
+	record := LogRecord{
+		Seq:      seq,
+		Kind:     kind,
+		Name:     name,
+		Envelope: env,
+		LoggedAt: time.Now(),
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal log record: %w", err)
+	}
+
+	if err := l.store.KV().Set(walKey(seq), data); err != nil {
+		return 0, fmt.Errorf("failed to write log record: %w", err)
+	}
+
+	return seq, nil
+}
+
+// Remove deletes a record once its envelope no longer needs to survive a restart.
+func (l *MessageLog) Remove(seq uint64) error {
+	if seq == 0 {
+		return nil
+	}
+	return l.store.KV().Delete(walKey(seq))
+}
+
+// Replay returns all records still in the log, ordered by sequence number.
+func (l *MessageLog) Replay() ([]*LogRecord, error) {
+	entries, err := l.store.KV().Scan(walKeyPrefix, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan message log: %w", err)
+	}
+
+	records := make([]*LogRecord, 0, len(entries))
+	for key, data := range entries {
+		var record LogRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, fmt.Errorf("corrupt log record %s: %w", key, err)
+		}
+		records = append(records, &record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Seq < records[j].Seq
+	})
+
+	return records, nil
+}
+
+// SaveDeadLetter stores a dead letter so it survives a broker restart.
+func (l *MessageLog) SaveDeadLetter(dl *DeadLetter) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+	if err := l.store.KV().Set(deadLetterKey(dl.Queue, dl.ID), data); err != nil {
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	return nil
+}
+
+// RemoveDeadLetter deletes a stored dead letter.
+func (l *MessageLog) RemoveDeadLetter(queue, id string) error {
+	return l.store.KV().Delete(deadLetterKey(queue, id))
+}
+
+// LoadDeadLetters returns all stored dead letters, oldest first.
+func (l *MessageLog) LoadDeadLetters() ([]*DeadLetter, error) {
+	entries, err := l.store.KV().Scan(deadLetterKeyPrefix, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan dead letters: %w", err)
+	}
+
+	letters := make([]*DeadLetter, 0, len(entries))
+	for key, data := range entries {
+		var dl DeadLetter
+		if err := json.Unmarshal(data, &dl); err != nil {
+			return nil, fmt.Errorf("corrupt dead letter %s: %w", key, err)
+		}
+		letters = append(letters, &dl)
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].FailedAt.Before(letters[j].FailedAt)
+	})
+
+	return letters, nil
+}
+
+// SaveScheduled stores a scheduled envelope until it is due.
+func (l *MessageLog) SaveScheduled(item *scheduledEnvelope) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to marshal scheduled envelope: %w", err)
+	}
+	if err := l.store.KV().Set(scheduledKeyPrefix+item.ID, data); err != nil {
+		return fmt.Errorf("failed to write scheduled envelope: %w", err)
+	}
+	return nil
+}
+
+// RemoveScheduled deletes a stored scheduled envelope.
+func (l *MessageLog) RemoveScheduled(id string) error {
+	return l.store.KV().Delete(scheduledKeyPrefix + id)
+}
+
+// LoadScheduled returns all stored scheduled envelopes, earliest due first.
+func (l *MessageLog) LoadScheduled() ([]*scheduledEnvelope, error) {
+	entries, err := l.store.KV().Scan(scheduledKeyPrefix, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan scheduled envelopes: %w", err)
+	}
+
+	items := make([]*scheduledEnvelope, 0, len(entries))
+	for key, data := range entries {
+		var item scheduledEnvelope
+		if err := json.Unmarshal(data, &item); err != nil {
+			return nil, fmt.Errorf("corrupt scheduled envelope %s: %w", key, err)
+		}
+		items = append(items, &item)
+	}
+
+	sortScheduled(items)
+	return items, nil
+}
+
+// Close flushes and closes the underlying store.
+func (l *MessageLog) Close() error {
+	return l.store.Close()
+}
+
+// walKey builds the KV key for a sequence number
+func walKey(seq uint64) string {
+	return fmt.Sprintf("%s%020d", walKeyPrefix, seq)
+}
+
+// deadLetterKey builds the KV key for a dead letter
+func deadLetterKey(queue, id string) string {
+	return fmt.Sprintf("%s%s/%s", deadLetterKeyPrefix, queue, id)
+}
+
+// parseWALKey extracts the sequence number from a KV key
+func parseWALKey(key string) (uint64, bool) {
+	if !strings.HasPrefix(key, walKeyPrefix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimPrefix(key, walKeyPrefix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
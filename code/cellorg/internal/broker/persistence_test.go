@@ -0,0 +1,378 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// newPersistentService creates a broker service with its message log opened and replayed
+func newPersistentService(t *testing.T, dataDir string) *Service {
+	t.Helper()
+
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json", DataDir: dataDir})
+	wal, err := OpenMessageLog(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to open message log: %v", err)
+	}
+	s.wal = wal
+	if err := s.recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	return s
+}
+
+// newRequest builds a JSON-RPC request for direct dispatch through handleRequest
+func newRequest(t *testing.T, method string, params interface{}) *BrokerRequest {
+	t.Helper()
+
+	data, err := json.Marshal(params)
+	if err != nil {
+		t.Fatalf("Failed to marshal params: %v", err)
+	}
+	return &BrokerRequest{ID: "req_1", Method: method, Params: data}
+}
+
+// Test that the message log keeps order and sequence numbers across reopen
+func TestMessageLogReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	wal, err := OpenMessageLog(dir)
+	if err != nil {
+		t.Fatalf("Failed to open message log: %v", err)
+	}
+
+	var seqs []uint64
+	for _, id := range []string{"a", "b", "c"} {
+		env, _ := envelope.NewEnvelope("producer", "pipe:work", "job", map[string]string{"id": id})
+		seq, err := wal.Append(LogKindPipe, "work", env)
+		if err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+		seqs = append(seqs, seq)
+	}
+
+	if err := wal.Remove(seqs[1]); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	wal.Close()
+
+	wal, err = OpenMessageLog(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen message log: %v", err)
+	}
+	defer wal.Close()
+
+	records, err := wal.Replay()
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records after removal, got %d", len(records))
+	}
+	if records[0].Seq != seqs[0] || records[1].Seq != seqs[2] {
+		t.Errorf("Expected sequences %d,%d, got %d,%d", seqs[0], seqs[2], records[0].Seq, records[1].Seq)
+	}
+
+	next, err := wal.Append(LogKindTopic, "events", records[0].Envelope)
+	if err != nil {
+		t.Fatalf("Append after reopen failed: %v", err)
+	}
+	if next <= seqs[2] {
+		t.Errorf("Expected sequence after %d, got %d", seqs[2], next)
+	}
+}
+
+// Test that a persistent pipe envelope is redelivered after a broker restart
+func TestPersistentPipeEnvelopeSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	conn := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	s := newPersistentService(t, dir)
+
+	durable, _ := envelope.NewEnvelope("producer", "pipe:ocr", "page", map[string]int{"page": 1})
+	durable.Persistent = true
+	transient, _ := envelope.NewEnvelope("producer", "pipe:ocr", "page", map[string]int{"page": 2})
+
+	for _, env := range []*envelope.Envelope{durable, transient} {
+		resp := s.handleRequest(conn, newRequest(t, "send_pipe_envelope", map[string]interface{}{
+			"pipe":     "ocr",
+			"envelope": env,
+		}))
+		if resp.Error != nil {
+			t.Fatalf("send_pipe_envelope failed: %s", resp.Error.Message)
+		}
+	}
+
+	// Simulate a crash: drop the service without consuming anything
+	s.wal.Close()
+
+	s = newPersistentService(t, dir)
+	defer s.wal.Close()
+
+	resp := s.handleRequest(conn, newRequest(t, "receive_pipe", map[string]interface{}{
+		"pipe":       "ocr",
+		"timeout_ms": 100,
+	}))
+	if resp.Error != nil {
+		t.Fatalf("Expected persistent envelope after restart, got error: %s", resp.Error.Message)
+	}
+	got, ok := resp.Result.(*envelope.Envelope)
+	if !ok || got.ID != durable.ID {
+		t.Fatalf("Expected envelope %s, got %+v", durable.ID, resp.Result)
+	}
+
+	// Only the persistent envelope survives, and consuming it clears the log
+	resp = s.handleRequest(conn, newRequest(t, "receive_pipe", map[string]interface{}{
+		"pipe":       "ocr",
+		"timeout_ms": 50,
+	}))
+	if resp.Error == nil {
+		t.Errorf("Expected non-persistent envelope to be lost on restart, got %+v", resp.Result)
+	}
+
+	records, err := s.wal.Replay()
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(records) != 0 {
+		t.Errorf("Expected empty log after consumption, got %d records", len(records))
+	}
+}
+
+// Test that a persistent topic envelope without subscribers is held for the first subscriber
+func TestPersistentTopicEnvelopeHeldUntilSubscribe(t *testing.T) {
+	dir := t.TempDir()
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	s := newPersistentService(t, dir)
+
+	env, _ := envelope.NewEnvelope("producer", "pub:extracted-text", "chunk", "hello")
+	env.Persistent = true
+	resp := s.handleRequest(producer, newRequest(t, "publish_envelope", map[string]interface{}{
+		"topic":    "extracted-text",
+		"envelope": env,
+	}))
+	if resp.Error != nil {
+		t.Fatalf("publish_envelope failed: %s", resp.Error.Message)
+	}
+	s.wal.Close()
+
+	s = newPersistentService(t, dir)
+	defer s.wal.Close()
+
+	topic := s.getOrCreateTopic("extracted-text")
+	if len(topic.Pending) != 1 || topic.Pending[0].Envelope.ID != env.ID {
+		t.Fatalf("Expected envelope %s pending after restart, got %d pending", env.ID, len(topic.Pending))
+	}
+}
+
+// Test that a persistent envelope fanned out to several subscribers stays
+// logged until every copy is written
+func TestPersistentFanOutUnloggedAfterLastCopy(t *testing.T) {
+	s := newPersistentService(t, t.TempDir())
+	defer s.wal.Close()
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	first := subscribeTestConn(t, s, "extracted-text")
+	second := &Connection{ID: "conn_second", AgentID: "indexer", outbox: newPriorityQueue(outboxCapacity, 0)}
+	if resp := s.handleRequest(second, newRequest(t, "subscribe", map[string]interface{}{"topic": "extracted-text"})); resp.Error != nil {
+		t.Fatalf("subscribe failed: %s", resp.Error.Message)
+	}
+
+	env, _ := envelope.NewEnvelope("producer", "pub:extracted-text", "chunk", "hello")
+	env.Persistent = true
+	if resp := s.handleRequest(producer, newRequest(t, "publish_envelope", map[string]interface{}{
+		"topic":    "extracted-text",
+		"envelope": env,
+	})); resp.Error != nil {
+		t.Fatalf("publish_envelope failed: %s", resp.Error.Message)
+	}
+
+	logged := func() int {
+		records, err := s.wal.Replay()
+		if err != nil {
+			t.Fatalf("Replay failed: %v", err)
+		}
+		return len(records)
+	}
+
+	// Written copies give up their hold on the record, as writeOutbox does
+	item := first.outbox.Pop()
+	s.unlogCopy(item.logRef, item.Seq)
+	if n := logged(); n != 1 {
+		t.Fatalf("Expected the envelope logged while a copy is queued, got %d records", n)
+	}
+	item = second.outbox.Pop()
+	s.unlogCopy(item.logRef, item.Seq)
+	if n := logged(); n != 0 {
+		t.Errorf("Expected the envelope unlogged after the last copy, got %d records", n)
+	}
+}
+
+// Test that recovered pipe envelopes that do not fit are queued as room frees up
+func TestRecoveredPipeBacklogRefilled(t *testing.T) {
+	dir := t.TempDir()
+	conn := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	s := newPersistentService(t, dir)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		env, _ := envelope.NewEnvelope("producer", "pipe:ocr", "page", map[string]int{"page": i})
+		env.Persistent = true
+		ids = append(ids, env.ID)
+		if resp := s.handleRequest(conn, newRequest(t, "send_pipe_envelope", map[string]interface{}{
+			"pipe":     "ocr",
+			"envelope": env,
+		})); resp.Error != nil {
+			t.Fatalf("send_pipe_envelope failed: %s", resp.Error.Message)
+		}
+	}
+	s.wal.Close()
+
+	// Restart with room for only one of them
+	s = NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json", DataDir: dir, PipeCapacity: 1})
+	wal, err := OpenMessageLog(dir)
+	if err != nil {
+		t.Fatalf("Failed to open message log: %v", err)
+	}
+	s.wal = wal
+	defer s.wal.Close()
+	if err := s.recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.refillPipes(ctx)
+
+	received := make(map[string]bool)
+	for range ids {
+		resp := s.handleRequest(conn, newRequest(t, "receive_pipe", map[string]interface{}{
+			"pipe":       "ocr",
+			"timeout_ms": 2000,
+		}))
+		if resp.Error != nil {
+			t.Fatalf("Expected all recovered envelopes, got error after %d: %s", len(received), resp.Error.Message)
+		}
+		received[resp.Result.(*envelope.Envelope).ID] = true
+	}
+	for _, id := range ids {
+		if !received[id] {
+			t.Errorf("Expected envelope %s after restart", id)
+		}
+	}
+}
+
+// Test that persistent copies waiting for a full outbox are kept, in publish
+// order, when the subscriber disconnects during the wait
+func TestBlockedPublishToDisconnectedSubscriber(t *testing.T) {
+	s := newPersistentService(t, t.TempDir())
+	defer s.wal.Close()
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	slow := &Connection{ID: "conn_slow", AgentID: "indexer", outbox: newPriorityQueue(1, 0), done: make(chan struct{})}
+	if resp := s.handleRequest(slow, newRequest(t, "subscribe", map[string]interface{}{"topic": "extracted-text"})); resp.Error != nil {
+		t.Fatalf("subscribe failed: %s", resp.Error.Message)
+	}
+
+	publish := func(payload string, blockMs int) (*envelope.Envelope, *BrokerResponse) {
+		env, _ := envelope.NewEnvelope("producer", "pub:extracted-text", "chunk", payload)
+		env.Persistent = true
+		return env, s.handleRequest(producer, newRequest(t, "publish_envelope", map[string]interface{}{
+			"topic":            "extracted-text",
+			"envelope":         env,
+			"block_timeout_ms": blockMs,
+		}))
+	}
+	first, resp := publish("first", 0)
+	if resp.Error != nil {
+		t.Fatalf("publish_envelope failed: %s", resp.Error.Message)
+	}
+
+	type published struct {
+		env  *envelope.Envelope
+		resp *BrokerResponse
+	}
+	blocked := make(chan published, 1)
+	go func() {
+		env, resp := publish("second", 2000)
+		blocked <- published{env, resp}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Disconnect as handleConnection does; emptying the outbox lets the
+	// blocked copy in after the subscriber is gone
+	close(slow.done)
+	s.dropSubscriber(slow)
+	second := <-blocked
+	if second.resp.Error != nil {
+		t.Fatalf("Blocked publish failed: %s", second.resp.Error.Message)
+	}
+	if depth, _ := slow.outbox.Fill(); depth != 0 {
+		t.Errorf("Expected nothing left in the closed outbox, got %d", depth)
+	}
+
+	// Both envelopes stay logged and reach the next subscriber in order
+	if records, err := s.wal.Replay(); err != nil || len(records) != 2 {
+		t.Fatalf("Expected 2 logged envelopes, got %d (%v)", len(records), err)
+	}
+	next := subscribeTestConn(t, s, "extracted-text")
+	for _, want := range []*envelope.Envelope{first, second.env} {
+		if item := next.outbox.Pop(); item == nil || item.Envelope.ID != want.ID {
+			t.Fatalf("Expected envelope %s, got %+v", want.ID, item)
+		}
+	}
+	if item := next.outbox.Pop(); item != nil {
+		t.Errorf("Expected each envelope once, got %s again", item.Envelope.ID)
+	}
+}
+
+// Test that shutdown closes open connections and waits for them before closing the log
+func TestShutdownClosesLogAfterConnections(t *testing.T) {
+	dir := t.TempDir()
+	s := NewService(BrokerConfig{Port: "127.0.0.1:39571", Protocol: "tcp", Codec: "json", DataDir: dir})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Start(ctx) }()
+
+	var agent net.Conn
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var err error
+		if agent, err = net.Dial("tcp", "127.0.0.1:39571"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer agent.Close()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Start returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected Start to return with an agent connected")
+	}
+
+	agent.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := agent.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected the broker to close the agent connection, got %v", err)
+	}
+
+	wal, err := OpenMessageLog(dir)
+	if err != nil {
+		t.Fatalf("Expected the log to be closed after Start returned: %v", err)
+	}
+	wal.Close()
+}
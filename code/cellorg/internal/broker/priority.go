@@ -0,0 +1,326 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// Priority bounds shared by envelopes (Envelope.Priority) and simple messages
+// (Message.Meta["priority"]). Higher values are delivered first.
+const (
+	MinPriority = 0
+	MaxPriority = 9
+)
+
+// Queue capacities and starvation protection defaults.
+const (
+	pipeCapacity         = 100             // Default maximum queued items per pipe
+	outboxCapacity       = 1000            // Default maximum queued deliveries per subscriber connection
+	defaultPriorityAging = 2 * time.Second // Waiting time that raises an item by one priority level
+)
+
+// queueItem is a single queued delivery: either a simple message or an envelope.
+type queueItem struct {
+	Priority int                // Base priority (MinPriority..MaxPriority)
+	Enqueued time.Time          // When the item entered the queue (used for aging)
+	Message  *Message           // Simple message payload (nil for envelopes)
+	Envelope *envelope.Envelope // Envelope payload (nil for simple messages)
+	Topic    string             // Source topic for subscriber deliveries (empty for pipes)
+	Seq      uint64             // Write-ahead log position (0 if not persistent)
+	Attempts int                // Pipe deliveries so far (redeliveries after nack or timeout)
+	Replayed bool               // Topic delivery replayed from the topic log
+	expire   *sync.Once         // Shared by fan-out copies of one envelope (nil = not shared)
+	logRef   *logRef            // Shared by fan-out copies of one persistent envelope (nil = sole copy)
+}
+
+// expireOnce runs the expiry routing for this item, once per fan-out group.
+func (i *queueItem) expireOnce(route func()) {
+	if i.expire == nil {
+		route()
+		return
+	}
+	i.expire.Do(route)
+}
+
+// discard gives up a fan-out copy that was built but not queued.
+func (i *queueItem) discard() {
+	if i.logRef != nil {
+		i.logRef.copies.Add(-1)
+	}
+}
+
+// QueueStats reports the depth of a priority queue, broken down by priority.
+type QueueStats struct {
+	Depth      int   `json:"depth"`       // Total queued items
+	Capacity   int   `json:"capacity"`    // Maximum queued items
+	ByPriority []int `json:"by_priority"` // Queued items per priority (index = priority)
+	InFlight   int   `json:"in_flight"`   // Delivered but not yet acknowledged (pipes only)
+}
+
+// priorityQueue is a bounded multi-level FIFO queue.
+//
+// Items are kept in one FIFO per priority level. Pop returns the head with the
+// highest effective priority, where the effective priority grows by one level
+// for every aging interval an item has waited (capped at MaxPriority). Ties go
+// to the item that has waited longest, so a steady stream of urgent items can
+// delay bulk work but never starve it.
+//
+// Thread Safety: All methods are safe for concurrent use.
+type priorityQueue struct {
+	levels   [MaxPriority + 1][]*queueItem
+	size     int
+	capacity int
+	aging    time.Duration // Zero disables aging (strict priority order)
+	notify   chan struct{} // Closed and replaced whenever an item is pushed
+	space    chan struct{} // Closed and replaced whenever items are removed
+	mux      sync.Mutex
+}
+
+// newPriorityQueue creates an empty queue holding at most capacity items.
+func newPriorityQueue(capacity int, aging time.Duration) *priorityQueue {
+	return &priorityQueue{
+		capacity: capacity,
+		aging:    aging,
+		notify:   make(chan struct{}),
+		space:    make(chan struct{}),
+	}
+}
+
+// Push adds an item, clamping its priority into range.
+// Returns false without queueing if the queue is full.
+func (q *priorityQueue) Push(item *queueItem) bool {
+	ok, _ := q.pushOrSpace(item)
+	return ok
+}
+
+// PushWait adds an item, blocking while the queue is full until a consumer
+// makes room or the timeout expires. Returns false on timeout.
+func (q *priorityQueue) PushWait(item *queueItem, timeout time.Duration) bool {
+	ok, space := q.pushOrSpace(item)
+	if ok || timeout <= 0 {
+		return ok
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case <-space:
+		case <-deadline.C:
+			return false
+		}
+		if ok, space = q.pushOrSpace(item); ok {
+			return true
+		}
+	}
+}
+
+// pushOrSpace queues an item, or returns the channel that is closed when items
+// are next removed. Both happen under one lock so a concurrent pop cannot be missed.
+func (q *priorityQueue) pushOrSpace(item *queueItem) (bool, <-chan struct{}) {
+	item.Priority = clampPriority(item.Priority)
+	if item.Enqueued.IsZero() {
+		item.Enqueued = time.Now()
+	}
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.size >= q.capacity {
+		return false, q.space
+	}
+	q.levels[item.Priority] = append(q.levels[item.Priority], item)
+	q.size++
+
+	// Wake up all waiters
+	close(q.notify)
+	q.notify = make(chan struct{})
+	return true, nil
+}
+
+// freed wakes up producers waiting for space. The caller must hold q.mux.
+func (q *priorityQueue) freed() {
+	close(q.space)
+	q.space = make(chan struct{})
+}
+
+// Pop removes and returns the next item, or nil if the queue is empty.
+func (q *priorityQueue) Pop() *queueItem {
+	item, _ := q.popOrNotify()
+	return item
+}
+
+// PopWait blocks until an item is available or the timeout expires.
+// Returns nil on timeout.
+func (q *priorityQueue) PopWait(timeout time.Duration) *queueItem {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		item, notify := q.popOrNotify()
+		if item != nil {
+			return item
+		}
+		select {
+		case <-notify:
+		case <-deadline.C:
+			return nil
+		}
+	}
+}
+
+// popOrNotify pops the next item, or returns the channel that is closed on the
+// next push. Both happen under one lock so a concurrent push cannot be missed.
+func (q *priorityQueue) popOrNotify() (*queueItem, <-chan struct{}) {
+	return q.popMatchingOrNotify(nil)
+}
+
+// popMatchingOrNotify is popOrNotify restricted to the items accepted by the
+// filter (nil accepts all). Within each level the first accepted item
+// competes, so items passed over keep their place in line.
+func (q *priorityQueue) popMatchingOrNotify(accept func(*queueItem) bool) (*queueItem, <-chan struct{}) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.size == 0 {
+		return nil, q.notify
+	}
+
+	now := time.Now()
+	best, bestIndex := -1, -1
+	bestEffective := -1
+	for level := MaxPriority; level >= MinPriority; level-- {
+		index := 0
+		if accept != nil {
+			for index < len(q.levels[level]) && !accept(q.levels[level][index]) {
+				index++
+			}
+		}
+		if index == len(q.levels[level]) {
+			continue
+		}
+		candidate := q.levels[level][index]
+		effective := q.effectivePriority(candidate, now)
+		if effective > bestEffective ||
+			(effective == bestEffective && candidate.Enqueued.Before(q.levels[best][bestIndex].Enqueued)) {
+			best, bestIndex = level, index
+			bestEffective = effective
+		}
+	}
+	if best < 0 {
+		return nil, q.notify
+	}
+
+	item := q.levels[best][bestIndex]
+	if bestIndex == 0 {
+		q.levels[best][0] = nil
+		q.levels[best] = q.levels[best][1:]
+	} else {
+		copy(q.levels[best][bestIndex:], q.levels[best][bestIndex+1:])
+		q.levels[best][len(q.levels[best])-1] = nil
+		q.levels[best] = q.levels[best][:len(q.levels[best])-1]
+	}
+	q.size--
+	q.freed()
+	return item, nil
+}
+
+// effectivePriority applies aging to an item's base priority
+func (q *priorityQueue) effectivePriority(item *queueItem, now time.Time) int {
+	if q.aging <= 0 {
+		return item.Priority
+	}
+	return clampPriority(item.Priority + int(now.Sub(item.Enqueued)/q.aging))
+}
+
+// Drain removes and returns all queued items in priority order.
+func (q *priorityQueue) Drain() []*queueItem {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	items := make([]*queueItem, 0, q.size)
+	for level := MaxPriority; level >= MinPriority; level-- {
+		items = append(items, q.levels[level]...)
+		q.levels[level] = nil
+	}
+	q.size = 0
+	q.freed()
+	return items
+}
+
+// Len returns the number of queued items.
+func (q *priorityQueue) Len() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.size
+}
+
+// Fill returns the number of queued items and the queue capacity.
+func (q *priorityQueue) Fill() (depth, capacity int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.size, q.capacity
+}
+
+// Oldest returns when the longest-waiting item was queued (zero if empty).
+func (q *priorityQueue) Oldest() time.Time {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	var oldest time.Time
+	for level := range q.levels {
+		if len(q.levels[level]) > 0 {
+			if head := q.levels[level][0].Enqueued; oldest.IsZero() || head.Before(oldest) {
+				oldest = head
+			}
+		}
+	}
+	return oldest
+}
+
+// Stats returns the current depth per priority level.
+func (q *priorityQueue) Stats() QueueStats {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	stats := QueueStats{
+		Depth:      q.size,
+		Capacity:   q.capacity,
+		ByPriority: make([]int, MaxPriority+1),
+	}
+	for level := range q.levels {
+		stats.ByPriority[level] = len(q.levels[level])
+	}
+	return stats
+}
+
+// clampPriority forces a priority into the MinPriority..MaxPriority range
+func clampPriority(priority int) int {
+	if priority < MinPriority {
+		return MinPriority
+	}
+	if priority > MaxPriority {
+		return MaxPriority
+	}
+	return priority
+}
+
+// messagePriority reads the priority of a simple message from Meta["priority"].
+// Messages without a numeric priority use MinPriority.
+func messagePriority(msg *Message) int {
+	switch p := msg.Meta["priority"].(type) {
+	case float64:
+		return clampPriority(int(p))
+	case int:
+		return clampPriority(p)
+	case int64: // MessagePack connections
+		return clampPriority(int(p))
+	case uint64:
+		return clampPriority(int(p))
+	default:
+		return MinPriority
+	}
+}
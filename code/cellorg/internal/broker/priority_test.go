@@ -0,0 +1,117 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// Test that higher priorities are popped first and equal priorities stay FIFO
+func TestPriorityQueueOrder(t *testing.T) {
+	q := newPriorityQueue(10, 0)
+
+	for i, priority := range []int{0, 5, 9, 5, 0} {
+		msg := &Message{ID: string(rune('a' + i))}
+		if !q.Push(&queueItem{Priority: priority, Message: msg}) {
+			t.Fatalf("Push %d failed", i)
+		}
+	}
+
+	var got string
+	for item := q.Pop(); item != nil; item = q.Pop() {
+		got += item.Message.ID
+	}
+	if got != "cbdae" {
+		t.Errorf("Expected pop order cbdae, got %s", got)
+	}
+}
+
+// Test that aging lets a waiting low-priority item overtake fresh urgent items
+func TestPriorityQueueAging(t *testing.T) {
+	q := newPriorityQueue(10, 10*time.Millisecond)
+
+	old := &queueItem{Priority: 0, Enqueued: time.Now().Add(-time.Second), Message: &Message{ID: "bulk"}}
+	q.Push(old)
+	q.Push(&queueItem{Priority: 9, Message: &Message{ID: "urgent"}})
+
+	if item := q.Pop(); item.Message.ID != "bulk" {
+		t.Errorf("Expected aged bulk item first, got %s", item.Message.ID)
+	}
+}
+
+// Test capacity limits, clamping and per-priority depth metrics
+func TestPriorityQueueStats(t *testing.T) {
+	q := newPriorityQueue(3, 0)
+
+	q.Push(&queueItem{Priority: -3, Message: &Message{}})
+	q.Push(&queueItem{Priority: 42, Message: &Message{}})
+	q.Push(&queueItem{Priority: 9, Message: &Message{}})
+	if q.Push(&queueItem{Priority: 1, Message: &Message{}}) {
+		t.Error("Expected push beyond capacity to fail")
+	}
+
+	stats := q.Stats()
+	if stats.Depth != 3 || stats.Capacity != 3 {
+		t.Errorf("Expected depth 3 of 3, got %d of %d", stats.Depth, stats.Capacity)
+	}
+	if stats.ByPriority[MinPriority] != 1 || stats.ByPriority[MaxPriority] != 2 {
+		t.Errorf("Unexpected per-priority depths: %v", stats.ByPriority)
+	}
+}
+
+// Test that PopWait wakes up on push and times out on an empty queue
+func TestPriorityQueuePopWait(t *testing.T) {
+	q := newPriorityQueue(10, 0)
+
+	if item := q.PopWait(20 * time.Millisecond); item != nil {
+		t.Fatalf("Expected timeout on empty queue, got %+v", item)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Push(&queueItem{Message: &Message{ID: "late"}})
+	}()
+
+	item := q.PopWait(time.Second)
+	if item == nil || item.Message.ID != "late" {
+		t.Fatalf("Expected late item, got %+v", item)
+	}
+}
+
+// Test that a pipe hands out urgent envelopes before an earlier bulk backlog
+func TestPipeReceivesByPriority(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	conn := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	for i := 0; i < 3; i++ {
+		bulk, _ := envelope.NewEnvelope("producer", "pipe:work", "ingest", i)
+		resp := s.handleRequest(conn, newRequest(t, "send_pipe_envelope", map[string]interface{}{
+			"pipe":     "work",
+			"envelope": bulk,
+		}))
+		if resp.Error != nil {
+			t.Fatalf("send_pipe_envelope failed: %s", resp.Error.Message)
+		}
+	}
+
+	urgent, _ := envelope.NewEnvelope("producer", "pipe:work", "query", "now")
+	urgent.Priority = 9
+	s.handleRequest(conn, newRequest(t, "send_pipe_envelope", map[string]interface{}{
+		"pipe":     "work",
+		"envelope": urgent,
+	}))
+
+	stats := s.Stats().Pipes["work"]
+	if stats.Depth != 4 || stats.ByPriority[0] != 3 || stats.ByPriority[9] != 1 {
+		t.Errorf("Unexpected pipe stats: %+v", stats)
+	}
+
+	resp := s.handleRequest(conn, newRequest(t, "receive_pipe", map[string]interface{}{
+		"pipe":       "work",
+		"timeout_ms": 100,
+	}))
+	if got, ok := resp.Result.(*envelope.Envelope); !ok || got.ID != urgent.ID {
+		t.Errorf("Expected urgent envelope first, got %+v", resp.Result)
+	}
+}
@@ -0,0 +1,319 @@
+package broker
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/config"
+	"github.com/tenzoki/agen/cellorg/internal/wildcard"
+)
+
+// Error codes for publications rejected by a rate limit, from the JSON-RPC
+// server error range. Rate-limited responses carry a SlowDown whose Queue
+// names the exceeded limit and whose RetryAfterMs says when the publication
+// would be accepted.
+const (
+	ErrCodeRateLimited     = -32029 // Publish rate or bytes of the agent or topic exceeded; retry later
+	ErrCodeMessageTooLarge = -32013 // Publication larger than max_message_bytes; retrying does not help
+)
+
+// Rate limit reasons reported by cellorg_broker_rate_limited_total.
+const (
+	LimitMessages = "messages" // messages_per_second exceeded
+	LimitBytes    = "bytes"    // bytes_per_second exceeded
+	LimitSize     = "size"     // max_message_bytes exceeded
+)
+
+// rateLimitLogInterval spaces the log lines of one limit while it is exceeded.
+const rateLimitLogInterval = 10 * time.Second
+
+// bucketIdleTimeout is how long the buckets of a limit are kept unused. By
+// then they are full again, so dropping them loses nothing.
+const bucketIdleTimeout = 10 * time.Minute
+
+// AnonymousScope is the stats and metrics label of the limits of connections
+// without authentication, each of which has buckets of its own.
+const AnonymousScope = "anonymous"
+
+// tokenBucket refills at rate tokens per second up to burst. Not safe for
+// concurrent use; guarded by the rate limiter's mutex.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full bucket. A zero burst allows one second's
+// worth of tokens, at least one.
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	if burst <= 0 {
+		burst = max(rate, 1)
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// wait refills the bucket and returns how long n tokens are not available,
+// 0 if they are. Amounts beyond the burst are available once the bucket is
+// full; taking them leaves it in debt.
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	missing := min(n, b.burst) - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / b.rate * float64(time.Second))
+}
+
+// take removes n tokens; call after wait returned 0.
+func (b *tokenBucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+// limitBuckets are the buckets of one agent, connection or topic limit.
+type limitBuckets struct {
+	scope    string // "agent:<id>", "conn:<connection id>" or "topic:<name>"
+	label    string // Scope in stats and metrics; AnonymousScope for connections
+	limit    config.RateLimit
+	messages *tokenBucket // Nil when the message rate is unlimited
+	bytes    *tokenBucket // Nil when the byte rate is unlimited
+	used     time.Time    // Last publication charged or rejected
+
+	logged     time.Time // Last violation logged
+	suppressed uint64    // Violations not logged since then
+}
+
+// rateLimiter applies the rate limits from cellorg.yaml to publications and
+// pipe sends. Buckets are created on first use and dropped once idle. Safe
+// for concurrent use.
+type rateLimiter struct {
+	agents   map[string]config.RateLimit
+	topics   map[string]config.RateLimit
+	patterns []string // Wildcard keys of topics, sorted
+
+	mux      sync.Mutex
+	buckets  map[string]*limitBuckets // Scope -> buckets
+	rejected map[string]uint64        // Label -> publications rejected, kept when buckets are dropped
+	swept    time.Time                // Last time idle buckets were dropped
+}
+
+// rateViolation describes a publication a limit rejected.
+type rateViolation struct {
+	scope  string
+	label  string        // Scope in stats and metrics
+	reason string        // LimitMessages, LimitBytes or LimitSize
+	retry  time.Duration // When the publication would fit (0 for LimitSize)
+}
+
+// newRateLimiter creates a limiter for the configured limits. Invalid topic
+// patterns are logged and ignored.
+func newRateLimiter(cfg config.RateLimitsConfig) *rateLimiter {
+	r := &rateLimiter{
+		agents:   cfg.Agents,
+		topics:   make(map[string]config.RateLimit, len(cfg.Topics)),
+		buckets:  make(map[string]*limitBuckets),
+		rejected: make(map[string]uint64),
+		swept:    time.Now(),
+	}
+	for topic, limit := range cfg.Topics {
+		if err := wildcard.Validate(topic); err != nil {
+			log.Printf("Broker: ignoring rate limit for topic %s: %v", topic, err)
+			continue
+		}
+		r.topics[topic] = limit
+		if wildcard.IsPattern(topic) {
+			r.patterns = append(r.patterns, topic)
+		}
+	}
+	sort.Strings(r.patterns)
+	return r
+}
+
+// enabled reports whether any limit is configured.
+func (r *rateLimiter) enabled() bool {
+	return len(r.agents) > 0 || len(r.topics) > 0
+}
+
+// topicLimit returns the limit of a topic: its own entry, or else that of
+// the first matching pattern in sorted order.
+func (r *rateLimiter) topicLimit(topic string) (config.RateLimit, bool) {
+	if limit, ok := r.topics[topic]; ok && !wildcard.IsPattern(topic) {
+		return limit, true
+	}
+	for _, pattern := range r.patterns {
+		if wildcard.Match(pattern, topic) {
+			return r.topics[pattern], true
+		}
+	}
+	return config.RateLimit{}, false
+}
+
+// allow charges one publication of size bytes on a connection to a topic
+// (empty for pipe sends) against the sender's and the topic's limits. Either
+// all limits take it or none does, in which case the violation is returned.
+//
+// The sender is the agent only if its ID is trusted, i.e. it authenticated
+// with a credential of its own: its entry or else "*" applies, shared by its
+// connections. Other agent IDs are self-declared (or shared-token) claims,
+// so they neither pick an entry nor escape their buckets by changing IDs:
+// each such connection gets the "*" limit on its own.
+func (r *rateLimiter) allow(connID, agentID string, trusted bool, topic string, size int64) *rateViolation {
+	if !r.enabled() {
+		return nil
+	}
+
+	var scopes []*limitBuckets
+	now := time.Now()
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if now.Sub(r.swept) >= bucketIdleTimeout {
+		r.sweep(now)
+	}
+
+	if trusted {
+		limit, ok := r.agents[agentID]
+		if !ok {
+			limit, ok = r.agents["*"]
+		}
+		if ok {
+			scope := "agent:" + agentID
+			scopes = append(scopes, r.bucketsFor(scope, scope, limit, now))
+		}
+	} else if limit, ok := r.agents["*"]; ok {
+		scopes = append(scopes, r.bucketsFor("conn:"+connID, AnonymousScope, limit, now))
+	}
+	if topic != "" {
+		if limit, ok := r.topicLimit(topic); ok {
+			scope := "topic:" + topic
+			scopes = append(scopes, r.bucketsFor(scope, scope, limit, now))
+		}
+	}
+
+	var violation *rateViolation
+	var limited *limitBuckets
+	for _, b := range scopes {
+		b.used = now
+		if b.limit.MaxMessageBytes > 0 && size > b.limit.MaxMessageBytes {
+			violation, limited = &rateViolation{scope: b.scope, label: b.label, reason: LimitSize}, b
+			break
+		}
+		if wait := b.messages.wait(1, now); wait > 0 && (violation == nil || wait > violation.retry) {
+			violation, limited = &rateViolation{scope: b.scope, label: b.label, reason: LimitMessages, retry: wait}, b
+		}
+		if wait := b.bytes.wait(float64(size), now); wait > 0 && (violation == nil || wait > violation.retry) {
+			violation, limited = &rateViolation{scope: b.scope, label: b.label, reason: LimitBytes, retry: wait}, b
+		}
+	}
+	if violation != nil {
+		r.logViolation(limited, violation, now)
+		return violation
+	}
+
+	for _, b := range scopes {
+		b.messages.take(1)
+		b.bytes.take(float64(size))
+	}
+	return nil
+}
+
+// bucketsFor returns the buckets of a scope, creating them on first use.
+// The caller must hold r.mux.
+func (r *rateLimiter) bucketsFor(scope, label string, limit config.RateLimit, now time.Time) *limitBuckets {
+	if b, ok := r.buckets[scope]; ok {
+		return b
+	}
+	b := &limitBuckets{scope: scope, label: label, limit: limit}
+	if limit.MessagesPerSecond > 0 {
+		b.messages = newTokenBucket(limit.MessagesPerSecond, float64(limit.Burst), now)
+	}
+	if limit.BytesPerSecond > 0 {
+		b.bytes = newTokenBucket(float64(limit.BytesPerSecond), float64(limit.BurstBytes), now)
+	}
+	r.buckets[scope] = b
+	return b
+}
+
+// sweep drops the buckets unused for bucketIdleTimeout, such as those of
+// closed connections. The caller must hold r.mux.
+func (r *rateLimiter) sweep(now time.Time) {
+	for scope, b := range r.buckets {
+		if now.Sub(b.used) >= bucketIdleTimeout {
+			delete(r.buckets, scope)
+		}
+	}
+	r.swept = now
+}
+
+// logViolation counts a violation and logs it, at most once per
+// rateLimitLogInterval for each limit. The caller must hold r.mux.
+func (r *rateLimiter) logViolation(b *limitBuckets, v *rateViolation, now time.Time) {
+	r.rejected[b.label]++
+	if now.Sub(b.logged) < rateLimitLogInterval {
+		b.suppressed++
+		return
+	}
+	if b.suppressed > 0 {
+		log.Printf("Broker: %s exceeded its %s limit (%d more since the last report)", v.scope, v.reason, b.suppressed)
+	} else {
+		log.Printf("Broker: %s exceeded its %s limit", v.scope, v.reason)
+	}
+	b.logged, b.suppressed = now, 0
+}
+
+// violations returns the rejected publications by limit scope, with those
+// of unauthenticated connections under AnonymousScope.
+func (r *rateLimiter) violations() map[string]uint64 {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	counts := make(map[string]uint64, len(r.rejected))
+	for label, count := range r.rejected {
+		counts[label] = count
+	}
+	return counts
+}
+
+// checkRate charges a publication or pipe send to a destination ("pub:<topic>"
+// or "pipe:<name>") against the rate limits of the connection's agent (of
+// the connection itself unless the agent authenticated with its own
+// credential) and, for topics, of the topic. The request size on the wire counts as the publication's bytes.
+// Returns nil to proceed, or the rejection; rate rejections carry a
+// slow-down signal saying when to retry.
+func (s *Service) checkRate(conn *Connection, req *BrokerRequest, destination string) *BrokerResponse {
+	topic, isTopic := strings.CutPrefix(destination, "pub:")
+	if !isTopic {
+		topic = "" // Pipes have agent limits only
+	}
+	trusted := conn.authenticated && s.guard.Bound(conn.AgentID)
+	violation := s.limits.allow(conn.ID, conn.AgentID, trusted, topic, int64(len(req.Params)))
+	if violation == nil {
+		return nil
+	}
+
+	s.metrics.rateLimited.Inc(violation.label, violation.reason)
+
+	if violation.reason == LimitSize {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: ErrCodeMessageTooLarge, Message: fmt.Sprintf("Message too large for %s: %d bytes exceed the limit of %s", destination, len(req.Params), violation.scope)},
+		}
+	}
+	return &BrokerResponse{
+		ID:       req.ID,
+		Error:    &BrokerError{Code: ErrCodeRateLimited, Message: fmt.Sprintf("Rate limit exceeded for %s: %s limit of %s, retry after %v", destination, violation.reason, violation.scope, violation.retry.Round(time.Millisecond))},
+		SlowDown: &SlowDown{Queue: violation.scope, RetryAfterMs: max(int(violation.retry/time.Millisecond), 1)},
+	}
+}
@@ -0,0 +1,214 @@
+package broker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/auth"
+	"github.com/tenzoki/agen/cellorg/internal/config"
+)
+
+// publishAs publishes a message with the given payload as an agent that
+// authenticated on its own connection
+func publishAs(t *testing.T, s *Service, agentID, topic string, payload string) *BrokerResponse {
+	t.Helper()
+
+	conn := &Connection{ID: "conn_" + agentID, AgentID: agentID, authenticated: true}
+	return publishOn(t, s, conn, topic, payload)
+}
+
+// publishOn publishes a message with the given payload on a connection
+func publishOn(t *testing.T, s *Service, conn *Connection, topic string, payload string) *BrokerResponse {
+	t.Helper()
+
+	return s.handleRequest(conn, newRequest(t, "publish", map[string]interface{}{
+		"topic":   topic,
+		"message": Message{ID: "msg-" + topic, Type: "event", Payload: payload},
+	}))
+}
+
+// Test that agent and topic limits reject publications beyond their burst
+func TestRateLimitAgentsAndTopics(t *testing.T) {
+	guard, err := auth.NewGuard(config.SecurityConfig{
+		Credentials: map[string]string{"chatty": "chatty-secret", "bulk": "bulk-secret"},
+	})
+	if err != nil {
+		t.Fatalf("NewGuard failed: %v", err)
+	}
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json", RateLimits: config.RateLimitsConfig{
+		Agents: map[string]config.RateLimit{
+			"*":    {MessagesPerSecond: 1, Burst: 2},
+			"bulk": {}, // Unlimited
+		},
+		Topics: map[string]config.RateLimit{
+			"alerts.#": {MessagesPerSecond: 1},
+		},
+	}})
+	s.SetGuard(guard)
+
+	for i := 0; i < 2; i++ {
+		if resp := publishAs(t, s, "chatty", "news", "x"); resp.Error != nil {
+			t.Fatalf("Publication %d within the burst rejected: %s", i, resp.Error.Message)
+		}
+	}
+	resp := publishAs(t, s, "chatty", "news", "x")
+	if resp.Error == nil || resp.Error.Code != ErrCodeRateLimited {
+		t.Fatalf("Expected ErrCodeRateLimited, got %+v", resp.Error)
+	}
+	if resp.SlowDown == nil || resp.SlowDown.Queue != "agent:chatty" || resp.SlowDown.RetryAfterMs <= 0 {
+		t.Errorf("Expected a retry hint for agent:chatty, got %+v", resp.SlowDown)
+	}
+
+	// The agent limit also covers pipe sends
+	pipeResp := s.handleRequest(&Connection{ID: "conn_chatty", AgentID: "chatty", authenticated: true}, newRequest(t, "send_pipe", map[string]interface{}{
+		"pipe":    "work",
+		"message": Message{ID: "task", Type: "task"},
+	}))
+	if pipeResp.Error == nil || pipeResp.Error.Code != ErrCodeRateLimited {
+		t.Errorf("Expected the pipe send to be rate limited, got %+v", pipeResp.Error)
+	}
+
+	// Each topic matching a pattern has its own bucket, shared by all publishers
+	for i := 0; i < 5; i++ {
+		if resp := publishAs(t, s, "bulk", "news", "x"); resp.Error != nil {
+			t.Fatalf("Unlimited agent rejected: %s", resp.Error.Message)
+		}
+	}
+	if resp := publishAs(t, s, "bulk", "alerts.fire", "x"); resp.Error != nil {
+		t.Fatalf("First alert rejected: %s", resp.Error.Message)
+	}
+	if resp := publishAs(t, s, "bulk", "alerts.fire", "x"); resp.Error == nil || resp.SlowDown.Queue != "topic:alerts.fire" {
+		t.Errorf("Expected topic:alerts.fire to be limited, got %+v", resp.Error)
+	}
+	if resp := publishAs(t, s, "bulk", "alerts.flood", "x"); resp.Error != nil {
+		t.Errorf("Other topic rejected: %s", resp.Error.Message)
+	}
+
+	violations := s.Stats().RateLimited
+	if violations["agent:chatty"] != 2 || violations["topic:alerts.fire"] != 1 || len(violations) != 2 {
+		t.Errorf("Unexpected rate limit stats: %v", violations)
+	}
+}
+
+// Test that connections without an agent credential of their own are limited
+// each on its own, whatever agent ID they claim
+func TestRateLimitUntrustedConnections(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json", RateLimits: config.RateLimitsConfig{
+		Agents: map[string]config.RateLimit{
+			"*":    {MessagesPerSecond: 1, Burst: 1},
+			"bulk": {}, // Unlimited, but only for bulk itself
+		},
+	}})
+	connect := func(conn *Connection, agentID string) {
+		t.Helper()
+		if resp := s.handleRequest(conn, newRequest(t, "connect", map[string]string{"agent_id": agentID})); resp.Error != nil {
+			t.Fatalf("connect as %s failed: %s", agentID, resp.Error.Message)
+		}
+	}
+
+	conn := &Connection{ID: "conn_a", outbox: newPriorityQueue(outboxCapacity, 0)}
+	connect(conn, "bulk")
+	if resp := publishOn(t, s, conn, "news", "x"); resp.Error != nil {
+		t.Fatalf("Publication within the burst rejected: %s", resp.Error.Message)
+	}
+	resp := publishOn(t, s, conn, "news", "x")
+	if resp.Error == nil || resp.Error.Code != ErrCodeRateLimited || resp.SlowDown.Queue != "conn:conn_a" {
+		t.Fatalf("Expected the claimed ID to be limited per connection, got %+v", resp.Error)
+	}
+
+	// Switching IDs keeps the connection's bucket
+	connect(conn, "fresh")
+	if resp := publishOn(t, s, conn, "news", "x"); resp.Error == nil || resp.Error.Code != ErrCodeRateLimited {
+		t.Errorf("Expected the new ID to stay limited, got %+v", resp.Error)
+	}
+
+	// Other connections have their own buckets
+	other := &Connection{ID: "conn_b", outbox: newPriorityQueue(outboxCapacity, 0)}
+	connect(other, "fresh")
+	if resp := publishOn(t, s, other, "news", "x"); resp.Error != nil {
+		t.Errorf("Other connection rejected: %s", resp.Error.Message)
+	}
+
+	violations := s.Stats().RateLimited
+	if violations[AnonymousScope] != 2 || len(violations) != 1 {
+		t.Errorf("Unexpected rate limit stats: %v", violations)
+	}
+}
+
+// Test that idle buckets are dropped while their violations stay counted
+func TestRateLimitEvictsIdleBuckets(t *testing.T) {
+	r := newRateLimiter(config.RateLimitsConfig{
+		Agents: map[string]config.RateLimit{"*": {MessagesPerSecond: 1, Burst: 1}},
+	})
+	for i := 0; i < 2; i++ {
+		r.allow("conn_old", "old", false, "", 1)
+	}
+
+	// Age the bucket and the last sweep beyond the idle timeout
+	r.mux.Lock()
+	past := time.Now().Add(-bucketIdleTimeout)
+	r.buckets["conn:conn_old"].used = past
+	r.swept = past
+	r.mux.Unlock()
+
+	if violation := r.allow("conn_new", "new", false, "", 1); violation != nil {
+		t.Fatalf("New connection rejected: %+v", violation)
+	}
+	r.mux.Lock()
+	_, kept := r.buckets["conn:conn_old"]
+	count := len(r.buckets)
+	r.mux.Unlock()
+	if kept || count != 1 {
+		t.Errorf("Expected only the new connection's bucket, got %d (old kept: %v)", count, kept)
+	}
+	if violations := r.violations(); violations[AnonymousScope] != 1 {
+		t.Errorf("Expected the dropped bucket's violation counted, got %v", violations)
+	}
+}
+
+// Test that publications larger than max_message_bytes are rejected for good
+func TestRateLimitMessageSize(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json", RateLimits: config.RateLimitsConfig{
+		Topics: map[string]config.RateLimit{"uploads": {MaxMessageBytes: 200}},
+	}})
+
+	if resp := publishAs(t, s, "ingester", "uploads", "small"); resp.Error != nil {
+		t.Fatalf("Small publication rejected: %s", resp.Error.Message)
+	}
+	resp := publishAs(t, s, "ingester", "uploads", strings.Repeat("x", 500))
+	if resp.Error == nil || resp.Error.Code != ErrCodeMessageTooLarge || resp.SlowDown != nil {
+		t.Errorf("Expected ErrCodeMessageTooLarge without retry hint, got %+v %+v", resp.Error, resp.SlowDown)
+	}
+	if resp := publishAs(t, s, "ingester", "other", strings.Repeat("x", 500)); resp.Error != nil {
+		t.Errorf("Unlimited topic rejected: %s", resp.Error.Message)
+	}
+}
+
+// Test that buckets refill at their rate and take oversized amounts when full
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 2, now)
+
+	for i := 0; i < 2; i++ {
+		if wait := b.wait(1, now); wait != 0 {
+			t.Fatalf("Expected token %d to be available, wait %v", i, wait)
+		}
+		b.take(1)
+	}
+	if wait := b.wait(1, now); wait != 100*time.Millisecond {
+		t.Errorf("Expected to wait 100ms for the next token, got %v", wait)
+	}
+	if wait := b.wait(1, now.Add(100*time.Millisecond)); wait != 0 {
+		t.Errorf("Expected a token after 100ms, wait %v", wait)
+	}
+
+	bytes := newTokenBucket(100, 0, now)
+	if wait := bytes.wait(250, now); wait != 0 {
+		t.Fatalf("Expected a full bucket to take more than its burst, wait %v", wait)
+	}
+	bytes.take(250)
+	if wait := bytes.wait(1, now.Add(time.Second)); wait <= 0 {
+		t.Error("Expected the bucket to stay in debt after an oversized take")
+	}
+}
@@ -0,0 +1,162 @@
+package broker
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// InboxPrefix starts the reply inbox names. Every connection has one inbox,
+// named after its connection ID.
+const InboxPrefix = "_inbox."
+
+// maxPendingRequests is how many requests awaiting a reply are remembered
+// per connection. Beyond it the oldest are forgotten and their replies
+// refused, like those of requests the requester gave up on.
+const maxPendingRequests = 1024
+
+// pendingRequests tracks the requests a connection published and has not
+// received a reply to, so only replies to them reach its inbox. The zero
+// value is ready to use. Safe for concurrent use.
+type pendingRequests struct {
+	mux   sync.Mutex
+	ids   map[string]uint64 // Request ID -> sequence number of its entry in order
+	order []pendingEntry    // Requests, oldest first
+	seq   uint64
+}
+
+// pendingEntry is one request in publication order.
+type pendingEntry struct {
+	id  string
+	seq uint64
+}
+
+// add records a request awaiting a reply, forgetting the oldest ones beyond
+// maxPendingRequests.
+func (p *pendingRequests) add(id string) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.ids == nil {
+		p.ids = make(map[string]uint64)
+	}
+	p.seq++
+	p.ids[id] = p.seq
+	p.order = append(p.order, pendingEntry{id: id, seq: p.seq})
+
+	for len(p.ids) > maxPendingRequests {
+		p.forgetOldest()
+	}
+	// Answered requests leave entries behind; drop them once they dominate
+	if len(p.order) > 2*maxPendingRequests {
+		live := p.order[:0]
+		for _, entry := range p.order {
+			if p.ids[entry.id] == entry.seq {
+				live = append(live, entry)
+			}
+		}
+		p.order = live
+	}
+}
+
+// take removes a request and reports whether it was awaiting a reply.
+func (p *pendingRequests) take(id string) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if _, pending := p.ids[id]; !pending {
+		return false
+	}
+	delete(p.ids, id)
+	return true
+}
+
+// forgetOldest drops the oldest entry, and its request unless it was
+// published again since. The caller must hold p.mux.
+func (p *pendingRequests) forgetOldest() {
+	oldest := p.order[0]
+	p.order = p.order[1:]
+	if p.ids[oldest.id] == oldest.seq {
+		delete(p.ids, oldest.id)
+	}
+}
+
+// inbox returns the reply inbox of a connection.
+func inbox(conn *Connection) string {
+	return InboxPrefix + conn.ID
+}
+
+// requestResult is the result of "request".
+type requestResult struct {
+	Inbox      string `json:"inbox"`      // Reply inbox stamped on the request
+	Recipients int    `json:"recipients"` // Subscribers and consumer groups the request was queued for
+}
+
+// handleReply delivers a reply envelope to the inbox of the connection that
+// sent the request. Replies must carry the correlation ID of a request the
+// requester is still waiting on, which envelope.NewReplyEnvelope sets; only
+// the first reply to a request is delivered. They go straight to the requester,
+// like responses, without passing its outbox or prefetch window, and are not
+// retained: a requester that disconnected meanwhile no longer has an inbox.
+//
+// Called by: handleRequest() when method is "reply"
+func (s *Service) handleReply(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	var params struct {
+		Inbox    string             `json:"inbox"`    // Reply inbox from the request's envelope.HeaderReplyTo
+		Envelope *envelope.Envelope `json:"envelope"` // Reply envelope
+	}
+	if err := conn.unmarshal(req.Params, &params); err != nil || params.Envelope == nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
+		}
+	}
+
+	if err := params.Envelope.Validate(); err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Invalid envelope: %v", err)},
+		}
+	}
+	if params.Envelope.CorrelationID == "" {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "Reply envelope has no correlation ID"},
+		}
+	}
+
+	connID, ok := strings.CutPrefix(params.Inbox, InboxPrefix)
+	s.connMux.RLock()
+	requester := s.connections[connID]
+	s.connMux.RUnlock()
+	if !ok || requester == nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Reply inbox not found: %s", params.Inbox)},
+		}
+	}
+	if !requester.requests.take(params.Envelope.CorrelationID) {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("No pending request %s in inbox %s", params.Envelope.CorrelationID, params.Inbox)},
+		}
+	}
+
+	if conn.AgentID != "" {
+		params.Envelope.AddHop(conn.AgentID)
+	}
+	if err := requester.send(params.Envelope); err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32603, Message: fmt.Sprintf("Failed to deliver reply: %v", err)},
+		}
+	}
+
+	if s.debug {
+		log.Printf("Broker: delivered reply to %s for request %s", params.Inbox, params.Envelope.CorrelationID)
+	}
+	return &BrokerResponse{ID: req.ID, Result: "delivered"}
+}
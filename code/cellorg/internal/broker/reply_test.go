@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/tenzoki/agen/cellorg/internal/codec"
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// Test that a request carries the requester's inbox and the reply reaches it directly
+func TestRequestReply(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	requester, reader, _ := handshakeTestConn(t, s, codec.JSON)
+	defer requester.Close()
+
+	responder := &Connection{ID: "conn_responder", AgentID: "context-enricher", outbox: newPriorityQueue(outboxCapacity, 0)}
+	if resp := s.handleRequest(responder, newRequest(t, "subscribe", map[string]string{"topic": "queries"})); resp.Error != nil {
+		t.Fatalf("subscribe failed: %s", resp.Error.Message)
+	}
+
+	request, _ := envelope.NewEnvelope("ner-agent", "pub:queries", "query", map[string]string{"q": "status"})
+	if err := json.NewEncoder(requester).Encode(newRequest(t, "request", map[string]interface{}{"topic": "queries", "envelope": request})); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	dec := json.NewDecoder(reader)
+	var resp struct {
+		Result requestResult `json:"result"`
+		Error  *BrokerError  `json:"error"`
+	}
+	if err := dec.Decode(&resp); err != nil || resp.Error != nil {
+		t.Fatalf("request failed: %v %+v", err, resp.Error)
+	}
+	if resp.Result.Recipients != 1 || !strings.HasPrefix(resp.Result.Inbox, InboxPrefix) {
+		t.Fatalf("Expected 1 recipient and an inbox, got %+v", resp.Result)
+	}
+
+	item := responder.outbox.Pop()
+	if item == nil || item.Envelope.Headers[envelope.HeaderReplyTo] != resp.Result.Inbox {
+		t.Fatalf("Expected the request with reply inbox %s, got %+v", resp.Result.Inbox, item)
+	}
+
+	reply, _ := envelope.NewReplyEnvelope(item.Envelope, "context-enricher", map[string]string{"status": "ok"})
+	if resp := s.handleRequest(responder, newRequest(t, "reply", map[string]interface{}{"inbox": resp.Result.Inbox, "envelope": reply})); resp.Error != nil {
+		t.Fatalf("reply failed: %s", resp.Error.Message)
+	}
+
+	var received envelope.Envelope
+	if err := dec.Decode(&received); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	if received.CorrelationID != request.ID || received.MessageType != "reply" {
+		t.Errorf("Expected reply to %s, got %+v", request.ID, received)
+	}
+
+	// Only the first reply to a pending request reaches the inbox
+	if resp := s.handleRequest(responder, newRequest(t, "reply", map[string]interface{}{"inbox": resp.Result.Inbox, "envelope": reply})); resp.Error == nil {
+		t.Error("Expected a second reply to the same request to be rejected")
+	}
+	stranger := &Connection{ID: "conn_stranger", AgentID: "intruder"}
+	forged, _ := envelope.NewEnvelope("intruder", "ner-agent", "reply", map[string]string{"status": "forged"})
+	forged.CorrelationID = "never-requested"
+	if resp := s.handleRequest(stranger, newRequest(t, "reply", map[string]interface{}{"inbox": resp.Result.Inbox, "envelope": forged})); resp.Error == nil {
+		t.Error("Expected a reply to a request never made to be rejected")
+	}
+
+	// Replies need a correlation ID and a live inbox
+	uncorrelated, _ := envelope.NewEnvelope("context-enricher", "ner-agent", "reply", nil)
+	if resp := s.handleRequest(responder, newRequest(t, "reply", map[string]interface{}{"inbox": resp.Result.Inbox, "envelope": uncorrelated})); resp.Error == nil {
+		t.Error("Expected reply without correlation ID to be rejected")
+	}
+	if resp := s.handleRequest(responder, newRequest(t, "reply", map[string]interface{}{"inbox": InboxPrefix + "conn_gone", "envelope": reply})); resp.Error == nil {
+		t.Error("Expected reply to an unknown inbox to be rejected")
+	}
+}
@@ -0,0 +1,212 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// HeaderOffset carries the topic log offset of a delivered envelope.
+// Simple messages carry it in Message.Offset.
+const HeaderOffset = "X-Offset"
+
+const (
+	defaultRetentionMessages = 100         // Entries kept per topic when no retention limit is configured
+	replayWait               = time.Second // Outbox wait between checks whether a replaying connection closed
+)
+
+// retentionPolicy limits how much history a topic log keeps.
+// Zero fields are unlimited.
+type retentionPolicy struct {
+	maxMessages int
+	maxAge      time.Duration
+	maxBytes    int64
+}
+
+// newRetentionPolicy applies the retention defaults: without any limit a topic
+// keeps its last 100 entries, as before offsets were introduced.
+func newRetentionPolicy(messages int, age time.Duration, bytes int64) retentionPolicy {
+	if messages <= 0 && age <= 0 && bytes <= 0 {
+		messages = defaultRetentionMessages
+	}
+	return retentionPolicy{maxMessages: max(messages, 0), maxAge: max(age, 0), maxBytes: max(bytes, 0)}
+}
+
+// LogEntry is one publication retained in a topic log.
+// Exactly one of Message and Envelope is set.
+type LogEntry struct {
+	Offset    uint64             // Position in the topic log, starting at 1
+	Timestamp time.Time          // When the broker accepted the publication
+	Size      int64              // Payload bytes counted against the byte limit
+	Message   *Message           // Published simple message
+	Envelope  *envelope.Envelope // Published envelope
+}
+
+// item builds the subscriber delivery for a retained entry on a topic.
+func (e *LogEntry) item(topicName string) *queueItem {
+	if e.Envelope != nil {
+		return &queueItem{Priority: e.Envelope.Priority, Envelope: e.Envelope, Topic: topicName}
+	}
+
+	// Create properly formatted message for subscriber delivery
+	// CRITICAL: Preserve all message fields including metadata
+	pubMsg := Message{
+		ID:        e.Message.ID,                     // Original message ID
+		Type:      e.Message.Type,                   // Message type
+		Target:    fmt.Sprintf("pub:%s", topicName), // Routing info
+		Payload:   e.Message.Payload,                // Message data
+		Meta:      e.Message.Meta,                   // Critical: preserve metadata!
+		Timestamp: e.Message.Timestamp,              // Processing timestamp
+		Offset:    e.Offset,                         // Position in the topic log
+	}
+	return &queueItem{Priority: messagePriority(&pubMsg), Message: &pubMsg, Topic: topicName}
+}
+
+// topicLog is the retained history of a topic. Offsets grow by one with every
+// publication and are never reused, so trimmed entries leave a gap at the
+// front only. Not safe for concurrent use; guarded by the topic's mutex.
+type topicLog struct {
+	entries []*LogEntry
+	next    uint64 // Offset of the next publication
+	bytes   int64  // Sum of retained entry sizes
+}
+
+// newTopicLog creates an empty log whose first entry gets offset 1.
+func newTopicLog() *topicLog {
+	return &topicLog{next: 1}
+}
+
+// append assigns the next offset to an entry, stores it and trims the log.
+func (l *topicLog) append(entry *LogEntry, policy retentionPolicy) uint64 {
+	entry.Offset = l.next
+	l.next++
+	l.entries = append(l.entries, entry)
+	l.bytes += entry.Size
+	l.trim(policy, entry.Timestamp)
+	return entry.Offset
+}
+
+// trim drops the oldest entries until the log is within all retention limits.
+func (l *topicLog) trim(policy retentionPolicy, now time.Time) {
+	drop := 0
+	for ; drop < len(l.entries); drop++ {
+		entry := l.entries[drop]
+		retained := len(l.entries) - drop
+		if (policy.maxMessages == 0 || retained <= policy.maxMessages) &&
+			(policy.maxBytes == 0 || l.bytes <= policy.maxBytes) &&
+			(policy.maxAge == 0 || now.Sub(entry.Timestamp) <= policy.maxAge) {
+			break
+		}
+		l.bytes -= entry.Size
+		l.entries[drop] = nil // Release the payload
+	}
+	l.entries = l.entries[drop:]
+}
+
+// since returns the retained entries from an offset or a point in time on,
+// after dropping entries past the age limit. An offset older than the log
+// starts at its oldest entry. Returns nil when neither is set.
+func (l *topicLog) since(offset uint64, from time.Time, policy retentionPolicy) []*LogEntry {
+	if offset == 0 && from.IsZero() {
+		return nil
+	}
+	l.trim(policy, time.Now())
+
+	var start int
+	if offset > 0 {
+		start = sort.Search(len(l.entries), func(i int) bool { return l.entries[i].Offset >= offset })
+	} else {
+		start = sort.Search(len(l.entries), func(i int) bool { return !l.entries[i].Timestamp.Before(from) })
+	}
+	return append([]*LogEntry(nil), l.entries[start:]...)
+}
+
+// stats reports the offsets and size of the log.
+func (l *topicLog) stats() TopicStats {
+	stats := TopicStats{NextOffset: l.next, Retained: len(l.entries), Bytes: l.bytes}
+	if len(l.entries) > 0 {
+		stats.FirstOffset = l.entries[0].Offset
+	}
+	return stats
+}
+
+// TopicStats reports the retained history of one topic.
+type TopicStats struct {
+	FirstOffset uint64 `json:"first_offset"` // Oldest retained offset (0 if the log is empty)
+	NextOffset  uint64 `json:"next_offset"`  // Offset the next publication gets
+	Retained    int    `json:"retained"`     // Retained entries
+	Bytes       int64  `json:"bytes"`        // Retained payload bytes (messages count only with a byte limit)
+}
+
+// retainMessage appends a message to the topic log and stamps its offset.
+// The caller must hold topic.mux.
+func (s *Service) retainMessage(topic *Topic, msg *Message) *LogEntry {
+	entry := &LogEntry{Timestamp: time.Now(), Message: msg}
+	if s.retention.maxBytes > 0 {
+		if data, err := json.Marshal(msg.Payload); err == nil {
+			entry.Size = int64(len(data))
+		}
+	}
+	msg.Offset = topic.history.append(entry, s.retention)
+	return entry
+}
+
+// retainEnvelope appends an envelope to the topic log and stamps its offset
+// in the HeaderOffset header. The caller must hold topic.mux.
+func (s *Service) retainEnvelope(topic *Topic, env *envelope.Envelope) *LogEntry {
+	entry := &LogEntry{Timestamp: time.Now(), Envelope: env, Size: int64(len(env.Payload))}
+	offset := topic.history.append(entry, s.retention)
+	env.SetHeader(HeaderOffset, strconv.FormatUint(offset, 10))
+	return entry
+}
+
+// replay queues retained entries for a new subscriber in the background,
+// waiting for outbox space as the agent works through them, so a long
+// history is paced by the agent's prefetch window. Entries still pending on
+// the topic were just handed over and are skipped, as are expired envelopes
+// and entries the subscription's filter does not match.
+// Replayed entries queue behind deliveries already in the outbox.
+func (s *Service) replay(conn *Connection, topicName string, entries []*LogEntry, pending []*loggedEnvelope, filter *Filter) {
+	if len(entries) == 0 || conn.outbox == nil {
+		return
+	}
+
+	handed := make(map[*envelope.Envelope]bool, len(pending))
+	for _, le := range pending {
+		handed[le.Envelope] = true
+	}
+
+	items := make([]*queueItem, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Envelope != nil && (handed[entry.Envelope] || entry.Envelope.IsExpired()) {
+			continue
+		}
+		item := entry.item(topicName)
+		if !filter.Match(item) {
+			continue
+		}
+		item.Replayed = true
+		items = append(items, item)
+	}
+
+	go func() {
+		for i, item := range items {
+			for !conn.deliverWithin(item, time.Now().Add(replayWait)) {
+				if conn.closed() {
+					if s.debug {
+						log.Printf("Broker: %s closed, replay of topic %s stopped after %d of %d entries", conn.ID, topicName, i, len(items))
+					}
+					return
+				}
+			}
+		}
+		if s.debug {
+			log.Printf("Broker: replayed %d entries of topic %s to %s", len(items), topicName, conn.ID)
+		}
+	}()
+}
@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// waitForOutbox waits until the background replay has queued n deliveries
+func waitForOutbox(t *testing.T, conn *Connection, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for conn.outbox.Len() < n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := conn.outbox.Len(); got != n {
+		t.Fatalf("Expected %d queued deliveries, got %d", n, got)
+	}
+}
+
+// Test that the topic log trims by count, bytes and age without reusing offsets
+func TestTopicLogRetention(t *testing.T) {
+	now := time.Now()
+	entry := func(age time.Duration, size int64) *LogEntry {
+		return &LogEntry{Timestamp: now.Add(-age), Size: size, Message: &Message{}}
+	}
+
+	byCount := newTopicLog()
+	for i := 0; i < 5; i++ {
+		byCount.append(entry(0, 1), newRetentionPolicy(3, 0, 0))
+	}
+	if stats := byCount.stats(); stats.FirstOffset != 3 || stats.NextOffset != 6 || stats.Retained != 3 {
+		t.Errorf("Expected offsets 3-5 retained, got %+v", stats)
+	}
+
+	byBytes := newTopicLog()
+	for i := 0; i < 4; i++ {
+		byBytes.append(entry(0, 40), newRetentionPolicy(0, 0, 100))
+	}
+	if stats := byBytes.stats(); stats.Retained != 2 || stats.Bytes != 80 {
+		t.Errorf("Expected 2 entries within 100 bytes, got %+v", stats)
+	}
+
+	byAge := newTopicLog()
+	policy := newRetentionPolicy(0, time.Hour, 0)
+	byAge.append(entry(2*time.Hour, 1), policy)
+	byAge.append(entry(0, 1), policy)
+	if entries := byAge.since(1, time.Time{}, policy); len(entries) != 1 || entries[0].Offset != 2 {
+		t.Errorf("Expected only offset 2 within the age limit, got %d entries", len(entries))
+	}
+
+	if policy := newRetentionPolicy(0, 0, 0); policy.maxMessages != defaultRetentionMessages {
+		t.Errorf("Expected default retention of %d entries, got %+v", defaultRetentionMessages, policy)
+	}
+}
+
+// Test that a subscriber replays retained messages from an offset, then gets live ones
+func TestSubscribeFromOffset(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	for i := 0; i < 5; i++ {
+		publishTestMessage(t, s, producer, "extracted-text")
+	}
+
+	enricher := &Connection{ID: "conn_enricher", AgentID: "context-enricher", outbox: newPriorityQueue(outboxCapacity, 0)}
+	resp := s.handleRequest(enricher, newRequest(t, "subscribe", map[string]interface{}{"topic": "extracted-text", "from_offset": 3}))
+	if resp.Error != nil {
+		t.Fatalf("subscribe failed: %s", resp.Error.Message)
+	}
+	waitForOutbox(t, enricher, 3)
+
+	publishTestMessage(t, s, producer, "extracted-text")
+	for want := uint64(3); want <= 6; want++ {
+		item := enricher.outbox.Pop()
+		if item == nil || item.Message.Offset != want {
+			t.Fatalf("Expected offset %d, got %+v", want, item)
+		}
+	}
+
+	if stats := s.Stats().Topics["extracted-text"]; stats.FirstOffset != 1 || stats.NextOffset != 7 {
+		t.Errorf("Expected offsets 1-6 in stats, got %+v", stats)
+	}
+}
+
+// Test that a wildcard subscriber replays envelopes by timestamp with their offset header
+func TestSubscribeFromTimestamp(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	publish := func(topic string) {
+		env, _ := envelope.NewEnvelope("producer", "pub:"+topic, "chunk", map[string]string{"text": "x"})
+		resp := s.handleRequest(producer, newRequest(t, "publish_envelope", map[string]interface{}{"topic": topic, "envelope": env}))
+		if resp.Error != nil {
+			t.Fatalf("publish_envelope failed: %s", resp.Error.Message)
+		}
+	}
+
+	publish("project-42.ocr")
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	publish("project-42.ocr")
+	publish("project-42.nlp")
+
+	conn := &Connection{ID: "conn_replay", AgentID: "context-enricher", outbox: newPriorityQueue(outboxCapacity, 0)}
+	resp := s.handleRequest(conn, newRequest(t, "subscribe", map[string]interface{}{"topic": "project-42.*", "from_timestamp": since}))
+	if resp.Error != nil {
+		t.Fatalf("subscribe failed: %s", resp.Error.Message)
+	}
+	waitForOutbox(t, conn, 2)
+
+	offsets := map[string]string{}
+	for item := conn.outbox.Pop(); item != nil; item = conn.outbox.Pop() {
+		offsets[item.Topic] = item.Envelope.Headers[HeaderOffset]
+	}
+	if offsets["project-42.ocr"] != "2" || offsets["project-42.nlp"] != "1" {
+		t.Errorf("Expected offsets 2 and 1, got %v", offsets)
+	}
+
+	resp = s.handleRequest(conn, newRequest(t, "subscribe", map[string]interface{}{"topic": "project-42.*", "from_offset": 1}))
+	if resp.Error == nil || resp.Error.Code != -32602 {
+		t.Errorf("Expected from_offset on a wildcard to be rejected, got %+v", resp)
+	}
+}
@@ -0,0 +1,222 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// HeaderScheduledFor is set on scheduled envelopes to the RFC3339 time they
+// were due, so consumers can tell delayed deliveries apart.
+const HeaderScheduledFor = "X-Scheduled-For"
+
+// scheduleRetryDelay is how long a due envelope waits before another attempt
+// when its pipe is full or the log write fails.
+const scheduleRetryDelay = time.Second
+
+// scheduleResult is the result of a publish or send with deliver_at or
+// delay_ms.
+type scheduleResult struct {
+	ScheduledID string    `json:"scheduled_id"` // Pass to cancel_scheduled
+	DeliverAt   time.Time `json:"deliver_at"`   // When the envelope will be delivered
+}
+
+// deliveryTime returns when an envelope published with deliver_at or delay_ms
+// is due. The zero time means deliver now: neither was given, or the time has
+// already passed.
+func deliveryTime(deliverAt time.Time, delayMs int64) (time.Time, *BrokerError) {
+	if delayMs < 0 {
+		return time.Time{}, &BrokerError{Code: -32602, Message: "Invalid params: delay_ms cannot be negative"}
+	}
+	if delayMs > 0 && !deliverAt.IsZero() {
+		return time.Time{}, &BrokerError{Code: -32602, Message: "Invalid params: use either deliver_at or delay_ms"}
+	}
+
+	due := deliverAt
+	if delayMs > 0 {
+		due = time.Now().Add(time.Duration(delayMs) * time.Millisecond)
+	}
+	if !due.After(time.Now()) {
+		return time.Time{}, nil
+	}
+	return due, nil
+}
+
+// scheduleEnvelope holds an envelope for a topic or pipe until deliverAt.
+// With a data directory the envelope is stored before the publish or send is
+// acknowledged, so it survives a restart whether or not it is persistent.
+//
+// Called by: handlePublishEnvelope() and handleSendPipeEnvelope() when
+// deliver_at or delay_ms lies in the future
+func (s *Service) scheduleEnvelope(conn *Connection, req *BrokerRequest, kind, name string, env *envelope.Envelope, deliverAt time.Time) *BrokerResponse {
+	env.SetHeader(HeaderScheduledFor, deliverAt.UTC().Format(time.RFC3339Nano))
+
+	item := &scheduledEnvelope{
+		ID:          uuid.New().String(),
+		Kind:        kind,
+		Name:        name,
+		DeliverAt:   deliverAt,
+		Envelope:    env,
+		AgentID:     conn.AgentID,
+		SenderConn:  conn.ID,
+		ScheduledAt: time.Now(),
+	}
+	if s.wal != nil {
+		if err := s.wal.SaveScheduled(item); err != nil {
+			return &BrokerResponse{
+				ID:    req.ID,
+				Error: &BrokerError{Code: -32603, Message: fmt.Sprintf("Failed to persist scheduled envelope: %v", err)},
+			}
+		}
+	}
+	s.scheduler.add(item)
+
+	if s.debug {
+		log.Printf("Broker: scheduled envelope %s for %s:%s at %s", env.ID, kind, name, deliverAt.Format(time.RFC3339))
+	}
+	return &BrokerResponse{
+		ID:     req.ID,
+		Result: scheduleResult{ScheduledID: item.ID, DeliverAt: deliverAt},
+	}
+}
+
+// handleCancelScheduled discards a scheduled envelope before it is due. Only
+// the agent that scheduled it may cancel it.
+//
+// Called by: handleRequest() when method is "cancel_scheduled"
+func (s *Service) handleCancelScheduled(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	var params struct {
+		ID string `json:"scheduled_id"` // ID returned by the scheduling publish or send
+	}
+	if err := conn.unmarshal(req.Params, &params); err != nil || params.ID == "" {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
+		}
+	}
+
+	item := s.scheduler.get(params.ID)
+	if item == nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Scheduled envelope not found: %s", params.ID)},
+		}
+	}
+	if item.AgentID != conn.AgentID {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: ErrCodeForbidden, Message: fmt.Sprintf("Scheduled envelope %s belongs to another agent", params.ID)},
+		}
+	}
+
+	// Lost the race against the scheduler: the envelope is being delivered
+	if s.scheduler.remove(params.ID) == nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Scheduled envelope already due: %s", params.ID)},
+		}
+	}
+	s.unsaveScheduled(params.ID)
+
+	return &BrokerResponse{ID: req.ID, Result: "cancelled"}
+}
+
+// runScheduler delivers scheduled envelopes as they become due until ctx is
+// cancelled.
+func (s *Service) runScheduler(ctx context.Context) {
+	ticker := time.NewTicker(wheelTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, item := range s.scheduler.advance(now) {
+				s.deliverScheduled(item)
+			}
+		}
+	}
+}
+
+// deliverScheduled publishes or sends a due envelope the way an immediate
+// publish or send would, and removes it from the store. Topic deliveries
+// skip the scheduling connection if it is still open. An envelope that
+// cannot be queued yet is tried again after scheduleRetryDelay.
+//
+// A crash between delivery and removal delivers the envelope again after the
+// restart (at-least-once).
+func (s *Service) deliverScheduled(item *scheduledEnvelope) {
+	env := item.Envelope
+	destination := fmt.Sprintf("pub:%s", item.Name)
+	if item.Kind == LogKindPipe {
+		destination = fmt.Sprintf("pipe:%s", item.Name)
+	}
+
+	// The TTL keeps running while the envelope waits
+	if env.IsExpired() {
+		s.expireEnvelope(env, destination, ExpiryStageDelivery)
+		s.unsaveScheduled(item.ID)
+		return
+	}
+
+	switch item.Kind {
+	case LogKindTopic:
+		s.connMux.RLock()
+		sender := s.connections[item.SenderConn]
+		s.connMux.RUnlock()
+
+		result, err := s.publishEnvelope(sender, item.Name, env, 0)
+		if err != nil {
+			s.retryScheduled(item, err)
+			return
+		}
+		if s.debug {
+			log.Printf("Broker: delivered scheduled envelope %s to topic %s (%d subscribers)", env.ID, item.Name, result.recipients)
+		}
+
+	case LogKindPipe:
+		seq, err := s.logEnvelope(LogKindPipe, item.Name, env)
+		if err != nil {
+			s.retryScheduled(item, err)
+			return
+		}
+		pipe := s.getOrCreatePipe(item.Name)
+		if !pipe.queue.Push(&queueItem{Priority: env.Priority, Envelope: env, Seq: seq}) {
+			s.unlogEnvelope(seq)
+			s.retryScheduled(item, fmt.Errorf("pipe buffer full"))
+			return
+		}
+		s.metrics.pipeSent.Inc(item.Name)
+		if s.debug {
+			log.Printf("Broker: delivered scheduled envelope %s to pipe %s", env.ID, item.Name)
+		}
+
+	default:
+		log.Printf("Broker: dropping scheduled envelope %s with unknown kind %q", env.ID, item.Kind)
+	}
+
+	s.unsaveScheduled(item.ID)
+}
+
+// retryScheduled puts a due envelope back into the wheel for a later attempt.
+func (s *Service) retryScheduled(item *scheduledEnvelope, cause error) {
+	log.Printf("Broker: scheduled envelope %s for %s:%s not delivered, retrying in %s: %v",
+		item.Envelope.ID, item.Kind, item.Name, scheduleRetryDelay, cause)
+	item.DeliverAt = time.Now().Add(scheduleRetryDelay)
+	s.scheduler.add(item)
+}
+
+// unsaveScheduled removes a scheduled envelope from the store.
+func (s *Service) unsaveScheduled(id string) {
+	if s.wal == nil {
+		return
+	}
+	if err := s.wal.RemoveScheduled(id); err != nil {
+		log.Printf("Broker: failed to remove scheduled envelope %s: %v", id, err)
+	}
+}
@@ -0,0 +1,142 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// Test that the timer wheel releases items in order, also beyond one revolution
+func TestTimerWheel(t *testing.T) {
+	start := time.Now()
+	w := newTimerWheel(start)
+
+	revolution := wheelSlots * wheelTick
+	for id, after := range map[string]time.Duration{
+		"soon":      250 * time.Millisecond,
+		"sooner":    150 * time.Millisecond,
+		"later":     revolution + time.Second,
+		"cancelled": time.Second,
+	} {
+		w.add(&scheduledEnvelope{ID: id, DeliverAt: start.Add(after)})
+	}
+	if w.remove("cancelled") == nil || w.remove("cancelled") != nil {
+		t.Error("Expected cancelled item to be removed once")
+	}
+
+	due := w.advance(start.Add(300 * time.Millisecond))
+	if len(due) != 2 || due[0].ID != "sooner" || due[1].ID != "soon" {
+		t.Fatalf("Expected sooner and soon to be due, got %+v", due)
+	}
+
+	// One revolution later the far item is still waiting
+	if due := w.advance(start.Add(revolution)); len(due) != 0 {
+		t.Fatalf("Expected nothing due after one revolution, got %+v", due)
+	}
+	if due := w.advance(start.Add(revolution + time.Second)); len(due) != 1 || due[0].ID != "later" {
+		t.Fatalf("Expected later to be due, got %+v", due)
+	}
+	if w.len() != 0 {
+		t.Errorf("Expected empty wheel, got %d items", w.len())
+	}
+}
+
+// Test that delayed publications are held until due and can be cancelled
+func TestScheduledPublish(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	producer := &Connection{ID: "conn_producer", AgentID: "scheduler-agent"}
+	other := &Connection{ID: "conn_other", AgentID: "other-agent"}
+	consumer := &Connection{ID: "conn_consumer", AgentID: "reminder-agent", outbox: newPriorityQueue(outboxCapacity, 0)}
+	if resp := s.handleRequest(consumer, newRequest(t, "subscribe", map[string]string{"topic": "reminders"})); resp.Error != nil {
+		t.Fatalf("subscribe failed: %s", resp.Error.Message)
+	}
+
+	publish := func(params map[string]interface{}) *BrokerResponse {
+		env, _ := envelope.NewEnvelope("scheduler-agent", "pub:reminders", "reminder", map[string]string{"text": "standup"})
+		params["topic"] = "reminders"
+		params["envelope"] = env
+		return s.handleRequest(producer, newRequest(t, "publish_envelope", params))
+	}
+
+	resp := publish(map[string]interface{}{"delay_ms": 500})
+	result, ok := resp.Result.(scheduleResult)
+	if resp.Error != nil || !ok || result.ScheduledID == "" {
+		t.Fatalf("Expected scheduled publication, got %+v", resp)
+	}
+	cancelled, _ := publish(map[string]interface{}{"deliver_at": time.Now().Add(time.Minute)}).Result.(scheduleResult)
+	if consumer.outbox.Len() != 0 || s.handleRequest(producer, newRequest(t, "stats", nil)).Result.(*Stats).Scheduled != 2 {
+		t.Fatal("Expected two envelopes waiting and none delivered")
+	}
+
+	// Only the scheduling agent may cancel
+	if resp := s.handleRequest(other, newRequest(t, "cancel_scheduled", map[string]string{"scheduled_id": cancelled.ScheduledID})); resp.Error == nil || resp.Error.Code != ErrCodeForbidden {
+		t.Errorf("Expected cancel by another agent to be forbidden, got %+v", resp)
+	}
+	if resp := s.handleRequest(producer, newRequest(t, "cancel_scheduled", map[string]string{"scheduled_id": cancelled.ScheduledID})); resp.Error != nil {
+		t.Fatalf("cancel_scheduled failed: %s", resp.Error.Message)
+	}
+
+	// Invalid schedules are rejected
+	if resp := publish(map[string]interface{}{"delay_ms": -1}); resp.Error == nil || resp.Error.Code != -32602 {
+		t.Errorf("Expected negative delay to be rejected, got %+v", resp)
+	}
+	if resp := publish(map[string]interface{}{"delay_ms": 10, "deliver_at": time.Now().Add(time.Minute)}); resp.Error == nil {
+		t.Errorf("Expected deliver_at with delay_ms to be rejected, got %+v", resp)
+	}
+
+	for _, item := range s.scheduler.advance(time.Now().Add(2 * time.Minute)) {
+		s.deliverScheduled(item)
+	}
+	item := consumer.outbox.Pop()
+	if item == nil || item.Envelope.Headers[HeaderScheduledFor] == "" || consumer.outbox.Len() != 0 {
+		t.Fatalf("Expected exactly the delayed envelope, got %+v", item)
+	}
+	if !result.DeliverAt.Equal(mustParseTime(t, item.Envelope.Headers[HeaderScheduledFor])) {
+		t.Errorf("Expected delivery time %s, got %s", result.DeliverAt, item.Envelope.Headers[HeaderScheduledFor])
+	}
+}
+
+// Test that scheduled pipe sends survive a restart
+func TestScheduledSendRecovery(t *testing.T) {
+	dir := t.TempDir()
+	s := newPersistentService(t, dir)
+	producer := &Connection{ID: "conn_producer", AgentID: "scheduler-agent"}
+
+	env, _ := envelope.NewEnvelope("scheduler-agent", "pipe:retries", "retry", map[string]int{"attempt": 2})
+	resp := s.handleRequest(producer, newRequest(t, "send_pipe_envelope", map[string]interface{}{
+		"pipe":     "retries",
+		"envelope": env,
+		"delay_ms": 60000,
+	}))
+	if _, ok := resp.Result.(scheduleResult); resp.Error != nil || !ok {
+		t.Fatalf("Expected scheduled send, got %+v", resp)
+	}
+	s.wal.Close()
+
+	s = newPersistentService(t, dir)
+	defer s.wal.Close()
+	if s.scheduler.len() != 1 {
+		t.Fatalf("Expected 1 recovered scheduled envelope, got %d", s.scheduler.len())
+	}
+	for _, item := range s.scheduler.advance(time.Now().Add(2 * time.Minute)) {
+		s.deliverScheduled(item)
+	}
+	if item := s.getOrCreatePipe("retries").queue.Pop(); item == nil || item.Envelope.ID != env.ID {
+		t.Fatalf("Expected recovered envelope in pipe, got %+v", item)
+	}
+	if scheduled, _ := s.wal.LoadScheduled(); len(scheduled) != 0 {
+		t.Errorf("Expected delivered envelope to be removed from the log, got %d", len(scheduled))
+	}
+}
+
+// mustParseTime parses an RFC3339 header value
+func mustParseTime(t *testing.T, value string) time.Time {
+	t.Helper()
+
+	parsed, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		t.Fatalf("Invalid time %q: %v", value, err)
+	}
+	return parsed
+}
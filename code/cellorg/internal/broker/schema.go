@@ -0,0 +1,149 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+	"github.com/tenzoki/agen/cellorg/internal/schema"
+)
+
+// ErrCodeSchemaViolation rejects a payload that does not match the schema
+// registered for its topic or message type.
+const ErrCodeSchemaViolation = -32022
+
+// Schema version stamps on validated payloads. Producers set them to pin the
+// version they follow; otherwise the broker sets the version that matched.
+const (
+	HeaderSchemaVersion = "X-Schema-Version" // Envelope header
+	MetaSchemaVersion   = "schema_version"   // Message meta key
+)
+
+// SetSchemas enables payload validation with the schemas declared in the
+// cell configuration. Must be called before Start. A nil registry turns
+// validation off.
+//
+// Called by: cellorg startup after loading the cells
+func (s *Service) SetSchemas(registry *schema.Registry) {
+	s.schemas = registry
+}
+
+// checkEnvelopeSchema validates an envelope's payload for a topic (empty for
+// pipes) and stamps the matching schema version. Chunks are not checked;
+// their payload is a fragment of the original one.
+func (s *Service) checkEnvelopeSchema(topic string, env *envelope.Envelope) *BrokerError {
+	if s.schemas == nil || env.Headers[envelope.HeaderChunkID] != "" {
+		return nil
+	}
+
+	pinned, err := schemaVersion(env.Headers[HeaderSchemaVersion])
+	if err != nil {
+		return &BrokerError{Code: -32602, Message: fmt.Sprintf("Invalid params: %v", err)}
+	}
+	version, err := s.schemas.Validate(topic, env.MessageType, env.Payload, pinned)
+	if err != nil {
+		return s.schemaViolation(topic, env.Destination, env.MessageType, version, err)
+	}
+	if version > 0 {
+		env.SetHeader(HeaderSchemaVersion, strconv.Itoa(version))
+	}
+	return nil
+}
+
+// metaChunkID marks chunks of simple messages split by the client.
+const metaChunkID = "chunk_id"
+
+// checkMessageSchema validates a simple message's payload for a topic (empty
+// for pipes) and stamps the matching schema version in its meta. Chunks are
+// not checked, like in checkEnvelopeSchema.
+func (s *Service) checkMessageSchema(topic string, msg *Message) *BrokerError {
+	if s.schemas == nil || msg.Meta[metaChunkID] != nil {
+		return nil
+	}
+
+	var stamp string
+	switch v := msg.Meta[MetaSchemaVersion].(type) {
+	case string:
+		stamp = v
+	case nil:
+	default:
+		stamp = fmt.Sprint(v)
+	}
+	pinned, err := schemaVersion(stamp)
+	if err != nil {
+		return &BrokerError{Code: -32602, Message: fmt.Sprintf("Invalid params: %v", err)}
+	}
+	version, err := s.schemas.ValidateValue(topic, msg.Type, msg.Payload, pinned)
+	if err != nil {
+		return s.schemaViolation(topic, msg.Target, msg.Type, version, err)
+	}
+	if version > 0 {
+		if msg.Meta == nil {
+			msg.Meta = make(map[string]interface{})
+		}
+		msg.Meta[MetaSchemaVersion] = strconv.Itoa(version)
+	}
+	return nil
+}
+
+// schemaVersion parses a pinned schema version; empty means unpinned.
+func schemaVersion(stamp string) (int, error) {
+	if stamp == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(stamp)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("schema version %q is not a positive number", stamp)
+	}
+	return version, nil
+}
+
+// schemaViolation builds the error for a rejected payload and counts it.
+func (s *Service) schemaViolation(topic, destination, messageType string, version int, err error) *BrokerError {
+	s.metrics.schemaRejected.Inc(destination, messageType)
+
+	where := destination
+	if topic != "" {
+		where = "topic " + topic
+	}
+	if errors.Is(err, schema.ErrUnknownVersion) {
+		return &BrokerError{
+			Code:    ErrCodeSchemaViolation,
+			Message: fmt.Sprintf("Payload of %q for %s: %v", messageType, where, err),
+		}
+	}
+	return &BrokerError{
+		Code:    ErrCodeSchemaViolation,
+		Message: fmt.Sprintf("Payload of %q for %s does not match schema version %d: %v", messageType, where, version, err),
+	}
+}
+
+// handleGetSchemas returns the registered schema versions, so consumers can
+// learn the payload shapes they will receive. With topic or message_type
+// parameters only the versions applying to them are returned.
+//
+// Called by: handleRequest() when method is "schemas"
+func (s *Service) handleGetSchemas(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	var params struct {
+		Topic       string `json:"topic,omitempty"`        // Topic the payloads are published on
+		MessageType string `json:"message_type,omitempty"` // Message type of the payloads
+	}
+	if len(req.Params) > 0 {
+		if err := conn.unmarshal(req.Params, &params); err != nil {
+			return &BrokerResponse{
+				ID:    req.ID,
+				Error: &BrokerError{Code: -32602, Message: "Invalid params"},
+			}
+		}
+	}
+
+	definitions := s.schemas.Definitions()
+	if params.Topic != "" || params.MessageType != "" {
+		definitions = s.schemas.Lookup(params.Topic, params.MessageType)
+	}
+	if definitions == nil {
+		definitions = []schema.Definition{}
+	}
+	return &BrokerResponse{ID: req.ID, Result: definitions}
+}
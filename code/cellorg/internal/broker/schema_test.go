@@ -0,0 +1,85 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+	"github.com/tenzoki/agen/cellorg/internal/schema"
+)
+
+// Test that publications are validated against the registered schemas and
+// stamped with the matching version
+func TestSchemaValidation(t *testing.T) {
+	registry := schema.NewRegistry()
+	registry.Register(schema.Subject{Topic: "extracted-text"}, 1, []byte(`{"type": "object", "required": ["text"]}`))
+	registry.Register(schema.Subject{Topic: "extracted-text"}, 2, []byte(`{"type": "object", "required": ["text", "lang"]}`))
+	registry.Register(schema.Subject{MessageType: "entities"}, 1, []byte(`{"type": "array"}`))
+
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	s.SetSchemas(registry)
+	producer := &Connection{ID: "conn_producer", AgentID: "text-extractor"}
+	consumer := &Connection{ID: "conn_consumer", AgentID: "ner-agent", outbox: newPriorityQueue(outboxCapacity, 0)}
+	if resp := s.handleRequest(consumer, newRequest(t, "subscribe", map[string]string{"topic": "extracted-text"})); resp.Error != nil {
+		t.Fatalf("subscribe failed: %s", resp.Error.Message)
+	}
+
+	publish := func(payload interface{}, version string) *BrokerResponse {
+		env, _ := envelope.NewEnvelope("text-extractor", "pub:extracted-text", "text", payload)
+		if version != "" {
+			env.SetHeader(HeaderSchemaVersion, version)
+		}
+		return s.handleRequest(producer, newRequest(t, "publish_envelope", map[string]interface{}{"topic": "extracted-text", "envelope": env}))
+	}
+
+	// Invalid payloads are rejected before delivery
+	resp := publish(map[string]string{"lang": "de"}, "")
+	if resp.Error == nil || resp.Error.Code != ErrCodeSchemaViolation {
+		t.Fatalf("Expected schema violation, got %+v", resp)
+	}
+	if resp := publish(map[string]string{"text": "Hallo"}, "2"); resp.Error == nil || resp.Error.Code != ErrCodeSchemaViolation {
+		t.Errorf("Expected payload pinned to version 2 to be rejected, got %+v", resp)
+	}
+	if resp := publish(map[string]string{"text": "Hallo"}, "latest"); resp.Error == nil || resp.Error.Code != -32602 {
+		t.Errorf("Expected invalid version to be rejected, got %+v", resp)
+	}
+	if consumer.outbox.Len() != 0 {
+		t.Fatalf("Expected no deliveries, got %d", consumer.outbox.Len())
+	}
+
+	// Valid payloads carry the version they matched
+	for payload, want := range map[string]string{`{"text": "Hallo", "lang": "de"}`: "2", `{"text": "Hello"}`: "1"} {
+		env, _ := envelope.NewEnvelope("text-extractor", "pub:extracted-text", "text", nil)
+		env.Payload = []byte(payload)
+		if resp := s.handleRequest(producer, newRequest(t, "publish_envelope", map[string]interface{}{"topic": "extracted-text", "envelope": env})); resp.Error != nil {
+			t.Fatalf("publish_envelope failed: %s", resp.Error.Message)
+		}
+		if item := consumer.outbox.Pop(); item == nil || item.Envelope.Headers[HeaderSchemaVersion] != want {
+			t.Errorf("Expected schema version %s, got %+v", want, item)
+		}
+	}
+
+	// Simple messages and pipes are checked by message type
+	resp = s.handleRequest(producer, newRequest(t, "send_pipe", map[string]interface{}{
+		"pipe":    "entities",
+		"message": Message{ID: "msg-1", Type: "entities", Payload: map[string]interface{}{"name": "Berlin"}},
+	}))
+	if resp.Error == nil || resp.Error.Code != ErrCodeSchemaViolation {
+		t.Errorf("Expected schema violation on pipe, got %+v", resp)
+	}
+	resp = s.handleRequest(producer, newRequest(t, "send_pipe", map[string]interface{}{
+		"pipe":    "entities",
+		"message": Message{ID: "msg-2", Type: "entities", Payload: []interface{}{"Berlin"}},
+	}))
+	if resp.Error != nil {
+		t.Fatalf("send_pipe failed: %s", resp.Error.Message)
+	}
+	if item := s.getOrCreatePipe("entities").queue.Pop(); item == nil || item.Message.Meta[MetaSchemaVersion] != "1" {
+		t.Errorf("Expected schema version in meta, got %+v", item)
+	}
+
+	// Consumers can look up the versions of a topic
+	resp = s.handleRequest(consumer, newRequest(t, "schemas", map[string]string{"topic": "extracted-text"}))
+	if definitions, ok := resp.Result.([]schema.Definition); !ok || len(definitions) != 2 || definitions[1].Version != 2 {
+		t.Errorf("Expected 2 schema versions, got %+v", resp.Result)
+	}
+}
@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/tenzoki/agen/cellorg/internal/auth"
+)
+
+// Error codes for rejected agents, from the JSON-RPC server error range.
+const (
+	ErrCodeUnauthorized = -32001 // Missing or invalid credentials, or a request before "connect"
+	ErrCodeForbidden    = -32003 // Topic not allowed by the agent's ACL
+)
+
+// SetGuard applies the security settings from cellorg.yaml: a TLS listener,
+// the credential check in "connect" and the topic ACLs. Must be called
+// before Start. A nil guard leaves the broker open.
+//
+// Called by: cellorg startup after loading the configuration
+func (s *Service) SetGuard(guard *auth.Guard) {
+	s.guard = guard
+}
+
+// authorize rejects requests from connections that have not authenticated
+// yet when the broker requires credentials. Returns nil to proceed.
+func (s *Service) authorize(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	if req.Method == "connect" || conn.authenticated || !s.guard.AuthRequired() {
+		return nil
+	}
+	return &BrokerResponse{
+		ID:    req.ID,
+		Error: &BrokerError{Code: ErrCodeUnauthorized, Message: "Not authenticated: connect with valid credentials first"},
+	}
+}
+
+// authenticate checks the credentials presented in "connect" and marks the
+// connection as authenticated. Failures are always logged.
+func (s *Service) authenticate(conn *Connection, agentID, token string) *BrokerError {
+	if err := s.guard.Authenticate(agentID, token); err != nil {
+		log.Printf("Broker: rejected connect on %s from %s: %v", conn.ID, conn.remoteAddr(), err)
+		conn.authenticated = false
+		return &BrokerError{Code: ErrCodeUnauthorized, Message: "Invalid credentials"}
+	}
+	conn.authenticated = true
+	return nil
+}
+
+// checkPublish returns a forbidden error if the connection's agent may not publish to topic.
+func (s *Service) checkPublish(conn *Connection, topic string) *BrokerError {
+	if s.guard.CanPublish(conn.AgentID, topic) {
+		return nil
+	}
+	if s.debug {
+		log.Printf("Broker: %s may not publish to %s", conn.AgentID, topic)
+	}
+	return &BrokerError{Code: ErrCodeForbidden, Message: fmt.Sprintf("Not allowed to publish to topic: %s", topic)}
+}
+
+// checkSubscribe returns a forbidden error if the connection's agent may not subscribe to topic.
+func (s *Service) checkSubscribe(conn *Connection, topic string) *BrokerError {
+	if s.guard.CanSubscribe(conn.AgentID, topic) {
+		return nil
+	}
+	if s.debug {
+		log.Printf("Broker: %s may not subscribe to %s", conn.AgentID, topic)
+	}
+	return &BrokerError{Code: ErrCodeForbidden, Message: fmt.Sprintf("Not allowed to subscribe to topic: %s", topic)}
+}
+
+// checkSendPipe returns a forbidden error if the connection's agent may not
+// send to pipe. Pipes appear in the publish ACL as "pipe:<name>".
+func (s *Service) checkSendPipe(conn *Connection, pipe string) *BrokerError {
+	return s.checkPublish(conn, fmt.Sprintf("pipe:%s", pipe))
+}
+
+// checkReceivePipe returns a forbidden error if the connection's agent may not
+// receive from pipe. Pipes appear in the subscribe ACL as "pipe:<name>".
+func (s *Service) checkReceivePipe(conn *Connection, pipe string) *BrokerError {
+	return s.checkSubscribe(conn, fmt.Sprintf("pipe:%s", pipe))
+}
+
+// checkDestination applies the publish ACL to a "pub:<topic>", "sub:<topic>"
+// or "pipe:<name>" destination.
+func (s *Service) checkDestination(conn *Connection, destination string) *BrokerError {
+	kind, name, _ := strings.Cut(destination, ":")
+	switch kind {
+	case "pub", "sub":
+		return s.checkPublish(conn, name)
+	case "pipe":
+		return s.checkSendPipe(conn, name)
+	}
+	return nil
+}
+
+// remoteAddr returns the peer address of the connection, if known.
+func (c *Connection) remoteAddr() string {
+	if c.Conn == nil {
+		return "unknown"
+	}
+	return c.Conn.RemoteAddr().String()
+}
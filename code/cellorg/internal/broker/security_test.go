@@ -0,0 +1,116 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/tenzoki/agen/cellorg/internal/auth"
+	"github.com/tenzoki/agen/cellorg/internal/config"
+)
+
+// newSecuredService creates a broker requiring a token and restricting ner-agent's topics
+func newSecuredService(t *testing.T) *Service {
+	t.Helper()
+
+	guard, err := auth.NewGuard(config.SecurityConfig{
+		Token: "shared",
+		ACLs: map[string]config.TopicACL{
+			"ner-agent": {Publish: []string{"ner-results", "pipe:ner-output"}, Subscribe: []string{"ner-requests", "pipe:ner-input"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewGuard failed: %v", err)
+	}
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	s.SetGuard(guard)
+	return s
+}
+
+// Test that requests are rejected until the agent connects with valid credentials
+func TestConnectRequiresCredentials(t *testing.T) {
+	s := newSecuredService(t)
+	conn := &Connection{ID: "conn_ner", outbox: newPriorityQueue(outboxCapacity, 0)}
+
+	resp := s.handleRequest(conn, newRequest(t, "subscribe", map[string]string{"topic": "ner-requests"}))
+	if resp.Error == nil || resp.Error.Code != ErrCodeUnauthorized {
+		t.Fatalf("Expected unauthorized before connect, got %+v", resp)
+	}
+
+	resp = s.handleRequest(conn, newRequest(t, "connect", map[string]string{"agent_id": "ner-agent", "token": "wrong"}))
+	if resp.Error == nil || resp.Error.Code != ErrCodeUnauthorized {
+		t.Fatalf("Expected wrong token to be rejected, got %+v", resp)
+	}
+	if conn.AgentID != "" {
+		t.Errorf("Expected agent ID to stay unset, got %s", conn.AgentID)
+	}
+
+	resp = s.handleRequest(conn, newRequest(t, "connect", map[string]string{"agent_id": "ner-agent", "token": "shared"}))
+	if resp.Error != nil {
+		t.Fatalf("connect failed: %s", resp.Error.Message)
+	}
+	if resp := s.handleRequest(conn, newRequest(t, "subscribe", map[string]string{"topic": "ner-requests"})); resp.Error != nil {
+		t.Errorf("Expected subscribe after connect to succeed, got %s", resp.Error.Message)
+	}
+}
+
+// Test that topic ACLs restrict publishing and subscribing
+func TestTopicACLsEnforced(t *testing.T) {
+	s := newSecuredService(t)
+	conn := &Connection{ID: "conn_ner", outbox: newPriorityQueue(outboxCapacity, 0)}
+	if resp := s.handleRequest(conn, newRequest(t, "connect", map[string]string{"agent_id": "ner-agent", "token": "shared"})); resp.Error != nil {
+		t.Fatalf("connect failed: %s", resp.Error.Message)
+	}
+
+	if resp := publishTestMessage(t, s, conn, "ner-results"); resp.Error != nil {
+		t.Errorf("Expected publish to ner-results to succeed, got %s", resp.Error.Message)
+	}
+	if resp := publishTestMessage(t, s, conn, "anonymized-text"); resp.Error == nil || resp.Error.Code != ErrCodeForbidden {
+		t.Errorf("Expected publish outside the ACL to be forbidden, got %+v", resp)
+	}
+
+	resp := s.handleRequest(conn, newRequest(t, "subscribe", map[string]string{"topic": "#"}))
+	if resp.Error == nil || resp.Error.Code != ErrCodeForbidden {
+		t.Errorf("Expected pattern wider than the ACL to be forbidden, got %+v", resp)
+	}
+	if len(s.wildcards) != 0 {
+		t.Errorf("Expected no wildcard subscription to be created, got %d", len(s.wildcards))
+	}
+}
+
+// Test that pipe ACLs restrict sending to and receiving from pipes
+func TestPipeACLsEnforced(t *testing.T) {
+	s := newSecuredService(t)
+	conn := &Connection{ID: "conn_ner", outbox: newPriorityQueue(outboxCapacity, 0)}
+	if resp := s.handleRequest(conn, newRequest(t, "connect", map[string]string{"agent_id": "ner-agent", "token": "shared"})); resp.Error != nil {
+		t.Fatalf("connect failed: %s", resp.Error.Message)
+	}
+
+	send := func(pipe string) *BrokerResponse {
+		return s.handleRequest(conn, newRequest(t, "send_pipe", map[string]interface{}{
+			"pipe":    pipe,
+			"message": Message{ID: "msg-" + pipe, Type: "event"},
+		}))
+	}
+	receive := func(pipe string) *BrokerResponse {
+		return s.handleRequest(conn, newRequest(t, "receive_pipe", map[string]interface{}{"pipe": pipe, "timeout_ms": 10}))
+	}
+
+	if resp := send("ner-output"); resp.Error != nil {
+		t.Errorf("Expected send to ner-output to succeed, got %s", resp.Error.Message)
+	}
+	if resp := send("ner-input"); resp.Error == nil || resp.Error.Code != ErrCodeForbidden {
+		t.Errorf("Expected send outside the publish ACL to be forbidden, got %+v", resp)
+	}
+	if resp := receive("ner-output"); resp.Error == nil || resp.Error.Code != ErrCodeForbidden {
+		t.Errorf("Expected receive outside the subscribe ACL to be forbidden, got %+v", resp)
+	}
+	if resp := s.handleRequest(conn, newRequest(t, "connect_pipe", map[string]string{"pipe": "ner-output", "role": "consumer"})); resp.Error == nil || resp.Error.Code != ErrCodeForbidden {
+		t.Errorf("Expected consumer registration outside the subscribe ACL to be forbidden, got %+v", resp)
+	}
+
+	s.pipesMux.RLock()
+	_, created := s.pipes["ner-input"]
+	s.pipesMux.RUnlock()
+	if created {
+		t.Error("Expected no pipe to be created by a forbidden send")
+	}
+}
@@ -9,21 +9,43 @@
 // - JSON-RPC based protocol for client-broker communication
 // - Thread-safe concurrent connection handling
 // - Message history and buffering capabilities
+// - Write-ahead log for persistent envelopes (survives broker restart)
+// - TTL enforcement with expired envelopes routed to an expiry topic
+// - Priority-ordered delivery for pipes and subscribers with starvation protection
+// - Dead-letter queues for messages agents failed to process, with re-injection
+// - Hierarchical wildcard subscriptions ("project-42.*", "extracted-text.#")
+// - Consumer groups sharing a topic's stream round-robin or least-loaded
+// - Retained topic logs with offsets, replayable from an offset or timestamp
+// - Prometheus-format metrics endpoint for throughput, queue depths and drops
+// - Delayed and scheduled envelope delivery through a persisted timer wheel
+// - Pipe consumers balanced round-robin, least-in-flight or sticky by key
+// - Content-filtered subscriptions on message type, source, headers and properties
+// - Deduplication of repeated envelopes by ID or idempotency key within a window
+// - Token-bucket rate limits and message size caps per agent and per topic
 //
 // The broker serves as the central communication hub that connects all agents
 // in the GOX orchestration system, enabling distributed processing workflows.
 package broker
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/tenzoki/agen/cellorg/internal/auth"
+	"github.com/tenzoki/agen/cellorg/internal/codec"
+	"github.com/tenzoki/agen/cellorg/internal/config"
 	"github.com/tenzoki/agen/cellorg/internal/envelope"
+	"github.com/tenzoki/agen/cellorg/internal/metrics"
+	"github.com/tenzoki/agen/cellorg/internal/schema"
+	"github.com/tenzoki/agen/cellorg/internal/wildcard"
 )
 
 // Service represents the central broker service that handles all agent communication.
@@ -37,14 +59,15 @@ type Service struct {
 	// Network configuration
 	port     string       // TCP port to listen on (e.g., ":9001")
 	protocol string       // Network protocol ("tcp")
-	codec    string       // Message encoding format ("json")
+	codec    string       // Codec advertised to agents ("json" or "msgpack"); negotiated per connection
 	debug    bool         // Enable debug logging
 	listener net.Listener // TCP listener for incoming connections
 
 	// Publish/Subscribe topics for event distribution
 	// Topics allow multiple agents to receive the same message
 	topics    map[string]*Topic // Map of topic name to Topic instance
-	topicsMux sync.RWMutex      // Protects topics map from concurrent access
+	wildcards map[string]*Topic // Wildcard subscriptions ("a.*", "a.#"), also kept in topics
+	topicsMux sync.RWMutex      // Protects topics and wildcards maps from concurrent access
 
 	// Point-to-point pipes for direct agent communication
 	// Pipes provide reliable message delivery between specific agents
@@ -55,35 +78,114 @@ type Service struct {
 	// Tracks all currently connected agents for routing and cleanup
 	connections map[string]*Connection // Map of connection ID to Connection
 	connMux     sync.RWMutex           // Protects connections map from concurrent access
+	stopping    bool                   // Set on shutdown; connections arriving later are refused
+
+	// Write-ahead log for envelopes marked Persistent
+	// Nil when persistence is disabled (no data directory configured)
+	dataDir string                  // Directory for the message log
+	wal     *MessageLog             // Persistent envelope log
+	backlog map[string][]*queueItem // Pipe -> recovered envelopes that did not fit, queued by refillPipes
+	workers sync.WaitGroup          // Connection handlers and background loops; the log closes once they are done
+
+	// Priority queueing
+	priorityAging time.Duration // Waiting time that raises a queued item by one priority level
+
+	// TTL enforcement
+	expiredPrefix string // Prefix of the topic receiving expired envelopes ("expired:" -> "expired:<topic>")
+
+	// Acknowledgements for pipe deliveries received in manual-ack mode
+	deliveries        *deliveryTable // In-flight deliveries awaiting ack/nack
+	visibilityTimeout time.Duration  // Default time before an unacked delivery is redelivered
+	maxDeliveries     int            // Deliveries of a pipe item before it is dead-lettered (0 = unlimited)
+
+	// Dead-letter queues for messages agents gave up on
+	deadLetters *deadLetterStore
+
+	// Envelopes published or sent with deliver_at/delay_ms, waiting until due
+	scheduler *timerWheel
+
+	// Flow control
+	pipeCapacity   int     // Maximum queued items per pipe
+	outboxCapacity int     // Maximum queued deliveries per subscriber connection
+	highWatermark  float64 // Queue fill ratio from which publishers get a slow-down signal
+
+	// TLS, agent credentials and topic ACLs (nil = open broker)
+	guard *auth.Guard
+
+	// Payload schemas from the cell configuration (nil = no validation)
+	schemas *schema.Registry
+
+	// Topic history kept for replay
+	retention retentionPolicy
+
+	// Recently accepted envelopes, to drop repeats from retrying producers
+	dedup *dedupIndex
+
+	// Publish rate limits per agent and topic (no limits = everything passes)
+	limits *rateLimiter
+
+	// Traffic counters and the HTTP endpoint serving them (empty port = disabled)
+	metrics     *brokerMetrics
+	metricsPort string
 }
 
 // Topic represents a publish/subscribe channel where multiple agents can
 // subscribe to receive all messages published to the topic. Topics support
 // both simple Message objects and full Envelope protocol messages.
 //
-// Topics maintain message history for debugging and replay capabilities,
-// with automatic cleanup when the buffer exceeds capacity.
+// Topics are retained logs: every publication gets the next offset and is
+// kept until the retention limits (count, age, bytes) drop it, so subscribers
+// can replay history from an offset or a point in time.
 type Topic struct {
-	Name        string               // Unique topic identifier
-	Subscribers []*Connection        // List of agents subscribed to this topic
-	Messages    []*Message           // Recent message history (max 100)
-	Envelopes   []*envelope.Envelope // Recent envelope history (max 100)
-	mux         sync.RWMutex         // Protects topic data from concurrent access
+	Name        string                    // Unique topic identifier
+	Subscribers []*Connection             // List of agents subscribed to this topic (each gets every message)
+	Groups      map[string]*ConsumerGroup // Consumer groups sharing this topic's stream, by group name
+	Pending     []*loggedEnvelope         // Persistent envelopes not yet delivered to any subscriber
+	history     *topicLog                 // Retained messages and envelopes with their offsets
+	filters     map[string]*Filter        // Content filters of ungrouped subscribers, by connection ID
+	mux         sync.RWMutex              // Protects topic data from concurrent access
 }
 
 // Pipe represents a point-to-point communication channel between two agents.
 // Unlike topics, pipes provide direct message delivery with buffering and
 // support both simple Message objects and full Envelope protocol messages.
 //
-// Pipes use Go channels for thread-safe message queuing and can buffer
-// up to 100 messages before blocking or rejecting new messages.
+// Pipes use a priority queue shared by messages and envelopes and can buffer
+// up to pipe_capacity items (default 100) before rejecting new ones, or
+// blocking senders that asked to wait. Higher priorities are received
+// first; items that wait long enough are aged up so they are never starved.
 type Pipe struct {
-	Name      string                  // Unique pipe identifier
-	Producer  *Connection             // Agent that sends messages to this pipe
-	Consumer  *Connection             // Agent that receives messages from this pipe
-	Messages  chan *Message           // Buffered channel for Message objects (capacity 100)
-	Envelopes chan *envelope.Envelope // Buffered channel for Envelope objects (capacity 100)
-	mux       sync.RWMutex            // Protects pipe metadata from concurrent access
+	Name      string         // Unique pipe identifier
+	Producer  *Connection    // Agent that sends messages to this pipe
+	Consumer  *Connection    // Agent that receives messages from this pipe
+	queue     *priorityQueue // Queued messages and envelopes (capacity pipe_capacity)
+	consumers *pipeConsumers // Receiving connections and their balancing policy
+	mux       sync.RWMutex   // Protects pipe metadata from concurrent access
+}
+
+// loggedEnvelope pairs a persistent envelope with its write-ahead log position.
+type loggedEnvelope struct {
+	Seq      uint64
+	Envelope *envelope.Envelope
+	logRef   *logRef // Shared with other copies still queued for subscribers (nil = sole copy)
+}
+
+// logRef counts the copies of a persistent topic envelope that still need
+// its write-ahead log record: those queued in outboxes or pending on the
+// topic, plus the publisher while it distributes them. The record is
+// removed when the count drops to zero, so a restart redelivers the
+// envelope to subscribers that did not receive their copy yet.
+type logRef struct {
+	copies atomic.Int64
+}
+
+// unlogCopy removes a persistent envelope from the write-ahead log once its
+// last copy is done with it.
+func (s *Service) unlogCopy(ref *logRef, seq uint64) {
+	if ref != nil && ref.copies.Add(-1) > 0 {
+		return
+	}
+	s.unlogEnvelope(seq)
 }
 
 // Connection represents an active agent connection to the broker.
@@ -91,14 +193,30 @@ type Pipe struct {
 // message serialization and tracks agent metadata for routing.
 //
 // Connections are used for both control messages (JSON-RPC requests)
-// and data delivery (topic publications, pipe messages).
+// and data delivery (topic publications, pipe messages). Every connection
+// starts with JSON; the agent may switch it to a binary codec in the
+// connect handshake. Topic deliveries
+// are queued in a per-connection outbox and written in priority order by
+// a dedicated writer goroutine, paced by the agent's prefetch window.
 type Connection struct {
-	ID       string        // Unique connection identifier (generated)
-	Conn     net.Conn      // Underlying TCP connection
-	Encoder  *json.Encoder // JSON encoder for sending messages to agent
-	Decoder  *json.Decoder // JSON decoder for receiving messages from agent
-	AgentID  string        // Agent identifier provided during connection handshake
-	LastSeen time.Time     // Timestamp of last received message (for health monitoring)
+	ID       string         // Unique connection identifier (generated)
+	Conn     net.Conn       // Underlying TCP connection
+	Encoder  codec.Encoder  // Encoder for sending messages to agent (JSON until negotiated otherwise)
+	Decoder  codec.Decoder  // Decoder for receiving messages from agent
+	AgentID  string         // Agent identifier provided during connection handshake
+	LastSeen time.Time      // Timestamp of last received message (for health monitoring)
+	outbox   *priorityQueue // Pending topic deliveries for this subscriber
+	credits  *creditWindow  // Prefetch window limiting unconfirmed topic deliveries
+	writeMux sync.Mutex     // Serializes writes from the request loop and the outbox writer
+
+	wire      codec.Codec  // Codec of the connection (nil = JSON)
+	nextCodec codec.Codec  // Codec agreed in the handshake, used after the response is sent
+	receiving atomic.Int32 // receive_pipe requests served concurrently; the codec is not switched under them
+
+	authenticated bool            // Passed the credential check in "connect"
+	requests      pendingRequests // Requests awaiting a reply in the connection's inbox
+
+	done chan struct{} // Closed when the connection handler exits
 }
 
 // Message represents a simple message object used for basic agent communication.
@@ -108,12 +226,13 @@ type Connection struct {
 // The Target field is automatically set by the broker based on the routing
 // destination (topic or pipe), and Timestamp is set when the message is processed.
 type Message struct {
-	ID        string                 `json:"id"`        // Unique message identifier
-	Type      string                 `json:"type"`      // Message type for handling dispatch
-	Target    string                 `json:"target"`    // Routing target (set by broker)
-	Payload   interface{}            `json:"payload"`   // Message data (any JSON-serializable type)
-	Meta      map[string]interface{} `json:"meta"`      // Metadata for message processing
-	Timestamp time.Time              `json:"timestamp"` // When message was processed by broker
+	ID        string                 `json:"id"`               // Unique message identifier
+	Type      string                 `json:"type"`             // Message type for handling dispatch
+	Target    string                 `json:"target"`           // Routing target (set by broker)
+	Payload   interface{}            `json:"payload"`          // Message data (any JSON-serializable type)
+	Meta      map[string]interface{} `json:"meta"`             // Metadata for message processing
+	Timestamp time.Time              `json:"timestamp"`        // When message was processed by broker
+	Offset    uint64                 `json:"offset,omitempty"` // Position in the topic log (topic deliveries only)
 }
 
 // BrokerRequest represents a JSON-RPC request from an agent to the broker.
@@ -121,11 +240,14 @@ type Message struct {
 // for method invocation and parameter passing.
 //
 // Supported methods: connect, publish, publish_envelope, subscribe,
-// send_pipe, send_pipe_envelope, receive_pipe
+// send_pipe, send_pipe_envelope, receive_pipe, ack, nack, stats, dead_letter,
+// list_dead_letters, get_dead_letter, reinject_dead_letter, delete_dead_letter,
+// prefetch, credit, schemas, cancel_scheduled, connect_pipe,
+// disconnect_pipe
 type BrokerRequest struct {
-	ID     string          `json:"id"`     // Request identifier for response correlation
-	Method string          `json:"method"` // Broker method to invoke
-	Params json.RawMessage `json:"params"` // Method parameters (method-specific structure)
+	ID     string    `json:"id"`     // Request identifier for response correlation
+	Method string    `json:"method"` // Broker method to invoke
+	Params codec.Raw `json:"params"` // Method parameters, encoded with the connection's codec
 }
 
 // BrokerResponse represents a JSON-RPC response from the broker to an agent.
@@ -133,10 +255,13 @@ type BrokerRequest struct {
 // JSON-RPC 2.0 specification for standardized error handling.
 //
 // The ID field matches the corresponding request for correlation.
+// Publish and send responses carry a SlowDown signal when the target queue
+// is filled beyond the high watermark.
 type BrokerResponse struct {
-	ID     string       `json:"id"`               // Request ID for correlation
-	Result interface{}  `json:"result,omitempty"` // Success result (method-specific type)
-	Error  *BrokerError `json:"error,omitempty"`  // Error information if request failed
+	ID       string       `json:"id"`                  // Request ID for correlation
+	Result   interface{}  `json:"result,omitempty"`    // Success result (method-specific type)
+	Error    *BrokerError `json:"error,omitempty"`     // Error information if request failed
+	SlowDown *SlowDown    `json:"slow_down,omitempty"` // Backpressure signal for publishers
 }
 
 // BrokerError represents an error response following JSON-RPC error conventions.
@@ -147,6 +272,13 @@ type BrokerError struct {
 	Message string `json:"message"` // Human-readable error description
 }
 
+// ConnectResult is the connect response when the agent asked for a codec.
+// The broker falls back to JSON if it does not support the requested codec.
+type ConnectResult struct {
+	Status string `json:"status"` // Always "connected"
+	Codec  string `json:"codec"`  // Codec used from the next message on
+}
+
 // Info contains broker service information for agent discovery and connection.
 // This structure is used to advertise broker capabilities and connection
 // details to agents that need to establish communication.
@@ -154,7 +286,31 @@ type Info struct {
 	Protocol string // Network protocol ("tcp")
 	Address  string // Broker IP address or hostname
 	Port     string // TCP port number
-	Codec    string // Message encoding format ("json")
+	Codec    string // Codec agents should request ("json" or "msgpack")
+}
+
+// Stats is a snapshot of broker queue depths returned by the "stats" method.
+// Depths are broken down by priority so backlogs of bulk work and waiting
+// urgent messages can be told apart.
+type Stats struct {
+	Pipes       map[string]QueueStats            `json:"pipes"`        // Pipe name -> queue depth
+	Subscribers map[string]SubscriberStats       `json:"subscribers"`  // Connection ID -> outbox depth
+	DeadLetters map[string]int                   `json:"dead_letters"` // Dead-letter queue -> record count
+	Groups      map[string]map[string]GroupStats `json:"groups"`       // Topic -> consumer group -> members
+	Topics      map[string]TopicStats            `json:"topics"`       // Topic -> retained offsets
+	Scheduled   int                              `json:"scheduled"`    // Envelopes waiting for their delivery time
+
+	PipeConsumers map[string]PipeConsumerStats `json:"pipe_consumers"` // Pipe name -> consumers and policy
+	Filters       map[string]map[string]string `json:"filters"`        // Topic -> connection ID -> filter of ungrouped subscriptions
+	Dedup         DedupStats                   `json:"dedup"`          // Remembered envelopes and repeats dropped
+	RateLimited   map[string]uint64            `json:"rate_limited"`   // Limit ("agent:<id>", "topic:<name>" or "anonymous") -> publications rejected
+}
+
+// SubscriberStats reports the pending topic deliveries of one connection.
+type SubscriberStats struct {
+	AgentID string      `json:"agent_id"` // Agent owning the connection
+	Outbox  QueueStats  `json:"outbox"`   // Deliveries not yet written to the agent
+	Flow    CreditStats `json:"flow"`     // Prefetch window and remaining credits
 }
 
 // BrokerConfig holds configuration parameters for initializing the broker service.
@@ -163,36 +319,114 @@ type Info struct {
 type BrokerConfig struct {
 	Port     string // TCP port to listen on (e.g., ":9001")
 	Protocol string // Network protocol ("tcp")
-	Codec    string // Message encoding ("json")
+	Codec    string // Codec advertised to agents ("json" or "msgpack")
 	Debug    bool   // Enable debug logging
+	DataDir  string // Directory for the persistent envelope log (empty disables persistence)
+
+	PriorityAging time.Duration // Wait that raises a queued item one priority level (0 = default 2s)
+	ExpiredPrefix string        // Prefix of the topic receiving expired envelopes (empty = "expired:")
+
+	VisibilityTimeout time.Duration // Unacked pipe deliveries are redelivered after this (0 = default 30s)
+	MaxDeliveries     int           // Deliveries of a pipe item before it is dead-lettered (0 = default 10, negative = unlimited)
+
+	PipeCapacity   int     // Maximum queued items per pipe (0 = default 100)
+	OutboxCapacity int     // Maximum queued deliveries per subscriber (0 = default 1000)
+	HighWatermark  float64 // Fill ratio from which publishers are told to slow down (0 = default 0.8)
+
+	RetentionMessages int           // Entries kept per topic log (0 = default 100, unlimited if another limit is set)
+	RetentionAge      time.Duration // Topic log entries older than this are dropped (0 = kept)
+	RetentionBytes    int64         // Payload bytes kept per topic log (0 = unlimited)
+
+	DedupWindow   time.Duration // Accepted envelopes are remembered this long (0 = default 10m, negative disables)
+	DedupCapacity int           // Envelopes remembered at most (0 = default 10000)
+
+	RateLimits config.RateLimitsConfig // Publish limits per agent and topic (empty = unlimited)
+
+	MetricsPort string // HTTP address of the Prometheus metrics endpoint (empty disables it)
 }
 
 // NewService creates a new broker service instance with the provided configuration.
-// The config parameter can be either a BrokerConfig struct or a compatible
-// struct with Port, Protocol, Codec, and Debug fields.
+// The config parameter can be a BrokerConfig, a config.BrokerConfig loaded from
+// cellorg.yaml, or a compatible struct with Port, Protocol, Codec, and Debug fields.
 //
 // Default values are used if configuration is not provided or invalid:
 // - Port: ":9001"
 // - Protocol: "tcp"
 // - Codec: "json"
 // - Debug: false
+// - PriorityAging: 2s
+// - ExpiredPrefix: "expired:"
+// - VisibilityTimeout: 30s
+// - MaxDeliveries: 10
+// - PipeCapacity: 100
+// - OutboxCapacity: 1000
+// - HighWatermark: 0.8
+// - Retention: last 100 entries per topic
+// - Deduplication: envelopes remembered for 10 minutes, at most 10000
 //
 // Returns a fully initialized Service ready to accept agent connections.
-func NewService(config interface{}) *Service {
+func NewService(cfg interface{}) *Service {
 	// Set default configuration values
 	port := ":9001"
 	protocol := "tcp"
 	codec := "json"
 	debug := false
+	dataDir := ""
+	priorityAging := defaultPriorityAging
+	expiredPrefix := DefaultExpiredPrefix
+	visibilityTimeout := defaultVisibilityTimeout
+	maxDeliveries := defaultMaxDeliveries
+	pipeCap := pipeCapacity
+	outboxCap := outboxCapacity
+	highWatermark := defaultHighWatermark
+	retention := newRetentionPolicy(0, 0, 0)
+	dedupWindow := defaultDedupWindow
+	dedupCap := defaultDedupCapacity
+	var rateLimits config.RateLimitsConfig
+	metricsPort := ""
 
 	// Extract configuration from provided interface
-	// Support both BrokerConfig and anonymous struct types
-	if bc, ok := config.(BrokerConfig); ok {
+	// Support BrokerConfig, config.BrokerConfig and anonymous struct types
+	if cc, ok := cfg.(config.BrokerConfig); ok {
+		cfg = brokerConfigFrom(cc)
+	}
+	if bc, ok := cfg.(BrokerConfig); ok {
 		port = bc.Port
 		protocol = bc.Protocol
 		codec = bc.Codec
 		debug = bc.Debug
-	} else if bc, ok := config.(struct {
+		dataDir = bc.DataDir
+		if bc.PriorityAging > 0 {
+			priorityAging = bc.PriorityAging
+		}
+		if bc.ExpiredPrefix != "" {
+			expiredPrefix = bc.ExpiredPrefix
+		}
+		if bc.VisibilityTimeout > 0 {
+			visibilityTimeout = bc.VisibilityTimeout
+		}
+		if bc.MaxDeliveries != 0 {
+			maxDeliveries = max(bc.MaxDeliveries, 0)
+		}
+		if bc.PipeCapacity > 0 {
+			pipeCap = bc.PipeCapacity
+		}
+		if bc.OutboxCapacity > 0 {
+			outboxCap = bc.OutboxCapacity
+		}
+		if bc.HighWatermark > 0 && bc.HighWatermark <= 1 {
+			highWatermark = bc.HighWatermark
+		}
+		retention = newRetentionPolicy(bc.RetentionMessages, bc.RetentionAge, bc.RetentionBytes)
+		if bc.DedupWindow != 0 {
+			dedupWindow = max(bc.DedupWindow, 0)
+		}
+		if bc.DedupCapacity > 0 {
+			dedupCap = bc.DedupCapacity
+		}
+		rateLimits = bc.RateLimits
+		metricsPort = bc.MetricsPort
+	} else if bc, ok := cfg.(struct {
 		Port, Protocol, Codec string
 		Debug                 bool
 	}); ok {
@@ -203,42 +437,133 @@ func NewService(config interface{}) *Service {
 	}
 
 	// Initialize service with configuration and empty collections
-	return &Service{
+	s := &Service{
 		port:        port,
 		protocol:    protocol,
 		codec:       codec,
 		debug:       debug,
+		dataDir:     dataDir,
 		topics:      make(map[string]*Topic),      // Initialize empty topics map
+		wildcards:   make(map[string]*Topic),      // Initialize empty wildcard subscriptions
 		pipes:       make(map[string]*Pipe),       // Initialize empty pipes map
 		connections: make(map[string]*Connection), // Initialize empty connections map
+
+		priorityAging: priorityAging,
+		expiredPrefix: expiredPrefix,
+
+		deliveries:        newDeliveryTable(),
+		visibilityTimeout: visibilityTimeout,
+		maxDeliveries:     maxDeliveries,
+
+		deadLetters: newDeadLetterStore(),
+
+		scheduler: newTimerWheel(time.Now()),
+
+		pipeCapacity:   pipeCap,
+		outboxCapacity: outboxCap,
+		highWatermark:  highWatermark,
+
+		retention: retention,
+
+		dedup: newDedupIndex(dedupWindow, dedupCap),
+
+		limits: newRateLimiter(rateLimits),
+
+		metricsPort: metricsPort,
+	}
+	s.metrics = newBrokerMetrics(s)
+	return s
+}
+
+// brokerConfigFrom converts the cellorg.yaml broker section into a BrokerConfig,
+// filling in defaults for fields left empty.
+func brokerConfigFrom(cc config.BrokerConfig) BrokerConfig {
+	bc := BrokerConfig{
+		Port:     cc.Port,
+		Protocol: cc.Protocol,
+		Codec:    cc.Codec,
+		Debug:    cc.Debug,
+		DataDir:  cc.DataDir,
+
+		PriorityAging: time.Duration(cc.PriorityAgingSeconds) * time.Second,
+		ExpiredPrefix: cc.ExpiredPrefix,
+
+		VisibilityTimeout: time.Duration(cc.VisibilityTimeoutSeconds) * time.Second,
+		MaxDeliveries:     cc.MaxDeliveries,
+
+		PipeCapacity:   cc.PipeCapacity,
+		OutboxCapacity: cc.OutboxCapacity,
+		HighWatermark:  cc.HighWatermark,
+
+		RetentionMessages: cc.RetentionMessages,
+		RetentionAge:      time.Duration(cc.RetentionAgeSeconds) * time.Second,
+		RetentionBytes:    cc.RetentionBytes,
+
+		DedupWindow:   time.Duration(cc.DedupWindowSeconds) * time.Second,
+		DedupCapacity: cc.DedupCapacity,
+
+		RateLimits: cc.RateLimits,
+
+		MetricsPort: cc.MetricsPort,
+	}
+	if bc.Port == "" {
+		bc.Port = ":9001"
+	}
+	if bc.Protocol == "" {
+		bc.Protocol = "tcp"
 	}
+	if bc.Codec == "" {
+		bc.Codec = "json"
+	}
+	return bc
 }
 
 // Start begins the broker service, listening for agent connections on the configured port.
 // The service runs indefinitely until the provided context is cancelled, at which point
 // it performs graceful shutdown by closing the listener and rejecting new connections.
+// Open connections are closed, and Start returns once their handlers and the
+// background loops have finished, after closing the persistent envelope log.
 //
 // Each incoming connection is handled in a separate goroutine to support concurrent
 // agent communication. The service will continue accepting connections even if
 // individual connection handling encounters errors.
 //
+// When a data directory is configured, the persistent envelope log is opened
+// and replayed before the first connection is accepted.
+//
 // Parameters:
 //   - ctx: Context for service lifecycle management and graceful shutdown
 //
 // Returns:
-//   - error: Network setup errors or nil on successful shutdown
+//   - error: Network setup errors, log recovery errors, or nil on successful shutdown
 //
 // Called by: GOX main service during startup
 func (s *Service) Start(ctx context.Context) error {
-	// Create TCP listener on configured port and protocol
-	listener, err := net.Listen(s.protocol, s.port)
+	// Open and replay the write-ahead log before accepting agents
+	if s.dataDir != "" {
+		wal, err := OpenMessageLog(s.dataDir)
+		if err != nil {
+			return err
+		}
+		s.wal = wal
+		if err := s.recover(); err != nil {
+			wal.Close()
+			return fmt.Errorf("failed to recover persistent envelopes: %w", err)
+		}
+	}
+
+	// Create TCP listener on configured port and protocol (TLS if configured)
+	listener, err := s.guard.Listen(s.protocol, s.port)
 	if err != nil {
+		if s.wal != nil {
+			s.wal.Close()
+		}
 		return fmt.Errorf("failed to listen on %s: %w", s.port, err)
 	}
 	s.listener = listener
 
 	if s.debug {
-		log.Printf("Broker service listening on %s (%s/%s)", s.port, s.protocol, s.codec)
+		log.Printf("Broker service listening on %s (%s/%s, tls: %v)", s.port, s.protocol, s.codec, s.guard.TLS())
 	}
 
 	// Handle graceful shutdown when context is cancelled
@@ -251,12 +576,33 @@ func (s *Service) Start(ctx context.Context) error {
 		s.listener.Close()
 	}()
 
+	// Queue recovered pipe envelopes that did not fit as consumers make room
+	s.refillPipes(ctx)
+
+	// Redeliver pipe deliveries that were not acknowledged in time
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		s.reapDeliveries(ctx)
+	}()
+
+	// Deliver scheduled envelopes when they are due
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		s.runScheduler(ctx)
+	}()
+
+	// Serve metrics over HTTP if configured
+	metrics.Start(ctx, s.metricsPort, s.metrics.registry, "Broker")
+
 	// Main accept loop - handle incoming agent connections
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			// Check if shutdown was requested via context cancellation
 			if ctx.Err() != nil {
+				s.stop()
 				return nil // Clean shutdown
 			}
 			// Log other errors but continue accepting connections
@@ -265,7 +611,32 @@ func (s *Service) Start(ctx context.Context) error {
 		}
 
 		// Handle each connection in a separate goroutine for concurrency
-		go s.handleConnection(conn)
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+// stop closes the open connections and waits for their handlers and the
+// background loops before closing the persistent envelope log, which
+// writers, ack handlers and the scheduler use until they have finished.
+//
+// Called by: Start() once the listener is closed
+func (s *Service) stop() {
+	s.connMux.Lock()
+	s.stopping = true
+	for _, conn := range s.connections {
+		if conn.Conn != nil {
+			conn.Conn.Close()
+		}
+	}
+	s.connMux.Unlock()
+
+	s.workers.Wait()
+	if s.wal != nil {
+		s.wal.Close()
 	}
 }
 
@@ -276,11 +647,13 @@ func (s *Service) Start(ctx context.Context) error {
 // Connection lifecycle:
 // 1. Create unique connection ID and register connection
 // 2. Setup JSON encoder/decoder for message serialization
-// 3. Enter request processing loop
-// 4. Clean up connection on disconnect or error
+// 3. Start the outbox writer for topic deliveries
+// 4. Enter request processing loop
+// 5. Clean up connection on disconnect or error
 //
 // The connection is automatically removed from the broker's connection registry
-// when this method exits, ensuring proper cleanup of resources.
+// and from all topic subscriber lists when this method exits, ensuring proper
+// cleanup of resources. Undelivered persistent envelopes go back to their topic.
 //
 // Parameters:
 //   - netConn: TCP connection from agent
@@ -300,10 +673,18 @@ func (s *Service) handleConnection(netConn net.Conn) {
 		Encoder:  json.NewEncoder(netConn), // For sending responses to agent
 		Decoder:  json.NewDecoder(netConn), // For receiving requests from agent
 		LastSeen: time.Now(),               // Track connection health
+		outbox:   newPriorityQueue(s.outboxCapacity, s.priorityAging),
+		credits:  newCreditWindow(),
+		done:     make(chan struct{}),
 	}
 
 	// Register connection in broker's connection registry
+	// Connections accepted while the broker stops are closed right away
 	s.connMux.Lock()
+	if s.stopping {
+		s.connMux.Unlock()
+		return
+	}
 	s.connections[connID] = conn
 	s.connMux.Unlock()
 
@@ -315,6 +696,19 @@ func (s *Service) handleConnection(netConn net.Conn) {
 		s.connMux.Unlock()
 	}()
 
+	// Write topic deliveries in priority order until the connection closes
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		s.writeOutbox(conn, conn.done)
+	}()
+	defer func() {
+		close(conn.done)
+		s.dropSubscriber(conn)
+		s.dropPipeConsumer(conn)
+		s.requeueConnectionDeliveries(conn)
+	}()
+
 	if s.debug {
 		log.Printf("Broker: new connection %s", connID)
 	}
@@ -338,16 +732,40 @@ func (s *Service) handleConnection(netConn net.Conn) {
 			log.Printf("Broker: received %s from %s", req.Method, connID)
 		}
 
+		// Blocking pipe receives run concurrently so a long poll does not
+		// hold up acks and sends on the same connection; responses are
+		// correlated by request ID on the client
+		if req.Method == "receive_pipe" {
+			conn.receiving.Add(1)
+			s.workers.Add(1)
+			go func(req BrokerRequest) {
+				defer s.workers.Done()
+				defer conn.receiving.Add(-1)
+				if err := conn.send(s.handleRequest(conn, &req)); err != nil && s.debug {
+					log.Printf("Broker: encode error to %s: %v", connID, err)
+				}
+			}(req)
+			continue
+		}
+
 		// Process request and generate response
 		resp := s.handleRequest(conn, &req)
 
 		// Send JSON-RPC response back to agent
-		if err := conn.Encoder.Encode(resp); err != nil {
+		if err := conn.send(resp); err != nil {
 			if s.debug {
 				log.Printf("Broker: encode error to %s: %v", connID, err)
 			}
 			return // Exit on encode error (connection likely closed)
 		}
+
+		// A codec agreed in the handshake applies from the next message on
+		if conn.nextCodec != nil {
+			conn.useCodec(conn.nextCodec)
+			if s.debug {
+				log.Printf("Broker: %s switched to %s", connID, conn.wire.Name())
+			}
+		}
 	}
 }
 
@@ -359,10 +777,22 @@ func (s *Service) handleConnection(netConn net.Conn) {
 //   - "connect": Agent registration and handshake
 //   - "publish": Send message to topic subscribers
 //   - "publish_envelope": Send envelope to topic subscribers
+//   - "request": Send envelope to topic subscribers with the connection's reply inbox
+//   - "reply": Deliver a reply envelope to a requester's inbox
 //   - "subscribe": Subscribe to topic for message delivery
 //   - "send_pipe": Send message to point-to-point pipe
 //   - "send_pipe_envelope": Send envelope to point-to-point pipe
 //   - "receive_pipe": Receive message from point-to-point pipe
+//   - "ack": Confirm processing of a manual-ack pipe delivery
+//   - "nack": Reject a manual-ack pipe delivery for redelivery
+//   - "stats": Report queue depths per pipe and subscriber
+//   - "dead_letter": Store a message an agent failed to process
+//   - "list_dead_letters": List dead letters of one or all queues
+//   - "get_dead_letter": Inspect a single dead letter
+//   - "reinject_dead_letter": Send a dead letter's message back for processing
+//   - "delete_dead_letter": Discard a dead letter
+//   - "prefetch": Advertise the connection's prefetch window for topic deliveries
+//   - "credit": Grant credits back after finishing topic deliveries
 //
 // Parameters:
 //   - conn: Connection that sent the request
@@ -373,14 +803,21 @@ func (s *Service) handleConnection(netConn net.Conn) {
 //
 // Called by: handleConnection() for each incoming request
 func (s *Service) handleRequest(conn *Connection, req *BrokerRequest) *BrokerResponse {
+	// Agents must authenticate in "connect" before anything else when credentials are configured
+	if resp := s.authorize(conn, req); resp != nil {
+		return resp
+	}
+
 	// Dispatch request to appropriate handler based on method name
 	switch req.Method {
 	case "connect":
 		return s.handleConnect(conn, req)
 	case "publish":
 		return s.handlePublish(conn, req)
-	case "publish_envelope":
+	case "publish_envelope", "request":
 		return s.handlePublishEnvelope(conn, req)
+	case "reply":
+		return s.handleReply(conn, req)
 	case "subscribe":
 		return s.handleSubscribe(conn, req)
 	case "send_pipe":
@@ -389,6 +826,34 @@ func (s *Service) handleRequest(conn *Connection, req *BrokerRequest) *BrokerRes
 		return s.handleSendPipeEnvelope(conn, req)
 	case "receive_pipe":
 		return s.handleReceivePipe(conn, req)
+	case "ack":
+		return s.handleAck(conn, req)
+	case "nack":
+		return s.handleNack(conn, req)
+	case "stats":
+		return &BrokerResponse{ID: req.ID, Result: s.Stats()}
+	case "dead_letter":
+		return s.handleDeadLetter(conn, req)
+	case "list_dead_letters":
+		return s.handleListDeadLetters(conn, req)
+	case "get_dead_letter":
+		return s.handleGetDeadLetter(conn, req)
+	case "reinject_dead_letter":
+		return s.handleReinjectDeadLetter(conn, req)
+	case "delete_dead_letter":
+		return s.handleDeleteDeadLetter(conn, req)
+	case "prefetch":
+		return s.handlePrefetch(conn, req)
+	case "credit":
+		return s.handleCredit(conn, req)
+	case "schemas":
+		return s.handleGetSchemas(conn, req)
+	case "cancel_scheduled":
+		return s.handleCancelScheduled(conn, req)
+	case "connect_pipe":
+		return s.handleConnectPipe(conn, req)
+	case "disconnect_pipe":
+		return s.handleDisconnectPipe(conn, req)
 	default:
 		// Return JSON-RPC "Method not found" error for unknown methods
 		return &BrokerResponse{
@@ -410,28 +875,50 @@ func (s *Service) handleRequest(conn *Connection, req *BrokerRequest) *BrokerRes
 //   - Envelope hop tracking for message routing history
 //   - Agent identification in topic subscriptions
 //
+// Codec negotiation:
+//   - With a codec parameter ("json" or "msgpack") the result is a
+//     ConnectResult naming the codec the connection uses from the next
+//     message on; unsupported codecs fall back to JSON
+//   - The response itself is still sent with the previous codec
+//   - A connection that already switched keeps its codec
+//
+// Authentication:
+//   - With a token or per-agent credentials configured, the token parameter
+//     must match; until then all other requests are rejected
+//
 // Parameters:
 //   - conn: Connection requesting registration
-//   - req: JSON-RPC request with agent_id parameter
+//   - req: JSON-RPC request with agent_id and optional token and codec parameters
 //
 // Returns:
-//   - BrokerResponse: Success confirmation or parameter validation error
+//   - BrokerResponse: Success confirmation (ConnectResult if a codec was
+//     requested), parameter validation error or ErrCodeUnauthorized
 //
 // Called by: handleRequest() when method is "connect"
 func (s *Service) handleConnect(conn *Connection, req *BrokerRequest) *BrokerResponse {
 	// Define expected parameter structure for type-safe unmarshaling
 	var params struct {
-		AgentID string `json:"agent_id"` // Unique agent identifier
+		AgentID string `json:"agent_id"`        // Unique agent identifier
+		Token   string `json:"token,omitempty"` // Shared token or agent secret
+		Codec   string `json:"codec,omitempty"` // Requested wire codec
 	}
 
 	// Parse and validate request parameters
-	if err := json.Unmarshal(req.Params, &params); err != nil {
+	if err := conn.unmarshal(req.Params, &params); err != nil {
 		return &BrokerResponse{
 			ID:    req.ID,
 			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
 		}
 	}
 
+	// Check credentials before the agent ID is trusted for routing and ACLs
+	if err := s.authenticate(conn, params.AgentID, params.Token); err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: err,
+		}
+	}
+
 	// Associate agent ID with this connection for future message routing
 	conn.AgentID = params.AgentID
 
@@ -440,9 +927,30 @@ func (s *Service) handleConnect(conn *Connection, req *BrokerRequest) *BrokerRes
 	}
 
 	// Confirm successful agent registration
+	if params.Codec == "" {
+		return &BrokerResponse{
+			ID:     req.ID,
+			Result: "connected",
+		}
+	}
+
+	// Agree on the codec for the rest of the connection
+	result := ConnectResult{Status: "connected", Codec: codec.JSON}
+	if conn.wire != nil {
+		result.Codec = conn.wire.Name()
+	} else if conn.receiving.Load() > 0 {
+		// Their params and responses use JSON; switching now would garble them
+		log.Printf("Broker: agent %s has pipe receives in flight, staying with JSON", params.AgentID)
+	} else if wire, err := codec.Lookup(params.Codec); err != nil {
+		log.Printf("Broker: agent %s requested %v, staying with JSON", params.AgentID, err)
+	} else if wire.Name() != codec.JSON {
+		conn.nextCodec = wire
+		result.Codec = wire.Name()
+	}
+
 	return &BrokerResponse{
 		ID:     req.ID,
-		Result: "connected",
+		Result: result,
 	}
 }
 
@@ -452,13 +960,24 @@ func (s *Service) handleConnect(conn *Connection, req *BrokerRequest) *BrokerRes
 //
 // Message processing:
 //   - Sets timestamp and target fields automatically
-//   - Stores message in topic history for debugging
-//   - Distributes to all subscribers except the sender
-//   - Maintains message ordering and metadata integrity
+//   - Rejects payloads not matching the topic's schema (ErrCodeSchemaViolation)
+//     and stamps the matching version in Meta["schema_version"]
+//   - Appends message to the topic log, stamping its offset
+//   - Queues for all subscribers except the sender, ordered by Meta["priority"]
+//   - Maintains metadata integrity
+//
+// Backpressure:
+//   - A full subscriber outbox drops the copy, unless block_timeout_ms asks
+//     to wait for the subscriber to make room
+//   - The response carries a slow_down signal when a subscriber's outbox is
+//     filled beyond the high watermark
+//   - Publications over the rate limits of the agent or topic are rejected
+//     with ErrCodeRateLimited and a slow_down signal saying when to retry,
+//     or ErrCodeMessageTooLarge
 //
 // Topic management:
 //   - Creates topics automatically if they don't exist
-//   - Maintains message history with circular buffer (max 100 messages)
+//   - Keeps the topic log within the configured retention limits
 //   - Handles concurrent access with proper locking
 //
 // Parameters:
@@ -472,79 +991,62 @@ func (s *Service) handleConnect(conn *Connection, req *BrokerRequest) *BrokerRes
 func (s *Service) handlePublish(conn *Connection, req *BrokerRequest) *BrokerResponse {
 	// Define expected parameter structure for type-safe unmarshaling
 	var params struct {
-		Topic   string  `json:"topic"`   // Target topic name
-		Message Message `json:"message"` // Message to publish
+		Topic        string  `json:"topic"`                      // Target topic name
+		Message      Message `json:"message"`                    // Message to publish
+		BlockTimeout int     `json:"block_timeout_ms,omitempty"` // Wait for space in full outboxes
 	}
 
 	// Parse and validate request parameters
-	if err := json.Unmarshal(req.Params, &params); err != nil {
+	if err := conn.unmarshal(req.Params, &params); err != nil {
 		return &BrokerResponse{
 			ID:    req.ID,
 			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
 		}
 	}
 
-	// Set broker-managed fields for proper message routing
-	params.Message.Timestamp = time.Now()                       // Record processing time
-	params.Message.Target = fmt.Sprintf("pub:%s", params.Topic) // Set routing target
-
-	// Find or create the target topic
-	s.topicsMux.Lock()
-	topic, exists := s.topics[params.Topic]
-	if !exists {
-		// Create new topic with initialized collections
-		topic = &Topic{
-			Name:        params.Topic,
-			Subscribers: make([]*Connection, 0),             // Empty subscriber list
-			Messages:    make([]*Message, 0, 100),           // Message history buffer
-			Envelopes:   make([]*envelope.Envelope, 0, 100), // Envelope history buffer
+	// Wildcards are only valid in subscriptions
+	if wildcard.IsPattern(params.Topic) {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Cannot publish to wildcard topic: %s", params.Topic)},
+		}
+	}
+	if err := s.checkPublish(conn, params.Topic); err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: err,
 		}
-		s.topics[params.Topic] = topic
 	}
-	s.topicsMux.Unlock()
 
-	// Add message to topic and distribute to subscribers
-	topic.mux.Lock()
+	// Agents and topics over their rate limit are told when to retry
+	if resp := s.checkRate(conn, req, fmt.Sprintf("pub:%s", params.Topic)); resp != nil {
+		return resp
+	}
 
-	// Store message in topic history with circular buffer behavior
-	topic.Messages = append(topic.Messages, &params.Message)
-	if len(topic.Messages) > 100 {
-		topic.Messages = topic.Messages[1:] // Remove oldest message
-	}
-
-	// Distribute message to all subscribers except the sender
-	for _, subscriber := range topic.Subscribers {
-		if subscriber.ID != conn.ID { // Prevent message echo to sender
-			// Create properly formatted message for subscriber delivery
-			// CRITICAL: Preserve all message fields including metadata
-			pubMsg := Message{
-				ID:        params.Message.ID,                   // Original message ID
-				Type:      params.Message.Type,                 // Message type
-				Target:    fmt.Sprintf("pub:%s", params.Topic), // Routing info
-				Payload:   params.Message.Payload,              // Message data
-				Meta:      params.Message.Meta,                 // Critical: preserve metadata!
-				Timestamp: params.Message.Timestamp,            // Processing timestamp
-			}
+	// Set broker-managed fields for proper message routing
+	params.Message.Timestamp = time.Now()                       // Record processing time
+	params.Message.Target = fmt.Sprintf("pub:%s", params.Topic) // Set routing target
 
-			// Send message to subscriber (non-blocking)
-			if err := subscriber.Encoder.Encode(pubMsg); err != nil {
-				if s.debug {
-					log.Printf("Broker: failed to send to subscriber %s: %v", subscriber.ID, err)
-				}
-				// Continue with other subscribers even if one fails
-			}
+	// Reject payloads that do not match the topic's schema
+	if err := s.checkMessageSchema(params.Topic, &params.Message); err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: err,
 		}
 	}
-	topic.mux.Unlock()
+
+	// Store message in topic history and distribute to subscribers
+	result := s.publishMessage(conn, params.Topic, &params.Message, blockTimeout(params.BlockTimeout))
 
 	if s.debug {
-		log.Printf("Broker: published to topic %s (%d subscribers)", params.Topic, len(topic.Subscribers))
+		log.Printf("Broker: published to topic %s (%d subscribers)", params.Topic, result.recipients)
 	}
 
 	// Confirm successful message publication
 	return &BrokerResponse{
-		ID:     req.ID,
-		Result: "published",
+		ID:       req.ID,
+		Result:   "published",
+		SlowDown: result.slowDown,
 	}
 }
 
@@ -556,10 +1058,28 @@ func (s *Service) handlePublish(conn *Connection, req *BrokerRequest) *BrokerRes
 //   - Creates new topics automatically if they don't exist
 //   - Prevents duplicate subscriptions for the same connection
 //   - Maintains subscriber list for message distribution
+//   - Accepts MQTT-style wildcard patterns: "*" matches one dot-separated
+//     level, "#" all remaining levels ("project-42.*", "extracted-text.#")
+//   - With a group parameter the connection joins a consumer group: each
+//     publication goes to one member, chosen round-robin (default) or by
+//     least-loaded outbox, while other groups get their own copy
+//   - A filter parameter (see Filter) limits delivery to the publications
+//     it matches; in a group, a publication goes to a member whose filter
+//     matches it. Subscribing again replaces the filter
+//
+// Replay:
+//   - from_offset queues the retained entries of the topic from that offset
+//     on (an offset older than the log starts at its oldest entry)
+//   - from_timestamp queues the entries published at or after that time; on
+//     a wildcard pattern, those of every matching topic
+//   - Replayed entries go to the subscribing connection only, also in a
+//     group, and are paced by its outbox and prefetch window; publications
+//     after the subscribe are delivered live as usual
 //
 // Parameters:
 //   - conn: Connection requesting subscription
-//   - req: JSON-RPC request with topic parameter
+//   - req: JSON-RPC request with topic and optional group, strategy, filter,
+//     from_offset and from_timestamp parameters
 //
 // Returns:
 //   - BrokerResponse: Success confirmation or parameter validation error
@@ -568,48 +1088,139 @@ func (s *Service) handlePublish(conn *Connection, req *BrokerRequest) *BrokerRes
 func (s *Service) handleSubscribe(conn *Connection, req *BrokerRequest) *BrokerResponse {
 	// Define expected parameter structure for type-safe unmarshaling
 	var params struct {
-		Topic string `json:"topic"` // Topic name to subscribe to
+		Topic    string `json:"topic"`              // Topic name to subscribe to
+		Group    string `json:"group,omitempty"`    // Optional consumer group sharing the stream
+		Strategy string `json:"strategy,omitempty"` // Group member selection (round_robin, least_loaded)
+		Filter   string `json:"filter,omitempty"`   // Content filter expression
+
+		FromOffset    uint64    `json:"from_offset,omitempty"`    // Replay retained entries from this offset
+		FromTimestamp time.Time `json:"from_timestamp,omitempty"` // Replay retained entries published since then
 	}
 
 	// Parse and validate request parameters
-	if err := json.Unmarshal(req.Params, &params); err != nil {
+	if err := conn.unmarshal(req.Params, &params); err != nil {
 		return &BrokerResponse{
 			ID:    req.ID,
 			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
 		}
 	}
 
-	// Find or create the requested topic
-	s.topicsMux.Lock()
-	topic, exists := s.topics[params.Topic]
-	if !exists {
-		// Create new topic with initialized collections
-		topic = &Topic{
-			Name:        params.Topic,
-			Subscribers: make([]*Connection, 0),             // Empty subscriber list
-			Messages:    make([]*Message, 0, 100),           // Message history buffer
-			Envelopes:   make([]*envelope.Envelope, 0, 100), // Envelope history buffer
+	// Wildcard patterns must be well-formed ("#" last, wildcards as whole levels)
+	if err := wildcard.Validate(params.Topic); err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Invalid topic: %v", err)},
+		}
+	}
+	if err := s.checkSubscribe(conn, params.Topic); err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: err,
 		}
-		s.topics[params.Topic] = topic
 	}
-	s.topicsMux.Unlock()
 
-	// Add connection to topic's subscriber list (avoid duplicates)
-	topic.mux.Lock()
-	found := false
-	for _, sub := range topic.Subscribers {
-		if sub.ID == conn.ID {
-			found = true
-			break
+	// Offsets are per topic, so a pattern can only replay by time
+	if params.FromOffset > 0 && !params.FromTimestamp.IsZero() {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "from_offset and from_timestamp are mutually exclusive"},
+		}
+	}
+	if params.FromOffset > 0 && wildcard.IsPattern(params.Topic) {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: "from_offset needs a concrete topic; use from_timestamp with wildcards"},
+		}
+	}
+
+	strategy, err := validGroupStrategy(params.Strategy)
+	if err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: err.Error()},
+		}
+	}
+	filter, err := ParseFilter(params.Filter)
+	if err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Invalid filter: %v", err)},
 		}
 	}
-	if !found {
-		topic.Subscribers = append(topic.Subscribers, conn)
+
+	// Find or create the requested topic (or wildcard subscription)
+	topic := s.getOrCreateTopic(params.Topic)
+
+	topic.mux.Lock()
+	if params.Group != "" {
+		// Join the consumer group; all members must agree on the strategy
+		group, exists := topic.Groups[params.Group]
+		if !exists {
+			group = &ConsumerGroup{Name: params.Group, Strategy: strategy}
+			topic.Groups[params.Group] = group
+		} else if params.Strategy != "" && group.Strategy != strategy {
+			topic.mux.Unlock()
+			return &BrokerResponse{
+				ID: req.ID,
+				Error: &BrokerError{Code: -32602, Message: fmt.Sprintf(
+					"Group %s on topic %s uses strategy %s", params.Group, params.Topic, group.Strategy)},
+			}
+		}
+		group.join(conn, filter)
+	} else {
+		// Add connection to topic's subscriber list (avoid duplicates)
+		found := false
+		for _, sub := range topic.Subscribers {
+			if sub.ID == conn.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			topic.Subscribers = append(topic.Subscribers, conn)
+		}
+		if filter != nil {
+			topic.filters[conn.ID] = filter
+		} else {
+			delete(topic.filters, conn.ID)
+		}
 	}
+
+	// Hand persistent envelopes that arrived while nobody was listening
+	// (or that were recovered from the log) to the first subscriber.
+	// History is read under the same lock the subscription was added with,
+	// so every publication is either replayed or delivered live.
+	pending := topic.Pending
+	topic.Pending = nil
+	history := topic.history.since(params.FromOffset, params.FromTimestamp, s.retention)
 	topic.mux.Unlock()
 
+	s.deliverPending(conn, params.Topic, pending, filter)
+	s.replay(conn, params.Topic, history, pending, filter)
+
+	// A wildcard subscription also picks up what is held back on matching topics
+	if wildcard.IsPattern(params.Topic) {
+		for _, matched := range s.matchingTopics(params.Topic) {
+			matched.mux.Lock()
+			pending := matched.Pending
+			matched.Pending = nil
+			history := matched.history.since(0, params.FromTimestamp, s.retention)
+			matched.mux.Unlock()
+
+			s.deliverPending(conn, matched.Name, pending, filter)
+			s.replay(conn, matched.Name, history, pending, filter)
+		}
+	}
+
 	if s.debug {
-		log.Printf("Broker: agent %s subscribed to topic %s", conn.AgentID, params.Topic)
+		if params.Group != "" {
+			log.Printf("Broker: agent %s joined group %s on topic %s (%s)", conn.AgentID, params.Group, params.Topic, strategy)
+		} else {
+			log.Printf("Broker: agent %s subscribed to topic %s", conn.AgentID, params.Topic)
+		}
+		if filter != nil {
+			log.Printf("Broker: agent %s filters topic %s by %s", conn.AgentID, params.Topic, filter)
+		}
 	}
 
 	// Confirm successful subscription
@@ -627,7 +1238,21 @@ func (s *Service) handleSubscribe(conn *Connection, req *BrokerRequest) *BrokerR
 //   - Validates envelope structure and required fields
 //   - Records message routing hops for debugging and audit trails
 //   - Sets destination field for proper routing
+//   - Rejects payloads not matching the topic's schema (ErrCodeSchemaViolation)
+//     and stamps the matching version in HeaderSchemaVersion
 //   - Preserves all envelope metadata and routing information
+//   - Queues for each subscriber in Envelope.Priority order
+//   - Routes envelopes past their TTL to the expiry topic instead
+//   - Applies the same backpressure as publish (block_timeout_ms, slow_down)
+//   - For "request", stamps the sender's reply inbox (envelope.HeaderReplyTo) and
+//     reports how many recipients the request reached
+//   - With deliver_at or delay_ms in the future, holds the envelope in the
+//     timer wheel and returns a scheduleResult instead (not for "request")
+//   - Drops repeats of an envelope published within the dedup window (same
+//     ID or HeaderIdempotencyKey) and answers "duplicate"; requests are
+//     never dropped
+//   - Rejects publications over the rate limits of the agent or topic
+//     (ErrCodeRateLimited, ErrCodeMessageTooLarge)
 //
 // The envelope protocol provides richer metadata compared to simple messages,
 // including sender information, routing history, and processing context.
@@ -639,22 +1264,44 @@ func (s *Service) handleSubscribe(conn *Connection, req *BrokerRequest) *BrokerR
 // Returns:
 //   - BrokerResponse: Success confirmation or validation error
 //
-// Called by: handleRequest() when method is "publish_envelope"
+// Called by: handleRequest() when method is "publish_envelope" or "request"
 func (s *Service) handlePublishEnvelope(conn *Connection, req *BrokerRequest) *BrokerResponse {
 	// Define expected parameter structure for type-safe unmarshaling
 	var params struct {
-		Topic    string             `json:"topic"`    // Target topic name
-		Envelope *envelope.Envelope `json:"envelope"` // Envelope to publish
+		Topic        string             `json:"topic"`                      // Target topic name
+		Envelope     *envelope.Envelope `json:"envelope"`                   // Envelope to publish
+		BlockTimeout int                `json:"block_timeout_ms,omitempty"` // Wait for space in full outboxes
+		DeliverAt    time.Time          `json:"deliver_at,omitempty"`       // Hold the envelope until this time
+		DelayMs      int64              `json:"delay_ms,omitempty"`         // Hold the envelope for this long
 	}
 
 	// Parse and validate request parameters
-	if err := json.Unmarshal(req.Params, &params); err != nil {
+	if err := conn.unmarshal(req.Params, &params); err != nil {
 		return &BrokerResponse{
 			ID:    req.ID,
 			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
 		}
 	}
 
+	// Wildcards are only valid in subscriptions
+	if wildcard.IsPattern(params.Topic) {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32602, Message: fmt.Sprintf("Cannot publish to wildcard topic: %s", params.Topic)},
+		}
+	}
+	if err := s.checkPublish(conn, params.Topic); err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: err,
+		}
+	}
+
+	// Agents and topics over their rate limit are told when to retry
+	if resp := s.checkRate(conn, req, fmt.Sprintf("pub:%s", params.Topic)); resp != nil {
+		return resp
+	}
+
 	// Validate envelope structure and required fields
 	if err := params.Envelope.Validate(); err != nil {
 		return &BrokerResponse{
@@ -674,52 +1321,92 @@ func (s *Service) handlePublishEnvelope(conn *Connection, req *BrokerRequest) *B
 		params.Envelope.Destination = fmt.Sprintf("pub:%s", params.Topic)
 	}
 
-	// Find or create the target topic
-	s.topicsMux.Lock()
-	topic, exists := s.topics[params.Topic]
-	if !exists {
-		// Create new topic with initialized collections
-		topic = &Topic{
-			Name:        params.Topic,
-			Subscribers: make([]*Connection, 0),             // Empty subscriber list
-			Messages:    make([]*Message, 0, 100),           // Message history buffer
-			Envelopes:   make([]*envelope.Envelope, 0, 100), // Envelope history buffer
+	// Reject payloads that do not match the topic's schema
+	if err := s.checkEnvelopeSchema(params.Topic, params.Envelope); err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: err,
 		}
-		s.topics[params.Topic] = topic
 	}
-	s.topicsMux.Unlock()
 
-	// Add envelope to topic and distribute to subscribers
-	topic.mux.Lock()
+	// Requests tell responders where the reply goes
+	if req.Method == "request" {
+		params.Envelope.SetHeader(envelope.HeaderReplyTo, inbox(conn))
+	}
 
-	// Store envelope in topic history with circular buffer behavior
-	topic.Envelopes = append(topic.Envelopes, params.Envelope)
-	if len(topic.Envelopes) > 100 {
-		topic.Envelopes = topic.Envelopes[1:] // Remove oldest envelope
+	// Check the schedule before anything is routed
+	deliverAt, scheduleErr := deliveryTime(params.DeliverAt, params.DelayMs)
+	if scheduleErr == nil && !deliverAt.IsZero() && req.Method == "request" {
+		scheduleErr = &BrokerError{Code: -32602, Message: "Invalid params: requests cannot be scheduled"}
+	}
+	if scheduleErr != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: scheduleErr,
+		}
 	}
 
-	// Distribute envelope to all subscribers except the sender
-	for _, subscriber := range topic.Subscribers {
-		if subscriber.ID != conn.ID { // Prevent envelope echo to sender
-			// Send complete envelope with all metadata preserved
-			if err := subscriber.Encoder.Encode(params.Envelope); err != nil {
-				if s.debug {
-					log.Printf("Broker: failed to send envelope to subscriber %s: %v", subscriber.ID, err)
-				}
-				// Continue with other subscribers even if one fails
-			}
+	// Repeats of an envelope accepted within the dedup window are dropped;
+	// requests are not, their retries wait for a reply of their own
+	destination := fmt.Sprintf("pub:%s", params.Topic)
+	if req.Method != "request" && !s.dedup.claim(destination, params.Envelope) {
+		return s.duplicate(req, destination, params.Envelope)
+	}
+
+	// Expired envelopes are not delivered; they are routed to the expiry topic instead
+	if params.Envelope.IsExpired() {
+		s.expireEnvelope(params.Envelope, fmt.Sprintf("pub:%s", params.Topic), ExpiryStagePublish)
+		return &BrokerResponse{
+			ID:     req.ID,
+			Result: "expired",
+		}
+	}
+
+	// Envelopes due later wait in the timer wheel
+	if !deliverAt.IsZero() {
+		resp := s.scheduleEnvelope(conn, req, LogKindTopic, params.Topic, params.Envelope, deliverAt)
+		if resp.Error != nil {
+			s.dedup.release(destination, params.Envelope)
+		}
+		return resp
+	}
+
+	// Replies are only let into the inbox for requests awaiting one
+	if req.Method == "request" {
+		conn.requests.add(params.Envelope.ID)
+	}
+
+	// Store envelope in topic history and distribute to subscribers
+	result, err := s.publishEnvelope(conn, params.Topic, params.Envelope, blockTimeout(params.BlockTimeout))
+	if err != nil {
+		if req.Method == "request" {
+			conn.requests.take(params.Envelope.ID)
+		}
+		s.dedup.release(destination, params.Envelope)
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: &BrokerError{Code: -32603, Message: fmt.Sprintf("Failed to persist envelope: %v", err)},
 		}
 	}
-	topic.mux.Unlock()
 
 	if s.debug {
-		log.Printf("Broker: published envelope to topic %s (%d subscribers)", params.Topic, len(topic.Subscribers))
+		log.Printf("Broker: published envelope to topic %s (%d subscribers)", params.Topic, result.recipients)
+	}
+
+	// Requesters learn whether anyone will see the request
+	if req.Method == "request" {
+		return &BrokerResponse{
+			ID:       req.ID,
+			Result:   requestResult{Inbox: inbox(conn), Recipients: result.recipients},
+			SlowDown: result.slowDown,
+		}
 	}
 
 	// Confirm successful envelope publication
 	return &BrokerResponse{
-		ID:     req.ID,
-		Result: "published",
+		ID:       req.ID,
+		Result:   "published",
+		SlowDown: result.slowDown,
 	}
 }
 
@@ -729,10 +1416,18 @@ func (s *Service) handlePublishEnvelope(conn *Connection, req *BrokerRequest) *B
 //
 // Pipe management:
 //   - Creates pipes automatically when first used
-//   - Uses buffered channels for non-blocking message delivery
+//   - Uses a bounded priority queue for non-blocking message delivery
 //   - Handles buffer overflow with appropriate error responses
 //   - Sets proper routing information for message delivery
 //
+// Backpressure:
+//   - With block_timeout_ms, a full pipe is waited on until the consumer
+//     makes room or the timeout expires
+//   - The response carries a slow_down signal when the pipe is filled beyond
+//     the high watermark, and always when the pipe is full
+//   - Sends over the agent's rate limits are rejected with
+//     ErrCodeRateLimited and a slow_down signal, or ErrCodeMessageTooLarge
+//
 // Unlike topics, pipes provide one-to-one communication with guaranteed
 // delivery order and buffering capabilities.
 //
@@ -747,54 +1442,68 @@ func (s *Service) handlePublishEnvelope(conn *Connection, req *BrokerRequest) *B
 func (s *Service) handleSendPipe(conn *Connection, req *BrokerRequest) *BrokerResponse {
 	// Define expected parameter structure for type-safe unmarshaling
 	var params struct {
-		Pipe    string  `json:"pipe"`    // Target pipe name
-		Message Message `json:"message"` // Message to send
+		Pipe         string  `json:"pipe"`                       // Target pipe name
+		Message      Message `json:"message"`                    // Message to send
+		BlockTimeout int     `json:"block_timeout_ms,omitempty"` // Wait for space in a full pipe
 	}
 
 	// Parse and validate request parameters
-	if err := json.Unmarshal(req.Params, &params); err != nil {
+	if err := conn.unmarshal(req.Params, &params); err != nil {
 		return &BrokerResponse{
 			ID:    req.ID,
 			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
 		}
 	}
 
+	if err := s.checkSendPipe(conn, params.Pipe); err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: err,
+		}
+	}
+
+	// Agents over their rate limit are told when to retry
+	if resp := s.checkRate(conn, req, fmt.Sprintf("pipe:%s", params.Pipe)); resp != nil {
+		return resp
+	}
+
 	// Set broker-managed fields for proper message routing
 	params.Message.Timestamp = time.Now()                       // Record processing time
 	params.Message.Target = fmt.Sprintf("pipe:%s", params.Pipe) // Set routing target
 
-	// Find or create the target pipe
-	s.pipesMux.Lock()
-	pipe, exists := s.pipes[params.Pipe]
-	if !exists {
-		// Create new pipe with buffered channels
-		pipe = &Pipe{
-			Name:      params.Pipe,
-			Messages:  make(chan *Message, 100),           // Buffered message channel
-			Envelopes: make(chan *envelope.Envelope, 100), // Buffered envelope channel
+	// Reject payloads that do not match the message type's schema
+	if err := s.checkMessageSchema("", &params.Message); err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: err,
 		}
-		s.pipes[params.Pipe] = pipe
 	}
-	s.pipesMux.Unlock()
 
-	// Attempt to send message to pipe with flow control
-	select {
-	case pipe.Messages <- &params.Message:
-		// Message successfully queued in pipe buffer
-		if s.debug {
-			log.Printf("Broker: sent message to pipe %s", params.Pipe)
-		}
-		return &BrokerResponse{
-			ID:     req.ID,
-			Result: "sent",
-		}
-	default:
+	// Find or create the target pipe
+	pipe := s.getOrCreatePipe(params.Pipe)
+
+	// Attempt to queue message in pipe with flow control, ordered by Meta["priority"]
+	item := &queueItem{Priority: messagePriority(&params.Message), Message: &params.Message}
+	if !pipe.queue.PushWait(item, blockTimeout(params.BlockTimeout)) {
 		// Pipe buffer is full - cannot accept more messages
+		s.metrics.dropped.Inc(fmt.Sprintf("pipe:%s", params.Pipe), DropPipeFull)
 		return &BrokerResponse{
-			ID:    req.ID,
-			Error: &BrokerError{Code: -32603, Message: "Pipe buffer full"},
+			ID:       req.ID,
+			Error:    &BrokerError{Code: -32603, Message: "Pipe buffer full"},
+			SlowDown: s.slowDown(fmt.Sprintf("pipe:%s", params.Pipe), pipe.queue),
 		}
 	}
+
+	// Message successfully queued in pipe buffer
+	s.metrics.pipeSent.Inc(params.Pipe)
+	if s.debug {
+		log.Printf("Broker: sent message to pipe %s", params.Pipe)
+	}
+	return &BrokerResponse{
+		ID:       req.ID,
+		Result:   "sent",
+		SlowDown: s.slowDown(fmt.Sprintf("pipe:%s", params.Pipe), pipe.queue),
+	}
 }
 
 // handleSendPipeEnvelope processes envelope sending requests to point-to-point pipes.
@@ -805,7 +1514,15 @@ func (s *Service) handleSendPipe(conn *Connection, req *BrokerRequest) *BrokerRe
 //   - Validates envelope structure and required fields
 //   - Records message routing hops for debugging and audit trails
 //   - Sets destination field for proper routing
-//   - Uses buffered channels for reliable delivery
+//   - Uses a bounded priority queue ordered by Envelope.Priority
+//   - Routes envelopes past their TTL to the expiry topic instead
+//   - Applies the same backpressure as send_pipe (block_timeout_ms, slow_down)
+//   - With deliver_at or delay_ms in the future, holds the envelope in the
+//     timer wheel and returns a scheduleResult instead
+//   - Drops repeats of an envelope sent within the dedup window (same ID or
+//     HeaderIdempotencyKey) and answers "duplicate"
+//   - Rejects sends over the agent's rate limits (ErrCodeRateLimited,
+//     ErrCodeMessageTooLarge)
 //
 // The envelope protocol provides richer metadata for pipe communication,
 // useful for complex agent workflows that require detailed routing information.
@@ -821,18 +1538,33 @@ func (s *Service) handleSendPipe(conn *Connection, req *BrokerRequest) *BrokerRe
 func (s *Service) handleSendPipeEnvelope(conn *Connection, req *BrokerRequest) *BrokerResponse {
 	// Define expected parameter structure for type-safe unmarshaling
 	var params struct {
-		Pipe     string             `json:"pipe"`     // Target pipe name
-		Envelope *envelope.Envelope `json:"envelope"` // Envelope to send
+		Pipe         string             `json:"pipe"`                       // Target pipe name
+		Envelope     *envelope.Envelope `json:"envelope"`                   // Envelope to send
+		BlockTimeout int                `json:"block_timeout_ms,omitempty"` // Wait for space in a full pipe
+		DeliverAt    time.Time          `json:"deliver_at,omitempty"`       // Hold the envelope until this time
+		DelayMs      int64              `json:"delay_ms,omitempty"`         // Hold the envelope for this long
 	}
 
 	// Parse and validate request parameters
-	if err := json.Unmarshal(req.Params, &params); err != nil {
+	if err := conn.unmarshal(req.Params, &params); err != nil {
 		return &BrokerResponse{
 			ID:    req.ID,
 			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
 		}
 	}
 
+	if err := s.checkSendPipe(conn, params.Pipe); err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: err,
+		}
+	}
+
+	// Agents over their rate limit are told when to retry
+	if resp := s.checkRate(conn, req, fmt.Sprintf("pipe:%s", params.Pipe)); resp != nil {
+		return resp
+	}
+
 	// Validate envelope structure and required fields
 	if err := params.Envelope.Validate(); err != nil {
 		return &BrokerResponse{
@@ -852,38 +1584,84 @@ func (s *Service) handleSendPipeEnvelope(conn *Connection, req *BrokerRequest) *
 		params.Envelope.Destination = fmt.Sprintf("pipe:%s", params.Pipe)
 	}
 
-	// Find or create the target pipe
-	s.pipesMux.Lock()
-	pipe, exists := s.pipes[params.Pipe]
-	if !exists {
-		// Create new pipe with buffered channels
-		pipe = &Pipe{
-			Name:      params.Pipe,
-			Messages:  make(chan *Message, 100),           // Buffered message channel
-			Envelopes: make(chan *envelope.Envelope, 100), // Buffered envelope channel
+	// Reject payloads that do not match the message type's schema
+	if err := s.checkEnvelopeSchema("", params.Envelope); err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: err,
 		}
-		s.pipes[params.Pipe] = pipe
 	}
-	s.pipesMux.Unlock()
 
-	// Attempt to send envelope to pipe with flow control
-	select {
-	case pipe.Envelopes <- params.Envelope:
-		// Envelope successfully queued in pipe buffer
-		if s.debug {
-			log.Printf("Broker: sent envelope to pipe %s", params.Pipe)
+	// Check the schedule before anything is routed
+	deliverAt, scheduleErr := deliveryTime(params.DeliverAt, params.DelayMs)
+	if scheduleErr != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: scheduleErr,
 		}
+	}
+
+	// Repeats of an envelope accepted within the dedup window are dropped
+	destination := fmt.Sprintf("pipe:%s", params.Pipe)
+	if !s.dedup.claim(destination, params.Envelope) {
+		return s.duplicate(req, destination, params.Envelope)
+	}
+
+	// Expired envelopes are not queued; they are routed to the expiry topic instead
+	if params.Envelope.IsExpired() {
+		s.expireEnvelope(params.Envelope, fmt.Sprintf("pipe:%s", params.Pipe), ExpiryStagePublish)
 		return &BrokerResponse{
 			ID:     req.ID,
-			Result: "sent",
+			Result: "expired",
 		}
-	default:
-		// Pipe buffer is full - cannot accept more envelopes
+	}
+
+	// Envelopes due later wait in the timer wheel
+	if !deliverAt.IsZero() {
+		resp := s.scheduleEnvelope(conn, req, LogKindPipe, params.Pipe, params.Envelope, deliverAt)
+		if resp.Error != nil {
+			s.dedup.release(destination, params.Envelope)
+		}
+		return resp
+	}
+
+	// Find or create the target pipe
+	pipe := s.getOrCreatePipe(params.Pipe)
+
+	// Persistent envelopes are written to the log before the send is acknowledged
+	seq, err := s.logEnvelope(LogKindPipe, params.Pipe, params.Envelope)
+	if err != nil {
+		s.dedup.release(destination, params.Envelope)
 		return &BrokerResponse{
 			ID:    req.ID,
-			Error: &BrokerError{Code: -32603, Message: "Pipe buffer full"},
+			Error: &BrokerError{Code: -32603, Message: fmt.Sprintf("Failed to persist envelope: %v", err)},
 		}
 	}
+
+	// Attempt to send envelope to pipe with flow control
+	item := &queueItem{Priority: params.Envelope.Priority, Envelope: params.Envelope, Seq: seq}
+	if !pipe.queue.PushWait(item, blockTimeout(params.BlockTimeout)) {
+		// Pipe buffer is full - cannot accept more envelopes
+		s.unlogEnvelope(seq)
+		s.dedup.release(destination, params.Envelope)
+		s.metrics.dropped.Inc(fmt.Sprintf("pipe:%s", params.Pipe), DropPipeFull)
+		return &BrokerResponse{
+			ID:       req.ID,
+			Error:    &BrokerError{Code: -32603, Message: "Pipe buffer full"},
+			SlowDown: s.slowDown(fmt.Sprintf("pipe:%s", params.Pipe), pipe.queue),
+		}
+	}
+
+	// Envelope successfully queued in pipe buffer
+	s.metrics.pipeSent.Inc(params.Pipe)
+	if s.debug {
+		log.Printf("Broker: sent envelope to pipe %s", params.Pipe)
+	}
+	return &BrokerResponse{
+		ID:       req.ID,
+		Result:   "sent",
+		SlowDown: s.slowDown(fmt.Sprintf("pipe:%s", params.Pipe), pipe.queue),
+	}
 }
 
 // handleReceivePipe processes message receiving requests from point-to-point pipes.
@@ -893,11 +1671,16 @@ func (s *Service) handleSendPipeEnvelope(conn *Connection, req *BrokerRequest) *
 // Receive behavior:
 //   - Blocks until message/envelope is available or timeout occurs
 //   - Handles both simple messages and full envelope protocol
+//   - Skips envelopes that expired while queued, routing them to the expiry topic
 //   - Creates pipes automatically if they don't exist
 //   - Supports configurable timeout with reasonable defaults
 //
-// The method uses Go's select statement to handle multiple channel operations
-// concurrently, ensuring proper timeout handling and message ordering.
+// Acknowledgement modes:
+//   - Default (ack=false): the item is removed from the pipe on receive
+//   - Manual (ack=true): the result is a Delivery with a delivery_tag; the item
+//     stays in flight until "ack"/"nack", and is redelivered to the next
+//     consumer if neither arrives within visibility_timeout_ms (default 30s)
+//     or the consumer disconnects
 //
 // Timeout handling:
 //   - Default timeout: 5 seconds (5000ms)
@@ -915,32 +1698,30 @@ func (s *Service) handleSendPipeEnvelope(conn *Connection, req *BrokerRequest) *
 func (s *Service) handleReceivePipe(conn *Connection, req *BrokerRequest) *BrokerResponse {
 	// Define expected parameter structure for type-safe unmarshaling
 	var params struct {
-		Pipe    string `json:"pipe"`                 // Source pipe name
-		Timeout int    `json:"timeout_ms,omitempty"` // Optional timeout in milliseconds
+		Pipe       string `json:"pipe"`                            // Source pipe name
+		Timeout    int    `json:"timeout_ms,omitempty"`            // Optional timeout in milliseconds
+		Ack        bool   `json:"ack,omitempty"`                   // Manual acknowledgement mode
+		Visibility int    `json:"visibility_timeout_ms,omitempty"` // Optional redelivery timeout in manual-ack mode
 	}
 
 	// Parse and validate request parameters
-	if err := json.Unmarshal(req.Params, &params); err != nil {
+	if err := conn.unmarshal(req.Params, &params); err != nil {
 		return &BrokerResponse{
 			ID:    req.ID,
 			Error: &BrokerError{Code: -32602, Message: "Invalid params"},
 		}
 	}
 
-	// Find or create the source pipe
-	s.pipesMux.Lock()
-	pipe, exists := s.pipes[params.Pipe]
-	if !exists {
-		// Create new pipe with buffered channels
-		// This allows senders to queue messages even if no receiver is waiting
-		pipe = &Pipe{
-			Name:      params.Pipe,
-			Messages:  make(chan *Message, 100),           // Buffered message channel
-			Envelopes: make(chan *envelope.Envelope, 100), // Buffered envelope channel
+	if err := s.checkReceivePipe(conn, params.Pipe); err != nil {
+		return &BrokerResponse{
+			ID:    req.ID,
+			Error: err,
 		}
-		s.pipes[params.Pipe] = pipe
 	}
-	s.pipesMux.Unlock()
+
+	// Find or create the source pipe
+	// Creating the pipe here allows senders to queue messages even if no receiver is waiting
+	pipe := s.getOrCreatePipe(params.Pipe)
 
 	// Configure timeout with reasonable default
 	timeout := 5000 // Default: 5 seconds
@@ -948,26 +1729,638 @@ func (s *Service) handleReceivePipe(conn *Connection, req *BrokerRequest) *Broke
 		timeout = params.Timeout
 	}
 
-	// Wait for message, envelope, or timeout using select statement
-	// This provides concurrent handling of multiple channel operations
-	select {
-	case msg := <-pipe.Messages:
-		// Message received successfully
+	// Wait for the highest-priority message or envelope the consumer policy
+	// hands to this connection, or timeout.
+	// Envelopes that expired while queued are routed away and skipped.
+	deadline := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	var item *queueItem
+	for item == nil {
+		item = s.receiveFromPipe(pipe, conn, time.Until(deadline))
+		if item == nil {
+			// Timeout occurred - no message available within specified time
+			return &BrokerResponse{
+				ID:    req.ID,
+				Error: &BrokerError{Code: -32603, Message: "Timeout waiting for message"},
+			}
+		}
+		if item.Envelope != nil && item.Envelope.IsExpired() {
+			s.expireEnvelope(item.Envelope, fmt.Sprintf("pipe:%s", params.Pipe), ExpiryStageDelivery)
+			s.unlogEnvelope(item.Seq)
+			item = nil
+		}
+	}
+
+	item.Attempts++
+	s.metrics.pipeReceived.Inc(params.Pipe)
+
+	// In manual-ack mode the item stays in flight (and logged) until acknowledged
+	if params.Ack {
+		visibility := s.visibilityTimeout
+		if params.Visibility > 0 {
+			visibility = time.Duration(params.Visibility) * time.Millisecond
+		}
 		return &BrokerResponse{
-			ID:     req.ID,
-			Result: msg,
+			ID: req.ID,
+			Result: &Delivery{
+				Tag:      s.deliveries.add(pipe, item, conn.ID, visibility),
+				Attempt:  item.Attempts,
+				Message:  item.Message,
+				Envelope: item.Envelope,
+			},
 		}
-	case env := <-pipe.Envelopes:
-		// Envelope received successfully
+	}
+
+	if item.Envelope != nil {
+		// Envelope received successfully - it no longer needs to survive a restart
+		s.unlogEnvelope(item.Seq)
 		return &BrokerResponse{
 			ID:     req.ID,
-			Result: env,
+			Result: item.Envelope,
 		}
-	case <-time.After(time.Duration(timeout) * time.Millisecond):
-		// Timeout occurred - no message available within specified time
-		return &BrokerResponse{
-			ID:    req.ID,
-			Error: &BrokerError{Code: -32603, Message: "Timeout waiting for message"},
+	}
+
+	// Message received successfully
+	return &BrokerResponse{
+		ID:     req.ID,
+		Result: item.Message,
+	}
+}
+
+// getOrCreateTopic returns the named topic, creating it on first use.
+func (s *Service) getOrCreateTopic(name string) *Topic {
+	s.topicsMux.Lock()
+	defer s.topicsMux.Unlock()
+
+	topic, exists := s.topics[name]
+	if !exists {
+		// Create new topic with initialized collections
+		topic = &Topic{
+			Name:        name,
+			Subscribers: make([]*Connection, 0),          // Empty subscriber list
+			Groups:      make(map[string]*ConsumerGroup), // No consumer groups yet
+			history:     newTopicLog(),                   // Retained publications
+			filters:     make(map[string]*Filter),        // No filtered subscribers yet
+		}
+		s.topics[name] = topic
+		if wildcard.IsPattern(name) {
+			s.wildcards[name] = topic
+		}
+	}
+	return topic
+}
+
+// subscribersOf returns the ungrouped subscribers and consumer groups of a
+// topic plus those of all matching wildcard subscriptions, and the content
+// filters of the ungrouped subscriptions. An ungrouped connection appears
+// once even if several of its subscriptions match.
+// The caller must hold topic.mux.
+func (s *Service) subscribersOf(topic *Topic) ([]*Connection, subscriberFilters, []*ConsumerGroup) {
+	s.topicsMux.RLock()
+	var patterns []*Topic
+	for pattern, wildcardTopic := range s.wildcards {
+		if wildcard.Match(pattern, topic.Name) {
+			patterns = append(patterns, wildcardTopic)
+		}
+	}
+	s.topicsMux.RUnlock()
+
+	groups := make([]*ConsumerGroup, 0, len(topic.Groups))
+	for _, group := range topic.Groups {
+		groups = append(groups, group)
+	}
+
+	filters := make(subscriberFilters, len(topic.filters))
+	for id, filter := range topic.filters {
+		filters.add(id, filter)
+	}
+	if len(patterns) == 0 {
+		return topic.Subscribers, filters, groups
+	}
+
+	seen := make(map[string]bool, len(topic.Subscribers))
+	subscribers := make([]*Connection, 0, len(topic.Subscribers))
+	for _, sub := range topic.Subscribers {
+		seen[sub.ID] = true
+		subscribers = append(subscribers, sub)
+	}
+	for _, pattern := range patterns {
+		pattern.mux.RLock()
+		for _, sub := range pattern.Subscribers {
+			if !seen[sub.ID] {
+				seen[sub.ID] = true
+				subscribers = append(subscribers, sub)
+			}
+		}
+		for _, sub := range pattern.Subscribers {
+			filters.add(sub.ID, pattern.filters[sub.ID])
+		}
+		for _, group := range pattern.Groups {
+			groups = append(groups, group)
+		}
+		pattern.mux.RUnlock()
+	}
+	return subscribers, filters, groups
+}
+
+// matchingTopics returns all concrete topics matched by a wildcard pattern.
+func (s *Service) matchingTopics(pattern string) []*Topic {
+	s.topicsMux.RLock()
+	defer s.topicsMux.RUnlock()
+
+	var matched []*Topic
+	for name, topic := range s.topics {
+		if !wildcard.IsPattern(name) && wildcard.Match(pattern, name) {
+			matched = append(matched, topic)
+		}
+	}
+	return matched
+}
+
+// publishMessage appends a message to the topic log and queues a copy for
+// all subscribers except the sender (nil for broker-originated messages).
+// block is how long to wait for space in full outboxes (0 drops the copy).
+func (s *Service) publishMessage(sender *Connection, topicName string, msg *Message, block time.Duration) distribution {
+	// Find or create the target topic
+	topic := s.getOrCreateTopic(topicName)
+
+	// Add message to topic and distribute to subscribers
+	topic.mux.Lock()
+
+	// Retain message in the topic log; this assigns its offset
+	entry := s.retainMessage(topic, msg)
+	s.metrics.published.Inc(topicName)
+
+	// Distribute message to all subscribers except the sender, including
+	// those of matching wildcard subscriptions, and to one member per group
+	result := s.distribute(sender, topic, block, func() *queueItem {
+		return entry.item(topicName)
+	})
+	topic.mux.Unlock()
+
+	// Full outboxes are waited on without holding up the topic
+	s.awaitOutboxes(topicName, &result)
+	return result
+}
+
+// publishEnvelope appends an envelope to the topic log and queues it for all
+// subscribers except the sender (nil for broker-originated envelopes).
+// Persistent envelopes are written to the log first; if no subscriber takes
+// them they stay pending on the topic. block is how long to wait for space in
+// full outboxes (0 drops the copy).
+func (s *Service) publishEnvelope(sender *Connection, topicName string, env *envelope.Envelope, block time.Duration) (distribution, error) {
+	// Persistent envelopes are written to the log before the publish is acknowledged
+	seq, err := s.logEnvelope(LogKindTopic, topicName, env)
+	if err != nil {
+		return distribution{}, err
+	}
+
+	// Find or create the target topic
+	topic := s.getOrCreateTopic(topicName)
+
+	topic.mux.Lock()
+
+	// Retain envelope in the topic log; this stamps its offset header
+	entry := s.retainEnvelope(topic, env)
+	s.metrics.published.Inc(topicName)
+
+	// Distribute envelope to all subscribers except the sender, including
+	// those of matching wildcard subscriptions, and to one member per group.
+	// All copies share one expiry guard so an envelope that expires while
+	// queued is routed to the expiry topic once, not once per subscriber.
+	// The outbox writers remove persistent envelopes from the log once the
+	// last copy is written; the publisher holds the record until then.
+	expireOnce := new(sync.Once)
+	var ref *logRef
+	if seq != 0 {
+		ref = new(logRef)
+		ref.copies.Store(1)
+	}
+	result := s.distribute(sender, topic, block, func() *queueItem {
+		// Queue complete envelope with all metadata preserved
+		item := entry.item(topicName)
+		item.Seq = seq
+		item.expire = expireOnce
+		if ref != nil {
+			ref.copies.Add(1)
+			item.logRef = ref
+		}
+		return item
+	})
+
+	// Full outboxes are waited on without holding up the topic
+	if len(result.waits) > 0 {
+		topic.mux.Unlock()
+		s.awaitOutboxes(topicName, &result)
+		topic.mux.Lock()
+	}
+
+	if seq != 0 {
+		if result.delivered == 0 && result.requeued == 0 {
+			// A persistent envelope nobody received stays logged until a subscriber shows up
+			topic.Pending = append(topic.Pending, &loggedEnvelope{Seq: seq, Envelope: env, logRef: ref})
+		} else {
+			s.unlogCopy(ref, seq)
+		}
+	}
+	topic.mux.Unlock()
+
+	return result, nil
+}
+
+// getOrCreatePipe returns the named pipe, creating it on first use.
+func (s *Service) getOrCreatePipe(name string) *Pipe {
+	s.pipesMux.Lock()
+	defer s.pipesMux.Unlock()
+
+	pipe, exists := s.pipes[name]
+	if !exists {
+		// Create new pipe with an empty priority queue
+		pipe = &Pipe{
+			Name:      name,
+			queue:     newPriorityQueue(s.pipeCapacity, s.priorityAging),
+			consumers: newPipeConsumers(),
+		}
+		s.pipes[name] = pipe
+	}
+	return pipe
+}
+
+// logEnvelope appends a persistent envelope to the write-ahead log.
+// Returns sequence 0 when the envelope is not persistent or persistence is disabled.
+func (s *Service) logEnvelope(kind, name string, env *envelope.Envelope) (uint64, error) {
+	if s.wal == nil || !env.Persistent {
+		return 0, nil
+	}
+	return s.wal.Append(kind, name, env)
+}
+
+// unlogEnvelope removes a delivered envelope from the write-ahead log.
+func (s *Service) unlogEnvelope(seq uint64) {
+	if s.wal == nil || seq == 0 {
+		return
+	}
+	if err := s.wal.Remove(seq); err != nil {
+		log.Printf("Broker: failed to remove log record %d: %v", seq, err)
+	}
+}
+
+// deliverPending queues held-back persistent envelopes for a new subscriber.
+// Envelopes its filter does not match, and those that do not fit in the
+// outbox, are put back on the topic.
+func (s *Service) deliverPending(conn *Connection, topicName string, pending []*loggedEnvelope, filter *Filter) {
+	var unmatched []*loggedEnvelope
+	for i, le := range pending {
+		item := &queueItem{Priority: le.Envelope.Priority, Envelope: le.Envelope, Topic: topicName, Seq: le.Seq, logRef: le.logRef}
+		if !filter.Match(item) {
+			unmatched = append(unmatched, le)
+			continue
+		}
+		if !conn.deliver(item) {
+			if s.debug {
+				log.Printf("Broker: outbox of %s full, keeping %d pending envelopes", conn.ID, len(pending)-i)
+			}
+			s.requeuePending(topicName, append(unmatched, pending[i:]...))
+			return
+		}
+	}
+	if len(unmatched) > 0 {
+		s.requeuePending(topicName, unmatched)
+	}
+
+	if s.debug && len(pending) > 0 {
+		log.Printf("Broker: queued %d pending envelopes on topic %s for %s", len(pending), topicName, conn.ID)
+	}
+}
+
+// requeuePending puts persistent envelopes back on a topic's pending list,
+// in the order they were logged, so they are delivered in publish order.
+func (s *Service) requeuePending(topicName string, pending []*loggedEnvelope) {
+	topic := s.getOrCreateTopic(topicName)
+	topic.mux.Lock()
+	topic.Pending = append(pending, topic.Pending...)
+	slices.SortStableFunc(topic.Pending, func(a, b *loggedEnvelope) int {
+		return cmp.Compare(a.Seq, b.Seq)
+	})
+	topic.mux.Unlock()
+}
+
+// send writes a message to the agent, serialized with all other writes on the connection.
+func (c *Connection) send(v interface{}) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	return c.Encoder.Encode(v)
+}
+
+// unmarshal decodes request params with the connection's codec.
+func (c *Connection) unmarshal(data []byte, v interface{}) error {
+	if c.wire == nil {
+		return json.Unmarshal(data, v)
+	}
+	return c.wire.Unmarshal(data, v)
+}
+
+// useCodec switches the connection to the codec agreed in the handshake.
+// Called by the request loop right after the handshake response was sent;
+// the agent only sends its next request after reading that response. No
+// other goroutine reads the codec then: the handshake only agrees on a
+// codec while no receive_pipe request is served concurrently.
+func (c *Connection) useCodec(wire codec.Codec) {
+	c.writeMux.Lock()
+	c.Encoder = wire.NewEncoder(c.Conn)
+	c.writeMux.Unlock()
+
+	c.Decoder = wire.NewDecoder(codec.Unread(c.Decoder, c.Conn))
+	c.wire = wire
+	c.nextCodec = nil
+}
+
+// deliver queues a topic delivery in the connection's outbox.
+// Returns false if the outbox is full or the connection has no writer.
+func (c *Connection) deliver(item *queueItem) bool {
+	if c.outbox == nil {
+		return false
+	}
+	return c.outbox.Push(item)
+}
+
+// closed reports whether the connection handler has exited.
+func (c *Connection) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliverWithin queues a topic delivery, waiting for outbox space until the
+// deadline. Returns false if the outbox is still full at the deadline.
+func (c *Connection) deliverWithin(item *queueItem, deadline time.Time) bool {
+	if c.outbox == nil {
+		return false
+	}
+	return c.outbox.PushWait(item, time.Until(deadline))
+}
+
+// writeOutbox writes queued topic deliveries in priority order until done is closed.
+// Each write takes a credit from the connection's prefetch window; without
+// credit the deliveries wait in the outbox. Persistent envelopes are removed
+// from the write-ahead log once their last fan-out copy is written.
+func (s *Service) writeOutbox(conn *Connection, done <-chan struct{}) {
+	for {
+		// Take the credit first so waiting deliveries stay in the outbox,
+		// where priority ordering and queue depth still apply
+		if !conn.credits.acquire(done) {
+			return
+		}
+
+		item, notify := conn.outbox.popOrNotify()
+		if item == nil {
+			// Give the credit back while idle; the window may change meanwhile
+			conn.credits.release()
+			select {
+			case <-notify:
+				continue
+			case <-done:
+				return
+			}
+		}
+
+		// Envelopes that expired while waiting in the outbox are routed away;
+		// replayed ones were routed when first published
+		if item.Envelope != nil && item.Envelope.IsExpired() {
+			if !item.Replayed {
+				item.expireOnce(func() {
+					s.expireEnvelope(item.Envelope, fmt.Sprintf("pub:%s", item.Topic), ExpiryStageDelivery)
+				})
+			}
+			s.unlogCopy(item.logRef, item.Seq)
+			conn.credits.release()
+			continue
+		}
+
+		var err error
+		if item.Envelope != nil {
+			err = conn.send(item.Envelope)
+		} else {
+			err = conn.send(item.Message)
+		}
+		if err != nil {
+			if s.debug {
+				log.Printf("Broker: failed to send to subscriber %s: %v", conn.ID, err)
+			}
+			// Keep a persistent envelope for the next subscriber
+			if item.Seq != 0 {
+				s.requeuePending(item.Topic, []*loggedEnvelope{{Seq: item.Seq, Envelope: item.Envelope, logRef: item.logRef}})
+			}
+			conn.credits.release()
+			continue
 		}
+		s.unlogCopy(item.logRef, item.Seq)
+		s.metrics.delivered.Inc(item.Topic)
+	}
+}
+
+// dropSubscriber removes a closed connection from all topics and hands its
+// undelivered persistent envelopes back to their topics.
+func (s *Service) dropSubscriber(conn *Connection) {
+	s.topicsMux.RLock()
+	topics := make([]*Topic, 0, len(s.topics))
+	for _, topic := range s.topics {
+		topics = append(topics, topic)
+	}
+	s.topicsMux.RUnlock()
+
+	for _, topic := range topics {
+		topic.mux.Lock()
+		for i, sub := range topic.Subscribers {
+			if sub.ID == conn.ID {
+				topic.Subscribers = append(topic.Subscribers[:i], topic.Subscribers[i+1:]...)
+				break
+			}
+		}
+		delete(topic.filters, conn.ID)
+		for name, group := range topic.Groups {
+			if group.leave(conn) {
+				delete(topic.Groups, name)
+			}
+		}
+		topic.mux.Unlock()
+	}
+
+	s.reclaimOutbox(conn)
+}
+
+// reclaimOutbox empties the outbox of a closed connection, handing its
+// persistent envelopes back to their topics for the next subscriber.
+func (s *Service) reclaimOutbox(conn *Connection) {
+	for _, item := range conn.outbox.Drain() {
+		if item.Seq != 0 {
+			s.requeuePending(item.Topic, []*loggedEnvelope{{Seq: item.Seq, Envelope: item.Envelope, logRef: item.logRef}})
+			continue
+		}
+		item.discard()
+	}
+}
+
+// recover replays the write-ahead log into topics and pipes after a restart.
+// Topic envelopes wait for their first subscriber; pipe envelopes are queued
+// for the next receive. Those that do not fit in a full pipe (e.g. deliveries
+// that were in flight) wait in the backlog until refillPipes queues them.
+func (s *Service) recover() error {
+	records, err := s.wal.Replay()
+	if err != nil {
+		return err
+	}
+
+	restored := 0
+	for _, record := range records {
+		switch record.Kind {
+		case LogKindTopic:
+			topic := s.getOrCreateTopic(record.Name)
+			topic.mux.Lock()
+			topic.Pending = append(topic.Pending, &loggedEnvelope{Seq: record.Seq, Envelope: record.Envelope})
+			topic.mux.Unlock()
+			s.dedup.restore(fmt.Sprintf("pub:%s", record.Name), record.Envelope, record.LoggedAt)
+			restored++
+		case LogKindPipe:
+			pipe := s.getOrCreatePipe(record.Name)
+			item := &queueItem{
+				Priority: record.Envelope.Priority,
+				Enqueued: record.LoggedAt, // Keep aging across restarts
+				Envelope: record.Envelope,
+				Seq:      record.Seq,
+			}
+			if !pipe.queue.Push(item) {
+				if s.backlog == nil {
+					s.backlog = make(map[string][]*queueItem)
+				}
+				s.backlog[record.Name] = append(s.backlog[record.Name], item)
+			}
+			s.dedup.restore(fmt.Sprintf("pipe:%s", record.Name), record.Envelope, record.LoggedAt)
+			restored++
+		default:
+			log.Printf("Broker: skipping log record %d with unknown kind %q", record.Seq, record.Kind)
+		}
+	}
+
+	if restored > 0 {
+		log.Printf("Broker: recovered %d persistent envelopes from %s", restored, s.dataDir)
 	}
+
+	// Dead letters stay until they are re-injected or deleted
+	letters, err := s.wal.LoadDeadLetters()
+	if err != nil {
+		return err
+	}
+	for _, dl := range letters {
+		s.deadLetters.add(dl)
+	}
+	if len(letters) > 0 {
+		log.Printf("Broker: recovered %d dead letters from %s", len(letters), s.dataDir)
+	}
+
+	// Scheduled envelopes wait for their time again; overdue ones go out first
+	scheduled, err := s.wal.LoadScheduled()
+	if err != nil {
+		return err
+	}
+	for _, item := range scheduled {
+		s.scheduler.add(item)
+	}
+	if len(scheduled) > 0 {
+		log.Printf("Broker: recovered %d scheduled envelopes from %s", len(scheduled), s.dataDir)
+	}
+	return nil
+}
+
+// refillPipes queues the backlog left by recover, each pipe's envelopes in
+// log order as soon as its consumers make room, until ctx is done.
+func (s *Service) refillPipes(ctx context.Context) {
+	for name, items := range s.backlog {
+		log.Printf("Broker: pipe %s full during recovery, %d envelopes wait for room", name, len(items))
+		go func(pipe *Pipe, items []*queueItem) {
+			for _, item := range items {
+				for !pipe.queue.PushWait(item, reapInterval) {
+					if ctx.Err() != nil {
+						return
+					}
+				}
+			}
+			log.Printf("Broker: queued recovered backlog of pipe %s", pipe.Name)
+		}(s.getOrCreatePipe(name), items)
+	}
+	s.backlog = nil
+}
+
+// Stats returns the current queue depths of all pipes and subscriber outboxes
+// (with each subscriber's prefetch window), dead-letter counts, consumer
+// group membership, and the retained offsets of each topic.
+func (s *Service) Stats() *Stats {
+	stats := &Stats{
+		Pipes:       make(map[string]QueueStats),
+		Subscribers: make(map[string]SubscriberStats),
+		DeadLetters: s.deadLetters.counts(),
+		Groups:      make(map[string]map[string]GroupStats),
+		Topics:      make(map[string]TopicStats),
+		Scheduled:   s.scheduler.len(),
+
+		PipeConsumers: make(map[string]PipeConsumerStats),
+		Filters:       make(map[string]map[string]string),
+		Dedup:         s.dedup.stats(),
+		RateLimited:   s.limits.violations(),
+	}
+
+	// Snapshot the topic list first; publishers lock a topic before the topic map
+	s.topicsMux.RLock()
+	topics := make([]*Topic, 0, len(s.topics))
+	for _, topic := range s.topics {
+		topics = append(topics, topic)
+	}
+	s.topicsMux.RUnlock()
+
+	for _, topic := range topics {
+		topic.mux.RLock()
+		if !wildcard.IsPattern(topic.Name) {
+			stats.Topics[topic.Name] = topic.history.stats()
+		}
+		for groupName, group := range topic.Groups {
+			if stats.Groups[topic.Name] == nil {
+				stats.Groups[topic.Name] = make(map[string]GroupStats)
+			}
+			stats.Groups[topic.Name][groupName] = group.stats()
+		}
+		if len(topic.filters) > 0 {
+			stats.Filters[topic.Name] = make(map[string]string, len(topic.filters))
+			for id, filter := range topic.filters {
+				stats.Filters[topic.Name][id] = filter.String()
+			}
+		}
+		topic.mux.RUnlock()
+	}
+
+	s.pipesMux.RLock()
+	for name, pipe := range s.pipes {
+		pipeStats := pipe.queue.Stats()
+		pipeStats.InFlight = s.deliveries.countForPipe(pipe)
+		stats.Pipes[name] = pipeStats
+		if pipe.consumers.len() > 0 {
+			stats.PipeConsumers[name] = pipe.consumers.stats(s.deliveries.countByConsumer(pipe))
+		}
+	}
+	s.pipesMux.RUnlock()
+
+	s.connMux.RLock()
+	for id, conn := range s.connections {
+		if conn.outbox != nil {
+			stats.Subscribers[id] = SubscriberStats{
+				AgentID: conn.AgentID,
+				Outbox:  conn.outbox.Stats(),
+				Flow:    conn.credits.stats(),
+			}
+		}
+	}
+	s.connMux.RUnlock()
+
+	return stats
 }
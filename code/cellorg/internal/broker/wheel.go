@@ -0,0 +1,142 @@
+package broker
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// Timer wheel geometry: one revolution covers wheelSlots * wheelTick. Items
+// further out stay in their slot for additional revolutions.
+const (
+	wheelTick  = 100 * time.Millisecond
+	wheelSlots = 600 // One minute per revolution
+)
+
+// scheduledEnvelope is an envelope held back until DeliverAt. It is stored in
+// the message log while waiting, so it survives a broker restart.
+type scheduledEnvelope struct {
+	ID          string             `json:"id"`                    // Schedule ID, used to cancel
+	Kind        string             `json:"kind"`                  // LogKindTopic or LogKindPipe
+	Name        string             `json:"name"`                  // Topic or pipe name
+	DeliverAt   time.Time          `json:"deliver_at"`            // When the envelope is due
+	Envelope    *envelope.Envelope `json:"envelope"`              // Envelope to deliver
+	AgentID     string             `json:"agent_id,omitempty"`    // Agent that scheduled it; only it may cancel
+	SenderConn  string             `json:"sender_conn,omitempty"` // Connection excluded from topic delivery while it exists
+	ScheduledAt time.Time          `json:"scheduled_at"`          // When the envelope was scheduled
+
+	slot   int // Wheel slot holding the item
+	rounds int // Revolutions left before the item is due
+}
+
+// timerWheel is a hashed timing wheel holding scheduled envelopes. Adding and
+// cancelling are O(1); each tick only looks at the items of one slot.
+//
+// Thread Safety: All methods are safe for concurrent use.
+type timerWheel struct {
+	slots  []map[string]*scheduledEnvelope
+	items  map[string]*scheduledEnvelope // Schedule ID -> item
+	cursor int                           // Slot of the last processed tick
+	last   time.Time                     // Time of the last processed tick
+	mux    sync.Mutex
+}
+
+// newTimerWheel creates an empty wheel whose first tick follows now.
+func newTimerWheel(now time.Time) *timerWheel {
+	w := &timerWheel{
+		slots: make([]map[string]*scheduledEnvelope, wheelSlots),
+		items: make(map[string]*scheduledEnvelope),
+		last:  now,
+	}
+	for i := range w.slots {
+		w.slots[i] = make(map[string]*scheduledEnvelope)
+	}
+	return w
+}
+
+// add places an item in the slot of its due time. Items already due go into
+// the next tick.
+func (w *timerWheel) add(item *scheduledEnvelope) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	ticks := int((item.DeliverAt.Sub(w.last) + wheelTick - 1) / wheelTick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	item.slot = (w.cursor + ticks) % wheelSlots
+	item.rounds = (ticks - 1) / wheelSlots
+
+	if old, ok := w.items[item.ID]; ok {
+		delete(w.slots[old.slot], old.ID)
+	}
+	w.slots[item.slot][item.ID] = item
+	w.items[item.ID] = item
+}
+
+// remove takes an item out of the wheel. Returns nil if it is not scheduled.
+func (w *timerWheel) remove(id string) *scheduledEnvelope {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	item, ok := w.items[id]
+	if !ok {
+		return nil
+	}
+	delete(w.slots[item.slot], id)
+	delete(w.items, id)
+	return item
+}
+
+// get returns a scheduled item without removing it.
+func (w *timerWheel) get(id string) *scheduledEnvelope {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.items[id]
+}
+
+// advance processes all ticks up to now and returns the items that became
+// due, in due-time order per tick.
+func (w *timerWheel) advance(now time.Time) []*scheduledEnvelope {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	var due []*scheduledEnvelope
+	for !w.last.Add(wheelTick).After(now) {
+		w.last = w.last.Add(wheelTick)
+		w.cursor = (w.cursor + 1) % wheelSlots
+
+		var fired []*scheduledEnvelope
+		for id, item := range w.slots[w.cursor] {
+			if item.rounds > 0 {
+				item.rounds--
+				continue
+			}
+			delete(w.slots[w.cursor], id)
+			delete(w.items, id)
+			fired = append(fired, item)
+		}
+		sortScheduled(fired)
+		due = append(due, fired...)
+	}
+	return due
+}
+
+// len returns the number of scheduled items.
+func (w *timerWheel) len() int {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return len(w.items)
+}
+
+// sortScheduled orders items by due time, then by schedule time.
+func sortScheduled(items []*scheduledEnvelope) {
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].DeliverAt.Equal(items[j].DeliverAt) {
+			return items[i].DeliverAt.Before(items[j].DeliverAt)
+		}
+		return items[i].ScheduledAt.Before(items[j].ScheduledAt)
+	})
+}
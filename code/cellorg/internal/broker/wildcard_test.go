@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// publishTestMessage publishes a simple message to a topic
+func publishTestMessage(t *testing.T, s *Service, conn *Connection, topic string) *BrokerResponse {
+	t.Helper()
+
+	return s.handleRequest(conn, newRequest(t, "publish", map[string]interface{}{
+		"topic":   topic,
+		"message": Message{ID: "msg-" + topic, Type: "event"},
+	}))
+}
+
+// Test that wildcard subscribers receive publications on matching topics only
+func TestWildcardSubscriptions(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	project := subscribeTestConn(t, s, "project-42.*")
+	text := subscribeTestConn(t, s, "extracted-text.#")
+
+	for _, topic := range []string{"project-42.ocr", "project-42.ocr.done", "project-7.ocr", "extracted-text", "extracted-text.native.de"} {
+		if resp := publishTestMessage(t, s, producer, topic); resp.Error != nil {
+			t.Fatalf("publish to %s failed: %s", topic, resp.Error.Message)
+		}
+	}
+
+	if got := project.outbox.Len(); got != 1 {
+		t.Errorf("Expected 1 delivery for project-42.*, got %d", got)
+	}
+	if item := project.outbox.Pop(); item == nil || item.Message.Target != "pub:project-42.ocr" {
+		t.Errorf("Expected delivery from project-42.ocr, got %+v", item)
+	}
+	if got := text.outbox.Len(); got != 2 {
+		t.Errorf("Expected 2 deliveries for extracted-text.#, got %d", got)
+	}
+}
+
+// Test that a connection with overlapping subscriptions receives one copy
+func TestWildcardOverlapDeliversOnce(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	auditor := subscribeTestConn(t, s, "project-42.ocr")
+	resp := s.handleRequest(auditor, newRequest(t, "subscribe", map[string]interface{}{"topic": "project-42.#"}))
+	if resp.Error != nil {
+		t.Fatalf("subscribe failed: %s", resp.Error.Message)
+	}
+
+	publishTestMessage(t, s, producer, "project-42.ocr")
+	if got := auditor.outbox.Len(); got != 1 {
+		t.Errorf("Expected a single delivery, got %d", got)
+	}
+}
+
+// Test that malformed patterns and publishing to patterns are rejected
+func TestWildcardValidation(t *testing.T) {
+	s := NewService(BrokerConfig{Port: ":0", Protocol: "tcp", Codec: "json"})
+	conn := &Connection{ID: "conn_agent", AgentID: "agent"}
+
+	resp := s.handleRequest(conn, newRequest(t, "subscribe", map[string]interface{}{"topic": "project.#.ocr"}))
+	if resp.Error == nil || resp.Error.Code != -32602 {
+		t.Errorf("Expected invalid pattern error, got %+v", resp)
+	}
+
+	resp = publishTestMessage(t, s, conn, "project-42.*")
+	if resp.Error == nil || resp.Error.Code != -32602 {
+		t.Errorf("Expected publish to wildcard topic to fail, got %+v", resp)
+	}
+}
+
+// Test that persistent envelopes held on a topic go to a later wildcard subscriber
+func TestWildcardSubscriberReceivesPending(t *testing.T) {
+	s := newPersistentService(t, t.TempDir())
+	defer s.wal.Close()
+	producer := &Connection{ID: "conn_producer", AgentID: "producer"}
+
+	env, err := envelope.NewEnvelope("producer", "pub:project-42.ocr", "page", map[string]int{"page": 1})
+	if err != nil {
+		t.Fatalf("Failed to create envelope: %v", err)
+	}
+	env.Persistent = true
+	resp := s.handleRequest(producer, newRequest(t, "publish_envelope", map[string]interface{}{
+		"topic":    "project-42.ocr",
+		"envelope": env,
+	}))
+	if resp.Error != nil {
+		t.Fatalf("publish_envelope failed: %s", resp.Error.Message)
+	}
+
+	auditor := subscribeTestConn(t, s, "project-42.*")
+	item := auditor.outbox.Pop()
+	if item == nil || item.Envelope.ID != env.ID || item.Topic != "project-42.ocr" {
+		t.Fatalf("Expected pending envelope from project-42.ocr, got %+v", item)
+	}
+}
@@ -0,0 +1,177 @@
+// Package codec implements the wire encodings of the GOX broker protocol.
+//
+// Every broker connection starts out with JSON, which stays the default
+// because it can be read in logs and with netcat. During the "connect"
+// handshake an agent may ask for a binary codec instead; once the broker
+// has answered, both sides switch the connection over. Two codecs exist:
+//
+//   - "json": JSON-RPC as before
+//   - "msgpack": MessagePack with the same field names as JSON; []byte
+//     payloads travel as raw binary instead of base64 text
+//
+// The package is shared by the broker and the client so both agree on the
+// encoding details.
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec names used in configuration and in the connect handshake.
+const (
+	JSON    = "json"
+	MsgPack = "msgpack"
+)
+
+// Encoder writes a stream of values to a connection.
+type Encoder interface {
+	Encode(v interface{}) error
+}
+
+// Decoder reads a stream of values from a connection.
+type Decoder interface {
+	Decode(v interface{}) error
+}
+
+// Codec encodes broker protocol messages.
+type Codec interface {
+	Name() string
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Lookup returns the codec with the given name; an empty name selects JSON.
+func Lookup(name string) (Codec, error) {
+	switch name {
+	case "", JSON:
+		return jsonCodec{}, nil
+	case MsgPack:
+		return msgpackCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported codec %q (expected %s or %s)", name, JSON, MsgPack)
+	}
+}
+
+// Unread returns a reader that yields the bytes a decoder has read ahead
+// from r but not yet consumed, followed by the rest of r. Used when a
+// connection switches codecs after the handshake. The newline a JSON encoder
+// writes after the handshake message is dropped; no protocol message starts
+// with whitespace in either codec.
+func Unread(dec Decoder, r io.Reader) io.Reader {
+	if buffered, ok := dec.(interface{ Buffered() io.Reader }); ok {
+		r = io.MultiReader(buffered.Buffered(), r)
+	}
+	return &skipSpace{r: r}
+}
+
+// skipSpace drops leading JSON whitespace from a reader.
+type skipSpace struct {
+	r    io.Reader
+	done bool // First non-whitespace byte seen
+}
+
+func (s *skipSpace) Read(p []byte) (int, error) {
+	for !s.done {
+		n, err := s.r.Read(p)
+		i := 0
+		for i < n && (p[i] == ' ' || p[i] == '\t' || p[i] == '\r' || p[i] == '\n') {
+			i++
+		}
+		if i < n {
+			s.done = true
+			return copy(p, p[i:n]), err
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return s.r.Read(p)
+}
+
+// Raw is an encoded value whose decoding is deferred, such as request params
+// or a response result. It is the codec-neutral counterpart of
+// json.RawMessage: under JSON it holds JSON text, under MessagePack the
+// MessagePack bytes of the value. Decode it with the connection's codec.
+type Raw []byte
+
+// MarshalJSON writes the raw JSON value.
+func (r Raw) MarshalJSON() ([]byte, error) {
+	if r == nil {
+		return []byte("null"), nil
+	}
+	return r, nil
+}
+
+// UnmarshalJSON keeps a copy of the raw JSON value.
+func (r *Raw) UnmarshalJSON(data []byte) error {
+	*r = append((*r)[0:0], data...)
+	return nil
+}
+
+// EncodeMsgpack writes the raw MessagePack value.
+func (r Raw) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if r == nil {
+		return enc.EncodeNil()
+	}
+	return enc.Encode(msgpack.RawMessage(r))
+}
+
+// DecodeMsgpack keeps the raw MessagePack value.
+func (r *Raw) DecodeMsgpack(dec *msgpack.Decoder) error {
+	var raw msgpack.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	*r = Raw(raw)
+	return nil
+}
+
+// jsonCodec is the default, human-readable encoding.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return JSON }
+func (jsonCodec) NewEncoder(w io.Writer) Encoder             { return json.NewEncoder(w) }
+func (jsonCodec) NewDecoder(r io.Reader) Decoder             { return json.NewDecoder(r) }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// msgpackCodec is the binary encoding. Struct fields use their JSON names
+// (including omitempty and "-"), so the protocol types need no extra tags.
+// Numbers decoded into interface{} values (e.g. Message.Meta) come out as
+// int64, uint64 or float64 rather than JSON's float64.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return MsgPack }
+
+func (msgpackCodec) NewEncoder(w io.Writer) Encoder {
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	return enc
+}
+
+func (msgpackCodec) NewDecoder(r io.Reader) Decoder {
+	dec := msgpack.NewDecoder(r)
+	dec.SetCustomStructTag("json")
+	dec.UseLooseInterfaceDecoding(true)
+	return dec
+}
+
+func (c msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := c.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return c.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
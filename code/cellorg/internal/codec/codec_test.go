@@ -0,0 +1,110 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// frame mirrors the shape of a broker request: raw params plus binary data
+type frame struct {
+	ID      string          `json:"id"`
+	Params  Raw             `json:"params"`
+	Payload json.RawMessage `json:"payload"`
+	Data    []byte          `json:"data,omitempty"`
+	Skipped string          `json:"-"`
+	Time    time.Time       `json:"time"`
+}
+
+// Test that both codecs round-trip protocol frames, deferring raw params
+func TestRoundTrip(t *testing.T) {
+	for _, name := range []string{JSON, MsgPack} {
+		wire, err := Lookup(name)
+		if err != nil {
+			t.Fatalf("Lookup(%s) failed: %v", name, err)
+		}
+
+		params, err := wire.Marshal(map[string]interface{}{"topic": "ner-requests", "priority": 7})
+		if err != nil {
+			t.Fatalf("%s: marshal params failed: %v", name, err)
+		}
+		in := frame{
+			ID:      "req_1",
+			Params:  params,
+			Payload: json.RawMessage(`{"text":"Grüße"}`),
+			Data:    []byte{0x00, 0xff, 0x10},
+			Skipped: "not sent",
+			Time:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		}
+
+		var buf bytes.Buffer
+		if err := wire.NewEncoder(&buf).Encode(in); err != nil {
+			t.Fatalf("%s: encode failed: %v", name, err)
+		}
+		var out frame
+		if err := wire.NewDecoder(&buf).Decode(&out); err != nil {
+			t.Fatalf("%s: decode failed: %v", name, err)
+		}
+
+		if out.ID != in.ID || string(out.Payload) != string(in.Payload) || !bytes.Equal(out.Data, in.Data) ||
+			out.Skipped != "" || !out.Time.Equal(in.Time) {
+			t.Errorf("%s: frame changed in transit: %+v", name, out)
+		}
+
+		var got struct {
+			Topic    string `json:"topic"`
+			Priority int    `json:"priority"`
+		}
+		if err := wire.Unmarshal(out.Params, &got); err != nil || got.Topic != "ner-requests" || got.Priority != 7 {
+			t.Errorf("%s: params decoded to %+v (%v)", name, got, err)
+		}
+	}
+}
+
+// Test that MessagePack sends binary data without base64 inflation
+func TestMsgPackIsBinary(t *testing.T) {
+	data := bytes.Repeat([]byte{0xab}, 3000)
+	in := frame{ID: "req_1", Data: data}
+
+	jsonBytes, _ := json.Marshal(in)
+	wire, _ := Lookup(MsgPack)
+	packed, err := wire.Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	if len(packed) >= len(jsonBytes) || len(packed) > len(data)+100 {
+		t.Errorf("Expected compact binary encoding, got %d bytes (JSON %d)", len(packed), len(jsonBytes))
+	}
+}
+
+// Test that unknown codecs are rejected and the empty name means JSON
+func TestLookup(t *testing.T) {
+	if wire, err := Lookup(""); err != nil || wire.Name() != JSON {
+		t.Errorf("Expected JSON for empty name, got %v (%v)", wire, err)
+	}
+	if _, err := Lookup("protobuf"); err == nil {
+		t.Error("Expected error for unsupported codec")
+	}
+}
+
+// Test that a decoder's read-ahead survives a codec switch
+func TestUnread(t *testing.T) {
+	packer, _ := Lookup(MsgPack)
+	packed, _ := packer.Marshal(frame{ID: "req_2"})
+
+	var stream bytes.Buffer
+	stream.WriteString(`{"id":"req_1"}` + "\n")
+	stream.Write(packed)
+
+	dec := json.NewDecoder(&stream)
+	var first frame
+	if err := dec.Decode(&first); err != nil || first.ID != "req_1" {
+		t.Fatalf("JSON decode failed: %+v (%v)", first, err)
+	}
+
+	var second frame
+	if err := packer.NewDecoder(Unread(dec, &stream)).Decode(&second); err != nil || second.ID != "req_2" {
+		t.Errorf("Expected req_2 after the switch, got %+v (%v)", second, err)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -14,8 +16,11 @@ type Config struct {
 	AppName string `yaml:"app_name"`
 	Debug   bool   `yaml:"debug"`
 
-	Support SupportConfig `yaml:"support"`
-	Broker  BrokerConfig  `yaml:"broker"`
+	Support    SupportConfig    `yaml:"support"`
+	Broker     BrokerConfig     `yaml:"broker"`
+	Security   SecurityConfig   `yaml:"security,omitempty"`
+	Federation FederationConfig `yaml:"federation,omitempty"`
+	Tracing    TracingConfig    `yaml:"tracing,omitempty"`
 
 	BaseDir []string `yaml:"basedir"`
 	Pool    []string `yaml:"pool"`
@@ -26,15 +31,136 @@ type Config struct {
 }
 
 type SupportConfig struct {
-	Port  string `yaml:"port"`
-	Debug bool   `yaml:"debug"`
+	Port        string `yaml:"port"`
+	Debug       bool   `yaml:"debug"`
+	MetricsPort string `yaml:"metrics_port,omitempty"` // HTTP address of the Prometheus metrics endpoint; empty disables it
+	DataDir     string `yaml:"data_dir,omitempty"`     // Persistent agent registry and state-history audit; empty keeps them in memory
 }
 
 type BrokerConfig struct {
 	Port     string `yaml:"port"`
 	Protocol string `yaml:"protocol"`
-	Codec    string `yaml:"codec"`
+	Codec    string `yaml:"codec"` // Wire codec agents request: "json" or "msgpack"
 	Debug    bool   `yaml:"debug"`
+	DataDir  string `yaml:"data_dir,omitempty"` // Persistent envelope log; empty disables persistence
+
+	PriorityAgingSeconds int    `yaml:"priority_aging_seconds,omitempty"` // Queue wait per priority boost; 0 uses the default
+	ExpiredPrefix        string `yaml:"expired_prefix,omitempty"`         // Expired envelopes go to <prefix><topic>; default "expired:"
+
+	VisibilityTimeoutSeconds int `yaml:"visibility_timeout_seconds,omitempty"` // Unacked pipe deliveries are redelivered after this; 0 uses the default
+	MaxDeliveries            int `yaml:"max_deliveries,omitempty"`             // Deliveries of a pipe item before the broker dead-letters it; 0 uses the default (10), negative is unlimited
+
+	PipeCapacity   int     `yaml:"pipe_capacity,omitempty"`   // Maximum queued items per pipe; 0 uses the default (100)
+	OutboxCapacity int     `yaml:"outbox_capacity,omitempty"` // Maximum queued deliveries per subscriber; 0 uses the default (1000)
+	HighWatermark  float64 `yaml:"high_watermark,omitempty"`  // Queue fill ratio that triggers slow-down signals; 0 uses the default (0.8)
+
+	RetentionMessages   int   `yaml:"retention_messages,omitempty"`    // Retained entries per topic; 0 uses the default (100) unless another limit is set
+	RetentionAgeSeconds int   `yaml:"retention_age_seconds,omitempty"` // Entries older than this are dropped from the topic log; 0 keeps them
+	RetentionBytes      int64 `yaml:"retention_bytes,omitempty"`       // Payload bytes retained per topic; 0 is unlimited
+
+	DedupWindowSeconds int `yaml:"dedup_window_seconds,omitempty"` // Accepted envelopes are remembered this long to drop repeats; 0 uses the default (600), negative disables
+	DedupCapacity      int `yaml:"dedup_capacity,omitempty"`       // Envelopes remembered at most; 0 uses the default (10000)
+
+	RateLimits RateLimitsConfig `yaml:"rate_limits,omitempty"` // Publish limits per agent and per topic; none by default
+
+	MetricsPort string `yaml:"metrics_port,omitempty"` // HTTP address of the Prometheus metrics endpoint; empty disables it
+}
+
+// RateLimitsConfig limits what agents publish to topics and send to pipes.
+// Agent limits apply to each agent ID across its connections; topic limits
+// are shared by all publishers of a topic.
+type RateLimitsConfig struct {
+	Agents map[string]RateLimit `yaml:"agents,omitempty"` // Agent ID -> limits; "*" applies to agents without an entry
+	Topics map[string]RateLimit `yaml:"topics,omitempty"` // Topic name or wildcard pattern -> limits of each matching topic
+}
+
+// RateLimit is a token bucket on publications and their bytes, plus a cap
+// on the size of a single publication. Zero fields are unlimited.
+type RateLimit struct {
+	MessagesPerSecond float64 `yaml:"messages_per_second,omitempty"` // Sustained publications per second
+	Burst             int     `yaml:"burst,omitempty"`               // Publications allowed at once; 0 uses one second's worth (at least 1)
+	BytesPerSecond    int64   `yaml:"bytes_per_second,omitempty"`    // Sustained request bytes per second
+	BurstBytes        int64   `yaml:"burst_bytes,omitempty"`         // Bytes allowed at once; 0 uses one second's worth
+	MaxMessageBytes   int64   `yaml:"max_message_bytes,omitempty"`   // Largest single publication or send in bytes
+}
+
+// validate rejects negative limits.
+func (l RateLimit) validate() error {
+	if l.MessagesPerSecond < 0 || l.Burst < 0 || l.BytesPerSecond < 0 || l.BurstBytes < 0 || l.MaxMessageBytes < 0 {
+		return fmt.Errorf("limits cannot be negative")
+	}
+	return nil
+}
+
+// SecurityConfig secures the support and broker services. With the zero
+// value both listen on plain TCP and accept every agent, as before.
+type SecurityConfig struct {
+	// Transport security; the TLS field names follow omnistore.SecurityConfig
+	TLSEnabled     bool   `yaml:"tls_enabled,omitempty"`      // Serve support and broker over TLS
+	CertFile       string `yaml:"cert_file,omitempty"`        // Server certificate (PEM)
+	KeyFile        string `yaml:"key_file,omitempty"`         // Server private key (PEM)
+	CAFile         string `yaml:"ca_file,omitempty"`          // CA for agent certificates; deployed agents verify the server with it
+	ClientAuth     bool   `yaml:"client_auth,omitempty"`      // Require agent certificates signed by CAFile (mutual TLS)
+	ClientCertFile string `yaml:"client_cert_file,omitempty"` // Certificate handed to deployed agents for mutual TLS
+	ClientKeyFile  string `yaml:"client_key_file,omitempty"`  // Private key handed to deployed agents for mutual TLS
+
+	// Agent authentication in connect/register_agent
+	Token       string            `yaml:"token,omitempty"`       // Shared token every agent must present
+	Credentials map[string]string `yaml:"credentials,omitempty"` // Agent ID -> secret; replaces the shared token for that agent
+
+	// Topic access per agent ID; "*" applies to agents without an entry
+	ACLs map[string]TopicACL `yaml:"acls,omitempty"`
+}
+
+// TopicACL lists the topics an agent may use, as topic names or wildcard
+// patterns. Pipes are listed as "pipe:<name>": Publish covers sending to
+// them, Subscribe receiving from them. A missing list leaves the action
+// unrestricted; an empty list denies it.
+type TopicACL struct {
+	Publish   []string `yaml:"publish,omitempty"`
+	Subscribe []string `yaml:"subscribe,omitempty"`
+}
+
+// FederationConfig links the broker of this cellorg instance with the
+// brokers of others, forwarding selected topics across instances.
+type FederationConfig struct {
+	Name    string           `yaml:"name,omitempty"`     // Name of this instance in envelope routes; required with links
+	MaxHops int              `yaml:"max_hops,omitempty"` // Envelopes with more hops are not forwarded; 0 uses the default (16)
+	Links   []FederationLink `yaml:"links,omitempty"`
+}
+
+// FederationLink is a bridge to one remote broker. Configure each link on one
+// side only; both directions are covered by Export and Import.
+type FederationLink struct {
+	Name    string   `yaml:"name"`             // Name of the remote instance (its federation name)
+	Address string   `yaml:"address"`          // Remote broker address (host:port)
+	Export  []string `yaml:"export,omitempty"` // Local topics or patterns forwarded to the remote broker
+	Import  []string `yaml:"import,omitempty"` // Remote topics or patterns forwarded to the local broker
+	Codec   string   `yaml:"codec,omitempty"`  // Wire codec towards the remote broker; default json
+
+	// Credentials and transport security of the remote broker
+	Token    string `yaml:"token,omitempty"`     // Token presented to the remote broker
+	TLS      bool   `yaml:"tls,omitempty"`       // Connect over TLS
+	CAFile   string `yaml:"ca_file,omitempty"`   // CA verifying the remote broker (empty = system roots)
+	CertFile string `yaml:"cert_file,omitempty"` // Client certificate for mutual TLS
+	KeyFile  string `yaml:"key_file,omitempty"`  // Client key for mutual TLS
+}
+
+// TracingConfig selects where agents export the spans of their processing
+// steps. The deployer hands it to agents via CELLORG_TRACE_* variables.
+type TracingConfig struct {
+	Exporter string `yaml:"exporter,omitempty"` // "otlp", "file" or "memory"; empty disables tracing
+	Endpoint string `yaml:"endpoint,omitempty"` // OTLP/HTTP traces endpoint (default http://localhost:4318/v1/traces)
+	File     string `yaml:"file,omitempty"`     // JSON lines file for the file exporter
+}
+
+// AgentToken returns the credential an agent presents: its own secret from
+// Credentials, or the shared token.
+func (s SecurityConfig) AgentToken(agentID string) string {
+	if secret, ok := s.Credentials[agentID]; ok {
+		return secret
+	}
+	return s.Token
 }
 
 type PoolConfig struct {
@@ -54,18 +180,57 @@ type CellsConfig struct {
 }
 
 type Cell struct {
-	ID          string      `yaml:"id"`
-	Description string      `yaml:"description"`
-	Debug       bool        `yaml:"debug"`
-	Agents      []CellAgent `yaml:"agents"`
+	ID            string            `yaml:"id"`
+	Description   string            `yaml:"description"`
+	Debug         bool              `yaml:"debug"`
+	Orchestration CellOrchestration `yaml:"orchestration,omitempty"`
+	Agents        []CellAgent       `yaml:"agents"`
+	Schemas       []SchemaConfig    `yaml:"schemas,omitempty"` // Payload schemas the broker enforces
+}
+
+// CellOrchestration holds the orchestration block of a cell. Durations are
+// Go duration strings such as "30s".
+type CellOrchestration struct {
+	StartupTimeout      string `yaml:"startup_timeout,omitempty"`
+	ShutdownTimeout     string `yaml:"shutdown_timeout,omitempty"`
+	MaxRetries          int    `yaml:"max_retries,omitempty"`
+	RetryDelay          string `yaml:"retry_delay,omitempty"`
+	HealthCheckInterval string `yaml:"health_check_interval,omitempty"` // How often the cell's agents send heartbeats
+}
+
+// HealthCheck returns the parsed health_check_interval, 0 when unset.
+func (o CellOrchestration) HealthCheck() (time.Duration, error) {
+	if o.HealthCheckInterval == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(o.HealthCheckInterval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid health_check_interval %q: %w", o.HealthCheckInterval, err)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("health_check_interval must be positive: %s", o.HealthCheckInterval)
+	}
+	return interval, nil
+}
+
+// SchemaConfig declares the JSON Schema that payloads on a topic, of a
+// message type, or both must match. Declare several versions of the same
+// topic and type to let producers and consumers migrate independently.
+type SchemaConfig struct {
+	Topic       string                 `yaml:"topic,omitempty"`        // Topic name (empty = any destination)
+	MessageType string                 `yaml:"message_type,omitempty"` // Message type (empty = any type)
+	Version     int                    `yaml:"version,omitempty"`      // Schema version; 0 is version 1
+	Schema      map[string]interface{} `yaml:"schema,omitempty"`       // Inline JSON Schema
+	File        string                 `yaml:"file,omitempty"`         // JSON Schema file, relative to the base directory
 }
 
 type CellAgent struct {
-	ID        string                 `yaml:"id"`
-	AgentType string                 `yaml:"agent_type"`
-	Ingress   string                 `yaml:"ingress"`
-	Egress    string                 `yaml:"egress"`
-	Config    map[string]interface{} `yaml:"config,omitempty"`
+	ID         string                 `yaml:"id"`
+	AgentType  string                 `yaml:"agent_type"`
+	Ingress    string                 `yaml:"ingress"`
+	Egress     string                 `yaml:"egress"`
+	DeadLetter string                 `yaml:"dead_letter,omitempty"` // Destination for messages the agent gives up on
+	Config     map[string]interface{} `yaml:"config,omitempty"`
 }
 
 func Load(filename string) (*Config, error) {
@@ -114,6 +279,37 @@ func Load(filename string) (*Config, error) {
 	if config.AwaitSupportRebootSeconds < 0 {
 		return nil, fmt.Errorf("await support reboot seconds cannot be negative: %d", config.AwaitSupportRebootSeconds)
 	}
+	if config.Broker.Codec != "json" && config.Broker.Codec != "msgpack" {
+		return nil, fmt.Errorf("unsupported broker codec %q (expected json or msgpack)", config.Broker.Codec)
+	}
+	switch config.Tracing.Exporter {
+	case "", "otlp", "memory":
+	case "file":
+		if config.Tracing.File == "" {
+			return nil, fmt.Errorf("file trace exporter requires tracing.file")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter %q (expected otlp, file or memory)", config.Tracing.Exporter)
+	}
+	if len(config.Federation.Links) > 0 && config.Federation.Name == "" {
+		return nil, fmt.Errorf("federation links require a federation name")
+	}
+	if config.Broker.RetentionMessages < 0 || config.Broker.RetentionAgeSeconds < 0 || config.Broker.RetentionBytes < 0 {
+		return nil, fmt.Errorf("broker retention limits cannot be negative")
+	}
+	if config.Broker.DedupCapacity < 0 {
+		return nil, fmt.Errorf("broker dedup capacity cannot be negative")
+	}
+	for agentID, limit := range config.Broker.RateLimits.Agents {
+		if err := limit.validate(); err != nil {
+			return nil, fmt.Errorf("broker rate limit for agent %s: %w", agentID, err)
+		}
+	}
+	for topic, limit := range config.Broker.RateLimits.Topics {
+		if err := limit.validate(); err != nil {
+			return nil, fmt.Errorf("broker rate limit for topic %s: %w", topic, err)
+		}
+	}
 
 	return &config, nil
 }
@@ -235,6 +431,11 @@ func ValidateConfiguration(pool *PoolConfig, cells *CellsConfig) error {
 	var errors []string
 
 	for _, cell := range cells.Cells {
+		// Check that the heartbeat interval parses
+		if _, err := cell.Orchestration.HealthCheck(); err != nil {
+			errors = append(errors, fmt.Sprintf("cell '%s': %v", cell.ID, err))
+		}
+
 		// Validate each agent in cell
 		for _, agent := range cell.Agents {
 			// Check if agent type exists in pool
@@ -246,6 +447,13 @@ func ValidateConfiguration(pool *PoolConfig, cells *CellsConfig) error {
 				continue
 			}
 
+			// Check that the dead-letter destination is routable
+			if agent.DeadLetter != "" && !isDeadLetterDestination(agent.DeadLetter) {
+				errors = append(errors, fmt.Sprintf(
+					"cell '%s': agent '%s' has dead_letter '%s' (expected dlq:<queue>, pipe:<name> or pub:<topic>)",
+					cell.ID, agent.ID, agent.DeadLetter))
+			}
+
 			// Check if binary exists (only for spawn/call operators, not await)
 			if agentTypeDef.Operator != "await" && agentTypeDef.Binary != "" {
 				if !fileExists(agentTypeDef.Binary) {
@@ -268,6 +476,16 @@ func ValidateConfiguration(pool *PoolConfig, cells *CellsConfig) error {
 	return nil
 }
 
+// isDeadLetterDestination checks that a dead-letter destination has a supported prefix and a name
+func isDeadLetterDestination(destination string) bool {
+	for _, prefix := range []string{"dlq:", "pipe:", "pub:"} {
+		if strings.HasPrefix(destination, prefix) && len(destination) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // fileExists checks if a file exists
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
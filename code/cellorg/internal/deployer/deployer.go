@@ -22,7 +22,9 @@ type AgentDeployer struct {
 	processes      map[string]*exec.Cmd              // agent_id -> process
 	processMux     sync.RWMutex
 	debug          bool
-	logFile        *os.File // Optional log file for agent output
+	logFile        *os.File              // Optional log file for agent output
+	security       config.SecurityConfig // Credentials and TLS settings handed to agents
+	tracing        config.TracingConfig  // Span exporter settings handed to agents
 }
 
 // NewAgentDeployer creates a new agent deployer
@@ -42,6 +44,66 @@ func (d *AgentDeployer) SetLogFile(logFile *os.File) {
 	d.logFile = logFile
 }
 
+// SetSecurity hands the credentials and TLS settings from cellorg.yaml to
+// spawned agents via CELLORG_TOKEN and CELLORG_TLS_* variables.
+func (d *AgentDeployer) SetSecurity(security config.SecurityConfig) {
+	d.security = security
+}
+
+// SetTracing hands the span exporter settings from cellorg.yaml to spawned
+// agents via CELLORG_TRACE_* variables.
+func (d *AgentDeployer) SetTracing(tracing config.TracingConfig) {
+	d.tracing = tracing
+}
+
+// tracingEnv returns the tracing environment variables for agents.
+func (d *AgentDeployer) tracingEnv() []string {
+	if d.tracing.Exporter == "" {
+		return nil
+	}
+
+	env := []string{fmt.Sprintf("CELLORG_TRACE_EXPORTER=%s", d.tracing.Exporter)}
+	if d.tracing.Endpoint != "" {
+		env = append(env, fmt.Sprintf("CELLORG_TRACE_ENDPOINT=%s", d.tracing.Endpoint))
+	}
+	if path := d.tracing.File; path != "" {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		env = append(env, fmt.Sprintf("CELLORG_TRACE_FILE=%s", path))
+	}
+	return env
+}
+
+// securityEnv returns the security environment variables for an agent.
+// File paths are made absolute since agents may run in another directory.
+func (d *AgentDeployer) securityEnv(agentID string) []string {
+	var env []string
+	if token := d.security.AgentToken(agentID); token != "" {
+		env = append(env, fmt.Sprintf("CELLORG_TOKEN=%s", token))
+	}
+	if !d.security.TLSEnabled {
+		return env
+	}
+
+	env = append(env, "CELLORG_TLS=true")
+	files := map[string]string{
+		"CELLORG_TLS_CA":   d.security.CAFile,
+		"CELLORG_TLS_CERT": d.security.ClientCertFile,
+		"CELLORG_TLS_KEY":  d.security.ClientKeyFile,
+	}
+	for key, path := range files {
+		if path == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		env = append(env, fmt.Sprintf("%s=%s", key, path))
+	}
+	return env
+}
+
 // LoadPool loads agent type definitions from pool configuration
 func (d *AgentDeployer) LoadPool(poolConfig *config.PoolConfig) error {
 	for _, agentType := range poolConfig.AgentTypes {
@@ -118,14 +180,19 @@ func (d *AgentDeployer) spawnAgentWithEnv(ctx context.Context, cellAgent config.
 	env = append(env, fmt.Sprintf("CELLORG_AGENT_TYPE=%s", cellAgent.AgentType))
 	env = append(env, fmt.Sprintf("CELLORG_SUPPORT_ADDRESS=%s", d.supportAddress))
 	env = append(env, fmt.Sprintf("CELLORG_DEBUG=%v", d.debug))
+	env = append(env, d.securityEnv(cellAgent.ID)...)
+	env = append(env, d.tracingEnv()...)
 
-	// Add ingress/egress to environment
+	// Add ingress/egress/dead-letter routing to environment
 	if cellAgent.Ingress != "" {
 		env = append(env, fmt.Sprintf("CELLORG_INGRESS=%s", cellAgent.Ingress))
 	}
 	if cellAgent.Egress != "" {
 		env = append(env, fmt.Sprintf("CELLORG_EGRESS=%s", cellAgent.Egress))
 	}
+	if cellAgent.DeadLetter != "" {
+		env = append(env, fmt.Sprintf("CELLORG_DEAD_LETTER=%s", cellAgent.DeadLetter))
+	}
 
 	// Apply custom environment variables (for embedded orchestrator)
 	for key, value := range customEnv {
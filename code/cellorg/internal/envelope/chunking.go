@@ -1,6 +1,7 @@
 package envelope
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"math"
@@ -10,6 +11,18 @@ import (
 	"github.com/google/uuid"
 )
 
+// Chunk headers shared by all chunks of one envelope.
+const (
+	HeaderChunkID         = "X-Chunk-ID"       // Group ID of the chunks
+	HeaderChunkIndex      = "X-Chunk-Index"    // Position of the chunk, from 0
+	HeaderChunkTotal      = "X-Chunk-Total"    // Number of chunks
+	HeaderChunkOriginalID = "X-Original-ID"    // ID of the chunked envelope
+	HeaderChunkEncoding   = "X-Chunk-Encoding" // "base64" for chunks made by SplitEnvelope
+)
+
+// chunkEncodingBase64 marks chunk payloads that are base64-encoded byte ranges.
+const chunkEncodingBase64 = "base64"
+
 // ChunkEnvelope splits a large envelope into manageable chunks based on token budget
 // Returns slice of envelopes, each fitting within the target model's token limits
 func ChunkEnvelope(env *Envelope, budget *EnvelopeBudget) ([]*Envelope, error) {
@@ -31,7 +44,40 @@ func ChunkEnvelope(env *Envelope, budget *EnvelopeBudget) ([]*Envelope, error) {
 		return nil, fmt.Errorf("failed to split payload: %w", err)
 	}
 
-	// Create chunk envelopes
+	return chunkEnvelopes(env, chunks), nil
+}
+
+// SplitEnvelope splits an envelope into n chunks by cutting its payload into
+// byte ranges of about equal size. Unlike ChunkEnvelope it works for any
+// payload: each chunk carries its range as a base64 JSON string, so chunk
+// payloads stay valid JSON, and MergeChunks restores the payload byte for
+// byte. Used for transport-level chunking, where the receiver reassembles
+// the envelope before looking at it.
+func SplitEnvelope(env *Envelope, n int) ([]*Envelope, error) {
+	if n < 2 || len(env.Payload) < n {
+		return []*Envelope{env}, nil
+	}
+
+	size := (len(env.Payload) + n - 1) / n
+	chunks := make([][]byte, 0, n)
+	for start := 0; start < len(env.Payload); start += size {
+		end := min(start+size, len(env.Payload))
+		encoded, err := json.Marshal(base64.StdEncoding.EncodeToString(env.Payload[start:end]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode chunk: %w", err)
+		}
+		chunks = append(chunks, encoded)
+	}
+
+	envelopes := chunkEnvelopes(env, chunks)
+	for _, chunk := range envelopes {
+		chunk.Headers[HeaderChunkEncoding] = chunkEncodingBase64
+	}
+	return envelopes, nil
+}
+
+// chunkEnvelopes creates the chunk envelopes of env carrying the given payloads.
+func chunkEnvelopes(env *Envelope, chunks [][]byte) []*Envelope {
 	envelopes := make([]*Envelope, len(chunks))
 	chunkID := uuid.New().String() // Group ID for all chunks
 
@@ -55,13 +101,13 @@ func ChunkEnvelope(env *Envelope, budget *EnvelopeBudget) ([]*Envelope, error) {
 		}
 
 		// Add chunk metadata headers
-		envelopes[i].Headers["X-Chunk-ID"] = chunkID
-		envelopes[i].Headers["X-Chunk-Index"] = strconv.Itoa(i)
-		envelopes[i].Headers["X-Chunk-Total"] = strconv.Itoa(len(chunks))
-		envelopes[i].Headers["X-Original-ID"] = env.ID
+		envelopes[i].Headers[HeaderChunkID] = chunkID
+		envelopes[i].Headers[HeaderChunkIndex] = strconv.Itoa(i)
+		envelopes[i].Headers[HeaderChunkTotal] = strconv.Itoa(len(chunks))
+		envelopes[i].Headers[HeaderChunkOriginalID] = env.ID
 	}
 
-	return envelopes, nil
+	return envelopes
 }
 
 // MergeChunks combines chunked envelopes back into a single envelope
@@ -73,21 +119,21 @@ func MergeChunks(chunks []*Envelope) (*Envelope, error) {
 
 	if len(chunks) == 1 {
 		// Single chunk, check if it's actually a chunk or standalone
-		if chunks[0].Headers["X-Chunk-ID"] == "" {
+		if chunks[0].Headers[HeaderChunkID] == "" {
 			return chunks[0], nil
 		}
 	}
 
 	// Validate all chunks belong to same group
-	chunkID := chunks[0].Headers["X-Chunk-ID"]
+	chunkID := chunks[0].Headers[HeaderChunkID]
 	if chunkID == "" {
 		return nil, fmt.Errorf("first chunk missing X-Chunk-ID header")
 	}
 
 	for i, chunk := range chunks {
-		if chunk.Headers["X-Chunk-ID"] != chunkID {
+		if chunk.Headers[HeaderChunkID] != chunkID {
 			return nil, fmt.Errorf("chunk %d has different chunk ID: %s vs %s",
-				i, chunk.Headers["X-Chunk-ID"], chunkID)
+				i, chunk.Headers[HeaderChunkID], chunkID)
 		}
 	}
 
@@ -97,8 +143,8 @@ func MergeChunks(chunks []*Envelope) (*Envelope, error) {
 
 	for i := 0; i < len(sortedChunks); i++ {
 		for j := i + 1; j < len(sortedChunks); j++ {
-			idxI, _ := strconv.Atoi(sortedChunks[i].Headers["X-Chunk-Index"])
-			idxJ, _ := strconv.Atoi(sortedChunks[j].Headers["X-Chunk-Index"])
+			idxI, _ := strconv.Atoi(sortedChunks[i].Headers[HeaderChunkIndex])
+			idxJ, _ := strconv.Atoi(sortedChunks[j].Headers[HeaderChunkIndex])
 			if idxI > idxJ {
 				sortedChunks[i], sortedChunks[j] = sortedChunks[j], sortedChunks[i]
 			}
@@ -106,18 +152,21 @@ func MergeChunks(chunks []*Envelope) (*Envelope, error) {
 	}
 
 	// Verify we have all chunks
-	expectedTotal, _ := strconv.Atoi(sortedChunks[0].Headers["X-Chunk-Total"])
+	expectedTotal, _ := strconv.Atoi(sortedChunks[0].Headers[HeaderChunkTotal])
 	if len(sortedChunks) != expectedTotal {
 		return nil, fmt.Errorf("missing chunks: have %d, expected %d",
 			len(sortedChunks), expectedTotal)
 	}
 
 	// Merge payloads
-	merged := mergePayloads(sortedChunks)
+	merged, err := mergePayloads(sortedChunks)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create merged envelope (use first chunk as template)
 	result := &Envelope{
-		ID:            sortedChunks[0].Headers["X-Original-ID"],
+		ID:            sortedChunks[0].Headers[HeaderChunkOriginalID],
 		CorrelationID: sortedChunks[0].CorrelationID,
 		TraceID:       sortedChunks[0].TraceID,
 		SpanID:        uuid.New().String(), // New span for merged envelope
@@ -135,10 +184,11 @@ func MergeChunks(chunks []*Envelope) (*Envelope, error) {
 	}
 
 	// Remove chunk headers from merged envelope
-	delete(result.Headers, "X-Chunk-ID")
-	delete(result.Headers, "X-Chunk-Index")
-	delete(result.Headers, "X-Chunk-Total")
-	delete(result.Headers, "X-Original-ID")
+	delete(result.Headers, HeaderChunkID)
+	delete(result.Headers, HeaderChunkIndex)
+	delete(result.Headers, HeaderChunkTotal)
+	delete(result.Headers, HeaderChunkOriginalID)
+	delete(result.Headers, HeaderChunkEncoding)
 
 	return result, nil
 }
@@ -254,18 +304,40 @@ func isWhitespace(c byte) bool {
 }
 
 // mergePayloads combines payloads from sorted chunks
-func mergePayloads(chunks []*Envelope) []byte {
+func mergePayloads(chunks []*Envelope) ([]byte, error) {
 	if len(chunks) == 0 {
-		return []byte("{}")
+		return []byte("{}"), nil
+	}
+
+	// Byte ranges made by SplitEnvelope
+	if chunks[0].Headers[HeaderChunkEncoding] == chunkEncodingBase64 {
+		return mergeByteRanges(chunks)
 	}
 
 	// Check if payloads are JSON arrays
 	if isJSONArray(chunks[0].Payload) {
-		return mergeJSONArrays(chunks)
+		return mergeJSONArrays(chunks), nil
 	}
 
 	// Merge as text
-	return mergeTextPayloads(chunks)
+	return mergeTextPayloads(chunks), nil
+}
+
+// mergeByteRanges decodes and concatenates base64-encoded chunk payloads
+func mergeByteRanges(chunks []*Envelope) ([]byte, error) {
+	var merged []byte
+	for i, chunk := range chunks {
+		var encoded string
+		if err := json.Unmarshal(chunk.Payload, &encoded); err != nil {
+			return nil, fmt.Errorf("chunk %d: invalid payload: %w", i, err)
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d: invalid payload: %w", i, err)
+		}
+		merged = append(merged, data...)
+	}
+	return merged, nil
 }
 
 // mergeJSONArrays combines JSON array chunks
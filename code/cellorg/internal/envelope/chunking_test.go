@@ -503,3 +503,51 @@ func TestMergeChunksMismatchedIDs(t *testing.T) {
 		t.Error("Expected error for mismatched chunk IDs, got nil")
 	}
 }
+
+// Test that byte-range chunks survive JSON transport and merge back exactly
+func TestSplitEnvelopeRoundTrip(t *testing.T) {
+	env, err := NewEnvelope("sender", "pub:documents", "document", map[string]string{
+		"text": strings.Repeat("Grüße aus Köln. ", 500),
+	})
+	if err != nil {
+		t.Fatalf("NewEnvelope failed: %v", err)
+	}
+
+	chunks, err := SplitEnvelope(env, 7)
+	if err != nil {
+		t.Fatalf("SplitEnvelope failed: %v", err)
+	}
+	if len(chunks) != 7 {
+		t.Fatalf("Expected 7 chunks, got %d", len(chunks))
+	}
+
+	// Chunks travel as JSON; arrive in reverse order
+	received := make([]*Envelope, 0, len(chunks))
+	for i := len(chunks) - 1; i >= 0; i-- {
+		data, err := json.Marshal(chunks[i])
+		if err != nil {
+			t.Fatalf("Failed to marshal chunk %d: %v", i, err)
+		}
+		var chunk Envelope
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			t.Fatalf("Failed to unmarshal chunk %d: %v", i, err)
+		}
+		received = append(received, &chunk)
+	}
+
+	merged, err := MergeChunks(received)
+	if err != nil {
+		t.Fatalf("MergeChunks failed: %v", err)
+	}
+	if merged.ID != env.ID || string(merged.Payload) != string(env.Payload) {
+		t.Errorf("Merged envelope differs from original: %s", merged.ID)
+	}
+	if merged.Headers[HeaderChunkEncoding] != "" || merged.Headers[HeaderChunkID] != "" {
+		t.Errorf("Expected chunk headers to be removed, got %v", merged.Headers)
+	}
+
+	// Small payloads are not split
+	if chunks, _ := SplitEnvelope(env, 1); len(chunks) != 1 || chunks[0] != env {
+		t.Errorf("Expected the envelope itself, got %d chunks", len(chunks))
+	}
+}
@@ -104,6 +104,10 @@ func NewEnvelope(source, destination, messageType string, payload interface{}) (
 	}, nil
 }
 
+// HeaderReplyTo carries the reply inbox the broker stamps on envelopes
+// published as requests. Responders send their reply to it.
+const HeaderReplyTo = "X-Reply-To"
+
 // NewReplyEnvelope creates a reply envelope for request/response patterns.
 //
 // Constructs a response envelope that links back to the original request through
@@ -0,0 +1,368 @@
+// Package federation links the brokers of separate cellorg instances. A bridge
+// connects to the local broker and to a remote one as an ordinary broker
+// client and forwards envelopes of selected topics in either direction:
+// exported topics from the local broker to the remote one, imported topics
+// the other way round.
+//
+// Loop prevention relies on the envelope route. The bridge connects to each
+// broker as "federation:<instance>", named after the instance the envelopes
+// come from, so every broker records where a forwarded envelope entered it
+// (Envelope.AddHop). An envelope is never forwarded to an instance already on
+// its route, and envelopes beyond the hop limit are dropped, which also stops
+// cycles through instances with inconsistent names.
+//
+// Only envelopes are bridged. Simple messages carry no route and cannot be
+// protected against loops.
+package federation
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/auth"
+	"github.com/tenzoki/agen/cellorg/internal/config"
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+	"github.com/tenzoki/agen/cellorg/internal/wildcard"
+	"github.com/tenzoki/agen/cellorg/public/client"
+)
+
+// AgentPrefix starts the agent IDs of bridge connections and thereby the
+// route entries of forwarded envelopes.
+const AgentPrefix = "federation:"
+
+// DefaultMaxHops limits forwarding when the config sets no max_hops.
+const DefaultMaxHops = 16
+
+const (
+	prefetch       = 50               // Deliveries in flight per bridge connection
+	healthInterval = 10 * time.Second // How often idle connections are checked
+	minBackoff     = time.Second      // First reconnect delay
+	maxBackoff     = 30 * time.Second // Reconnect delay cap
+)
+
+// RouteMarker returns the route entry a broker records for envelopes that a
+// bridge forwarded from the named instance.
+func RouteMarker(instance string) string {
+	return AgentPrefix + instance
+}
+
+// Endpoint describes how a bridge connects to one broker.
+type Endpoint struct {
+	Address string      // Broker address (host:port)
+	Token   string      // Credential for the connect handshake
+	Codec   string      // Wire codec (empty = json)
+	TLS     *tls.Config // Transport security (nil = plain TCP)
+}
+
+// Bridge forwards topics between the local broker and one remote broker.
+// It keeps reconnecting until its context is cancelled.
+type Bridge struct {
+	instance string // Federation name of the local instance
+	link     config.FederationLink
+	local    Endpoint
+	remote   Endpoint
+	maxHops  int
+	debug    bool
+
+	forwarded atomic.Int64 // Envelopes forwarded in either direction
+	skipped   atomic.Int64 // Envelopes held back by loop prevention or outside the bridged topics
+}
+
+// NewBridge validates a link and creates its bridge. maxHops of zero uses
+// DefaultMaxHops.
+func NewBridge(instance string, link config.FederationLink, local Endpoint, maxHops int, debug bool) (*Bridge, error) {
+	if instance == "" {
+		return nil, fmt.Errorf("federation link %s: local instance name is required", link.Name)
+	}
+	if link.Name == "" || link.Address == "" {
+		return nil, fmt.Errorf("federation link requires name and address")
+	}
+	if link.Name == instance {
+		return nil, fmt.Errorf("federation link %s: remote instance has the local name", link.Name)
+	}
+	if len(link.Export) == 0 && len(link.Import) == 0 {
+		return nil, fmt.Errorf("federation link %s: no topics to export or import", link.Name)
+	}
+	for _, pattern := range append(append([]string(nil), link.Export...), link.Import...) {
+		if err := wildcard.Validate(pattern); err != nil {
+			return nil, fmt.Errorf("federation link %s: %w", link.Name, err)
+		}
+	}
+
+	remote := Endpoint{Address: link.Address, Token: link.Token, Codec: link.Codec}
+	if link.TLS {
+		tlsConfig, err := auth.ClientTLS(link.CAFile, link.CertFile, link.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("federation link %s: %w", link.Name, err)
+		}
+		remote.TLS = tlsConfig
+	}
+
+	if maxHops <= 0 {
+		maxHops = DefaultMaxHops
+	}
+	return &Bridge{
+		instance: instance,
+		link:     link,
+		local:    local,
+		remote:   remote,
+		maxHops:  maxHops,
+		debug:    debug,
+	}, nil
+}
+
+// Start creates a bridge for every configured link and runs them in the
+// background until ctx is cancelled. localAddress is the address of this
+// instance's broker; the bridges present the credentials and client
+// certificate the security config hands to agents.
+func Start(ctx context.Context, cfg *config.Config, localAddress string) ([]*Bridge, error) {
+	federation := cfg.Federation
+	if len(federation.Links) == 0 {
+		return nil, nil
+	}
+
+	bridges := make([]*Bridge, 0, len(federation.Links))
+	for _, link := range federation.Links {
+		local := Endpoint{
+			Address: localAddress,
+			Token:   cfg.Security.AgentToken(RouteMarker(link.Name)),
+			Codec:   cfg.Broker.Codec,
+		}
+		if cfg.Security.TLSEnabled {
+			tlsConfig, err := auth.ClientTLS(cfg.Security.CAFile, cfg.Security.ClientCertFile, cfg.Security.ClientKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("federation link %s: %w", link.Name, err)
+			}
+			local.TLS = tlsConfig
+		}
+
+		bridge, err := NewBridge(federation.Name, link, local, federation.MaxHops, cfg.Debug)
+		if err != nil {
+			return nil, err
+		}
+		bridges = append(bridges, bridge)
+	}
+
+	for _, bridge := range bridges {
+		go bridge.Run(ctx)
+	}
+	return bridges, nil
+}
+
+// Name returns the name of the remote instance.
+func (b *Bridge) Name() string {
+	return b.link.Name
+}
+
+// Forwarded returns how many envelopes the bridge forwarded.
+func (b *Bridge) Forwarded() int64 {
+	return b.forwarded.Load()
+}
+
+// Skipped returns how many envelopes loop prevention held back or whose
+// destination lies outside the bridged topics.
+func (b *Bridge) Skipped() int64 {
+	return b.skipped.Load()
+}
+
+// Run connects to both brokers and forwards envelopes until ctx is cancelled.
+// A failed connection closes both sides and reconnects with exponential
+// backoff; envelopes published while the bridge is down are not forwarded
+// unless the topics are persistent.
+func (b *Bridge) Run(ctx context.Context) {
+	backoff := minBackoff
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := b.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > maxBackoff {
+			backoff = minBackoff // The link was up for a while; retry quickly
+		}
+		log.Printf("Federation link %s: %v (reconnecting in %v)", b.link.Name, err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// session runs one connection to both brokers until it fails or ctx ends.
+func (b *Bridge) session(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Each side is entered under the name of the instance envelopes come from
+	local, err := b.connect(b.local, RouteMarker(b.link.Name))
+	if err != nil {
+		return fmt.Errorf("local broker: %w", err)
+	}
+	defer local.Disconnect()
+
+	remote, err := b.connect(b.remote, RouteMarker(b.instance))
+	if err != nil {
+		return fmt.Errorf("remote broker %s: %w", b.remote.Address, err)
+	}
+	defer remote.Disconnect()
+
+	errs := make(chan error, 1)
+	for _, pattern := range b.link.Export {
+		envelopes, err := local.SubscribeEnvelopes(pattern)
+		if err != nil {
+			return fmt.Errorf("subscribe to local %s: %w", pattern, err)
+		}
+		go b.forward(ctx, pattern, envelopes, local, remote, b.link.Name, errs)
+	}
+	for _, pattern := range b.link.Import {
+		envelopes, err := remote.SubscribeEnvelopes(pattern)
+		if err != nil {
+			return fmt.Errorf("subscribe to remote %s: %w", pattern, err)
+		}
+		go b.forward(ctx, pattern, envelopes, remote, local, b.instance, errs)
+	}
+
+	if b.debug {
+		log.Printf("Federation link %s: connected %s <-> %s (export %v, import %v)",
+			b.link.Name, b.local.Address, b.remote.Address, b.link.Export, b.link.Import)
+	}
+
+	// Subscription channels stay silent when a connection drops, so both
+	// sides are checked periodically
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return err
+		case <-ticker.C:
+			if _, err := local.Stats(); err != nil {
+				return fmt.Errorf("local broker: %w", err)
+			}
+			if _, err := remote.Stats(); err != nil {
+				return fmt.Errorf("remote broker %s: %w", b.remote.Address, err)
+			}
+		}
+	}
+}
+
+// connect opens a broker connection with flow control, so a slow target
+// broker holds envelopes in the source broker instead of overflowing the
+// subscription channels.
+func (b *Bridge) connect(endpoint Endpoint, agentID string) (*client.BrokerClient, error) {
+	broker := client.NewBrokerClient(endpoint.Address, agentID, b.debug)
+	if endpoint.Codec != "" {
+		if err := broker.SetCodec(endpoint.Codec); err != nil {
+			return nil, err
+		}
+	}
+	broker.SetToken(endpoint.Token)
+	if endpoint.TLS != nil {
+		broker.SetTLS(endpoint.TLS)
+	}
+	if err := broker.Connect(); err != nil {
+		return nil, err
+	}
+	if err := broker.SetPrefetch(prefetch); err != nil {
+		broker.Disconnect()
+		return nil, err
+	}
+	return broker, nil
+}
+
+// forward publishes envelopes from the subscription to pattern on the other
+// broker. target is the instance behind the other broker.
+func (b *Bridge) forward(ctx context.Context, pattern string, envelopes <-chan *envelope.Envelope, from, to *client.BrokerClient, target string, errs chan<- error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case env, ok := <-envelopes:
+			if !ok {
+				select {
+				case errs <- fmt.Errorf("subscription to %s closed", pattern):
+				default:
+				}
+				return
+			}
+			err := b.relay(env, pattern, to, target)
+			if err == nil {
+				err = from.Credit(1)
+			}
+			if err != nil {
+				select {
+				case errs <- err:
+				default:
+				}
+				return
+			}
+		}
+	}
+}
+
+// relay publishes one envelope received through the subscription to
+// pattern on the same topic of the other broker, unless loop prevention
+// holds it back.
+func (b *Bridge) relay(env *envelope.Envelope, pattern string, to *client.BrokerClient, target string) error {
+	topic, ok := bridgedTopic(env, pattern)
+	if !ok {
+		b.skipped.Add(1)
+		log.Printf("Federation link %s: not forwarding %s, destination %q is outside %s", b.link.Name, env.ID, env.Destination, pattern)
+		return nil
+	}
+	if !Forwardable(env, target, b.maxHops) {
+		b.skipped.Add(1)
+		if b.debug {
+			log.Printf("Federation link %s: not forwarding %s to %s (route %v)", b.link.Name, env.ID, target, env.Route)
+		}
+		return nil
+	}
+
+	// Subscribers on the other broker see the topic it was published on
+	env.Destination = "pub:" + topic
+	if err := to.PublishEnvelope(topic, env); err != nil {
+		return fmt.Errorf("forward %s to %s: %w", env.ID, target, err)
+	}
+	b.forwarded.Add(1)
+	return nil
+}
+
+// bridgedTopic returns the topic to publish an envelope on: the subscribed
+// topic itself, or for a wildcard pattern the topic named by the envelope's
+// destination, which the producer sets, if the pattern covers it.
+func bridgedTopic(env *envelope.Envelope, pattern string) (string, bool) {
+	if !wildcard.IsPattern(pattern) {
+		return pattern, true
+	}
+	topic, isTopic := strings.CutPrefix(env.Destination, "pub:")
+	if !isTopic || !wildcard.Match(pattern, topic) {
+		return "", false
+	}
+	return topic, true
+}
+
+// Forwardable reports whether an envelope may be forwarded to the target
+// instance: it has not passed through the target before and is within the
+// hop limit.
+func Forwardable(env *envelope.Envelope, target string, maxHops int) bool {
+	if maxHops > 0 && env.HopCount >= maxHops {
+		return false
+	}
+	marker := RouteMarker(target)
+	for _, hop := range env.Route {
+		if hop == marker {
+			return false
+		}
+	}
+	return true
+}
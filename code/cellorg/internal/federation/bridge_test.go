@@ -0,0 +1,272 @@
+package federation
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/broker"
+	"github.com/tenzoki/agen/cellorg/internal/config"
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+	"github.com/tenzoki/agen/cellorg/public/client"
+)
+
+// startBroker runs a broker on a free loopback port and returns its address
+func startBroker(t *testing.T, ctx context.Context) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	s := broker.NewService(broker.BrokerConfig{Port: address, Protocol: "tcp", Codec: "json"})
+	go s.Start(ctx)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			return address
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Broker on %s did not start", address)
+	return ""
+}
+
+// connectAgent connects a test agent to a broker
+func connectAgent(t *testing.T, address, agentID string) *client.BrokerClient {
+	t.Helper()
+
+	c := client.NewBrokerClient(address, agentID, false)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Failed to connect %s: %v", agentID, err)
+	}
+	t.Cleanup(func() { c.Disconnect() })
+	return c
+}
+
+// subscribe subscribes a test agent to envelopes on a topic
+func subscribe(t *testing.T, c *client.BrokerClient, topic string) <-chan *envelope.Envelope {
+	t.Helper()
+
+	ch, err := c.SubscribeEnvelopes(topic)
+	if err != nil {
+		t.Fatalf("Failed to subscribe to %s: %v", topic, err)
+	}
+	return ch
+}
+
+// await publishes envelopes on a topic until one arrives on ch, covering the
+// time the bridge needs to connect and subscribe
+func await(t *testing.T, publisher *client.BrokerClient, topic string, ch <-chan *envelope.Envelope) *envelope.Envelope {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		env, _ := envelope.NewEnvelope("test-agent", "pub:"+topic, "chunk", map[string]string{"text": "x"})
+		if err := publisher.PublishEnvelope(topic, env); err != nil {
+			t.Fatalf("Failed to publish to %s: %v", topic, err)
+		}
+		select {
+		case received := <-ch:
+			return received
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	t.Fatalf("No envelope forwarded on %s", topic)
+	return nil
+}
+
+// drain discards envelopes until ch has been quiet for a moment and returns how many arrived
+func drain(ch <-chan *envelope.Envelope) int {
+	n := 0
+	for {
+		select {
+		case <-ch:
+			n++
+		case <-time.After(300 * time.Millisecond):
+			return n
+		}
+	}
+}
+
+// startBridge runs a bridge from one broker to another
+func startBridge(t *testing.T, ctx context.Context, instance, localAddress string, link config.FederationLink) *Bridge {
+	t.Helper()
+
+	bridge, err := NewBridge(instance, link, Endpoint{Address: localAddress}, 0, false)
+	if err != nil {
+		t.Fatalf("NewBridge failed: %v", err)
+	}
+	go bridge.Run(ctx)
+	return bridge
+}
+
+// Test that loop prevention holds back envelopes that visited the target or exceeded the hop limit
+func TestForwardable(t *testing.T) {
+	env, _ := envelope.NewEnvelope("text-extractor", "pub:extracted-text", "chunk", nil)
+	env.AddHop("text-extractor")
+
+	if !Forwardable(env, "site-b", DefaultMaxHops) {
+		t.Error("Expected a local envelope to be forwardable")
+	}
+
+	env.AddHop(RouteMarker("site-b"))
+	if Forwardable(env, "site-b", DefaultMaxHops) {
+		t.Error("Expected an envelope from site-b not to be sent back")
+	}
+	if !Forwardable(env, "site-c", DefaultMaxHops) {
+		t.Error("Expected an envelope from site-b to be forwardable to site-c")
+	}
+	if Forwardable(env, "site-c", 2) {
+		t.Error("Expected the hop limit to stop forwarding")
+	}
+}
+
+// Test that invalid links are rejected
+func TestNewBridgeValidation(t *testing.T) {
+	links := []config.FederationLink{
+		{Address: "localhost:9001", Export: []string{"a"}},
+		{Name: "site-a", Address: "localhost:9001", Export: []string{"a"}},
+		{Name: "site-b", Address: "localhost:9001"},
+		{Name: "site-b", Address: "localhost:9001", Import: []string{"a.#.b"}},
+	}
+	for _, link := range links {
+		if _, err := NewBridge("site-a", link, Endpoint{}, 0, false); err == nil {
+			t.Errorf("Expected link %+v to be rejected", link)
+		}
+	}
+}
+
+// Test that a bridge forwards exported and imported topics and records the hop
+func TestBridgeForwardsTopics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addressA := startBroker(t, ctx)
+	addressB := startBroker(t, ctx)
+	agentA := connectAgent(t, addressA, "text-extractor")
+	agentB := connectAgent(t, addressB, "ner-agent")
+
+	ingest := subscribe(t, agentB, "ingest.#")
+	results := subscribe(t, agentA, "results")
+
+	bridge := startBridge(t, ctx, "site-a", addressA, config.FederationLink{
+		Name:    "site-b",
+		Address: addressB,
+		Export:  []string{"ingest.#"},
+		Import:  []string{"results"},
+	})
+
+	exported := await(t, agentA, "ingest.text", ingest)
+	if exported.Destination != "pub:ingest.text" || exported.Route[len(exported.Route)-1] != RouteMarker("site-a") {
+		t.Errorf("Expected ingest.text forwarded from site-a, got %s with route %v", exported.Destination, exported.Route)
+	}
+
+	imported := await(t, agentB, "results", results)
+	if imported.Route[len(imported.Route)-1] != RouteMarker("site-b") {
+		t.Errorf("Expected results forwarded from site-b, got route %v", imported.Route)
+	}
+
+	drain(ingest)
+	drain(results)
+	if bridge.Forwarded() < 2 {
+		t.Errorf("Expected at least 2 forwarded envelopes, got %d", bridge.Forwarded())
+	}
+}
+
+// Test that envelopes are forwarded on the bridged topic, not on whatever
+// destination their producer wrote into them
+func TestBridgeIgnoresProducerDestination(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	address := startBroker(t, ctx)
+	remote := connectAgent(t, address, RouteMarker("site-a"))
+	agent := connectAgent(t, address, "auditor")
+	orders := subscribe(t, agent, "orders")
+	admin := subscribe(t, agent, "admin")
+	reports := subscribe(t, agent, "reports.daily")
+
+	bridge, err := NewBridge("site-a", config.FederationLink{Name: "site-b", Address: address, Export: []string{"orders", "reports.*"}}, Endpoint{}, 0, false)
+	if err != nil {
+		t.Fatalf("NewBridge failed: %v", err)
+	}
+
+	for _, relay := range []struct {
+		destination, pattern string
+	}{
+		{"pub:admin", "orders"},            // Forwarded on orders
+		{"pub:admin", "reports.*"},         // Outside the pattern
+		{"pipe:x", "reports.*"},            // Not a topic
+		{"pub:reports.daily", "reports.*"}, // Forwarded on reports.daily
+	} {
+		env, _ := envelope.NewEnvelope("producer", relay.destination, "order", map[string]string{"id": "1"})
+		if err := bridge.relay(env, relay.pattern, remote, "site-b"); err != nil {
+			t.Fatalf("relay failed: %v", err)
+		}
+	}
+
+	if n := drain(orders); n != 1 {
+		t.Errorf("Expected 1 envelope on orders, got %d", n)
+	}
+	if n := drain(reports); n != 1 {
+		t.Errorf("Expected 1 envelope on reports.daily, got %d", n)
+	}
+	if n := drain(admin); n != 0 {
+		t.Errorf("Expected nothing on admin, got %d", n)
+	}
+	if bridge.Forwarded() != 2 || bridge.Skipped() != 2 {
+		t.Errorf("Expected 2 forwarded and 2 skipped, got %d and %d", bridge.Forwarded(), bridge.Skipped())
+	}
+}
+
+// Test that bridges configured on both sides do not send envelopes back and forth
+func TestBridgeStopsLoops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addressA := startBroker(t, ctx)
+	addressB := startBroker(t, ctx)
+	agentA := connectAgent(t, addressA, "text-extractor")
+	agentB := connectAgent(t, addressB, "ner-agent")
+
+	sharedA := subscribe(t, agentA, "shared")
+	sharedB := subscribe(t, agentB, "shared")
+	probeA := subscribe(t, agentA, "probe.b")
+	probeB := subscribe(t, agentB, "probe.a")
+
+	fromA := startBridge(t, ctx, "site-a", addressA, config.FederationLink{
+		Name: "site-b", Address: addressB, Export: []string{"shared", "probe.a"},
+	})
+	fromB := startBridge(t, ctx, "site-b", addressB, config.FederationLink{
+		Name: "site-a", Address: addressA, Export: []string{"shared", "probe.b"},
+	})
+	await(t, agentA, "probe.a", probeB)
+	await(t, agentB, "probe.b", probeA)
+	drain(probeA)
+	drain(probeB)
+
+	env, _ := envelope.NewEnvelope("text-extractor", "pub:shared", "chunk", map[string]string{"text": "once"})
+	if err := agentA.PublishEnvelope("shared", env); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	if n := drain(sharedB); n != 1 {
+		t.Errorf("Expected site-b to receive the envelope once, got %d", n)
+	}
+	if n := drain(sharedA); n != 0 {
+		t.Errorf("Expected the envelope not to return to site-a, got %d", n)
+	}
+	if fromB.Skipped() == 0 {
+		t.Error("Expected the site-b bridge to hold the envelope back")
+	}
+	if fromA.Skipped() != 0 {
+		t.Errorf("Expected nothing held back towards site-b, got %d", fromA.Skipped())
+	}
+}
@@ -0,0 +1,292 @@
+// Package metrics exposes service metrics over HTTP in the Prometheus text
+// exposition format (version 0.0.4), so the support and broker services can be
+// scraped and graphed without pulling in a client library.
+//
+// Counters are incremented as events happen. Gauges are read from the
+// service's own state when the endpoint is scraped, so queue depths and
+// agent states never drift from what the service reports elsewhere.
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContentType is the media type of the Prometheus text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Path is where Serve exposes the metrics.
+const Path = "/metrics"
+
+// Registry holds the metric families of one service.
+//
+// Thread Safety: All methods are safe for concurrent use.
+type Registry struct {
+	families []family
+	mux      sync.RWMutex
+}
+
+// family is a counter or gauge with its samples.
+type family interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Counter registers a counter with the given label names.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{meta: meta{fullName: name, help: help, labels: labels}, values: make(map[string]*sample)}
+	r.register(c)
+	return c
+}
+
+// Gauge registers a gauge whose samples are produced by collect on every
+// scrape. collect calls emit once per sample with its value and label values.
+func (r *Registry) Gauge(name, help string, labels []string, collect func(emit Emit)) {
+	r.register(&gauge{meta: meta{fullName: name, help: help, labels: labels}, collect: collect})
+}
+
+// Emit reports one gauge sample; label values follow the gauge's label names.
+type Emit func(value float64, labelValues ...string)
+
+// register adds a family; names must be unique.
+func (r *Registry) register(f family) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, existing := range r.families {
+		if existing.name() == f.name() {
+			panic(fmt.Sprintf("metrics: %s registered twice", f.name()))
+		}
+	}
+	r.families = append(r.families, f)
+}
+
+// WriteTo writes all families in the text format, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mux.RLock()
+	families := append([]family(nil), r.families...)
+	r.mux.RUnlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name() < families[j].name() })
+
+	counter := &countingWriter{w: w}
+	buf := bufio.NewWriter(counter)
+	for _, f := range families {
+		f.write(buf)
+	}
+	err := buf.Flush()
+	return counter.n, err
+}
+
+// ServeHTTP answers a scrape.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
+
+// Serve exposes the registry at Path on addr until ctx is cancelled.
+// An empty addr disables the endpoint.
+func Serve(ctx context.Context, addr string, r *Registry) error {
+	if addr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(Path, r)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Start runs Serve in the background, logging failures. Used by the services
+// so a busy metrics port does not keep them from starting.
+func Start(ctx context.Context, addr string, r *Registry, service string) {
+	if addr == "" {
+		return
+	}
+	go func() {
+		if err := Serve(ctx, addr, r); err != nil {
+			log.Printf("%s metrics endpoint: %v", service, err)
+		}
+	}()
+}
+
+// meta is the name, help text and label names shared by all metric kinds.
+type meta struct {
+	fullName string
+	help     string
+	labels   []string
+}
+
+func (m *meta) name() string {
+	return m.fullName
+}
+
+// header writes the HELP and TYPE lines.
+func (m *meta) header(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", m.fullName, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.fullName, kind)
+}
+
+// sample writes one sample line.
+func (m *meta) sample(w *bufio.Writer, value float64, labelValues []string) {
+	w.WriteString(m.fullName)
+	if len(m.labels) > 0 {
+		w.WriteByte('{')
+		for i, label := range m.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			value := ""
+			if i < len(labelValues) {
+				value = labelValues[i]
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", label, escapeLabel(value))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatValue(value))
+	w.WriteByte('\n')
+}
+
+// Counter is a monotonically increasing value per label combination.
+type Counter struct {
+	meta
+	values map[string]*sample // Joined label values -> sample
+	mux    sync.Mutex
+}
+
+// sample is the current value of one label combination.
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+// Inc adds one for the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds n (which must not be negative) for the given label values.
+func (c *Counter) Add(n float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	s, ok := c.values[key]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), labelValues...)}
+		c.values[key] = s
+	}
+	s.value += n
+}
+
+// Value returns the current value for the given label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if s, ok := c.values[strings.Join(labelValues, "\xff")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mux.Lock()
+	samples := make([]sample, 0, len(c.values))
+	for _, s := range c.values {
+		samples = append(samples, *s)
+	}
+	c.mux.Unlock()
+
+	sortSamples(samples)
+	c.header(w, "counter")
+	for _, s := range samples {
+		c.sample(w, s.value, s.labelValues)
+	}
+}
+
+// gauge is read from service state at scrape time.
+type gauge struct {
+	meta
+	collect func(emit Emit)
+}
+
+func (g *gauge) write(w *bufio.Writer) {
+	var samples []sample
+	g.collect(func(value float64, labelValues ...string) {
+		samples = append(samples, sample{labelValues: labelValues, value: value})
+	})
+
+	sortSamples(samples)
+	g.header(w, "gauge")
+	for _, s := range samples {
+		g.sample(w, s.value, s.labelValues)
+	}
+}
+
+// sortSamples orders samples by label values for stable output.
+func sortSamples(samples []sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labelValues, "\xff") < strings.Join(samples[j].labelValues, "\xff")
+	})
+}
+
+// formatValue renders a sample value; integers are written without exponent.
+func formatValue(v float64) string {
+	if v == float64(int64(v)) {
+		return strconv.FormatInt(int64(v), 10)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escapeLabel escapes backslashes, quotes and newlines in label values.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// escapeHelp escapes backslashes and newlines in help texts.
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+// countingWriter counts the bytes written for WriteTo.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
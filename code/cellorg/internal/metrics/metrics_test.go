@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test the text format of counters and gauges, including label escaping
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	published := r.Counter("test_published_total", "Published messages.", "topic")
+	r.Gauge("test_depth", "Queue depth.", []string{"pipe"}, func(emit Emit) {
+		emit(2.5, `a"b`)
+		emit(7, "x")
+	})
+	r.Gauge("test_connections", "Open connections.", nil, func(emit Emit) {
+		emit(3)
+	})
+
+	published.Inc("extracted-text")
+	published.Add(2, "extracted-text")
+	published.Inc("chunks")
+
+	var out strings.Builder
+	if _, err := r.WriteTo(&out); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+
+	want := `# HELP test_connections Open connections.
+# TYPE test_connections gauge
+test_connections 3
+# HELP test_depth Queue depth.
+# TYPE test_depth gauge
+test_depth{pipe="a\"b"} 2.5
+test_depth{pipe="x"} 7
+# HELP test_published_total Published messages.
+# TYPE test_published_total counter
+test_published_total{topic="chunks"} 1
+test_published_total{topic="extracted-text"} 3
+`
+	if out.String() != want {
+		t.Errorf("Unexpected output:\n%s\nwant:\n%s", out.String(), want)
+	}
+	if got := published.Value("extracted-text"); got != 3 {
+		t.Errorf("Expected counter value 3, got %v", got)
+	}
+}
+
+// Test that Serve exposes the registry over HTTP until the context is cancelled
+func TestServe(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_total", "Test counter.").Inc()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Serve(ctx, addr, r) }()
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = http.Get("http://" + addr + Path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != ContentType {
+		t.Errorf("Unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(body), "test_total 1\n") {
+		t.Errorf("Expected counter in body, got:\n%s", body)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Serve returned %v after cancel", err)
+	}
+}
@@ -37,6 +37,8 @@ const (
 	StatePaused     agent.AgentState = "paused"     // Agent temporarily suspended
 	StateStopped    agent.AgentState = "stopped"    // Agent cleanly shut down
 	StateError      agent.AgentState = "error"      // Agent in error state requiring intervention
+
+	StateDisconnected agent.AgentState = "disconnected" // Agent reconnecting to the broker
 )
 
 // PipelineOrchestrator manages agent startup/shutdown with dependency resolution.
@@ -0,0 +1,308 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/tenzoki/agen/cellorg/internal/config"
+)
+
+// ErrUnknownVersion is returned when a payload names a schema version that
+// is not registered for its topic and message type.
+var ErrUnknownVersion = errors.New("unknown schema version")
+
+// Subject is what a schema applies to: payloads published on Topic, of
+// MessageType, or both. An empty field matches any value.
+type Subject struct {
+	Topic       string `json:"topic,omitempty"`
+	MessageType string `json:"message_type,omitempty"`
+}
+
+func (s Subject) String() string {
+	switch {
+	case s.Topic != "" && s.MessageType != "":
+		return fmt.Sprintf("%s on topic %s", s.MessageType, s.Topic)
+	case s.Topic != "":
+		return "topic " + s.Topic
+	default:
+		return "message type " + s.MessageType
+	}
+}
+
+// Definition is one registered version of a subject's schema.
+type Definition struct {
+	Subject
+	Version int             `json:"version"`
+	Schema  json.RawMessage `json:"schema"` // The JSON Schema document
+
+	compiled *Schema
+}
+
+// Registry holds the schema versions of all subjects.
+//
+// A payload is checked against the most specific subject that has schemas:
+// its topic and message type, then its topic, then its message type. Payloads
+// without a matching subject are not checked.
+//
+// Producers may pin the version their payload follows. Unpinned payloads are
+// accepted by the newest version they match, so producers of an older
+// version keep working while newer ones roll out; the matching version is
+// reported back so consumers can tell the shapes apart.
+//
+// Thread Safety: All methods are safe for concurrent use.
+type Registry struct {
+	subjects map[Subject][]*Definition // Versions in ascending order
+	mux      sync.RWMutex
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{subjects: make(map[Subject][]*Definition)}
+}
+
+// Register compiles and adds a schema version for a subject. Version 0 is
+// taken as 1.
+func (r *Registry) Register(subject Subject, version int, document []byte) error {
+	if subject.Topic == "" && subject.MessageType == "" {
+		return fmt.Errorf("schema needs a topic or message type")
+	}
+	if version < 0 {
+		return fmt.Errorf("schema for %s: version cannot be negative", subject)
+	}
+	if version == 0 {
+		version = 1
+	}
+
+	compiled, err := Compile(document)
+	if err != nil {
+		return fmt.Errorf("schema for %s version %d: %w", subject, version, err)
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	versions := r.subjects[subject]
+	for _, existing := range versions {
+		if existing.Version == version {
+			return fmt.Errorf("schema for %s version %d is declared twice", subject, version)
+		}
+	}
+	versions = append(versions, &Definition{
+		Subject:  subject,
+		Version:  version,
+		Schema:   json.RawMessage(document),
+		compiled: compiled,
+	})
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	r.subjects[subject] = versions
+	return nil
+}
+
+// Len returns the number of registered schema versions.
+func (r *Registry) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	n := 0
+	for _, versions := range r.subjects {
+		n += len(versions)
+	}
+	return n
+}
+
+// Lookup returns the schema versions that apply to a payload on topic of
+// messageType, oldest first. Nil when the payload is not checked.
+func (r *Registry) Lookup(topic, messageType string) []Definition {
+	if r == nil {
+		return nil
+	}
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	versions := r.lookup(topic, messageType)
+	definitions := make([]Definition, 0, len(versions))
+	for _, d := range versions {
+		definitions = append(definitions, *d)
+	}
+	return definitions
+}
+
+// Definitions returns all registered schema versions, ordered by subject and
+// version.
+func (r *Registry) Definitions() []Definition {
+	if r == nil {
+		return nil
+	}
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	var definitions []Definition
+	for _, versions := range r.subjects {
+		for _, d := range versions {
+			definitions = append(definitions, *d)
+		}
+	}
+	sort.Slice(definitions, func(i, j int) bool {
+		a, b := definitions[i], definitions[j]
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		if a.MessageType != b.MessageType {
+			return a.MessageType < b.MessageType
+		}
+		return a.Version < b.Version
+	})
+	return definitions
+}
+
+// lookup returns the versions of the most specific subject. Caller holds mux.
+func (r *Registry) lookup(topic, messageType string) []*Definition {
+	candidates := []Subject{
+		{Topic: topic, MessageType: messageType},
+		{Topic: topic},
+		{MessageType: messageType},
+	}
+	for _, subject := range candidates {
+		if subject.Topic == "" && subject.MessageType == "" {
+			continue
+		}
+		if versions := r.subjects[subject]; len(versions) > 0 {
+			return versions
+		}
+	}
+	return nil
+}
+
+// Validate checks a JSON payload published on topic (empty for pipes) with
+// messageType. With version > 0 the payload must match that version;
+// otherwise the newest matching version is taken. Returns the version the
+// payload matched, or 0 when no schema applies.
+//
+// A payload matching no version fails with the violations of the newest
+// one (or of the pinned one) as *ValidationError.
+func (r *Registry) Validate(topic, messageType string, payload []byte, version int) (int, error) {
+	if r == nil {
+		return 0, nil
+	}
+	r.mux.RLock()
+	versions := r.lookup(topic, messageType)
+	r.mux.RUnlock()
+	if len(versions) == 0 {
+		return 0, nil
+	}
+
+	var value interface{}
+	if len(payload) == 0 {
+		payload = []byte("null")
+	}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return 0, &ValidationError{Violations: []string{fmt.Sprintf("$: invalid JSON: %v", err)}}
+	}
+	return validate(versions, value, version)
+}
+
+// ValidateValue is Validate for payloads that are already decoded.
+func (r *Registry) ValidateValue(topic, messageType string, payload interface{}, version int) (int, error) {
+	if r == nil {
+		return 0, nil
+	}
+	r.mux.RLock()
+	versions := r.lookup(topic, messageType)
+	r.mux.RUnlock()
+	if len(versions) == 0 {
+		return 0, nil
+	}
+	return validate(versions, normalize(payload), version)
+}
+
+// validate checks value against the pinned or the newest matching version.
+func validate(versions []*Definition, value interface{}, version int) (int, error) {
+	if version > 0 {
+		for _, d := range versions {
+			if d.Version == version {
+				return version, d.compiled.Validate(value)
+			}
+		}
+		return 0, fmt.Errorf("%w %d for %s", ErrUnknownVersion, version, versions[0].Subject)
+	}
+
+	newest := versions[len(versions)-1]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].compiled.matches(value) {
+			return versions[i].Version, nil
+		}
+	}
+	return newest.Version, newest.compiled.Validate(value)
+}
+
+// Load builds the registry from the schemas declared in the cells. Schema
+// files are resolved against baseDir.
+func Load(cells *config.CellsConfig, baseDir string) (*Registry, error) {
+	registry := NewRegistry()
+	if cells == nil {
+		return registry, nil
+	}
+
+	for _, cell := range cells.Cells {
+		for _, declared := range cell.Schemas {
+			document, err := documentOf(declared, baseDir)
+			if err != nil {
+				return nil, fmt.Errorf("cell '%s': %w", cell.ID, err)
+			}
+			subject := Subject{Topic: declared.Topic, MessageType: declared.MessageType}
+			if err := registry.Register(subject, declared.Version, document); err != nil {
+				return nil, fmt.Errorf("cell '%s': %w", cell.ID, err)
+			}
+		}
+	}
+	return registry, nil
+}
+
+// FromConfig loads the cells of a cellorg configuration and builds the
+// registry from their schemas.
+func FromConfig(cfg *config.Config) (*Registry, error) {
+	cells, err := cfg.LoadCells()
+	if err != nil {
+		return nil, err
+	}
+	baseDir := "."
+	if len(cfg.BaseDir) > 0 {
+		baseDir = cfg.BaseDir[0]
+	}
+	return Load(cells, baseDir)
+}
+
+// documentOf returns the JSON Schema of a declaration, inline or from its file.
+func documentOf(declared config.SchemaConfig, baseDir string) ([]byte, error) {
+	if declared.File != "" && declared.Schema != nil {
+		return nil, fmt.Errorf("schema for topic %q type %q has both schema and file", declared.Topic, declared.MessageType)
+	}
+	if declared.Schema != nil {
+		document, err := json.Marshal(declared.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("schema for topic %q type %q: %w", declared.Topic, declared.MessageType, err)
+		}
+		return document, nil
+	}
+	if declared.File == "" {
+		return nil, fmt.Errorf("schema for topic %q type %q needs schema or file", declared.Topic, declared.MessageType)
+	}
+
+	path := declared.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(baseDir, path)
+	}
+	document, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema file: %w", err)
+	}
+	return document, nil
+}
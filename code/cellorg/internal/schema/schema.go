@@ -0,0 +1,486 @@
+// Package schema validates message payloads against JSON Schemas declared
+// per topic or message type in the cell configuration.
+//
+// The validator covers the JSON Schema keywords used to describe message
+// payloads: type, properties, required, additionalProperties, items, enum,
+// const, the numeric, string, array and object bounds, pattern, and the
+// allOf/anyOf/oneOf/not combinators. Annotations such as title, description
+// or $schema are ignored; references ($ref) are not supported.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxViolations caps the violations reported for one payload.
+const maxViolations = 10
+
+// Schema is a compiled JSON Schema.
+type Schema struct {
+	types []string // Allowed JSON types; empty allows any
+
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema // Schema of undeclared properties; nil allows any
+	noAdditional         bool    // additionalProperties: false
+	minProperties        *int
+	maxProperties        *int
+
+	items    *Schema
+	minItems *int
+	maxItems *int
+
+	enum     []interface{}
+	constant *interface{}
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	allOf []*Schema
+	anyOf []*Schema
+	oneOf []*Schema
+	not   *Schema
+}
+
+// document is the JSON form of a schema before compilation.
+type document struct {
+	Type                 json.RawMessage            `json:"type"`
+	Properties           map[string]json.RawMessage `json:"properties"`
+	Required             []string                   `json:"required"`
+	AdditionalProperties json.RawMessage            `json:"additionalProperties"`
+	MinProperties        *int                       `json:"minProperties"`
+	MaxProperties        *int                       `json:"maxProperties"`
+	Items                json.RawMessage            `json:"items"`
+	MinItems             *int                       `json:"minItems"`
+	MaxItems             *int                       `json:"maxItems"`
+	Enum                 []interface{}              `json:"enum"`
+	Const                json.RawMessage            `json:"const"`
+	Minimum              *float64                   `json:"minimum"`
+	Maximum              *float64                   `json:"maximum"`
+	ExclusiveMinimum     *float64                   `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *float64                   `json:"exclusiveMaximum"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	Pattern              string                     `json:"pattern"`
+	AllOf                []json.RawMessage          `json:"allOf"`
+	AnyOf                []json.RawMessage          `json:"anyOf"`
+	OneOf                []json.RawMessage          `json:"oneOf"`
+	Not                  json.RawMessage            `json:"not"`
+	Ref                  string                     `json:"$ref"`
+}
+
+var jsonTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// Compile parses a JSON Schema document.
+func Compile(data []byte) (*Schema, error) {
+	return compile(data, "$")
+}
+
+// compile parses the schema at path; path names the location in errors.
+func compile(data []byte, path string) (*Schema, error) {
+	data = bytes.TrimSpace(data)
+	if string(data) == "true" {
+		return &Schema{}, nil
+	}
+	if string(data) == "false" {
+		return &Schema{not: &Schema{}}, nil
+	}
+
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: invalid schema: %w", path, err)
+	}
+	if doc.Ref != "" {
+		return nil, fmt.Errorf("%s: $ref is not supported", path)
+	}
+
+	s := &Schema{
+		required:      doc.Required,
+		minProperties: doc.MinProperties,
+		maxProperties: doc.MaxProperties,
+		minItems:      doc.MinItems,
+		maxItems:      doc.MaxItems,
+		enum:          normalizeAll(doc.Enum),
+		minimum:       doc.Minimum,
+		maximum:       doc.Maximum,
+
+		exclusiveMinimum: doc.ExclusiveMinimum,
+		exclusiveMaximum: doc.ExclusiveMaximum,
+
+		minLength: doc.MinLength,
+		maxLength: doc.MaxLength,
+	}
+
+	if len(doc.Type) > 0 {
+		var single string
+		if err := json.Unmarshal(doc.Type, &single); err == nil {
+			s.types = []string{single}
+		} else if err := json.Unmarshal(doc.Type, &s.types); err != nil {
+			return nil, fmt.Errorf("%s: type must be a string or a list of strings", path)
+		}
+		for _, t := range s.types {
+			if !jsonTypes[t] {
+				return nil, fmt.Errorf("%s: unknown type %q", path, t)
+			}
+		}
+	}
+
+	if len(doc.Properties) > 0 {
+		s.properties = make(map[string]*Schema, len(doc.Properties))
+		for name, raw := range doc.Properties {
+			property, err := compile(raw, path+"."+name)
+			if err != nil {
+				return nil, err
+			}
+			s.properties[name] = property
+		}
+	}
+
+	if len(doc.AdditionalProperties) > 0 {
+		if string(bytes.TrimSpace(doc.AdditionalProperties)) == "false" {
+			s.noAdditional = true
+		} else {
+			additional, err := compile(doc.AdditionalProperties, path+".*")
+			if err != nil {
+				return nil, err
+			}
+			s.additionalProperties = additional
+		}
+	}
+
+	if len(doc.Items) > 0 {
+		items, err := compile(doc.Items, path+"[]")
+		if err != nil {
+			return nil, err
+		}
+		s.items = items
+	}
+
+	if len(doc.Const) > 0 {
+		var constant interface{}
+		if err := json.Unmarshal(doc.Const, &constant); err != nil {
+			return nil, fmt.Errorf("%s: invalid const: %w", path, err)
+		}
+		constant = normalize(constant)
+		s.constant = &constant
+	}
+
+	if doc.Pattern != "" {
+		pattern, err := regexp.Compile(doc.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern: %w", path, err)
+		}
+		s.pattern = pattern
+	}
+
+	var err error
+	if s.allOf, err = compileAll(doc.AllOf, path, "allOf"); err != nil {
+		return nil, err
+	}
+	if s.anyOf, err = compileAll(doc.AnyOf, path, "anyOf"); err != nil {
+		return nil, err
+	}
+	if s.oneOf, err = compileAll(doc.OneOf, path, "oneOf"); err != nil {
+		return nil, err
+	}
+	if len(doc.Not) > 0 {
+		if s.not, err = compile(doc.Not, path+"(not)"); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// compileAll compiles the subschemas of a combinator.
+func compileAll(raws []json.RawMessage, path, keyword string) ([]*Schema, error) {
+	schemas := make([]*Schema, 0, len(raws))
+	for i, raw := range raws {
+		s, err := compile(raw, fmt.Sprintf("%s(%s %d)", path, keyword, i))
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, s)
+	}
+	return schemas, nil
+}
+
+// ValidationError lists why a payload does not match a schema. Each
+// violation starts with the path of the offending value ("$" is the root).
+type ValidationError struct {
+	Violations []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Violations, "; ")
+}
+
+// ValidateJSON checks a JSON document against the schema.
+func (s *Schema) ValidateJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return &ValidationError{Violations: []string{fmt.Sprintf("$: invalid JSON: %v", err)}}
+	}
+	return s.Validate(value)
+}
+
+// Validate checks a decoded value against the schema. Values decoded from
+// JSON or msgpack are accepted, as are maps, slices and Go numbers.
+func (s *Schema) Validate(value interface{}) error {
+	var violations []string
+	s.check(normalize(value), "$", &violations)
+	if len(violations) == 0 {
+		return nil
+	}
+	if len(violations) > maxViolations {
+		violations = append(violations[:maxViolations], fmt.Sprintf("and %d more", len(violations)-maxViolations))
+	}
+	return &ValidationError{Violations: violations}
+}
+
+// matches reports whether value satisfies the schema.
+func (s *Schema) matches(value interface{}) bool {
+	var violations []string
+	s.check(value, "$", &violations)
+	return len(violations) == 0
+}
+
+// check appends the violations of value at path.
+func (s *Schema) check(value interface{}, path string, violations *[]string) {
+	fail := func(format string, args ...interface{}) {
+		*violations = append(*violations, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(s.types) > 0 && !hasType(value, s.types) {
+		fail("expected %s, got %s", strings.Join(s.types, " or "), typeOf(value))
+		return
+	}
+	if s.constant != nil && !reflect.DeepEqual(value, *s.constant) {
+		fail("must equal %s", encode(*s.constant))
+	}
+	if len(s.enum) > 0 && !contains(s.enum, value) {
+		fail("must be one of %s", encode(s.enum))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		s.checkObject(v, path, violations)
+	case []interface{}:
+		if s.minItems != nil && len(v) < *s.minItems {
+			fail("must have at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			fail("must have at most %d items", *s.maxItems)
+		}
+		if s.items != nil {
+			for i, item := range v {
+				s.items.check(item, fmt.Sprintf("%s[%d]", path, i), violations)
+			}
+		}
+	case string:
+		length := len([]rune(v))
+		if s.minLength != nil && length < *s.minLength {
+			fail("must be at least %d characters", *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			fail("must be at most %d characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match %s", s.pattern)
+		}
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			fail("must be >= %v", *s.minimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			fail("must be <= %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+			fail("must be > %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+			fail("must be < %v", *s.exclusiveMaximum)
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.check(value, path, violations)
+	}
+	if len(s.anyOf) > 0 {
+		matched := false
+		for _, sub := range s.anyOf {
+			if sub.matches(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must match at least one schema of anyOf")
+		}
+	}
+	if len(s.oneOf) > 0 {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if sub.matches(value) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("must match exactly one schema of oneOf, matched %d", matched)
+		}
+	}
+	if s.not != nil && s.not.matches(value) {
+		fail("must not match the schema of not")
+	}
+}
+
+// checkObject appends the violations of an object's properties.
+func (s *Schema) checkObject(object map[string]interface{}, path string, violations *[]string) {
+	for _, name := range s.required {
+		if _, ok := object[name]; !ok {
+			*violations = append(*violations, fmt.Sprintf("%s: missing required property %q", path, name))
+		}
+	}
+	if s.minProperties != nil && len(object) < *s.minProperties {
+		*violations = append(*violations, fmt.Sprintf("%s: must have at least %d properties", path, *s.minProperties))
+	}
+	if s.maxProperties != nil && len(object) > *s.maxProperties {
+		*violations = append(*violations, fmt.Sprintf("%s: must have at most %d properties", path, *s.maxProperties))
+	}
+
+	// Sorted for stable error messages
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := object[name]
+		if property, ok := s.properties[name]; ok {
+			property.check(value, path+"."+name, violations)
+		} else if s.noAdditional {
+			*violations = append(*violations, fmt.Sprintf("%s: unexpected property %q", path, name))
+		} else if s.additionalProperties != nil {
+			s.additionalProperties.check(value, path+"."+name, violations)
+		}
+	}
+}
+
+// hasType reports whether value is one of the JSON types.
+func hasType(value interface{}, types []string) bool {
+	actual := typeOf(value)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf returns the JSON type of a normalized value; whole numbers are
+// "integer".
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// normalize converts a decoded value to the types encoding/json produces,
+// so payloads decoded by other codecs validate alike. The value itself is
+// left unchanged.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, string, float64:
+		return v
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			object[key] = normalize(item)
+		}
+		return object
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = normalize(item)
+		}
+		return list
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case float32:
+		return float64(v)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return reflect.ValueOf(v).Convert(reflect.TypeOf(float64(0))).Float()
+	default:
+		// Other maps, slices and structs via their JSON form
+		data, err := json.Marshal(v)
+		if err != nil {
+			return v
+		}
+		var decoded interface{}
+		if json.Unmarshal(data, &decoded) != nil {
+			return v
+		}
+		return decoded
+	}
+}
+
+// normalizeAll normalizes each value of a list.
+func normalizeAll(values []interface{}) []interface{} {
+	for i, v := range values {
+		values[i] = normalize(v)
+	}
+	return values
+}
+
+// contains reports whether values holds value.
+func contains(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// encode renders a value as JSON for error messages.
+func encode(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
@@ -0,0 +1,183 @@
+package schema
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tenzoki/agen/cellorg/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+const chunkSchema = `{
+	"type": "object",
+	"required": ["text", "index"],
+	"additionalProperties": false,
+	"properties": {
+		"text":  {"type": "string", "minLength": 1},
+		"index": {"type": "integer", "minimum": 0},
+		"lang":  {"enum": ["de", "en"]},
+		"tags":  {"type": "array", "items": {"type": "string"}, "maxItems": 3}
+	}
+}`
+
+// Test that payloads are checked against the supported keywords
+func TestValidate(t *testing.T) {
+	s, err := Compile([]byte(chunkSchema))
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	valid := []string{
+		`{"text": "Hallo", "index": 0}`,
+		`{"text": "Hello", "index": 3, "lang": "en", "tags": ["a", "b"]}`,
+	}
+	for _, payload := range valid {
+		if err := s.ValidateJSON([]byte(payload)); err != nil {
+			t.Errorf("Expected %s to be valid, got %v", payload, err)
+		}
+	}
+
+	invalid := map[string]string{
+		`{"index": 0}`:                             `$: missing required property "text"`,
+		`{"text": 42, "index": 0}`:                 `$.text: expected string, got integer`,
+		`{"text": "", "index": 0}`:                 `$.text: must be at least 1 characters`,
+		`{"text": "x", "index": 1.5}`:              `$.index: expected integer, got number`,
+		`{"text": "x", "index": -1}`:               `$.index: must be >= 0`,
+		`{"text": "x", "index": 0, "lang": "fr"}`:  `$.lang: must be one of ["de","en"]`,
+		`{"text": "x", "index": 0, "tags": [1]}`:   `$.tags[0]: expected string, got integer`,
+		`{"text": "x", "index": 0, "extra": true}`: `$: unexpected property "extra"`,
+		`["text"]`: `$: expected object, got array`,
+	}
+	for payload, want := range invalid {
+		err := s.ValidateJSON([]byte(payload))
+		var violation *ValidationError
+		if !errors.As(err, &violation) || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %s to fail with %q, got %v", payload, want, err)
+		}
+	}
+
+	// Decoded values from other codecs validate like JSON
+	if err := s.Validate(map[string]interface{}{"text": "x", "index": int64(2)}); err != nil {
+		t.Errorf("Expected integer payload to be valid, got %v", err)
+	}
+}
+
+// Test combinators and unsupported schemas
+func TestCompileCombinators(t *testing.T) {
+	s, err := Compile([]byte(`{"oneOf": [{"type": "string"}, {"type": "integer"}], "not": {"const": "none"}}`))
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	for value, valid := range map[string]bool{`"text"`: true, `7`: true, `1.5`: false, `"none"`: false} {
+		if err := s.ValidateJSON([]byte(value)); (err == nil) != valid {
+			t.Errorf("Expected %s valid=%v, got %v", value, valid, err)
+		}
+	}
+
+	for _, document := range []string{`{"$ref": "#/definitions/x"}`, `{"type": "text"}`, `{"pattern": "("}`} {
+		if _, err := Compile([]byte(document)); err == nil {
+			t.Errorf("Expected %s to be rejected", document)
+		}
+	}
+}
+
+// Test that the registry picks the most specific subject and tracks versions
+func TestRegistryVersions(t *testing.T) {
+	r := NewRegistry()
+	v1 := `{"type": "object", "required": ["text"]}`
+	v2 := `{"type": "object", "required": ["text", "lang"]}`
+	if err := r.Register(Subject{Topic: "extracted-text"}, 1, []byte(v1)); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if err := r.Register(Subject{Topic: "extracted-text"}, 2, []byte(v2)); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if err := r.Register(Subject{Topic: "extracted-text"}, 2, []byte(v2)); err == nil {
+		t.Error("Expected duplicate version to be rejected")
+	}
+	if err := r.Register(Subject{MessageType: "chunk"}, 0, []byte(`{"type": "string"}`)); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	// Unpinned payloads get the newest version they match
+	if version, err := r.Validate("extracted-text", "text", []byte(`{"text": "a", "lang": "de"}`), 0); err != nil || version != 2 {
+		t.Errorf("Expected version 2, got %d %v", version, err)
+	}
+	if version, err := r.Validate("extracted-text", "text", []byte(`{"text": "a"}`), 0); err != nil || version != 1 {
+		t.Errorf("Expected version 1, got %d %v", version, err)
+	}
+	if version, err := r.Validate("extracted-text", "text", []byte(`{}`), 0); err == nil || version != 2 {
+		t.Errorf("Expected failure against version 2, got %d %v", version, err)
+	}
+
+	// Pinned payloads must match their version
+	if _, err := r.Validate("extracted-text", "text", []byte(`{"text": "a"}`), 2); err == nil {
+		t.Error("Expected payload pinned to version 2 to fail")
+	}
+	if _, err := r.Validate("extracted-text", "text", []byte(`{"text": "a"}`), 3); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("Expected ErrUnknownVersion, got %v", err)
+	}
+
+	// The topic subject wins over the message type; unknown subjects pass
+	if _, err := r.Validate("extracted-text", "chunk", []byte(`{"text": "a"}`), 0); err != nil {
+		t.Errorf("Expected topic schema to apply, got %v", err)
+	}
+	if _, err := r.Validate("", "chunk", []byte(`{"text": "a"}`), 0); err == nil {
+		t.Error("Expected message type schema to apply to pipes")
+	}
+	if version, err := r.Validate("other", "text", []byte(`42`), 0); err != nil || version != 0 {
+		t.Errorf("Expected unchecked payload, got %d %v", version, err)
+	}
+
+	if r.Len() != 3 || len(r.Lookup("extracted-text", "")) != 2 || len(r.Definitions()) != 3 {
+		t.Errorf("Unexpected registry contents: %+v", r.Definitions())
+	}
+}
+
+// Test that schemas are loaded inline and from files declared in cells
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "entities.json"), []byte(`{"type": "array"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var cell struct {
+		Cell config.Cell `yaml:"cell"`
+	}
+	err := yaml.Unmarshal([]byte(`
+cell:
+  id: "pipeline:ner"
+  schemas:
+    - topic: "extracted-text"
+      version: 1
+      schema:
+        type: object
+        required: [text]
+        properties:
+          text: {type: string}
+    - message_type: "entities"
+      file: "entities.json"
+`), &cell)
+	if err != nil {
+		t.Fatalf("Failed to parse cell: %v", err)
+	}
+
+	r, err := Load(&config.CellsConfig{Cells: []config.Cell{cell.Cell}}, dir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if _, err := r.Validate("extracted-text", "text", []byte(`{"text": 1}`), 0); err == nil {
+		t.Error("Expected inline schema to apply")
+	}
+	if _, err := r.Validate("", "entities", []byte(`[]`), 0); err != nil {
+		t.Errorf("Expected file schema to apply, got %v", err)
+	}
+
+	cell.Cell.Schemas = append(cell.Cell.Schemas, config.SchemaConfig{Topic: "missing", File: "missing.json"})
+	if _, err := Load(&config.CellsConfig{Cells: []config.Cell{cell.Cell}}, dir); err == nil {
+		t.Error("Expected missing schema file to fail")
+	}
+}
@@ -0,0 +1,231 @@
+package support
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	cellconfig "github.com/tenzoki/agen/cellorg/internal/config"
+)
+
+const (
+	defaultHeartbeatInterval = 15 * time.Second // Asked of agents whose cell sets no health_check_interval
+	heartbeatMisses          = 3                // Heartbeats an agent may miss before it counts as silent
+	livenessCheckPeriod      = time.Second      // How often agents are checked for silence
+)
+
+// ErrCodeUnknownAgent is returned for heartbeats of unregistered agents,
+// telling them to register again.
+const ErrCodeUnknownAgent = -32004
+
+// Health failure reasons reported by cellorg_support_health_failures_total.
+const (
+	HealthSilent    = "silent"    // No heartbeat for heartbeatMisses intervals
+	HealthUnhealthy = "unhealthy" // The agent's health probe failed
+)
+
+// SetHealthChecks applies the health_check_interval of each cell's
+// orchestration block to the cell's agents. Agents of such cells that stay
+// silent for several intervals are moved to the error state. Invalid
+// intervals are logged and ignored. Safe to call while the service runs.
+func (s *Service) SetHealthChecks(cells *cellconfig.CellsConfig) {
+	intervals := make(map[string]time.Duration)
+	for _, cell := range cells.Cells {
+		interval, err := cell.Orchestration.HealthCheck()
+		if err != nil {
+			log.Printf("Support service: ignoring health checks of cell %s: %v", cell.ID, err)
+			continue
+		}
+		if interval == 0 {
+			continue
+		}
+		for _, agent := range cell.Agents {
+			intervals[agent.ID] = interval
+		}
+	}
+
+	s.agentsMux.Lock()
+	s.healthIntervals = intervals
+	s.agentsMux.Unlock()
+}
+
+// OnStateChange adds a listener for agent state changes, both reported by
+// agents and made by the liveness monitor. Listeners are called one at a
+// time, outside the registry lock.
+func (s *Service) OnStateChange(listener func(agentID string, event StateChangeEvent)) {
+	s.listenersMux.Lock()
+	defer s.listenersMux.Unlock()
+	s.stateListeners = append(s.stateListeners, listener)
+}
+
+// heartbeatInterval returns how often an agent is expected to send
+// heartbeats and whether it is monitored for silence: agents of cells with
+// a health_check_interval always are, others once they sent a heartbeat.
+// The caller must hold s.agentsMux.
+func (s *Service) heartbeatInterval(agent *AgentRegistration) (time.Duration, bool) {
+	if interval, ok := s.healthIntervals[agent.ID]; ok {
+		return interval, true
+	}
+	return defaultHeartbeatInterval, !agent.LastHeartbeat.IsZero()
+}
+
+// changeState moves an agent to a new state and records it in the history
+// and, if the registry is persistent, in the audit. The caller must hold
+// s.agentsMux and pass the event to notifyStateChange once it is released.
+func (s *Service) changeState(agent *AgentRegistration, state, reason string) StateChangeEvent {
+	event := StateChangeEvent{
+		FromState: agent.State,
+		ToState:   state,
+		Timestamp: time.Now(),
+		Reason:    reason,
+	}
+	agent.State = state
+	agent.StateHistory = append(agent.StateHistory, event)
+	s.persistAgent(agent, &event)
+	return event
+}
+
+// notifyStateChange counts a state change and passes it to the listeners.
+func (s *Service) notifyStateChange(agentID string, event StateChangeEvent) {
+	s.metrics.stateChanges.Inc(event.ToState)
+
+	s.listenersMux.Lock()
+	defer s.listenersMux.Unlock()
+	for _, listener := range s.stateListeners {
+		listener(agentID, event)
+	}
+}
+
+// failAgent moves an agent the support service considers dead or unhealthy
+// to the error state, remembering the state to return to once it recovers.
+// Returns false if the agent is stopped or already in the error state. The
+// caller must hold s.agentsMux.
+func (s *Service) failAgent(agent *AgentRegistration, failure, reason string) (StateChangeEvent, bool) {
+	if agent.State == "stopped" || agent.State == "error" {
+		return StateChangeEvent{}, false
+	}
+	agent.RecoverState = agent.State
+	agent.Failure = failure
+	return s.changeState(agent, "error", reason), true
+}
+
+// handleHeartbeat records that an agent is alive, along with the result of
+// its health probe. A failing probe moves the agent to the error state; a
+// passing one returns an agent the support service failed to its previous
+// state. The result tells the agent how often to send heartbeats.
+func (s *Service) handleHeartbeat(req *Request) *Response {
+	var params struct {
+		AgentID string `json:"agent_id"`
+		Healthy bool   `json:"healthy"`
+		Detail  string `json:"detail,omitempty"` // Why the health probe failed
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return &Response{
+			ID:    req.ID,
+			Error: &Error{Code: -32602, Message: "Invalid params"},
+		}
+	}
+
+	s.agentsMux.Lock()
+	agent, exists := s.agents[params.AgentID]
+	if !exists {
+		s.agentsMux.Unlock()
+		return &Response{
+			ID:    req.ID,
+			Error: &Error{Code: ErrCodeUnknownAgent, Message: "Agent not found"},
+		}
+	}
+
+	now := time.Now()
+	first := agent.LastHeartbeat.IsZero()
+	agent.LastPing = now
+	agent.LastHeartbeat = now
+	agent.Unconfirmed = false
+	interval, _ := s.heartbeatInterval(agent)
+
+	var event StateChangeEvent
+	var changed bool
+	switch {
+	case !params.Healthy:
+		event, changed = s.failAgent(agent, HealthUnhealthy, "health check failed: "+params.Detail)
+	case agent.State == "error" && agent.RecoverState != "":
+		recovered := agent.RecoverState
+		agent.RecoverState = ""
+		agent.Failure = ""
+		event, changed = s.changeState(agent, recovered, "agent healthy again"), true
+	}
+	if first && !changed {
+		s.persistAgent(agent, nil) // Heartbeating agents stay monitored after a restart
+	}
+	state := agent.State
+	s.agentsMux.Unlock()
+
+	if changed {
+		if event.ToState == "error" {
+			s.metrics.healthFailures.Inc(HealthUnhealthy)
+		}
+		log.Printf("Agent %s state change: %s → %s (%s)", params.AgentID, event.FromState, event.ToState, event.Reason)
+		s.notifyStateChange(params.AgentID, event)
+	}
+
+	return &Response{
+		ID: req.ID,
+		Result: map[string]interface{}{
+			"state":       state,
+			"interval_ms": interval.Milliseconds(),
+		},
+	}
+}
+
+// monitorLiveness periodically moves agents that stopped sending heartbeats
+// to the error state until ctx is done.
+func (s *Service) monitorLiveness(ctx context.Context) {
+	ticker := time.NewTicker(livenessCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.checkLiveness(now)
+		}
+	}
+}
+
+// checkLiveness moves the monitored agents not seen for heartbeatMisses
+// intervals to the error state. Agents restored after a restart that have
+// not checked back in are given the intervals from the restart on.
+func (s *Service) checkLiveness(now time.Time) {
+	type failure struct {
+		agentID string
+		event   StateChangeEvent
+	}
+	var failed []failure
+
+	s.agentsMux.Lock()
+	for id, agent := range s.agents {
+		interval, monitored := s.heartbeatInterval(agent)
+		seen := agent.LastPing
+		if agent.Unconfirmed && s.restoredAt.After(seen) {
+			seen = s.restoredAt
+		}
+		silence := now.Sub(seen)
+		if !monitored || silence <= heartbeatMisses*interval {
+			continue
+		}
+		reason := fmt.Sprintf("no heartbeat for %v", silence.Round(time.Second))
+		if event, ok := s.failAgent(agent, HealthSilent, reason); ok {
+			failed = append(failed, failure{agentID: id, event: event})
+		}
+	}
+	s.agentsMux.Unlock()
+
+	for _, f := range failed {
+		s.metrics.healthFailures.Inc(HealthSilent)
+		log.Printf("Agent %s state change: %s → %s (%s)", f.agentID, f.event.FromState, f.event.ToState, f.event.Reason)
+		s.notifyStateChange(f.agentID, f.event)
+	}
+}
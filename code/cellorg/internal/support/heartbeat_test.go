@@ -0,0 +1,139 @@
+package support
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// newRequest builds a support request with JSON-encoded params
+func newRequest(t *testing.T, method string, params interface{}) *Request {
+	t.Helper()
+	data, err := json.Marshal(params)
+	if err != nil {
+		t.Fatalf("Failed to marshal params: %v", err)
+	}
+	return &Request{ID: "req_" + method, Method: method, Params: data}
+}
+
+// registerTestAgent registers an agent and reports it running
+func registerTestAgent(t *testing.T, s *Service, agentID string) {
+	t.Helper()
+	resp := s.handleRequest(newRequest(t, "register_agent", map[string]interface{}{
+		"agent_id":   agentID,
+		"agent_type": "health-test",
+	}))
+	if resp.Error != nil {
+		t.Fatalf("Failed to register %s: %s", agentID, resp.Error.Message)
+	}
+	resp = s.handleRequest(newRequest(t, "report_state_change", map[string]interface{}{
+		"agent_id": agentID,
+		"state":    "running",
+	}))
+	if resp.Error != nil {
+		t.Fatalf("Failed to report %s running: %s", agentID, resp.Error.Message)
+	}
+}
+
+// heartbeat sends a heartbeat and returns the state the service answers with
+func heartbeat(t *testing.T, s *Service, agentID string, healthy bool, detail string) string {
+	t.Helper()
+	resp := s.handleRequest(newRequest(t, "heartbeat", map[string]interface{}{
+		"agent_id": agentID,
+		"healthy":  healthy,
+		"detail":   detail,
+	}))
+	if resp.Error != nil {
+		t.Fatalf("Heartbeat of %s failed: %s", agentID, resp.Error.Message)
+	}
+	return resp.Result.(map[string]interface{})["state"].(string)
+}
+
+// agentState returns the state the registry holds for an agent
+func agentState(s *Service, agentID string) (state, failure, recoverState string) {
+	s.agentsMux.Lock()
+	defer s.agentsMux.Unlock()
+	agent := s.agents[agentID]
+	return agent.State, agent.Failure, agent.RecoverState
+}
+
+func TestHeartbeatUnknownAgent(t *testing.T) {
+	s := NewService(SupportConfig{Port: ":0", Debug: true})
+
+	resp := s.handleRequest(newRequest(t, "heartbeat", map[string]interface{}{
+		"agent_id": "ghost",
+		"healthy":  true,
+	}))
+	if resp.Error == nil || resp.Error.Code != ErrCodeUnknownAgent {
+		t.Fatalf("Expected unknown agent error, got %+v", resp)
+	}
+}
+
+func TestUnhealthyHeartbeatFailsAgent(t *testing.T) {
+	s := NewService(SupportConfig{Port: ":0", Debug: true})
+	registerTestAgent(t, s, "worker")
+
+	var events []StateChangeEvent
+	s.OnStateChange(func(agentID string, event StateChangeEvent) {
+		events = append(events, event)
+	})
+
+	if state := heartbeat(t, s, "worker", false, "disk full"); state != "error" {
+		t.Fatalf("Expected error state after unhealthy heartbeat, got %s", state)
+	}
+	state, failure, recoverState := agentState(s, "worker")
+	if state != "error" || failure != HealthUnhealthy || recoverState != "running" {
+		t.Errorf("Expected error/%s/running, got %s/%s/%s", HealthUnhealthy, state, failure, recoverState)
+	}
+	if len(events) != 1 || events[0].Reason != "health check failed: disk full" {
+		t.Errorf("Expected one state change for the failed check, got %+v", events)
+	}
+
+	// Further failing heartbeats leave the agent in the error state
+	heartbeat(t, s, "worker", false, "disk full")
+	if len(events) != 1 {
+		t.Errorf("Expected no further state changes, got %d", len(events))
+	}
+}
+
+func TestHealthyHeartbeatRecoversAgent(t *testing.T) {
+	s := NewService(SupportConfig{Port: ":0", Debug: true})
+	registerTestAgent(t, s, "worker")
+
+	heartbeat(t, s, "worker", false, "disk full")
+	if state := heartbeat(t, s, "worker", true, ""); state != "running" {
+		t.Fatalf("Expected running state after healthy heartbeat, got %s", state)
+	}
+	state, failure, recoverState := agentState(s, "worker")
+	if state != "running" || failure != "" || recoverState != "" {
+		t.Errorf("Expected running with no failure, got %s/%s/%s", state, failure, recoverState)
+	}
+}
+
+func TestSilentAgentFails(t *testing.T) {
+	s := NewService(SupportConfig{Port: ":0", Debug: true})
+	registerTestAgent(t, s, "worker")
+	registerTestAgent(t, s, "quiet") // Never sent a heartbeat, so not monitored
+
+	heartbeat(t, s, "worker", true, "")
+	now := time.Now()
+
+	s.checkLiveness(now.Add(heartbeatMisses * defaultHeartbeatInterval / 2))
+	if state, _, _ := agentState(s, "worker"); state != "running" {
+		t.Fatalf("Expected worker still running within the interval, got %s", state)
+	}
+
+	s.checkLiveness(now.Add(heartbeatMisses*defaultHeartbeatInterval + time.Second))
+	state, failure, recoverState := agentState(s, "worker")
+	if state != "error" || failure != HealthSilent || recoverState != "running" {
+		t.Errorf("Expected silent worker failed, got %s/%s/%s", state, failure, recoverState)
+	}
+	if state, _, _ := agentState(s, "quiet"); state != "running" {
+		t.Errorf("Expected agent without heartbeats left alone, got %s", state)
+	}
+
+	// The next heartbeat brings the agent back
+	if state := heartbeat(t, s, "worker", true, ""); state != "running" {
+		t.Errorf("Expected running after heartbeat resumed, got %s", state)
+	}
+}
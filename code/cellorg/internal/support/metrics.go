@@ -0,0 +1,55 @@
+package support
+
+import (
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/metrics"
+)
+
+// supportMetrics counts registry activity for the metrics endpoint. Agent
+// states are read from the registry on every scrape.
+type supportMetrics struct {
+	registry       *metrics.Registry
+	registrations  *metrics.Counter // agent_type
+	stateChanges   *metrics.Counter // state
+	healthFailures *metrics.Counter // reason
+}
+
+// newSupportMetrics registers the support service's metric families.
+func newSupportMetrics(s *Service) *supportMetrics {
+	r := metrics.NewRegistry()
+	m := &supportMetrics{
+		registry:       r,
+		registrations:  r.Counter("cellorg_support_registrations_total", "Accepted agent registrations per agent type.", "agent_type"),
+		stateChanges:   r.Counter("cellorg_support_state_changes_total", "Agent state changes per new state.", "state"),
+		healthFailures: r.Counter("cellorg_support_health_failures_total", "Agents moved to the error state for missed heartbeats (silent) or a failing health probe (unhealthy).", "reason"),
+	}
+
+	r.Gauge("cellorg_support_agents", "Registered agents per lifecycle state.", []string{"state"}, func(emit metrics.Emit) {
+		s.agentsMux.RLock()
+		defer s.agentsMux.RUnlock()
+
+		byState := make(map[string]int)
+		for _, agent := range s.agents {
+			byState[agent.State]++
+		}
+		for state, count := range byState {
+			emit(float64(count), state)
+		}
+	})
+	r.Gauge("cellorg_support_agent_last_seen_seconds", "Time since each agent last registered, reported a state change or sent a heartbeat.", []string{"agent", "state"}, func(emit metrics.Emit) {
+		s.agentsMux.RLock()
+		defer s.agentsMux.RUnlock()
+
+		for id, agent := range s.agents {
+			emit(time.Since(agent.LastPing).Seconds(), id, agent.State)
+		}
+	})
+
+	return m
+}
+
+// Metrics returns the registry served on the support service's metrics endpoint.
+func (s *Service) Metrics() *metrics.Registry {
+	return s.metrics.registry
+}
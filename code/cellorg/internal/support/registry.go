@@ -0,0 +1,225 @@
+package support
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tenzoki/agen/omni/public/omnistore"
+)
+
+// agentKeyPrefix is the KV prefix under which registrations are stored,
+// keyed as support/agents/<agent id>.
+const agentKeyPrefix = "support/agents/"
+
+// historyKeyPrefix is the KV prefix of the state-history audit. Sequence
+// numbers are zero-padded so lexical key order equals the order of events.
+const historyKeyPrefix = "support/history/"
+
+// HistoryRecord is a single entry of the state-history audit.
+type HistoryRecord struct {
+	Seq     uint64           `json:"seq"`      // Monotonic sequence number across all agents
+	AgentID string           `json:"agent_id"` // Agent whose state changed
+	Event   StateChangeEvent `json:"event"`
+}
+
+// RegistryStore persists the agent registry so it survives support service
+// restarts. Registrations are stored without their history; every state
+// change is appended to an audit kept across restarts and registrations.
+//
+// The registry is stored in an embedded omni KV store (BadgerDB).
+//
+// Thread Safety: All methods are safe for concurrent use.
+type RegistryStore struct {
+	store omnistore.OmniStore
+	seq   uint64     // Last assigned history sequence number
+	mux   sync.Mutex // Protects seq
+}
+
+// OpenRegistryStore opens (or creates) the registry in dataDir. The history
+// continues after the highest sequence number found on disk.
+func OpenRegistryStore(dataDir string) (*RegistryStore, error) {
+	store, err := omnistore.NewOmniStoreWithDefaults(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open agent registry at %s: %w", dataDir, err)
+	}
+
+	r := &RegistryStore{store: store}
+
+	keys, err := store.KV().ListKeys(historyKeyPrefix, 0)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to scan state history: %w", err)
+	}
+	for _, key := range keys {
+		if seq, ok := parseHistoryKey(key); ok && seq > r.seq {
+			r.seq = seq
+		}
+	}
+
+	return r, nil
+}
+
+// SaveAgent stores a registration, replacing the stored one.
+func (r *RegistryStore) SaveAgent(agent *AgentRegistration) error {
+	stored := *agent
+	stored.StateHistory = nil // Kept in the audit
+
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return fmt.Errorf("failed to marshal agent %s: %w", agent.ID, err)
+	}
+	if err := r.store.KV().Set(agentKeyPrefix+agent.ID, data); err != nil {
+		return fmt.Errorf("failed to write agent %s: %w", agent.ID, err)
+	}
+	return nil
+}
+
+// AppendHistory adds a state change of an agent to the audit.
+func (r *RegistryStore) AppendHistory(agentID string, event StateChangeEvent) error {
+	r.mux.Lock()
+	r.seq++
+	seq := r.seq
+	r.mux.Unlock()
+
+	data, err := json.Marshal(HistoryRecord{Seq: seq, AgentID: agentID, Event: event})
+	if err != nil {
+		return fmt.Errorf("failed to marshal history record: %w", err)
+	}
+	if err := r.store.KV().Set(historyKey(seq), data); err != nil {
+		return fmt.Errorf("failed to write history record: %w", err)
+	}
+	return nil
+}
+
+// LoadAgents returns the stored registrations with their full state
+// history, oldest registration first.
+func (r *RegistryStore) LoadAgents() ([]*AgentRegistration, error) {
+	entries, err := r.store.KV().Scan(agentKeyPrefix, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan agent registry: %w", err)
+	}
+
+	agents := make([]*AgentRegistration, 0, len(entries))
+	byID := make(map[string]*AgentRegistration, len(entries))
+	for key, data := range entries {
+		var agent AgentRegistration
+		if err := json.Unmarshal(data, &agent); err != nil {
+			return nil, fmt.Errorf("corrupt registration %s: %w", key, err)
+		}
+		agent.StateHistory = make([]StateChangeEvent, 0)
+		agents = append(agents, &agent)
+		byID[agent.ID] = &agent
+	}
+
+	history, err := r.History()
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range history {
+		if agent, ok := byID[record.AgentID]; ok {
+			agent.StateHistory = append(agent.StateHistory, record.Event)
+		}
+	}
+
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].RegisteredAt.Before(agents[j].RegisteredAt)
+	})
+
+	return agents, nil
+}
+
+// History returns the whole state-history audit, ordered by sequence number.
+func (r *RegistryStore) History() ([]*HistoryRecord, error) {
+	entries, err := r.store.KV().Scan(historyKeyPrefix, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan state history: %w", err)
+	}
+
+	records := make([]*HistoryRecord, 0, len(entries))
+	for key, data := range entries {
+		var record HistoryRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, fmt.Errorf("corrupt history record %s: %w", key, err)
+		}
+		records = append(records, &record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Seq < records[j].Seq
+	})
+
+	return records, nil
+}
+
+// Close flushes and closes the underlying store.
+func (r *RegistryStore) Close() error {
+	return r.store.Close()
+}
+
+// historyKey builds the KV key for a sequence number
+func historyKey(seq uint64) string {
+	return fmt.Sprintf("%s%020d", historyKeyPrefix, seq)
+}
+
+// parseHistoryKey extracts the sequence number from a KV key
+func parseHistoryKey(key string) (uint64, bool) {
+	if !strings.HasPrefix(key, historyKeyPrefix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimPrefix(key, historyKeyPrefix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+// persistAgent stores an agent's registration and the state change that
+// led to it, if any. Failures are logged: the registry in memory stays
+// authoritative while the service runs. The caller must hold s.agentsMux.
+func (s *Service) persistAgent(agent *AgentRegistration, event *StateChangeEvent) {
+	if s.registry == nil {
+		return
+	}
+	if event != nil {
+		if err := s.registry.AppendHistory(agent.ID, *event); err != nil {
+			log.Printf("Support service: %v", err)
+		}
+	}
+	if err := s.registry.SaveAgent(agent); err != nil {
+		log.Printf("Support service: %v", err)
+	}
+}
+
+// restoreAgents loads the registry persisted before a restart and makes it
+// the service's registry. Agents keep
+// their last known state, history and last recorded ping, and are marked
+// unconfirmed until they check back in by heartbeat, state report or
+// registering again. Running agents get the usual number of missed
+// heartbeats from the restart on before the liveness monitor moves them to
+// the error state.
+func (s *Service) restoreAgents(registry *RegistryStore) error {
+	agents, err := registry.LoadAgents()
+	if err != nil {
+		return err
+	}
+
+	s.agentsMux.Lock()
+	s.registry = registry
+	s.restoredAt = time.Now()
+	for _, agent := range agents {
+		agent.Unconfirmed = true
+		s.agents[agent.ID] = agent
+	}
+	s.agentsMux.Unlock()
+
+	if len(agents) > 0 {
+		log.Printf("Support service: restored %d agents from %s", len(agents), s.dataDir)
+	}
+	return nil
+}
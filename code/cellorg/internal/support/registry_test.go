@@ -0,0 +1,143 @@
+package support
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// startPersistentService runs a support service with its registry in dir.
+// The returned stop function waits until the registry is closed.
+func startPersistentService(t *testing.T, dir string) (*Service, func()) {
+	t.Helper()
+	s := NewService(SupportConfig{Port: "127.0.0.1:0", Debug: true, DataDir: dir})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Start(ctx) }()
+
+	// Start restores the registry before it serves
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.agentsMux.RLock()
+		open := s.registry != nil
+		s.agentsMux.RUnlock()
+		if open {
+			break
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("Support service failed to start: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Support service did not open its registry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stop := func() {
+		cancel()
+		<-done
+		for {
+			s.agentsMux.RLock()
+			closed := s.registry == nil
+			s.agentsMux.RUnlock()
+			if closed {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return s, stop
+}
+
+func TestRegistrySurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	s, stop := startPersistentService(t, dir)
+	registerTestAgent(t, s, "worker")
+	heartbeat(t, s, "worker", false, "disk full")
+	stop()
+
+	s, stop = startPersistentService(t, dir)
+	defer stop()
+
+	s.agentsMux.RLock()
+	agent, ok := s.agents["worker"]
+	s.agentsMux.RUnlock()
+	if !ok {
+		t.Fatal("Expected worker restored after restart")
+	}
+	if agent.State != "error" || agent.Failure != HealthUnhealthy || agent.RecoverState != "running" {
+		t.Errorf("Expected error/%s/running, got %s/%s/%s", HealthUnhealthy, agent.State, agent.Failure, agent.RecoverState)
+	}
+	if !agent.Unconfirmed {
+		t.Error("Expected restored agent unconfirmed until it checks back in")
+	}
+	wantHistory := []string{"installed→running", "running→error"}
+	if got := historyOf(agent); !slices.Equal(got, wantHistory) {
+		t.Errorf("Expected history %v, got %v", wantHistory, got)
+	}
+
+	// Checking back in confirms the agent and returns it to running
+	if state := heartbeat(t, s, "worker", true, ""); state != "running" {
+		t.Errorf("Expected running after healthy heartbeat, got %s", state)
+	}
+	s.agentsMux.RLock()
+	unconfirmed := agent.Unconfirmed
+	s.agentsMux.RUnlock()
+	if unconfirmed {
+		t.Error("Expected agent confirmed by its heartbeat")
+	}
+
+	// Registering again keeps the history and records the return to installed
+	registerTestAgent(t, s, "worker")
+	s.agentsMux.RLock()
+	agent = s.agents["worker"]
+	s.agentsMux.RUnlock()
+	wantHistory = []string{"installed→running", "running→error", "error→running", "running→installed", "installed→running"}
+	if got := historyOf(agent); !slices.Equal(got, wantHistory) {
+		t.Errorf("Expected history %v, got %v", wantHistory, got)
+	}
+
+	records, err := s.registry.History()
+	if err != nil {
+		t.Fatalf("Failed to read the audit: %v", err)
+	}
+	if len(records) != len(wantHistory) {
+		t.Errorf("Expected %d audit records, got %d", len(wantHistory), len(records))
+	}
+}
+
+func TestRestoredAgentGracePeriod(t *testing.T) {
+	s := NewService(SupportConfig{Port: ":0", Debug: true})
+	registerTestAgent(t, s, "worker")
+	heartbeat(t, s, "worker", true, "")
+
+	// Simulate a restore an hour after the agent was last heard from
+	restart := time.Now().Add(time.Hour)
+	s.agentsMux.Lock()
+	s.restoredAt = restart
+	s.agents["worker"].Unconfirmed = true
+	s.agentsMux.Unlock()
+
+	s.checkLiveness(restart.Add(time.Second))
+	if state, _, _ := agentState(s, "worker"); state != "running" {
+		t.Fatalf("Expected restored agent given time to check back in, got %s", state)
+	}
+
+	s.checkLiveness(restart.Add(heartbeatMisses*defaultHeartbeatInterval + time.Second))
+	if state, failure, _ := agentState(s, "worker"); state != "error" || failure != HealthSilent {
+		t.Errorf("Expected restored agent failed once silent past the grace period, got %s/%s", state, failure)
+	}
+}
+
+// historyOf lists an agent's state changes as from→to
+func historyOf(agent *AgentRegistration) []string {
+	changes := make([]string, len(agent.StateHistory))
+	for i, event := range agent.StateHistory {
+		changes[i] = event.FromState + "→" + event.ToState
+	}
+	return changes
+}
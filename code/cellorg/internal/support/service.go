@@ -10,7 +10,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/tenzoki/agen/cellorg/internal/auth"
 	"github.com/tenzoki/agen/cellorg/internal/broker"
+	cellconfig "github.com/tenzoki/agen/cellorg/internal/config"
+	"github.com/tenzoki/agen/cellorg/internal/metrics"
 	"gopkg.in/yaml.v3"
 )
 
@@ -24,6 +27,16 @@ type Service struct {
 	brokerMux     sync.RWMutex
 	agentTypes    map[string]AgentTypeSpec
 	agentTypesMux sync.RWMutex
+	guard         *auth.Guard // TLS and agent credentials (nil = open service)
+	metrics       *supportMetrics
+	metricsPort   string         // HTTP address of the metrics endpoint (empty = disabled)
+	dataDir       string         // Directory of the persistent agent registry (empty = in memory only)
+	registry      *RegistryStore // Persistent registry, open while the service runs (nil = in memory only)
+	restoredAt    time.Time      // When the registry was restored; unconfirmed agents are given until then to check back in
+
+	healthIntervals map[string]time.Duration // Agent ID -> health_check_interval of its cell; guarded by agentsMux
+	stateListeners  []func(agentID string, event StateChangeEvent)
+	listenersMux    sync.Mutex
 }
 
 type AgentRegistration struct {
@@ -33,12 +46,19 @@ type AgentRegistration struct {
 	Address      string                 `json:"address"`
 	Port         string                 `json:"port"`
 	Codec        string                 `json:"codec"`
+	Token        string                 `json:"token,omitempty"` // Credential checked on registration, never stored
 	Capabilities []string               `json:"capabilities"`
 	RegisteredAt time.Time              `json:"registered_at"`
 	LastPing     time.Time              `json:"last_ping"`
 	State        string                 `json:"state"` // installed, configured, ready, running, paused, stopped, error
 	Config       map[string]interface{} `json:"config"`
 	StateHistory []StateChangeEvent     `json:"state_history"`
+
+	// Liveness, maintained by heartbeats and the liveness monitor
+	LastHeartbeat time.Time `json:"last_heartbeat,omitempty"`
+	Failure       string    `json:"failure,omitempty"`       // HealthSilent or HealthUnhealthy while the support service holds the agent in error
+	RecoverState  string    `json:"recover_state,omitempty"` // State to return to once the agent is healthy again
+	Unconfirmed   bool      `json:"unconfirmed,omitempty"`   // Restored after a support service restart, not heard from since
 }
 
 type StateChangeEvent struct {
@@ -66,8 +86,10 @@ type Error struct {
 }
 
 type SupportConfig struct {
-	Port  string
-	Debug bool
+	Port        string
+	Debug       bool
+	MetricsPort string // HTTP address of the Prometheus metrics endpoint (empty disables it)
+	DataDir     string // Directory of the persistent agent registry (empty keeps it in memory)
 }
 
 type AgentTypeSpec struct {
@@ -88,10 +110,17 @@ func NewService(config interface{}) *Service {
 	// Extract values from config interface (could be config.SupportConfig)
 	port := ":9000"
 	debug := false
+	metricsPort := ""
+	dataDir := ""
 
+	if cc, ok := config.(cellconfig.SupportConfig); ok {
+		config = SupportConfig{Port: cc.Port, Debug: cc.Debug, MetricsPort: cc.MetricsPort, DataDir: cc.DataDir}
+	}
 	if sc, ok := config.(SupportConfig); ok {
 		port = sc.Port
 		debug = sc.Debug
+		metricsPort = sc.MetricsPort
+		dataDir = sc.DataDir
 	} else if sc, ok := config.(struct {
 		Port  string
 		Debug bool
@@ -100,11 +129,16 @@ func NewService(config interface{}) *Service {
 		debug = sc.Debug
 	}
 	service := &Service{
-		port:       port,
-		debug:      debug,
-		agents:     make(map[string]*AgentRegistration),
-		agentTypes: make(map[string]AgentTypeSpec),
+		port:        port,
+		debug:       debug,
+		agents:      make(map[string]*AgentRegistration),
+		agentTypes:  make(map[string]AgentTypeSpec),
+		metricsPort: metricsPort,
+		dataDir:     dataDir,
+
+		healthIntervals: make(map[string]time.Duration),
 	}
+	service.metrics = newSupportMetrics(service)
 
 	// Agent types will be loaded by orchestrator via LoadAgentTypesFromFile
 	// This prevents duplicate loading and allows proper path resolution
@@ -112,15 +146,39 @@ func NewService(config interface{}) *Service {
 	return service
 }
 
+// SetGuard applies the security settings from cellorg.yaml: a TLS listener
+// and the credential check in register_agent. Must be called before Start.
+func (s *Service) SetGuard(guard *auth.Guard) {
+	s.guard = guard
+}
+
 func (s *Service) Start(ctx context.Context) error {
-	listener, err := net.Listen("tcp", s.port)
+	// Reload the registry before agents check back in
+	if s.dataDir != "" {
+		registry, err := OpenRegistryStore(s.dataDir)
+		if err != nil {
+			return err
+		}
+		if err := s.restoreAgents(registry); err != nil {
+			registry.Close()
+			return fmt.Errorf("failed to restore agent registry: %w", err)
+		}
+	}
+
+	listener, err := s.guard.Listen("tcp", s.port)
 	if err != nil {
+		s.agentsMux.Lock()
+		if s.registry != nil {
+			s.registry.Close()
+			s.registry = nil
+		}
+		s.agentsMux.Unlock()
 		return fmt.Errorf("failed to listen on %s: %w", s.port, err)
 	}
 	s.listener = listener
 
 	if s.debug {
-		log.Printf("Support service listening on %s", s.port)
+		log.Printf("Support service listening on %s (tls: %v)", s.port, s.guard.TLS())
 	}
 
 	// Handle context cancellation in a separate goroutine
@@ -130,8 +188,20 @@ func (s *Service) Start(ctx context.Context) error {
 			log.Printf("Support service shutting down")
 		}
 		s.listener.Close()
+		if s.registry != nil {
+			s.agentsMux.Lock()
+			s.registry.Close()
+			s.registry = nil
+			s.agentsMux.Unlock()
+		}
 	}()
 
+	// Serve metrics over HTTP if configured
+	metrics.Start(ctx, s.metricsPort, s.metrics.registry, "Support service")
+
+	// Move agents that stop sending heartbeats to the error state
+	go s.monitorLiveness(ctx)
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -185,6 +255,8 @@ func (s *Service) handleRequest(req *Request) *Response {
 		return s.handleGetBroker(req)
 	case "report_state_change":
 		return s.handleReportStateChange(req)
+	case "heartbeat":
+		return s.handleHeartbeat(req)
 	case "get_agent_state":
 		return s.handleGetAgentState(req)
 	case "wait_for_state":
@@ -215,6 +287,16 @@ func (s *Service) handleRegisterAgent(req *Request) *Response {
 		}
 	}
 
+	// Check credentials before accepting the registration
+	if err := s.guard.Authenticate(params.ID, params.Token); err != nil {
+		log.Printf("Support service rejected registration: %v", err)
+		return &Response{
+			ID:    req.ID,
+			Error: &Error{Code: -32001, Message: "Invalid credentials"},
+		}
+	}
+	params.Token = ""
+
 	// Validate agent type
 	if !s.validateAgentType(params.AgentType) {
 		return &Response{
@@ -226,16 +308,36 @@ func (s *Service) handleRegisterAgent(req *Request) *Response {
 	params.RegisteredAt = time.Now()
 	params.LastPing = time.Now()
 	params.State = "installed" // Initial lifecycle state
+	params.LastHeartbeat = time.Time{}
+	params.Failure = ""
+	params.RecoverState = ""
+	params.Unconfirmed = false
 	if params.Config == nil {
 		params.Config = make(map[string]interface{})
 	}
-	if params.StateHistory == nil {
-		params.StateHistory = make([]StateChangeEvent, 0)
-	}
+	params.StateHistory = make([]StateChangeEvent, 0)
 
+	// An agent registering again (after it or the support service restarted)
+	// keeps its history, and the return to the installed state is recorded
+	var reregistered *StateChangeEvent
 	s.agentsMux.Lock()
+	if previous, known := s.agents[params.ID]; known {
+		event := StateChangeEvent{
+			FromState: previous.State,
+			ToState:   params.State,
+			Timestamp: params.RegisteredAt,
+			Reason:    "registered again",
+		}
+		params.StateHistory = append(previous.StateHistory, event)
+		reregistered = &event
+	}
 	s.agents[params.ID] = &params
+	s.persistAgent(&params, reregistered)
 	s.agentsMux.Unlock()
+	s.metrics.registrations.Inc(params.AgentType)
+	if reregistered != nil {
+		s.notifyStateChange(params.ID, *reregistered)
+	}
 
 	if s.debug {
 		log.Printf("Registered agent: %s (%s) at %s:%s", params.ID, params.AgentType, params.Address, params.Port)
@@ -379,23 +481,18 @@ func (s *Service) handleReportStateChange(req *Request) *Response {
 		}
 	}
 
-	// Update agent state
-	oldState := agent.State
-	agent.State = params.State
+	// Update agent state and add it to the history; a reported state
+	// overrides one the liveness monitor set
 	agent.LastPing = time.Now()
-
-	// Add to state history
-	stateChange := StateChangeEvent{
-		FromState: oldState,
-		ToState:   params.State,
-		Timestamp: time.Now(),
-		Reason:    params.Reason,
-	}
-	agent.StateHistory = append(agent.StateHistory, stateChange)
+	agent.Failure = ""
+	agent.RecoverState = ""
+	agent.Unconfirmed = false
+	stateChange := s.changeState(agent, params.State, params.Reason)
 	s.agentsMux.Unlock()
+	s.notifyStateChange(params.AgentID, stateChange)
 
 	if s.debug {
-		log.Printf("Agent %s state change: %s → %s", params.AgentID, oldState, params.State)
+		log.Printf("Agent %s state change: %s → %s", params.AgentID, stateChange.FromState, params.State)
 	}
 
 	return &Response{
@@ -431,6 +528,8 @@ func (s *Service) handleGetAgentState(req *Request) *Response {
 		"agent_id":      agent.ID,
 		"state":         agent.State,
 		"last_ping":     agent.LastPing,
+		"failure":       agent.Failure,
+		"unconfirmed":   agent.Unconfirmed,
 		"state_history": agent.StateHistory,
 	}
 
@@ -553,6 +652,7 @@ func (s *Service) handleGetAgentCellConfig(req *Request) *Response {
 		"agent_type":   agent.AgentType,
 		"ingress":      agent.Ingress,
 		"egress":       agent.Egress,
+		"dead_letter":  agent.DeadLetter,
 		"dependencies": agent.Dependencies,
 		"config":       agent.Config,
 	}
@@ -574,11 +674,11 @@ type CellsFile struct {
 }
 
 type OrchestrationSettings struct {
-	StartupTimeout      string `yaml:"startup_timeout,omitempty"`
-	ShutdownTimeout     string `yaml:"shutdown_timeout,omitempty"`
-	MaxRetries          int    `yaml:"max_retries,omitempty"`
-	RetryDelay          string `yaml:"retry_delay,omitempty"`
-	HealthCheckInterval string `yaml:"health_check_interval,omitempty"`
+	StartupTimeout      string `yaml:"startup_timeout,omitempty" json:"startup_timeout,omitempty"`
+	ShutdownTimeout     string `yaml:"shutdown_timeout,omitempty" json:"shutdown_timeout,omitempty"`
+	MaxRetries          int    `yaml:"max_retries,omitempty" json:"max_retries,omitempty"`
+	RetryDelay          string `yaml:"retry_delay,omitempty" json:"retry_delay,omitempty"`
+	HealthCheckInterval string `yaml:"health_check_interval,omitempty" json:"health_check_interval,omitempty"`
 }
 
 type AgentCellConfig struct {
@@ -586,6 +686,7 @@ type AgentCellConfig struct {
 	AgentType    string                 `yaml:"agent_type"`
 	Ingress      string                 `yaml:"ingress"`
 	Egress       string                 `yaml:"egress"`
+	DeadLetter   string                 `yaml:"dead_letter,omitempty"`
 	Dependencies []string               `yaml:"dependencies,omitempty"`
 	Config       map[string]interface{} `yaml:"config"`
 }
@@ -0,0 +1,275 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Exporter names accepted by NewExporter.
+const (
+	ExporterOTLP   = "otlp"
+	ExporterFile   = "file"
+	ExporterMemory = "memory"
+)
+
+// DefaultOTLPEndpoint is the traces endpoint of a local OpenTelemetry
+// collector (OTLP/HTTP).
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+// Exporter sends finished spans to a tracing backend.
+// Implementations must be safe for concurrent use.
+type Exporter interface {
+	// ExportSpans sends a batch of spans.
+	ExportSpans(ctx context.Context, spans []Span) error
+	// Shutdown releases the exporter's resources after the last export.
+	Shutdown(ctx context.Context) error
+}
+
+// NewExporter creates an exporter by name: "otlp" posts to endpoint
+// (default DefaultOTLPEndpoint), "file" appends to path, "memory" keeps the
+// spans in process.
+func NewExporter(name, endpoint, path string) (Exporter, error) {
+	switch name {
+	case ExporterOTLP:
+		return NewOTLPExporter(endpoint), nil
+	case ExporterFile:
+		return NewFileExporter(path)
+	case ExporterMemory:
+		return NewMemoryExporter(), nil
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q (expected otlp, file or memory)", name)
+	}
+}
+
+// MemoryExporter keeps exported spans in memory, for tests and inspection.
+type MemoryExporter struct {
+	spans []Span
+	mux   sync.Mutex
+}
+
+// NewMemoryExporter creates an empty in-memory exporter.
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+func (m *MemoryExporter) ExportSpans(ctx context.Context, spans []Span) error {
+	m.mux.Lock()
+	m.spans = append(m.spans, spans...)
+	m.mux.Unlock()
+	return nil
+}
+
+func (m *MemoryExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// Spans returns the exported spans in export order.
+func (m *MemoryExporter) Spans() []Span {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return append([]Span(nil), m.spans...)
+}
+
+// Reset discards the exported spans.
+func (m *MemoryExporter) Reset() {
+	m.mux.Lock()
+	m.spans = nil
+	m.mux.Unlock()
+}
+
+// FileExporter appends spans to a file as JSON lines, one span per line.
+// Several agents may share a file; each line is written at once.
+type FileExporter struct {
+	file *os.File
+	mux  sync.Mutex
+}
+
+// NewFileExporter opens (or creates) path for appending.
+func NewFileExporter(path string) (*FileExporter, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file trace exporter requires a path")
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace file: %w", err)
+	}
+	return &FileExporter{file: file}, nil
+}
+
+func (f *FileExporter) ExportSpans(ctx context.Context, spans []Span) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	for _, span := range spans {
+		line, err := json.Marshal(span)
+		if err != nil {
+			return err
+		}
+		if _, err := f.file.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("failed to write trace file: %w", err)
+		}
+	}
+	return nil
+}
+
+func (f *FileExporter) Shutdown(ctx context.Context) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.file.Close()
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector using OTLP/HTTP
+// with JSON encoding.
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewOTLPExporter creates an exporter for a collector's traces endpoint
+// (empty = DefaultOTLPEndpoint).
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	if endpoint == "" {
+		endpoint = DefaultOTLPEndpoint
+	}
+	return &OTLPExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (o *OTLPExporter) ExportSpans(ctx context.Context, spans []Span) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post spans to %s: %w", o.endpoint, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector %s rejected spans: %s", o.endpoint, resp.Status)
+	}
+	return nil
+}
+
+func (o *OTLPExporter) Shutdown(ctx context.Context) error {
+	o.client.CloseIdleConnections()
+	return nil
+}
+
+// OTLP/JSON message types (opentelemetry/proto/collector/trace/v1),
+// limited to the fields cellorg spans fill.
+type (
+	otlpExport struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"` // 0 unset, 2 error
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// otlpKinds maps span kinds to OTLP SpanKind values.
+var otlpKinds = map[SpanKind]int{
+	KindInternal: 1,
+	KindProducer: 4,
+	KindConsumer: 5,
+}
+
+// otlpRequest groups spans by service into one resource each.
+func otlpRequest(spans []Span) otlpExport {
+	var request otlpExport
+	index := make(map[string]int)
+	for _, span := range spans {
+		i, ok := index[span.Service]
+		if !ok {
+			i = len(request.ResourceSpans)
+			index[span.Service] = i
+			request.ResourceSpans = append(request.ResourceSpans, otlpResourceSpans{
+				Resource: otlpResource{Attributes: []otlpAttribute{
+					{Key: "service.name", Value: otlpValue{StringValue: span.Service}},
+				}},
+				ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "cellorg"}}},
+			})
+		}
+
+		converted := otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentSpanID,
+			Name:              span.Name,
+			Kind:              otlpKinds[span.Kind],
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		keys := make([]string, 0, len(span.Attributes))
+		for key := range span.Attributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			converted.Attributes = append(converted.Attributes, otlpAttribute{Key: key, Value: otlpValue{StringValue: span.Attributes[key]}})
+		}
+		if span.Error != "" {
+			converted.Status = otlpStatus{Code: 2, Message: span.Error}
+		}
+
+		scope := &request.ResourceSpans[i].ScopeSpans[0]
+		scope.Spans = append(scope.Spans, converted)
+	}
+	return request
+}
@@ -0,0 +1,334 @@
+// Package tracing turns the trace context that envelopes and messages carry
+// through a pipeline into spans, so the path of one document from ingester to
+// writer can be followed in a trace viewer.
+//
+// Each agent opens a span around its processing step whose parent is the
+// span of the upstream agent, taken from Envelope.TraceID/SpanID or from the
+// "trace_id"/"span_id" metadata of simple messages. Results are sent on with
+// the agent's own span as their context. Finished spans are batched and
+// handed to an Exporter: OTLP over HTTP for collectors such as Jaeger or
+// Tempo, JSON lines in a file, or memory for tests.
+//
+// IDs follow the W3C/OpenTelemetry format (32 and 16 hex digits). IDs in
+// other formats, such as the UUIDs of envelope.NewReplyEnvelope, are mapped
+// to valid ones deterministically, so all spans of a trace still line up.
+//
+// A nil *Tracer and the nil *Span it returns are valid and do nothing, so
+// callers need no checks when tracing is disabled.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// Metadata keys carrying the trace context of simple messages.
+const (
+	MetaTraceID = "trace_id"
+	MetaSpanID  = "span_id"
+)
+
+const (
+	flushInterval = 2 * time.Second // Export cadence for partial batches
+	maxBatch      = 256             // Spans exported at once
+	maxQueued     = 8192            // Spans kept while the exporter is down; newer spans are dropped
+)
+
+// SpanKind tells a trace viewer what a span stands for.
+type SpanKind string
+
+const (
+	KindInternal SpanKind = "internal" // Work inside an agent
+	KindProducer SpanKind = "producer" // Creating and sending a message
+	KindConsumer SpanKind = "consumer" // Processing a received message
+)
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// IsValid reports whether the context belongs to a trace.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != ""
+}
+
+// Span is one timed operation. Spans are not safe for concurrent use;
+// End hands them to the tracer.
+type Span struct {
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Name         string            `json:"name"`
+	Kind         SpanKind          `json:"kind"`
+	Service      string            `json:"service"` // Agent type or service that recorded the span
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Error        string            `json:"error,omitempty"` // Set when the operation failed
+
+	tracer *Tracer
+}
+
+// Context returns the context to propagate to downstream work.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return SpanContext{TraceID: s.TraceID, SpanID: s.SpanID}
+}
+
+// SetAttribute records a key/value pair on the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Error = err.Error()
+}
+
+// Finish ends the span and queues it for export. Later calls do nothing.
+func (s *Span) Finish() {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	s.End = time.Now()
+	tracer := s.tracer
+	s.tracer = nil
+	tracer.enqueue(*s)
+}
+
+// Tracer creates spans for one service and exports them in batches.
+//
+// Thread Safety: All methods are safe for concurrent use.
+type Tracer struct {
+	service  string
+	exporter Exporter
+
+	queue   []Span
+	mux     sync.Mutex
+	kick    chan struct{} // Asks the export loop for an early flush
+	stop    chan struct{} // Closed by Shutdown
+	stopped chan struct{} // Closed when the export loop exits
+	dropped int           // Spans lost because the queue was full
+}
+
+// NewTracer creates a tracer exporting the spans of service and starts its
+// export loop. Call Shutdown to export the remaining spans.
+func NewTracer(service string, exporter Exporter) *Tracer {
+	t := &Tracer{
+		service:  service,
+		exporter: exporter,
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Start opens a span. A valid parent makes it a child in the parent's
+// trace; otherwise the span starts a new trace.
+func (t *Tracer) Start(name string, kind SpanKind, parent SpanContext) *Span {
+	if t == nil {
+		return nil
+	}
+
+	span := &Span{
+		SpanID:     newID(8),
+		Name:       name,
+		Kind:       kind,
+		Service:    t.service,
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+		tracer:     t,
+	}
+	if parent.IsValid() {
+		span.TraceID = normalizeID(parent.TraceID, 16)
+		if parent.SpanID != "" {
+			span.ParentSpanID = normalizeID(parent.SpanID, 8)
+		}
+	} else {
+		span.TraceID = newID(16)
+	}
+	return span
+}
+
+// Flush exports all finished spans now.
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	for {
+		batch := t.next()
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := t.exporter.ExportSpans(ctx, batch); err != nil {
+			return err
+		}
+	}
+}
+
+// Shutdown stops the export loop, exports the remaining spans and shuts the
+// exporter down.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	close(t.stop)
+	<-t.stopped
+
+	err := t.Flush(ctx)
+	if shutdownErr := t.exporter.Shutdown(ctx); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// enqueue adds a finished span to the export queue.
+func (t *Tracer) enqueue(span Span) {
+	t.mux.Lock()
+	if len(t.queue) >= maxQueued {
+		t.dropped++
+		t.mux.Unlock()
+		return
+	}
+	t.queue = append(t.queue, span)
+	full := len(t.queue) >= maxBatch
+	t.mux.Unlock()
+
+	if full {
+		select {
+		case t.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// next takes up to maxBatch spans off the queue.
+func (t *Tracer) next() []Span {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	n := min(len(t.queue), maxBatch)
+	batch := append([]Span(nil), t.queue[:n]...)
+	t.queue = t.queue[n:]
+	return batch
+}
+
+// run exports batches periodically and when the queue fills up. Failed
+// batches are logged and dropped, so a missing collector costs no memory.
+func (t *Tracer) run() {
+	defer close(t.stopped)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		case <-t.kick:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), flushInterval)
+		if err := t.Flush(ctx); err != nil {
+			log.Printf("tracing: failed to export spans of %s: %v", t.service, err)
+		}
+		cancel()
+
+		t.mux.Lock()
+		if t.dropped > 0 {
+			log.Printf("tracing: dropped %d spans of %s (export queue full)", t.dropped, t.service)
+			t.dropped = 0
+		}
+		t.mux.Unlock()
+	}
+}
+
+// FromEnvelope returns the trace context an envelope carries.
+func FromEnvelope(env *envelope.Envelope) SpanContext {
+	return SpanContext{TraceID: env.TraceID, SpanID: env.SpanID}
+}
+
+// InjectEnvelope makes sc the envelope's trace context. An invalid context
+// leaves the envelope unchanged.
+func InjectEnvelope(env *envelope.Envelope, sc SpanContext) {
+	if !sc.IsValid() {
+		return
+	}
+	env.TraceID = sc.TraceID
+	env.SpanID = sc.SpanID
+}
+
+// FromMeta returns the trace context in the metadata of a simple message.
+func FromMeta(meta map[string]interface{}) SpanContext {
+	traceID, _ := meta[MetaTraceID].(string)
+	spanID, _ := meta[MetaSpanID].(string)
+	return SpanContext{TraceID: traceID, SpanID: spanID}
+}
+
+// InjectMeta stores sc in message metadata, creating the map if needed. An
+// invalid context leaves the metadata unchanged.
+func InjectMeta(meta map[string]interface{}, sc SpanContext) map[string]interface{} {
+	if !sc.IsValid() {
+		return meta
+	}
+	if meta == nil {
+		meta = make(map[string]interface{})
+	}
+	meta[MetaTraceID] = sc.TraceID
+	meta[MetaSpanID] = sc.SpanID
+	return meta
+}
+
+// SetEnvelopeAttributes records an envelope's identity and path on a span.
+func SetEnvelopeAttributes(span *Span, env *envelope.Envelope) {
+	if span == nil {
+		return
+	}
+	span.SetAttribute("messaging.message.id", env.ID)
+	span.SetAttribute("messaging.destination.name", env.Destination)
+	span.SetAttribute("cellorg.message_type", env.MessageType)
+	span.SetAttribute("cellorg.source", env.Source)
+	span.SetAttribute("cellorg.hop_count", strconv.Itoa(env.HopCount))
+	if len(env.Route) > 0 {
+		span.SetAttribute("cellorg.route", strings.Join(env.Route, ","))
+	}
+}
+
+// newID returns size random bytes in hex.
+func newID(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// normalizeID returns id as size bytes in lowercase hex. Valid IDs and UUIDs
+// (dashes removed) of the right length are kept; anything else is hashed.
+func normalizeID(id string, size int) string {
+	plain := strings.ToLower(strings.ReplaceAll(id, "-", ""))
+	if b, err := hex.DecodeString(plain); err == nil && len(b) == size && strings.Trim(plain, "0") != "" {
+		return plain
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:size])
+}
@@ -0,0 +1,182 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// Test that spans started from an envelope join its trace and propagate downstream
+func TestSpanPropagation(t *testing.T) {
+	exporter := NewMemoryExporter()
+	tracer := NewTracer("text-extractor", exporter)
+
+	env, _ := envelope.NewEnvelope("file-ingester", "pub:extracted-text", "text", map[string]string{"text": "hello"})
+	// Upstream context in the UUID form envelope helpers use
+	traceID := "3f2504e0-4f89-11d3-9a0c-0305e82c3301"
+	env.TraceID, env.SpanID = traceID, "9a0c0305e82c3301"
+
+	consume := tracer.Start("process", KindConsumer, FromEnvelope(env))
+	SetEnvelopeAttributes(consume, env)
+	InjectEnvelope(env, consume.Context())
+
+	produce := tracer.Start("publish extracted-text", KindProducer, FromEnvelope(env))
+	produce.SetError(errors.New("broker unavailable"))
+	produce.Finish()
+	consume.Finish()
+	consume.Finish() // Second call is ignored
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+	producer, consumer := spans[0], spans[1]
+	if len(consumer.TraceID) != 32 || len(consumer.SpanID) != 16 {
+		t.Errorf("Expected OpenTelemetry-sized IDs, got %q/%q", consumer.TraceID, consumer.SpanID)
+	}
+	if consumer.TraceID != normalizeID(traceID, 16) || consumer.ParentSpanID != "9a0c0305e82c3301" || env.SpanID != consumer.SpanID {
+		t.Errorf("Expected consumer span in the envelope's trace and as its new context")
+	}
+	if producer.TraceID != consumer.TraceID || producer.ParentSpanID != consumer.SpanID {
+		t.Errorf("Expected producer span to be a child of %s, got parent %s", consumer.SpanID, producer.ParentSpanID)
+	}
+	if producer.Error != "broker unavailable" || consumer.Error != "" {
+		t.Errorf("Expected only the producer span to fail, got %q/%q", producer.Error, consumer.Error)
+	}
+	if consumer.Attributes["cellorg.source"] != "file-ingester" || consumer.Service != "text-extractor" {
+		t.Errorf("Unexpected consumer span: %+v", consumer)
+	}
+}
+
+// Test that IDs are normalized deterministically and nil tracers are no-ops
+func TestNormalizeIDAndNilTracer(t *testing.T) {
+	uuid := "3f2504e0-4f89-11d3-9a0c-0305e82c3301"
+	if got := normalizeID(uuid, 16); got != "3f2504e04f8911d39a0c0305e82c3301" {
+		t.Errorf("Expected UUID to keep its digits, got %s", got)
+	}
+	if normalizeID("trace-42", 16) != normalizeID("trace-42", 16) || len(normalizeID("trace-42", 8)) != 16 {
+		t.Error("Expected foreign IDs to be hashed deterministically to the requested size")
+	}
+	if normalizeID("00000000000000000000000000000000", 16) == "00000000000000000000000000000000" {
+		t.Error("Expected all-zero ID to be replaced")
+	}
+
+	var tracer *Tracer
+	span := tracer.Start("process", KindConsumer, SpanContext{})
+	span.SetAttribute("key", "value")
+	span.Finish()
+	if span.Context().IsValid() {
+		t.Error("Expected nil span to have no context")
+	}
+	if meta := InjectMeta(nil, span.Context()); meta != nil {
+		t.Errorf("Expected invalid context to leave metadata unchanged, got %v", meta)
+	}
+}
+
+// Test that the OTLP exporter posts spans grouped by service
+func TestOTLPExporter(t *testing.T) {
+	var received otlpExport
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Expected JSON content type, got %s", r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("Failed to decode export: %v", err)
+		}
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL)
+	tracer := NewTracer("ner-agent", exporter)
+	parent := tracer.Start("process", KindConsumer, SpanContext{})
+	child := tracer.Start("publish entities", KindProducer, parent.Context())
+	child.SetAttribute("b", "2")
+	child.SetAttribute("a", "1")
+	child.SetError(errors.New("failed"))
+	child.Finish()
+	parent.Finish()
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	if len(received.ResourceSpans) != 1 {
+		t.Fatalf("Expected 1 resource, got %d", len(received.ResourceSpans))
+	}
+	resource := received.ResourceSpans[0]
+	if resource.Resource.Attributes[0].Value.StringValue != "ner-agent" {
+		t.Errorf("Expected service.name ner-agent, got %+v", resource.Resource.Attributes)
+	}
+	spans := resource.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+	if spans[0].Kind != 4 || spans[0].Status.Code != 2 || spans[0].ParentSpanID != spans[1].SpanID {
+		t.Errorf("Unexpected producer span: %+v", spans[0])
+	}
+	if spans[0].Attributes[0].Key != "a" || spans[1].Kind != 5 {
+		t.Errorf("Expected sorted attributes and a consumer span, got %+v", spans)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	batch := []Span{{TraceID: newID(16), SpanID: newID(8), Name: "process"}}
+	if err := NewOTLPExporter(failing.URL).ExportSpans(context.Background(), batch); err == nil {
+		t.Error("Expected rejected export to fail")
+	}
+}
+
+// Test that the file exporter appends one JSON line per span
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	for i := 0; i < 2; i++ {
+		exporter, err := NewExporter(ExporterFile, "", path)
+		if err != nil {
+			t.Fatalf("NewExporter failed: %v", err)
+		}
+		tracer := NewTracer("file-writer", exporter)
+		tracer.Start("process", KindConsumer, SpanContext{}).Finish()
+		if err := tracer.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open trace file: %v", err)
+	}
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var span Span
+		if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+			t.Fatalf("Invalid span line %q: %v", scanner.Text(), err)
+		}
+		if span.Service != "file-writer" || span.End.Before(span.Start) {
+			t.Errorf("Unexpected span: %+v", span)
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("Expected 2 span lines, got %d", lines)
+	}
+
+	if _, err := NewExporter("zipkin", "", ""); err == nil {
+		t.Error("Expected unknown exporter to be rejected")
+	}
+}
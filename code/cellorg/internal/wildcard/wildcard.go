@@ -0,0 +1,114 @@
+// Package wildcard implements MQTT-style topic patterns for the GOX broker.
+// Topic names are hierarchical, with levels separated by dots
+// (e.g. "project-42.ocr.done"). Subscription patterns may use two wildcards:
+//
+//   - "*" matches exactly one level ("project-42.*" matches "project-42.ocr")
+//   - "#" matches any number of trailing levels, including none, and must be
+//     the last level ("extracted-text.#" matches "extracted-text" and
+//     "extracted-text.native.de")
+//
+// Wildcards must occupy a whole level; "project-*" is not a pattern.
+// The package is shared by the broker (subscriber selection) and the client
+// (routing deliveries to subscription channels).
+package wildcard
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	Separator   = "." // Level separator in topic names
+	SingleLevel = "*" // Matches exactly one level
+	MultiLevel  = "#" // Matches all remaining levels (last level only)
+)
+
+// IsPattern reports whether a topic name contains wildcard levels.
+func IsPattern(pattern string) bool {
+	for _, level := range strings.Split(pattern, Separator) {
+		if level == SingleLevel || level == MultiLevel {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that a subscription pattern is well-formed: wildcards take
+// up a whole level and "#" only appears as the last level.
+func Validate(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("empty topic pattern")
+	}
+
+	levels := strings.Split(pattern, Separator)
+	for i, level := range levels {
+		if level == MultiLevel && i != len(levels)-1 {
+			return fmt.Errorf("invalid topic pattern %q: %q must be the last level", pattern, MultiLevel)
+		}
+		if level != SingleLevel && level != MultiLevel && strings.ContainsAny(level, SingleLevel+MultiLevel) {
+			return fmt.Errorf("invalid topic pattern %q: wildcards must occupy a whole level", pattern)
+		}
+	}
+	return nil
+}
+
+// Match reports whether a concrete topic name matches a pattern.
+// A pattern without wildcards only matches the identical topic name.
+func Match(pattern, topic string) bool {
+	if pattern == topic {
+		return true
+	}
+
+	patternLevels := strings.Split(pattern, Separator)
+	topicLevels := strings.Split(topic, Separator)
+
+	for i, level := range patternLevels {
+		if level == MultiLevel {
+			return true // Matches the rest, including no levels at all
+		}
+		if i >= len(topicLevels) {
+			return false // Topic is shorter than the pattern
+		}
+		if level != SingleLevel && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(patternLevels) == len(topicLevels)
+}
+
+// Covers reports whether every topic matched by sub is also matched by
+// pattern, e.g. "project-42.#" covers "project-42.*" but "project-42.*" does
+// not cover "project-42.#". Used to check subscription patterns against
+// access rules; for a concrete topic it is the same as Match.
+func Covers(pattern, sub string) bool {
+	if pattern == sub {
+		return true
+	}
+
+	patternLevels := strings.Split(pattern, Separator)
+	subLevels := strings.Split(sub, Separator)
+
+	for i, level := range patternLevels {
+		if level == MultiLevel {
+			return true // Covers the rest, whatever it matches
+		}
+		if i >= len(subLevels) {
+			return false // sub matches shorter topics
+		}
+		switch subLevels[i] {
+		case MultiLevel:
+			return false // sub matches any number of levels here, pattern does not
+		case SingleLevel:
+			if level != SingleLevel {
+				return false
+			}
+		default:
+			if level != SingleLevel && level != subLevels[i] {
+				return false
+			}
+		}
+	}
+
+	return len(patternLevels) == len(subLevels)
+}
@@ -0,0 +1,77 @@
+package wildcard
+
+import "testing"
+
+// Test pattern matching for single- and multi-level wildcards
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"project-42.ocr", "project-42.ocr", true},
+		{"project-42.ocr", "project-42.nlp", false},
+		{"project-42.*", "project-42.ocr", true},
+		{"project-42.*", "project-42", false},
+		{"project-42.*", "project-42.ocr.done", false},
+		{"*.done", "ocr.done", true},
+		{"project-42.*.done", "project-42.ocr.done", true},
+		{"extracted-text.#", "extracted-text", true},
+		{"extracted-text.#", "extracted-text.native", true},
+		{"extracted-text.#", "extracted-text.native.de", true},
+		{"extracted-text.#", "extracted-text-native", false},
+		{"#", "anything.at.all", true},
+		{"project-*", "project-42", false},
+	}
+
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+// Test that malformed patterns are rejected
+func TestValidate(t *testing.T) {
+	valid := []string{"project-42", "project-42.*", "extracted-text.#", "#", "*.done"}
+	for _, pattern := range valid {
+		if err := Validate(pattern); err != nil {
+			t.Errorf("Validate(%q) failed: %v", pattern, err)
+		}
+	}
+
+	invalid := []string{"", "a.#.b", "project-*", "a.b#"}
+	for _, pattern := range invalid {
+		if err := Validate(pattern); err == nil {
+			t.Errorf("Validate(%q) accepted an invalid pattern", pattern)
+		}
+	}
+}
+
+// Test that pattern coverage respects both wildcards on either side
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		pattern string
+		sub     string
+		want    bool
+	}{
+		{"project-42.ocr", "project-42.ocr", true},
+		{"project-42.*", "project-42.ocr", true},
+		{"project-42.#", "project-42.*", true},
+		{"project-42.#", "project-42.#", true},
+		{"project-42.#", "project-42", true},
+		{"#", "extracted-text.#", true},
+		{"*.done", "*.done", true},
+		{"project-42.*", "project-42.#", false},
+		{"project-42.*", "project-42.*.done", false},
+		{"project-42.ocr", "project-42.*", false},
+		{"project-42.*", "*.ocr", false},
+		{"project-42.#", "#", false},
+	}
+
+	for _, tt := range tests {
+		if got := Covers(tt.pattern, tt.sub); got != tt.want {
+			t.Errorf("Covers(%q, %q) = %v, want %v", tt.pattern, tt.sub, got, tt.want)
+		}
+	}
+}
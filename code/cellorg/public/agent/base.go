@@ -18,15 +18,20 @@ package agent
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/tenzoki/agen/atomic/logging"
 	"github.com/tenzoki/agen/atomic/vfs"
+	"github.com/tenzoki/agen/cellorg/internal/auth"
+	"github.com/tenzoki/agen/cellorg/internal/tracing"
 	"github.com/tenzoki/agen/cellorg/public/client"
 )
 
@@ -65,6 +70,15 @@ type BaseAgent struct {
 	// VFS for project-scoped file operations
 	VFS       *vfs.VFS // Virtual file system rooted at project directory
 	ProjectID string   // Project identifier for multi-tenant isolation
+
+	tracer *tracing.Tracer // Span tracer set up by the agent framework (nil = tracing off)
+
+	registration client.AgentRegistration // Sent again when the support service lost track of the agent
+
+	// Broker connection events
+	connMux       sync.Mutex                     // Protects resumeState and connListeners
+	resumeState   AgentState                     // State to return to once reconnected
+	connListeners []func(client.ConnectionEvent) // Added with AddConnectionListener
 }
 
 // AgentConfig holds the initialization configuration for creating a new agent.
@@ -83,8 +97,16 @@ type AgentConfig struct {
 	DataRoot   string // Root directory for VFS (defaults to /var/lib/cellorg or CELLORG_DATA_ROOT env)
 	VFSEnabled bool   // Enable VFS for this agent (default: true)
 	ReadOnly   bool   // Create read-only VFS (for query-only agents)
+
+	// Security (set when cellorg.yaml enables TLS or authentication)
+	Token string      // Credential for support and broker (defaults to CELLORG_TOKEN)
+	TLS   *tls.Config // TLS settings for support and broker (defaults to CELLORG_TLS_* variables)
 }
 
+// defaultHeartbeatInterval spaces heartbeats until the support service
+// says how often it expects them.
+const defaultHeartbeatInterval = 15 * time.Second
+
 // NewBaseAgent creates a new base agent instance with full service integration.
 // This constructor handles all the complex setup required for agent operation,
 // including service discovery, connection establishment, and configuration loading.
@@ -109,8 +131,14 @@ type AgentConfig struct {
 //
 // Called by: Specific agent main() functions during startup
 func NewBaseAgent(config AgentConfig) (*BaseAgent, error) {
+	// Pick up credentials and TLS settings handed over by the deployer
+	if err := resolveSecurity(&config); err != nil {
+		return nil, err
+	}
+
 	// Connect to support service with retry logic (15-minute timeout)
 	supportClient := client.NewSupportClient(config.SupportAddress, config.Debug)
+	supportClient.SetTLS(config.TLS)
 
 	// Retry connection to cellorg support service for up to 15 minutes
 	const maxRetryDuration = 15 * time.Minute
@@ -181,6 +209,14 @@ func NewBaseAgent(config AgentConfig) (*BaseAgent, error) {
 	// Establish connection to message broker
 	brokerAddress := brokerInfo.Address + brokerInfo.Port
 	brokerClient := client.NewBrokerClient(brokerAddress, config.ID, config.Debug)
+	brokerClient.SetTLS(config.TLS)
+	brokerClient.SetToken(config.Token)
+	if brokerInfo.Codec != "" {
+		// Binary codecs are negotiated in the connect handshake
+		if err := brokerClient.SetCodec(brokerInfo.Codec); err != nil {
+			return nil, fmt.Errorf("invalid broker codec: %w", err)
+		}
+	}
 	if err := brokerClient.Connect(); err != nil {
 		return nil, fmt.Errorf("failed to connect to broker: %w", err)
 	}
@@ -207,6 +243,7 @@ func NewBaseAgent(config AgentConfig) (*BaseAgent, error) {
 		Lifecycle:      lifecycle,
 		ProjectID:      config.ProjectID,
 	}
+	brokerClient.OnConnectionEvent(agent.handleConnectionEvent)
 
 	// Initialize VFS if enabled (default: true unless explicitly disabled)
 	vfsEnabled := true
@@ -227,16 +264,19 @@ func NewBaseAgent(config AgentConfig) (*BaseAgent, error) {
 		Address:      "localhost",
 		Port:         "0",
 		Codec:        "json",
+		Token:        config.Token,
 		Capabilities: config.Capabilities,
 	}
 
 	if err := supportClient.RegisterAgent(registration); err != nil {
 		return nil, fmt.Errorf("failed to register agent: %w", err)
 	}
+	agent.registration = registration
 
 	// Check environment variables first (set by deployer)
 	ingressFromEnv := os.Getenv("CELLORG_INGRESS")
 	egressFromEnv := os.Getenv("CELLORG_EGRESS")
+	deadLetterFromEnv := os.Getenv("CELLORG_DEAD_LETTER")
 
 	if ingressFromEnv != "" {
 		agent.Config["ingress"] = ingressFromEnv
@@ -250,6 +290,12 @@ func NewBaseAgent(config AgentConfig) (*BaseAgent, error) {
 			agent.LogDebug("loaded egress from environment: %s", egressFromEnv)
 		}
 	}
+	if deadLetterFromEnv != "" {
+		agent.Config["dead_letter"] = deadLetterFromEnv
+		if config.Debug {
+			agent.LogDebug("loaded dead letter destination from environment: %s", deadLetterFromEnv)
+		}
+	}
 
 	// Fetch cell-specific configuration from support service
 	// (fallback if env vars not set, or to get additional config)
@@ -272,6 +318,9 @@ func NewBaseAgent(config AgentConfig) (*BaseAgent, error) {
 		if agent.Config["egress"] == nil && cellConfig.Egress != "" {
 			agent.Config["egress"] = cellConfig.Egress
 		}
+		if agent.Config["dead_letter"] == nil && cellConfig.DeadLetter != "" {
+			agent.Config["dead_letter"] = cellConfig.DeadLetter
+		}
 
 		if config.Debug {
 			agent.LogDebug("loaded cell config from support service")
@@ -297,6 +346,142 @@ func NewBaseAgent(config AgentConfig) (*BaseAgent, error) {
 	return agent, nil
 }
 
+// AddConnectionListener adds a callback for broker connection events. It is
+// called after the lifecycle state reflects the event.
+func (a *BaseAgent) AddConnectionListener(listener func(client.ConnectionEvent)) {
+	a.connMux.Lock()
+	defer a.connMux.Unlock()
+	a.connListeners = append(a.connListeners, listener)
+}
+
+// handleConnectionEvent reflects broker connection changes in the lifecycle:
+// the agent is disconnected while the client reconnects, returns to its
+// previous state once the session is restored, and enters the error state
+// when the client gives up.
+//
+// Called by: BrokerClient for every connection event, one at a time
+func (a *BaseAgent) handleConnectionEvent(event client.ConnectionEvent) {
+	a.connMux.Lock()
+	switch event.State {
+	case client.ConnectionLost:
+		a.LogError("Broker connection lost: %v", event.Err)
+		if state := a.Lifecycle.GetState(); a.Lifecycle.CanTransitionTo(StateDisconnected) {
+			if err := a.Lifecycle.SetState(StateDisconnected, event.Err.Error()); err == nil {
+				a.resumeState = state
+			}
+		}
+	case client.ConnectionRetrying:
+		a.LogDebug("Reconnect attempt %d failed, retrying in %v: %v", event.Attempt, event.Delay, event.Err)
+	case client.ConnectionRestored:
+		if event.Err != nil {
+			a.LogError("Reconnected to broker, but the session was not fully restored: %v", event.Err)
+		} else {
+			a.LogInfo("Reconnected to broker")
+		}
+		if a.Lifecycle.GetState() == StateDisconnected && a.resumeState != "" {
+			if err := a.Lifecycle.SetState(a.resumeState, "broker connection restored"); err != nil {
+				a.LogError("Failed to leave disconnected state: %v", err)
+			}
+		}
+		a.resumeState = ""
+	case client.ConnectionFailed:
+		a.LogError("Giving up reconnecting to broker after %d attempts: %v", event.Attempt, event.Err)
+		if a.Lifecycle.CanTransitionTo(StateError) {
+			a.Lifecycle.SetState(StateError, "broker unreachable")
+		}
+		a.resumeState = ""
+	}
+	listeners := a.connListeners
+	a.connMux.Unlock()
+
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
+
+// StartHeartbeat sends heartbeats to the support service until the agent
+// stops, as often as the support service asks (the health_check_interval of
+// the agent's cell). The optional probe runs before each heartbeat; an error
+// reports the agent unhealthy with the error as the reason. When a heartbeat
+// fails, e.g. because the support service restarted, the agent reconnects
+// and registers again.
+func (a *BaseAgent) StartHeartbeat(probe func() error) {
+	go a.sendHeartbeats(probe)
+}
+
+// sendHeartbeats is the heartbeat loop started by StartHeartbeat.
+func (a *BaseAgent) sendHeartbeats(probe func() error) {
+	interval := defaultHeartbeatInterval
+	healthy := true
+
+	for {
+		detail := ""
+		if probe != nil {
+			err := probe()
+			if err != nil {
+				detail = err.Error()
+			}
+			if (err == nil) != healthy {
+				healthy = err == nil
+				if healthy {
+					a.LogInfo("Health check passed again")
+				} else {
+					a.LogError("Health check failed: %v", err)
+				}
+			}
+		}
+
+		next, err := a.SupportClient.Heartbeat(a.ID, healthy, detail)
+		if err != nil {
+			a.LogDebug("Heartbeat failed: %v", err)
+			if lostRegistration(err) {
+				if err := a.reregister(); err != nil {
+					a.LogDebug("Registering again failed: %v", err)
+				} else {
+					a.LogInfo("Registered again with support service at %s", a.SupportAddress)
+				}
+			}
+		} else if next > 0 {
+			interval = next
+		}
+
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// lostRegistration reports whether a heartbeat error means the agent must
+// reconnect and register again: the support service could not be reached,
+// or it no longer knows the agent.
+func lostRegistration(err error) bool {
+	if errors.Is(err, client.ErrSupportUnavailable) {
+		return true
+	}
+	var supportErr *client.SupportError
+	return errors.As(err, &supportErr) && supportErr.Code == client.ErrCodeUnknownAgent
+}
+
+// reregister reconnects to the support service and registers the agent
+// again, then reports its current state, so a restarted support service
+// reconciles its registry with the running agent.
+func (a *BaseAgent) reregister() error {
+	if a.ctx.Err() != nil {
+		return a.ctx.Err()
+	}
+
+	a.SupportClient.Disconnect()
+	if err := a.SupportClient.Connect(); err != nil {
+		return err
+	}
+	if err := a.SupportClient.RegisterAgent(a.registration); err != nil {
+		return fmt.Errorf("failed to register agent: %w", err)
+	}
+	return a.SupportClient.ReportStateChange(a.ID, string(a.Lifecycle.GetState()))
+}
+
 // Stop gracefully shuts down the agent and cleans up all resources.
 // This method performs orderly shutdown of all agent connections and
 // notifies the support service of the agent's termination.
@@ -377,6 +562,11 @@ func (a *BaseAgent) GetEgress() string {
 	return a.GetConfigString("egress", "")
 }
 
+// GetDeadLetter returns the agent's dead-letter destination ("" if not configured)
+func (a *BaseAgent) GetDeadLetter() string {
+	return a.GetConfigString("dead_letter", "")
+}
+
 // GetSupportAddress returns the support service address
 func (a *BaseAgent) GetSupportAddress() string {
 	return a.SupportAddress
@@ -420,6 +610,12 @@ func (a *BaseAgent) Context() context.Context {
 	return a.ctx
 }
 
+// Tracer returns the agent's span tracer, nil when tracing is off.
+// Pass it to EnvelopeFramework.SetTracer to trace envelope publishing.
+func (a *BaseAgent) Tracer() *tracing.Tracer {
+	return a.tracer
+}
+
 // GetAgentID resolves the agent's unique identifier using multiple fallback strategies.
 // This function provides flexible agent ID resolution to support different deployment
 // scenarios from development to production environments.
@@ -487,6 +683,28 @@ func GetEnvConfig(key, defaultValue string) string {
 	return defaultValue
 }
 
+// resolveSecurity fills the agent's credential and TLS settings from the
+// environment set by the deployer, unless the config already has them:
+//   - CELLORG_TOKEN: shared token or the agent's own secret
+//   - CELLORG_TLS=true: connect to support and broker over TLS
+//   - CELLORG_TLS_CA: CA verifying the services (default: system roots)
+//   - CELLORG_TLS_CERT, CELLORG_TLS_KEY: agent certificate for mutual TLS
+func resolveSecurity(config *AgentConfig) error {
+	if config.Token == "" {
+		config.Token = os.Getenv("CELLORG_TOKEN")
+	}
+	if config.TLS != nil || os.Getenv("CELLORG_TLS") != "true" {
+		return nil
+	}
+
+	tlsConfig, err := auth.ClientTLS(os.Getenv("CELLORG_TLS_CA"), os.Getenv("CELLORG_TLS_CERT"), os.Getenv("CELLORG_TLS_KEY"))
+	if err != nil {
+		return fmt.Errorf("failed to load TLS settings: %w", err)
+	}
+	config.TLS = tlsConfig
+	return nil
+}
+
 // GetDebugFromEnv checks for debug flag
 func GetDebugFromEnv() bool {
 	if os.Getenv("CELLORG_DEBUG") == "true" {
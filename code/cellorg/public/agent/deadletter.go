@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+	"github.com/tenzoki/agen/cellorg/public/client"
+)
+
+// DeadLetterMessageType is the envelope message type of dead letters routed
+// to a plain pipe or topic instead of a broker dead-letter queue.
+const DeadLetterMessageType = "dead_letter"
+
+// defaultMaxAttempts is how often a message is delivered before the agent gives
+// up on it, unless the agent config sets max_attempts.
+const defaultMaxAttempts = 3
+
+// SendDeadLetter routes a message the agent gave up on to its configured
+// dead-letter destination (cell YAML "dead_letter"), together with the error
+// and the number of delivery attempts.
+//
+// Supported destinations:
+//   - "dlq:<queue>": broker dead-letter queue, listable and re-injectable
+//   - "pipe:<name>": dead_letter envelope queued in a pipe
+//   - "pub:<topic>": dead_letter envelope published to a topic
+//
+// Returns an error if no destination is configured or it cannot be reached.
+func (a *BaseAgent) SendDeadLetter(msg *client.BrokerMessage, cause error, attempts int) error {
+	destination := a.GetDeadLetter()
+	if destination == "" {
+		return fmt.Errorf("no dead letter destination configured")
+	}
+	if a.BrokerClient == nil {
+		return fmt.Errorf("no broker connection for dead letter destination %s", destination)
+	}
+
+	dl := &client.DeadLetter{
+		AgentID:  a.ID,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		Source:   a.GetIngress(),
+		FailedAt: time.Now(),
+		Message:  msg,
+	}
+
+	kind, name, _ := strings.Cut(destination, ":")
+	if name == "" {
+		return fmt.Errorf("invalid dead letter destination: %s", destination)
+	}
+
+	switch kind {
+	case "dlq":
+		_, err := a.BrokerClient.SendDeadLetter(name, dl)
+		return err
+	case "pipe", "pub":
+		env, err := envelope.NewEnvelope(a.ID, destination, DeadLetterMessageType, dl)
+		if err != nil {
+			return fmt.Errorf("failed to create dead letter envelope: %w", err)
+		}
+		env.Persistent = true
+		if kind == "pipe" {
+			return a.BrokerClient.SendPipeEnvelope(name, env)
+		}
+		return a.BrokerClient.PublishEnvelope(name, env)
+	default:
+		return fmt.Errorf("unsupported dead letter destination: %s", destination)
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/tenzoki/agen/cellorg/internal/broker"
 	"github.com/tenzoki/agen/cellorg/internal/envelope"
+	"github.com/tenzoki/agen/cellorg/internal/tracing"
 	"github.com/tenzoki/agen/cellorg/public/client"
 	"github.com/tenzoki/agen/omni/tokencount"
 )
@@ -18,6 +19,7 @@ type EnvelopeFramework struct {
 	defaultCounter  tokencount.Counter
 	providerConfig  *broker.ProviderConfig
 	subscriptions   map[string]<-chan *envelope.Envelope // topic -> channel
+	tracer          *tracing.Tracer                      // Producer spans for published envelopes (nil = off)
 }
 
 // NewEnvelopeFramework creates a new envelope framework with chunking support
@@ -41,6 +43,13 @@ func (ef *EnvelopeFramework) SetDefaultCounter(counter tokencount.Counter) {
 	ef.defaultCounter = counter
 }
 
+// SetTracer records a producer span for every published envelope and makes
+// it the envelope's trace context, so the receiving agents' spans become its
+// children. Use BaseAgent.Tracer().
+func (ef *EnvelopeFramework) SetTracer(tracer *tracing.Tracer) {
+	ef.tracer = tracer
+}
+
 // Subscribe subscribes to a topic and returns a channel for receiving complete envelopes
 // Chunked envelopes are automatically reassembled before being delivered
 func (ef *EnvelopeFramework) Subscribe(topic string) (<-chan *envelope.Envelope, error) {
@@ -87,7 +96,17 @@ func (ef *EnvelopeFramework) processEnvelopes(input <-chan *envelope.Envelope, o
 
 // Publish publishes an envelope with automatic chunking if needed
 // The framework determines if chunking is needed based on registered providers
-func (ef *EnvelopeFramework) Publish(topic string, env *envelope.Envelope) error {
+func (ef *EnvelopeFramework) Publish(topic string, env *envelope.Envelope) (err error) {
+	// Trace the publication as a child of the envelope's current context
+	if span := ef.tracer.Start("publish "+topic, tracing.KindProducer, tracing.FromEnvelope(env)); span != nil {
+		tracing.SetEnvelopeAttributes(span, env)
+		tracing.InjectEnvelope(env, span.Context())
+		defer func() {
+			span.SetError(err)
+			span.Finish()
+		}()
+	}
+
 	// Determine if we should use chunking based on destination
 	counter := ef.providerConfig.GetCounter(env.Destination)
 	if counter == nil && ef.defaultCounter != nil {
@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -10,7 +11,9 @@ import (
 	"time"
 
 	"github.com/tenzoki/agen/atomic/logging"
+	"github.com/tenzoki/agen/cellorg/internal/tracing"
 	"github.com/tenzoki/agen/cellorg/public/client"
+	"github.com/tenzoki/agen/omni/tokencount"
 	"gopkg.in/yaml.v3"
 )
 
@@ -21,6 +24,7 @@ type AgentFramework struct {
 	baseAgent *BaseAgent
 	handlers  *ConnectionHandlers
 	agentType string
+	tracer    *tracing.Tracer // Spans around message processing (nil = tracing off)
 }
 
 // NewFramework creates a new agent framework instance
@@ -45,6 +49,11 @@ func (f *AgentFramework) Run() error {
 	}
 	defer f.baseAgent.Stop()
 
+	if err := f.setupTracing(); err != nil {
+		return fmt.Errorf("failed to setup tracing: %w", err)
+	}
+	defer f.shutdownTracing()
+
 	// Step 2: Setup connections (replaces connection parsing from all agents)
 	if err := f.setupConnections(); err != nil {
 		return fmt.Errorf("failed to setup connections: %w", err)
@@ -56,6 +65,9 @@ func (f *AgentFramework) Run() error {
 	}
 	defer f.runner.Cleanup(f.baseAgent)
 
+	// Keep the support service informed that the agent is alive
+	f.startHeartbeat()
+
 	// Step 4: Start message processing (replaces message loops from all agents)
 	msgChan, err := f.startMessageProcessing()
 	if err != nil {
@@ -239,10 +251,98 @@ func (f *AgentFramework) setupConnections() error {
 		return err
 	}
 
+	// Let sends wait for room when downstream queues are full instead of failing
+	if ms := f.baseAgent.GetConfigInt("publish_timeout_ms", 0); ms > 0 {
+		f.baseAgent.BrokerClient.SetPublishTimeout(time.Duration(ms) * time.Millisecond)
+	}
+
+	f.setupChunking()
+	if err := f.setupReconnect(); err != nil {
+		return err
+	}
+
 	f.handlers = handlers
 	return nil
 }
 
+// setupChunking configures transport chunking from the agent config, so
+// large payloads travel in chunks and arrive reassembled:
+//   - chunk_max_bytes: split payloads larger than this
+//   - chunk_provider, chunk_model: split payloads exceeding the model's token budget
+//   - chunk_timeout_ms: how long received chunks wait for the rest (default 5 minutes)
+//
+// Chunked messages that cannot be reassembled go to the runner's
+// HandleChunkError if it implements ChunkErrorHandler, or to the log.
+func (f *AgentFramework) setupChunking() {
+	cfg := client.ChunkingConfig{
+		MaxBytes: f.baseAgent.GetConfigInt("chunk_max_bytes", 0),
+		Timeout:  time.Duration(f.baseAgent.GetConfigInt("chunk_timeout_ms", 0)) * time.Millisecond,
+	}
+	if provider := f.baseAgent.GetConfigString("chunk_provider", ""); provider != "" {
+		counter, err := tokencount.NewCounter(tokencount.Config{
+			Provider: provider,
+			Model:    f.baseAgent.GetConfigString("chunk_model", ""),
+		})
+		if err != nil {
+			f.baseAgent.LogError("Token-based chunking disabled: %v", err)
+		} else {
+			cfg.Counter = counter
+		}
+	}
+	f.baseAgent.BrokerClient.SetChunking(cfg)
+	if cfg.MaxBytes > 0 || cfg.Counter != nil {
+		f.baseAgent.LogInfo("Chunking large payloads (max bytes: %d, token counter: %v)", cfg.MaxBytes, cfg.Counter != nil)
+	}
+
+	f.baseAgent.BrokerClient.OnChunkError(func(err error) {
+		if handler, ok := f.runner.(ChunkErrorHandler); ok {
+			handler.HandleChunkError(err, f.baseAgent)
+			return
+		}
+		f.baseAgent.LogError("Chunked message lost: %v", err)
+	})
+}
+
+// setupReconnect configures how the broker client reconnects after the
+// connection drops (see client.ReconnectConfig):
+//   - reconnect_max_attempts: give up and enter the error state after this many attempts (default: never)
+//   - reconnect_max_delay_ms: longest wait between attempts (default 30 seconds)
+//   - offline_publish: "fail" (default) or "buffer" publishes while reconnecting
+//   - offline_buffer: publishes kept under "buffer" (default 1000)
+//
+// Connection events go to the runner's HandleConnectionEvent if it
+// implements ConnectionEventHandler.
+func (f *AgentFramework) setupReconnect() error {
+	cfg := client.ReconnectConfig{
+		MaxAttempts: f.baseAgent.GetConfigInt("reconnect_max_attempts", 0),
+		MaxDelay:    time.Duration(f.baseAgent.GetConfigInt("reconnect_max_delay_ms", 0)) * time.Millisecond,
+		Publish:     f.baseAgent.GetConfigString("offline_publish", client.PublishFail),
+		BufferSize:  f.baseAgent.GetConfigInt("offline_buffer", 0),
+	}
+	if err := f.baseAgent.BrokerClient.SetReconnect(cfg); err != nil {
+		return fmt.Errorf("invalid reconnect configuration: %w", err)
+	}
+
+	if handler, ok := f.runner.(ConnectionEventHandler); ok {
+		f.baseAgent.AddConnectionListener(func(event client.ConnectionEvent) {
+			handler.HandleConnectionEvent(event, f.baseAgent)
+		})
+	}
+	return nil
+}
+
+// startHeartbeat sends heartbeats to the support service, probing the
+// runner's health first if it implements HealthChecker.
+func (f *AgentFramework) startHeartbeat() {
+	var probe func() error
+	if checker, ok := f.runner.(HealthChecker); ok {
+		probe = func() error {
+			return checker.HealthCheck(f.baseAgent)
+		}
+	}
+	f.baseAgent.StartHeartbeat(probe)
+}
+
 // startMessageProcessing starts the message processing loop
 func (f *AgentFramework) startMessageProcessing() (<-chan *client.BrokerMessage, error) {
 	// Connect to ingress
@@ -274,9 +374,13 @@ func (f *AgentFramework) startMessageProcessing() (<-chan *client.BrokerMessage,
 						f.baseAgent.LogError("Failed to process generated message: %v", err)
 					}
 				} else {
-					// For regular processing agents
+					// For regular processing agents: acknowledge only after egress
+					// succeeded, so a failure or crash leads to redelivery
 					if err := f.processMessage(msg); err != nil {
 						f.baseAgent.LogError("Failed to process message: %v", err)
+						f.handleFailure(msg, err)
+					} else if ackErr := f.handlers.Ack(msg); ackErr != nil {
+						f.baseAgent.LogError("Failed to ack message %s: %v", msg.ID, ackErr)
 					}
 				}
 			}
@@ -287,17 +391,31 @@ func (f *AgentFramework) startMessageProcessing() (<-chan *client.BrokerMessage,
 }
 
 // processMessage handles a single message using the agent's business logic
-func (f *AgentFramework) processMessage(msg *client.BrokerMessage) error {
+func (f *AgentFramework) processMessage(msg *client.BrokerMessage) (err error) {
 	f.baseAgent.LogDebug("Processing message %s", msg.ID)
 
+	// Trace the processing step as a child of the upstream agent's step
+	span := f.startSpan(msg, tracing.KindConsumer, "process")
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
 	// Call agent-specific processing logic
 	resultMsg, err := f.runner.ProcessMessage(msg, f.baseAgent)
 	if err != nil {
 		return fmt.Errorf("agent processing failed: %w", err)
 	}
 
-	// If agent returned a result, send it via egress
-	if resultMsg != nil {
+	// If agent returned a result, send it via egress, or back to the
+	// requester for requests (published with BrokerClient.Request)
+	if resultMsg != nil && client.IsRequest(msg) {
+		if err := f.baseAgent.BrokerClient.ReplyMessage(msg, resultMsg.Payload); err != nil {
+			return fmt.Errorf("failed to reply to request: %w", err)
+		}
+		f.baseAgent.LogInfo("Processed and answered request %s", msg.ID)
+	} else if resultMsg != nil {
+		resultMsg.Meta = tracing.InjectMeta(resultMsg.Meta, tracing.FromMeta(msg.Meta))
 		if err := f.handlers.Send(resultMsg); err != nil {
 			return fmt.Errorf("failed to send result message: %w", err)
 		}
@@ -311,10 +429,54 @@ func (f *AgentFramework) processMessage(msg *client.BrokerMessage) error {
 	return nil
 }
 
+// handleFailure decides what happens to a message that failed processing.
+// Redeliverable messages are nacked until max_attempts (default 3) is reached;
+// after that, or right away for ingress types without redelivery, the message
+// goes to the agent's dead-letter destination. Without a dead-letter
+// destination the message is dropped once retries are exhausted.
+func (f *AgentFramework) handleFailure(msg *client.BrokerMessage, cause error) {
+	attempt := msg.DeliveryAttempt
+	if attempt == 0 {
+		attempt = 1
+	}
+
+	if f.handlers.CanRetry(msg) && attempt < f.baseAgent.GetConfigInt("max_attempts", defaultMaxAttempts) {
+		if err := f.handlers.Nack(msg, cause); err != nil {
+			f.baseAgent.LogError("Failed to nack message %s: %v", msg.ID, err)
+		}
+		return
+	}
+
+	if f.baseAgent.GetDeadLetter() != "" {
+		if err := f.baseAgent.SendDeadLetter(msg, cause, attempt); err != nil {
+			// Keep the message in the system rather than losing it
+			f.baseAgent.LogError("Failed to dead-letter message %s: %v", msg.ID, err)
+			if nackErr := f.handlers.Nack(msg, cause); nackErr != nil {
+				f.baseAgent.LogError("Failed to nack message %s: %v", msg.ID, nackErr)
+			}
+			return
+		}
+		f.baseAgent.LogInfo("Dead-lettered message %s to %s after %d attempts", msg.ID, f.baseAgent.GetDeadLetter(), attempt)
+	} else {
+		f.baseAgent.LogError("Dropping message %s after %d attempts", msg.ID, attempt)
+	}
+
+	if err := f.handlers.Ack(msg); err != nil {
+		f.baseAgent.LogError("Failed to ack message %s: %v", msg.ID, err)
+	}
+}
+
 // processGeneratedMessage handles messages generated by ingress handlers (like file_ingester)
-func (f *AgentFramework) processGeneratedMessage(msg *client.BrokerMessage) error {
+func (f *AgentFramework) processGeneratedMessage(msg *client.BrokerMessage) (err error) {
 	f.baseAgent.LogDebug("Processing generated message %s", msg.ID)
 
+	// Generated messages start a new trace
+	span := f.startSpan(msg, tracing.KindProducer, "ingest")
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
 	// For message generators, call the agent's ProcessMessage for any custom logic
 	resultMsg, err := f.runner.ProcessMessage(msg, f.baseAgent)
 	if err != nil {
@@ -326,6 +488,7 @@ func (f *AgentFramework) processGeneratedMessage(msg *client.BrokerMessage) erro
 	if msgToSend == nil {
 		msgToSend = msg // Use original if agent didn't transform
 	}
+	msgToSend.Meta = tracing.InjectMeta(msgToSend.Meta, tracing.FromMeta(msg.Meta))
 
 	if err := f.handlers.Send(msgToSend); err != nil {
 		return fmt.Errorf("failed to send generated message: %w", err)
@@ -335,6 +498,61 @@ func (f *AgentFramework) processGeneratedMessage(msg *client.BrokerMessage) erro
 	return nil
 }
 
+// setupTracing creates the span tracer from the trace_exporter, trace_endpoint
+// and trace_file config keys, falling back to the CELLORG_TRACE_* variables
+// set by the deployer. Without an exporter tracing stays off.
+func (f *AgentFramework) setupTracing() error {
+	name := f.baseAgent.GetConfigString("trace_exporter", GetEnvConfig("TRACE_EXPORTER", ""))
+	if name == "" {
+		return nil
+	}
+
+	exporter, err := tracing.NewExporter(name,
+		f.baseAgent.GetConfigString("trace_endpoint", GetEnvConfig("TRACE_ENDPOINT", "")),
+		f.baseAgent.GetConfigString("trace_file", GetEnvConfig("TRACE_FILE", "")))
+	if err != nil {
+		return err
+	}
+	f.tracer = tracing.NewTracer(f.agentType, exporter)
+	f.baseAgent.tracer = f.tracer
+	f.baseAgent.LogInfo("Tracing enabled (%s exporter)", name)
+	return nil
+}
+
+// shutdownTracing exports the remaining spans before the agent exits
+func (f *AgentFramework) shutdownTracing() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := f.tracer.Shutdown(ctx); err != nil {
+		f.baseAgent.LogError("Failed to export remaining spans: %v", err)
+	}
+}
+
+// startSpan opens the span of one processing step, with the trace context in
+// the message meta as its parent. While the agent works on the message, the
+// meta carries the new span's context instead, so results the agent builds
+// from a copy of it continue the trace. Without tracing the meta is left as
+// it is and passes the upstream context on.
+func (f *AgentFramework) startSpan(msg *client.BrokerMessage, kind tracing.SpanKind, operation string) *tracing.Span {
+	span := f.tracer.Start(f.agentType+" "+operation, kind, tracing.FromMeta(msg.Meta))
+	if span == nil {
+		return nil
+	}
+
+	span.SetAttribute("cellorg.agent_id", f.baseAgent.ID)
+	span.SetAttribute("messaging.message.id", msg.ID)
+	span.SetAttribute("cellorg.message_type", msg.Type)
+	if msg.Target != "" {
+		span.SetAttribute("messaging.destination.name", msg.Target)
+	}
+	if msg.DeliveryAttempt > 1 {
+		span.SetAttribute("cellorg.delivery_attempt", fmt.Sprint(msg.DeliveryAttempt))
+	}
+
+	msg.Meta = tracing.InjectMeta(msg.Meta, span.Context())
+	return span
+}
+
 // handleShutdown manages graceful shutdown with signal handling
 func (f *AgentFramework) handleShutdown(msgChan <-chan *client.BrokerMessage) error {
 	// Setup signal handling (identical across all agents)
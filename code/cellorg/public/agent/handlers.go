@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/tenzoki/agen/cellorg/internal/wildcard"
 	"github.com/tenzoki/agen/cellorg/public/client"
 )
 
@@ -20,6 +22,14 @@ type IngressHandler interface {
 	Type() string
 }
 
+// AckableIngress is implemented by ingress handlers whose messages must be
+// acknowledged once processing, including egress, has succeeded. Messages
+// that are never acknowledged are redelivered by the broker.
+type AckableIngress interface {
+	Ack(msg *client.BrokerMessage) error
+	Nack(msg *client.BrokerMessage, cause error) error
+}
+
 // EgressHandler abstracts egress connection types
 type EgressHandler interface {
 	Send(config string, msg *client.BrokerMessage, base *BaseAgent) error
@@ -60,26 +70,110 @@ func (h *ConnectionHandlers) Send(msg *client.BrokerMessage) error {
 	return h.egress.Send("", msg, nil) // Config already parsed in constructor
 }
 
+// Ack confirms a fully processed ingress message (no-op for ingress types without acks)
+func (h *ConnectionHandlers) Ack(msg *client.BrokerMessage) error {
+	if ackable, ok := h.ingress.(AckableIngress); ok {
+		return ackable.Ack(msg)
+	}
+	return nil
+}
+
+// Nack rejects an ingress message that failed processing so it is redelivered
+// (no-op for ingress types without acks)
+func (h *ConnectionHandlers) Nack(msg *client.BrokerMessage, cause error) error {
+	if ackable, ok := h.ingress.(AckableIngress); ok {
+		return ackable.Nack(msg, cause)
+	}
+	return nil
+}
+
+// CanRetry reports whether a failed ingress message can be redelivered via Nack
+func (h *ConnectionHandlers) CanRetry(msg *client.BrokerMessage) bool {
+	_, ok := h.ingress.(AckableIngress)
+	return ok && msg.DeliveryTag != ""
+}
+
 // --- INGRESS HANDLERS ---
 
 // SubscriptionIngressHandler handles "sub:" connections
+// The topic may be a wildcard pattern ("sub:project-42.*", "sub:extracted-text.#")
+// so monitoring and audit agents can follow a whole topic hierarchy.
+// Replicas that set the same "consumer_group" config key share the topic's
+// messages instead of each processing all of them; "group_strategy" selects
+// round_robin (default) or least_loaded distribution.
+// The "prefetch" config key limits how many messages the broker hands the
+// agent before it finished them; the rest wait in the broker, so a bulk
+// producer cannot flood a slow agent.
+// A content filter after "?" makes the broker deliver only matching
+// messages ("sub:extracted-text?message_type=chunk&headers.lang=de"); see
+// client.SubscribeOptions.Filter for the syntax.
+// Requests published to the topic with client.BrokerClient.Request arrive as
+// messages too; the framework sends their results back to the requester
+// instead of to egress.
 type SubscriptionIngressHandler struct {
 	topicName string
+	filter    string // Content filter evaluated by the broker ("" = everything)
 	base      *BaseAgent
+	prefetch  int // Prefetch window advertised to the broker (0 = no flow control)
 }
 
 func (s *SubscriptionIngressHandler) Type() string { return "subscription" }
 
+// Ack returns the message's credit to the broker once it is processed
+func (s *SubscriptionIngressHandler) Ack(msg *client.BrokerMessage) error {
+	if s.prefetch == 0 {
+		return nil
+	}
+	return s.base.BrokerClient.Credit(1)
+}
+
+// Nack returns the credit of a failed message; topic messages are not redelivered
+func (s *SubscriptionIngressHandler) Nack(msg *client.BrokerMessage, cause error) error {
+	return s.Ack(msg)
+}
+
 func (s *SubscriptionIngressHandler) Connect(config string, base *BaseAgent) (<-chan *client.BrokerMessage, error) {
-	msgChan, err := s.base.BrokerClient.Subscribe(s.topicName)
+	// Advertise the prefetch window before subscribing so the first
+	// deliveries are already paced
+	if prefetch := s.base.GetConfigInt("prefetch", 0); prefetch > 0 {
+		if err := s.base.BrokerClient.SetPrefetch(prefetch); err != nil {
+			return nil, fmt.Errorf("failed to set prefetch window: %w", err)
+		}
+		s.prefetch = prefetch
+		s.base.LogInfo("Prefetch window: %d messages", prefetch)
+	}
+
+	opts := client.SubscribeOptions{
+		Group:    s.base.GetConfigString("consumer_group", ""),
+		Strategy: s.base.GetConfigString("group_strategy", ""),
+		Filter:   s.filter,
+	}
+	msgChan, err := s.base.BrokerClient.SubscribeWithOptions(s.topicName, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to subscribe to topic %s: %w", s.topicName, err)
 	}
-	s.base.LogInfo("Subscribed to topic: %s", s.topicName)
+	if s.filter != "" {
+		s.base.LogInfo("Filtering topic %s by %s", s.topicName, s.filter)
+	}
+	if opts.Group != "" {
+		s.base.LogInfo("Subscribed to topic %s in consumer group %s", s.topicName, opts.Group)
+	} else if wildcard.IsPattern(s.topicName) {
+		s.base.LogInfo("Subscribed to topic pattern: %s", s.topicName)
+	} else {
+		s.base.LogInfo("Subscribed to topic: %s", s.topicName)
+	}
 	return msgChan, nil
 }
 
 // PipeIngressHandler handles "pipe:" connections (consumer)
+// Messages are received in manual-ack mode: the framework acks them after
+// egress succeeds, and the broker redelivers them if the agent fails or
+// crashes first. The "visibility_timeout_ms" config key sets how long
+// processing may take before redelivery (broker default: 30s).
+// Replicas consuming the same pipe share its messages by the "pipe_policy"
+// config key: round_robin (default), least_in_flight, or sticky, which keeps
+// messages with the same "sticky_key" (correlation_id or header:<name>) on
+// one replica for agents that hold per-document state.
 type PipeIngressHandler struct {
 	pipeName string
 	base     *BaseAgent
@@ -87,15 +181,41 @@ type PipeIngressHandler struct {
 
 func (p *PipeIngressHandler) Type() string { return "pipe_consumer" }
 
+// Ack confirms a processed pipe message
+func (p *PipeIngressHandler) Ack(msg *client.BrokerMessage) error {
+	if msg.DeliveryTag == "" {
+		return nil
+	}
+	return p.base.BrokerClient.Ack(msg.DeliveryTag)
+}
+
+// Nack returns a failed pipe message to the pipe for redelivery
+func (p *PipeIngressHandler) Nack(msg *client.BrokerMessage, cause error) error {
+	if msg.DeliveryTag == "" {
+		return nil
+	}
+	p.base.LogDebug("Returning message %s to pipe %s: %v", msg.ID, p.pipeName, cause)
+	return p.base.BrokerClient.Nack(msg.DeliveryTag, true)
+}
+
 func (p *PipeIngressHandler) Connect(config string, base *BaseAgent) (<-chan *client.BrokerMessage, error) {
-	if err := p.base.BrokerClient.ConnectPipe(p.pipeName, "consumer"); err != nil {
+	opts := client.PipeConsumerOptions{
+		Policy: p.base.GetConfigString("pipe_policy", ""),
+		Key:    p.base.GetConfigString("sticky_key", ""),
+	}
+	if err := p.base.BrokerClient.ConnectPipeConsumer(p.pipeName, opts); err != nil {
 		return nil, fmt.Errorf("failed to connect to pipe %s: %w", p.pipeName, err)
 	}
-	p.base.LogInfo("Connected to pipe as consumer: %s", p.pipeName)
+	if opts.Policy != "" {
+		p.base.LogInfo("Connected to pipe as consumer: %s (policy %s)", p.pipeName, opts.Policy)
+	} else {
+		p.base.LogInfo("Connected to pipe as consumer: %s", p.pipeName)
+	}
 
 	// For pipe consumers, we need to create a channel and handle receiving in a goroutine
 	// This matches the current file_writer implementation
 	msgChan := make(chan *client.BrokerMessage, 10)
+	visibilityMs := p.base.GetConfigInt("visibility_timeout_ms", 0)
 
 	go func() {
 		defer close(msgChan)
@@ -105,8 +225,13 @@ func (p *PipeIngressHandler) Connect(config string, base *BaseAgent) (<-chan *cl
 				p.base.LogDebug("Pipe ingress handler shutting down")
 				return
 			default:
-				msg, err := p.base.BrokerClient.ReceivePipe(p.pipeName, 1000) // 1 second timeout
+				delivery, err := p.base.BrokerClient.ReceivePipeWithAck(p.pipeName, 1000, visibilityMs) // 1 second timeout
 				if err != nil {
+					// Connection losses are reported by the base agent; wait for the reconnect
+					if errors.Is(err, client.ErrNotConnected) || errors.Is(err, client.ErrConnectionLost) {
+						time.Sleep(500 * time.Millisecond)
+						continue
+					}
 					if !strings.Contains(err.Error(), "Timeout waiting for message") {
 						p.base.LogError("Failed to receive from pipe: %v", err)
 					}
@@ -114,20 +239,27 @@ func (p *PipeIngressHandler) Connect(config string, base *BaseAgent) (<-chan *cl
 					continue
 				}
 
-				if msg != nil {
-					if brokerMsg, ok := msg.(*client.BrokerMessage); ok {
-						// Debug: Log message received from pipe
-						p.base.LogDebug("PipeIngressHandler received message %s from pipe %s with meta: %+v", brokerMsg.ID, p.pipeName, brokerMsg.Meta)
-						for k, v := range brokerMsg.Meta {
-							p.base.LogDebug("  Received Meta[%s] = %+v (type: %T)", k, v, v)
-						}
-
-						select {
-						case msgChan <- brokerMsg:
-						case <-p.base.Context().Done():
-							return
-						}
+				// Envelopes are not handled by the message framework; settle them
+				// so the broker does not redeliver them forever
+				if delivery.Message == nil {
+					p.base.LogDebug("Ignoring non-message delivery %s from pipe %s", delivery.Tag, p.pipeName)
+					if err := p.base.BrokerClient.Ack(delivery.Tag); err != nil {
+						p.base.LogError("Failed to ack delivery %s: %v", delivery.Tag, err)
 					}
+					continue
+				}
+
+				// Debug: Log message received from pipe
+				brokerMsg := delivery.Message
+				p.base.LogDebug("PipeIngressHandler received message %s from pipe %s with meta: %+v (attempt %d)", brokerMsg.ID, p.pipeName, brokerMsg.Meta, delivery.Attempt)
+				for k, v := range brokerMsg.Meta {
+					p.base.LogDebug("  Received Meta[%s] = %+v (type: %T)", k, v, v)
+				}
+
+				select {
+				case msgChan <- brokerMsg:
+				case <-p.base.Context().Done():
+					return
 				}
 			}
 		}
@@ -492,9 +624,13 @@ func (f *FileEgressHandler) Send(config string, msg *client.BrokerMessage, base
 // NewIngressHandler creates appropriate ingress handler based on config
 func NewIngressHandler(config string, base *BaseAgent) (IngressHandler, error) {
 	if strings.HasPrefix(config, "sub:") {
-		topicName := strings.TrimPrefix(config, "sub:")
+		topicName, filter, _ := strings.Cut(strings.TrimPrefix(config, "sub:"), "?")
+		if err := wildcard.Validate(topicName); err != nil {
+			return nil, fmt.Errorf("invalid ingress %s: %w", config, err)
+		}
 		return &SubscriptionIngressHandler{
 			topicName: topicName,
+			filter:    filter,
 			base:      base,
 		}, nil
 	}
@@ -525,6 +661,9 @@ func NewIngressHandler(config string, base *BaseAgent) (IngressHandler, error) {
 func NewEgressHandler(config string, base *BaseAgent) (EgressHandler, error) {
 	if strings.HasPrefix(config, "pub:") {
 		topicName := strings.TrimPrefix(config, "pub:")
+		if wildcard.IsPattern(topicName) {
+			return nil, fmt.Errorf("invalid egress %s: cannot publish to a wildcard topic", config)
+		}
 		return &PublishEgressHandler{
 			topicName: topicName,
 			base:      base,
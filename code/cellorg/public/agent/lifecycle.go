@@ -18,17 +18,23 @@ const (
 	StatePaused     AgentState = "paused"     // Agent suspended, not processing new messages
 	StateStopped    AgentState = "stopped"    // Agent cleanly shut down
 	StateError      AgentState = "error"      // Agent in error state, needs intervention
+
+	// Agent lost its broker connection and is reconnecting; returns to the
+	// state it left once the connection is restored
+	StateDisconnected AgentState = "disconnected"
 )
 
 // StateTransitions defines valid state transitions
 var StateTransitions = map[AgentState][]AgentState{
-	StateInstalled:  {StateConfigured, StateError},
-	StateConfigured: {StateReady, StateError},
-	StateReady:      {StateRunning, StateStopped, StateError},
-	StateRunning:    {StatePaused, StateStopped, StateError},
-	StatePaused:     {StateRunning, StateStopped, StateError},
+	StateInstalled:  {StateConfigured, StateError, StateDisconnected},
+	StateConfigured: {StateReady, StateError, StateDisconnected},
+	StateReady:      {StateRunning, StateStopped, StateError, StateDisconnected},
+	StateRunning:    {StatePaused, StateStopped, StateError, StateDisconnected},
+	StatePaused:     {StateRunning, StateStopped, StateError, StateDisconnected},
 	StateStopped:    {},                              // Terminal state
 	StateError:      {StateConfigured, StateStopped}, // Can recover or stop
+	StateDisconnected: {StateInstalled, StateConfigured, StateReady, StateRunning, StatePaused,
+		StateStopped, StateError}, // Back to the state before the connection dropped
 }
 
 // LifecycleManager handles agent state transitions
@@ -29,3 +29,28 @@ func (d *DefaultAgentRunner) Init(base *BaseAgent) error {
 func (d *DefaultAgentRunner) Cleanup(base *BaseAgent) {
 	// Default: no custom cleanup needed
 }
+
+// ChunkErrorHandler can be implemented by runners that want to react to
+// chunked messages that never reached them: incomplete ones
+// (client.ErrChunkTimeout) and ones whose chunks did not merge. Without it
+// the framework logs these errors.
+type ChunkErrorHandler interface {
+	HandleChunkError(err error, base *BaseAgent)
+}
+
+// ConnectionEventHandler can be implemented by runners that want to react to
+// broker connection changes, e.g. to flush local state once the connection
+// is restored. The base agent already logs the events and reflects them in
+// its lifecycle state (StateDisconnected while reconnecting).
+type ConnectionEventHandler interface {
+	HandleConnectionEvent(event client.ConnectionEvent, base *BaseAgent)
+}
+
+// HealthChecker can be implemented by runners that can tell whether they
+// still work, e.g. by checking a database connection. The framework calls
+// HealthCheck before each heartbeat; an error reports the agent unhealthy
+// and the support service moves it to the error state until a later check
+// passes. Without it every heartbeat reports the agent healthy.
+type HealthChecker interface {
+	HealthCheck(base *BaseAgent) error
+}
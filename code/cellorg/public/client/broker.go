@@ -5,10 +5,12 @@
 //
 // Key Features:
 // - TCP connection management with automatic reconnection
-// - JSON-RPC protocol for broker communication
+// - Subscriptions and pipe roles restored after a reconnect, publishes buffered or failed meanwhile
+// - JSON-RPC protocol for broker communication, optionally MessagePack-encoded
 // - Publish/Subscribe messaging for event distribution
 // - Point-to-point pipes for direct agent communication
 // - Full envelope protocol support with metadata tracking
+// - Transparent chunking of large payloads, reassembled on receipt
 // - Concurrent message handling with proper synchronization
 // - Request/response correlation and timeout handling
 //
@@ -18,16 +20,26 @@
 package client
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/tenzoki/agen/cellorg/internal/codec"
 	"github.com/tenzoki/agen/cellorg/internal/envelope"
+	"github.com/tenzoki/agen/cellorg/internal/wildcard"
 )
 
+// subscriptionBuffer is how many deliveries each subscription channel holds.
+// Deliveries to a full channel are dropped, so prefetch windows are capped
+// at it.
+const subscriptionBuffer = 100
+
 // BrokerClient manages communication between an agent and the central broker.
 // It handles all aspects of broker connectivity including connection management,
 // message routing, subscription handling, and protocol translation.
@@ -40,47 +52,99 @@ import (
 // concurrently from multiple goroutines.
 type BrokerClient struct {
 	// Connection configuration
-	address string // Broker TCP address (e.g., "localhost:9001")
-	agentID string // Unique agent identifier for this client
-	debug   bool   // Enable debug logging
+	address string      // Broker TCP address (e.g., "localhost:9001")
+	agentID string      // Unique agent identifier for this client
+	debug   bool        // Enable debug logging
+	tls     *tls.Config // TLS settings (nil = plain TCP)
+	token   string      // Credential presented in the connect handshake
 
 	// Network connection state
-	conn    net.Conn      // TCP connection to broker
-	encoder *json.Encoder // JSON encoder for sending requests
-	decoder *json.Decoder // JSON decoder for receiving responses
-	mux     sync.Mutex    // Protects connection state during connect/disconnect
+	conn      net.Conn      // TCP connection to broker
+	encoder   codec.Encoder // Encoder for sending requests
+	decoder   codec.Decoder // Decoder for receiving responses and deliveries
+	codecName string        // Codec requested in the handshake ("json" or "msgpack")
+	wire      codec.Codec   // Codec agreed with the broker, used for params and results
+	mux       sync.Mutex    // Protects connection state during connect/disconnect
+	sendMux   sync.Mutex    // Serializes request writes; protects conn, encoder and decoder
 
 	// Request/response correlation
-	reqID int64 // Incrementing request ID counter
+	reqID int64 // Incrementing request ID counter (atomic)
 
 	// Message routing for subscriptions
-	listeners    map[string]chan *BrokerMessage     // Topic message listeners
-	envListeners map[string]chan *envelope.Envelope // Topic envelope listeners
+	listeners    map[string]chan *BrokerMessage     // Topic message listeners, keyed by topic or wildcard pattern
+	envListeners map[string]chan *envelope.Envelope // Topic envelope listeners, keyed by topic or wildcard pattern
 	listenersMux sync.RWMutex                       // Protects listener maps
 
 	// Request/response correlation for JSON-RPC calls
 	responseChans map[string]chan *BrokerResponse // Pending request channels
 	responseChMux sync.RWMutex                    // Protects response channel map
+
+	// Request/reply correlation for Request
+	requests    map[string]chan *envelope.Envelope // Pending requests, keyed by correlation ID
+	requestsMux sync.Mutex                         // Protects requests
+
+	// Backpressure handling for publishes and pipe sends
+	publishTimeout time.Duration   // Wait for space in full broker queues (0 = fail fast)
+	onSlowDown     func(*SlowDown) // Called with slow-down signals (nil = ignore them)
+	flowMux        sync.RWMutex    // Protects publishTimeout and onSlowDown
+
+	// Transport chunking of large payloads
+	chunks *chunkState // Chunking limits and partially received messages
+
+	// Reconnection after a dropped connection, protected by mux
+	reconnect     ReconnectConfig                  // Backoff and publish policy
+	closed        bool                             // Disconnect was called; do not reconnect
+	reconnecting  bool                             // A reconnect loop is running
+	stop          chan struct{}                    // Closed to end the reconnect loop
+	buffered      []bufferedSend                   // Sends waiting for the reconnect (PublishBuffer)
+	subscriptions map[string]SubscribeOptions      // Subscriptions to restore, keyed by topic or pattern
+	pipeRoles     map[pipeRole]PipeConsumerOptions // Pipe registrations to restore
+	prefetch      int                              // Prefetch window to restore
+	flowControl   atomic.Bool                      // A prefetch window is set; read by the message listener
+	onConnEvent   func(ConnectionEvent)            // Connection event handler
+	events        []ConnectionEvent                // Events waiting for the handler
+	dispatching   bool                             // A goroutine is passing events to the handler
+}
+
+// link is one connection to the broker with the codec agreed for it.
+type link struct {
+	conn    net.Conn
+	encoder codec.Encoder
+	decoder codec.Decoder
+	wire    codec.Codec
 }
 
 // BrokerRequest represents a JSON-RPC request sent to the broker.
 // This follows the JSON-RPC 2.0 specification for standardized
 // remote procedure call communication.
 type BrokerRequest struct {
-	ID     string          `json:"id"`     // Request identifier for response correlation
-	Method string          `json:"method"` // Broker method to invoke
-	Params json.RawMessage `json:"params"` // Method parameters (method-specific structure)
+	ID     string    `json:"id"`     // Request identifier for response correlation
+	Method string    `json:"method"` // Broker method to invoke
+	Params codec.Raw `json:"params"` // Method parameters (method-specific structure)
 }
 
 // BrokerResponse represents a JSON-RPC response received from the broker.
 // Contains either a successful result or an error, following JSON-RPC 2.0
 // specification for standardized error handling.
 type BrokerResponse struct {
-	ID     string          `json:"id"`               // Request ID for correlation
-	Result json.RawMessage `json:"result,omitempty"` // Success result (method-specific)
-	Error  *BrokerError    `json:"error,omitempty"`  // Error information if request failed
+	ID       string       `json:"id"`                  // Request ID for correlation
+	Result   codec.Raw    `json:"result,omitempty"`    // Success result (method-specific, in the connection's codec)
+	Error    *BrokerError `json:"error,omitempty"`     // Error information if request failed
+	SlowDown *SlowDown    `json:"slow_down,omitempty"` // Backpressure signal on publish and send responses
 }
 
+// Broker error codes for rejected agents and payloads, in addition to the
+// standard JSON-RPC codes.
+const (
+	ErrCodeUnauthorized = -32001 // Missing or invalid credentials
+	ErrCodeForbidden    = -32003 // Topic not allowed by the agent's ACL
+
+	ErrCodeSchemaViolation = -32022 // Payload does not match the schema registered for it
+
+	ErrCodeRateLimited     = -32029 // Publish rate of the agent or topic exceeded; the response's SlowDown says when to retry
+	ErrCodeMessageTooLarge = -32013 // Publication larger than the agent's or topic's max_message_bytes
+)
+
 // BrokerError represents an error response from the broker following
 // JSON-RPC error conventions. Standard error codes include -32601
 // (Method not found), -32602 (Invalid params), -32603 (Internal error).
@@ -89,16 +153,162 @@ type BrokerError struct {
 	Message string `json:"message"` // Human-readable error description
 }
 
+// Error implements the error interface so callers can inspect broker error
+// codes with errors.As on errors returned by client methods.
+func (e *BrokerError) Error() string {
+	return fmt.Sprintf("%s (code: %d)", e.Message, e.Code)
+}
+
 // BrokerMessage represents a simple message received from the broker.
 // This is used for basic agent communication when full envelope protocol
 // is not required, providing a lightweight alternative for simple data exchange.
 type BrokerMessage struct {
-	ID        string                 `json:"id"`        // Unique message identifier
-	Type      string                 `json:"type"`      // Message type for handling dispatch
-	Target    string                 `json:"target"`    // Routing target (topic or pipe)
-	Payload   interface{}            `json:"payload"`   // Message data (any JSON-serializable type)
-	Meta      map[string]interface{} `json:"meta"`      // Metadata for message processing
-	Timestamp time.Time              `json:"timestamp"` // When message was processed by broker
+	ID        string                 `json:"id"`               // Unique message identifier
+	Type      string                 `json:"type"`             // Message type for handling dispatch
+	Target    string                 `json:"target"`           // Routing target (topic or pipe)
+	Payload   interface{}            `json:"payload"`          // Message data (any JSON-serializable type)
+	Meta      map[string]interface{} `json:"meta"`             // Metadata for message processing
+	Timestamp time.Time              `json:"timestamp"`        // When message was processed by broker
+	Offset    uint64                 `json:"offset,omitempty"` // Position in the topic log (topic messages only)
+
+	DeliveryTag     string `json:"-"` // Set for pipe messages received in manual-ack mode
+	DeliveryAttempt int    `json:"-"` // Delivery attempt in manual-ack mode (1 = first delivery)
+}
+
+// Delivery is a pipe item received in manual-ack mode. Exactly one of Message
+// and Envelope is set. The broker redelivers it to the next consumer unless it
+// is acked (or nacked) before the visibility timeout expires.
+type Delivery struct {
+	Tag      string             `json:"delivery_tag"`       // Passed to Ack/Nack
+	Attempt  int                `json:"attempt"`            // 1 for the first delivery, 2+ for redeliveries
+	Message  *BrokerMessage     `json:"message,omitempty"`  // Simple message payload
+	Envelope *envelope.Envelope `json:"envelope,omitempty"` // Envelope payload
+}
+
+// QueueStats reports the depth of a broker queue, broken down by priority.
+type QueueStats struct {
+	Depth      int   `json:"depth"`       // Total queued items
+	Capacity   int   `json:"capacity"`    // Maximum queued items
+	ByPriority []int `json:"by_priority"` // Queued items per priority (index = priority, 0-9)
+	InFlight   int   `json:"in_flight"`   // Delivered but not yet acknowledged (pipes only)
+}
+
+// SubscriberStats reports the pending topic deliveries of one broker connection.
+type SubscriberStats struct {
+	AgentID string      `json:"agent_id"` // Agent owning the connection
+	Outbox  QueueStats  `json:"outbox"`   // Deliveries not yet written to the agent
+	Flow    CreditStats `json:"flow"`     // Prefetch window and remaining credits
+}
+
+// CreditStats reports the prefetch window of a broker connection.
+// Prefetch 0 means flow control is off.
+type CreditStats struct {
+	Prefetch int `json:"prefetch"` // Maximum unconfirmed topic deliveries
+	Credits  int `json:"credits"`  // Deliveries the broker may still write before the next grant
+}
+
+// SlowDown is the broker's backpressure signal: the queue a publish or send
+// went to is filled beyond the high watermark. By default the client pauses
+// for RetryAfterMs before returning (see OnSlowDown).
+type SlowDown struct {
+	Queue        string `json:"queue"`              // "pipe:<name>", "outbox:<connection id>", or the exceeded rate limit ("agent:<id>", "topic:<name>")
+	AgentID      string `json:"agent_id,omitempty"` // Slow subscriber (topic publications only)
+	Depth        int    `json:"depth"`              // Queued items
+	Capacity     int    `json:"capacity"`           // Maximum queued items
+	RetryAfterMs int    `json:"retry_after_ms"`     // Suggested pause before the next publication
+}
+
+// maxPublishTimeout bounds SetPublishTimeout below the 30 second request timeout.
+const maxPublishTimeout = 20 * time.Second
+
+// handshakeTimeout bounds the connect handshake, matching the request timeout.
+const handshakeTimeout = 30 * time.Second
+
+// BrokerStats is a snapshot of broker queue depths.
+type BrokerStats struct {
+	Pipes       map[string]QueueStats            `json:"pipes"`        // Pipe name -> queue depth
+	Subscribers map[string]SubscriberStats       `json:"subscribers"`  // Connection ID -> outbox depth
+	DeadLetters map[string]int                   `json:"dead_letters"` // Dead-letter queue -> record count
+	Groups      map[string]map[string]GroupStats `json:"groups"`       // Topic -> consumer group -> members
+	Topics      map[string]TopicStats            `json:"topics"`       // Topic -> retained offsets
+	Scheduled   int                              `json:"scheduled"`    // Envelopes waiting for their delivery time
+
+	PipeConsumers map[string]PipeConsumerStats `json:"pipe_consumers"` // Pipe name -> consumers and policy
+	Filters       map[string]map[string]string `json:"filters"`        // Topic -> connection ID -> filter of ungrouped subscriptions
+	Dedup         DedupStats                   `json:"dedup"`          // Remembered envelopes and repeats dropped
+	RateLimited   map[string]uint64            `json:"rate_limited"`   // Limit ("agent:<id>", "topic:<name>" or "anonymous") -> publications rejected
+}
+
+// DedupStats reports the broker's index of recently accepted envelopes.
+type DedupStats struct {
+	Window  time.Duration     `json:"window"`  // How long accepted envelopes are remembered (0 = disabled)
+	Entries int               `json:"entries"` // Envelopes currently remembered
+	Hits    map[string]uint64 `json:"hits"`    // Destination ("pub:<topic>" or "pipe:<name>") -> repeats dropped
+}
+
+// HeaderIdempotencyKey is the envelope header naming what makes an envelope
+// a repeat. The broker drops envelopes published or sent to the same
+// destination with the same key, or without one the same ID, within its
+// dedup window; PublishEnvelope and SendPipeEnvelope succeed for them. Set it
+// when a retry builds a new envelope for the same work.
+const HeaderIdempotencyKey = "X-Idempotency-Key"
+
+// PipeConsumerStats reports the consumers of one broker pipe.
+type PipeConsumerStats struct {
+	Policy    string          `json:"policy"`        // Consumer selection policy
+	Key       string          `json:"key,omitempty"` // Sticky key (sticky policy only)
+	Consumers []ConsumerStats `json:"consumers"`     // Registered consumers
+}
+
+// ConsumerStats reports one consumer of a pipe.
+type ConsumerStats struct {
+	ConnID   string `json:"conn_id"`        // Consumer connection
+	AgentID  string `json:"agent_id"`       // Agent owning the connection
+	Received uint64 `json:"received"`       // Items received
+	InFlight int    `json:"in_flight"`      // Deliveries awaiting ack
+	Waiting  int    `json:"waiting"`        // Receives waiting for an item
+	Keys     int    `json:"keys,omitempty"` // Sticky keys owned
+}
+
+// TopicStats reports the history a broker topic retains for replay.
+type TopicStats struct {
+	FirstOffset uint64 `json:"first_offset"` // Oldest retained offset (0 if nothing is retained)
+	NextOffset  uint64 `json:"next_offset"`  // Offset the next publication gets
+	Retained    int    `json:"retained"`     // Retained entries
+	Bytes       int64  `json:"bytes"`        // Retained payload bytes (messages count only with a byte limit)
+}
+
+// HeaderOffset is the envelope header in which the broker delivers the topic
+// log offset of a topic envelope (see EnvelopeOffset).
+const HeaderOffset = "X-Offset"
+
+// EnvelopeOffset returns the topic log offset of an envelope received from a
+// topic subscription, or 0 if it carries none.
+func EnvelopeOffset(env *envelope.Envelope) uint64 {
+	offset, _ := strconv.ParseUint(env.Headers[HeaderOffset], 10, 64)
+	return offset
+}
+
+// GroupStats reports the members of one consumer group.
+type GroupStats struct {
+	Strategy string            `json:"strategy"`          // Member selection strategy
+	Members  []string          `json:"members"`           // Connection IDs of the members
+	Filters  map[string]string `json:"filters,omitempty"` // Connection ID -> content filter of filtering members
+}
+
+// DeadLetter is a message an agent failed to process and gave up on, kept by
+// the broker in a dead-letter queue for inspection and re-injection.
+// Exactly one of Message and Envelope is set.
+type DeadLetter struct {
+	ID       string             `json:"id,omitempty"`       // Assigned by the broker
+	Queue    string             `json:"queue,omitempty"`    // Dead-letter queue holding the record
+	AgentID  string             `json:"agent_id"`           // Agent that failed to process the message
+	Error    string             `json:"error"`              // Last processing error
+	Attempts int                `json:"attempts"`           // Delivery attempts before giving up
+	Source   string             `json:"source,omitempty"`   // Ingress the message came from ("pipe:x", "sub:y")
+	FailedAt time.Time          `json:"failed_at"`          // When the agent gave up
+	Message  *BrokerMessage     `json:"message,omitempty"`  // Original simple message
+	Envelope *envelope.Envelope `json:"envelope,omitempty"` // Original envelope
 }
 
 // NewBrokerClient creates a new broker client instance for agent communication.
@@ -122,9 +332,60 @@ func NewBrokerClient(address, agentID string, debug bool) *BrokerClient {
 		listeners:     make(map[string]chan *BrokerMessage),     // Initialize message listeners
 		envListeners:  make(map[string]chan *envelope.Envelope), // Initialize envelope listeners
 		responseChans: make(map[string]chan *BrokerResponse),    // Initialize response channels
+		requests:      make(map[string]chan *envelope.Envelope), // Initialize pending requests
+		subscriptions: make(map[string]SubscribeOptions),        // Nothing to restore yet
+		pipeRoles:     make(map[pipeRole]PipeConsumerOptions),
+		onSlowDown:    PauseOnSlowDown, // Back off when queues fill up
+		codecName:     codec.JSON,      // Human-readable unless configured otherwise
+		chunks:        newChunkState(), // Reassemble chunks; send whole payloads until SetChunking
 	}
 }
 
+// SetCodec selects the wire codec requested from the broker on the next
+// Connect: "json" (default) or "msgpack". MessagePack is more compact and
+// sends []byte payloads as raw binary instead of base64 text. If the broker
+// does not support the codec, the connection stays on JSON.
+//
+// Called by: NewBaseAgent with the codec from the cellorg broker config
+func (c *BrokerClient) SetCodec(name string) error {
+	wire, err := codec.Lookup(name)
+	if err != nil {
+		return err
+	}
+
+	c.mux.Lock()
+	c.codecName = wire.Name()
+	c.mux.Unlock()
+	return nil
+}
+
+// SetTLS makes the next Connect use TLS with the given settings.
+func (c *BrokerClient) SetTLS(config *tls.Config) {
+	c.mux.Lock()
+	c.tls = config
+	c.mux.Unlock()
+}
+
+// SetToken sets the credential presented in the connect handshake: the shared
+// token or the agent's own secret from the cellorg security config.
+func (c *BrokerClient) SetToken(token string) {
+	c.mux.Lock()
+	c.token = token
+	c.mux.Unlock()
+}
+
+// Codec returns the codec of the current connection, or the requested codec
+// while disconnected.
+func (c *BrokerClient) Codec() string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.Connected() && c.wire != nil {
+		return c.wire.Name()
+	}
+	return c.codecName
+}
+
 // Connect establishes a TCP connection to the broker and performs agent registration.
 // This method sets up the complete communication pipeline including connection,
 // message listener, and agent handshake with the broker.
@@ -132,12 +393,14 @@ func NewBrokerClient(address, agentID string, debug bool) *BrokerClient {
 // Connection process:
 // 1. Establish TCP connection to broker
 // 2. Create JSON encoder/decoder for message serialization
-// 3. Start background message listener goroutine
-// 4. Send agent registration request
-// 5. Complete handshake and mark agent as connected
+// 3. Send agent registration request, asking for the configured codec
+// 4. Switch encoder/decoder if the broker agreed to a binary codec
+// 5. Start background message listener goroutine
 //
 // The method is idempotent - calling it multiple times on an already
-// connected client will return immediately without error.
+// connected client will return immediately without error. Called while the
+// client reconnects, it connects right away and restores the session like a
+// successful reconnect attempt.
 //
 // Returns:
 //   - error: Network connection error, registration error, or nil on success
@@ -147,52 +410,136 @@ func (c *BrokerClient) Connect() error {
 	c.mux.Lock()
 
 	// Check if already connected to avoid duplicate connections
-	if c.conn != nil {
+	if c.Connected() {
 		c.mux.Unlock()
 		return nil // Already connected
 	}
 
-	// Establish TCP connection to broker
-	conn, err := net.Dial("tcp", c.address)
+	l, err := c.open()
 	if err != nil {
 		c.mux.Unlock()
-		return fmt.Errorf("failed to connect to broker at %s: %w", c.address, err)
+		return err
 	}
 
-	// Set up JSON codec for message serialization
-	c.conn = conn
-	c.encoder = json.NewEncoder(conn)
-	c.decoder = json.NewDecoder(conn)
-
-	// Start background message listener for incoming messages
-	// This goroutine handles subscription deliveries and response correlation
-	go c.messageListener()
+	c.closed = false
+	c.attach(l)
+	if c.reconnecting {
+		c.endReconnect()
+		c.emit(ConnectionEvent{State: ConnectionRestored, Err: c.restore()})
+	}
 
-	// Release mutex before making JSON-RPC calls to avoid deadlock
 	c.mux.Unlock()
 
-	// Allow message listener time to initialize
-	time.Sleep(10 * time.Millisecond)
+	if c.debug {
+		log.Printf("Connected to broker at %s (%s)", c.address, l.wire.Name())
+	}
 
-	// Send agent registration request to broker
-	params := map[string]interface{}{
-		"agent_id": c.agentID,
+	return nil
+}
+
+// open dials the broker and registers with it. The caller must hold c.mux.
+func (c *BrokerClient) open() (*link, error) {
+	// Establish TCP connection to broker
+	conn, err := dial(c.address, c.tls)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to broker at %s: %w", c.address, err)
 	}
-	if _, err := c.call("connect", params); err != nil {
+
+	// Every connection starts with JSON until the handshake agrees otherwise
+	wire, _ := codec.Lookup(codec.JSON)
+	l := &link{conn: conn, wire: wire, encoder: wire.NewEncoder(conn), decoder: wire.NewDecoder(conn)}
+
+	// Register with the broker before the listener starts, so the codec
+	// switch happens between two messages read right here
+	if err := c.handshake(l); err != nil {
 		// Clean up connection on registration failure
-		c.mux.Lock()
 		conn.Close()
-		c.conn = nil
-		c.encoder = nil
-		c.decoder = nil
-		c.mux.Unlock()
-		return fmt.Errorf("failed to register with broker: %w", err)
+		return nil, fmt.Errorf("failed to register with broker: %w", err)
 	}
+	return l, nil
+}
 
-	if c.debug {
-		log.Printf("Connected to broker at %s", c.address)
+// attach makes a registered connection the client's connection and starts
+// its message listener. The caller must hold c.mux.
+func (c *BrokerClient) attach(l *link) {
+	c.sendMux.Lock()
+	c.conn, c.encoder, c.decoder = l.conn, l.encoder, l.decoder
+	if c.wire == nil || c.wire.Name() != l.wire.Name() {
+		c.wire = l.wire
+	}
+	c.sendMux.Unlock()
+
+	// Start background message listener for incoming messages
+	// This goroutine handles subscription deliveries and response correlation
+	go c.messageListener(l)
+}
+
+// handshake sends the "connect" request and reads its response directly
+// from the connection. If a binary codec was requested and the broker agreed,
+// the encoder and decoder switch to it for all later messages. Brokers that
+// do not negotiate codecs answer "connected" and the connection stays JSON.
+// The caller must hold c.mux.
+func (c *BrokerClient) handshake(l *link) error {
+	params := map[string]interface{}{
+		"agent_id": c.agentID,
+	}
+	if c.token != "" {
+		params["token"] = c.token
+	}
+	if c.codecName != codec.JSON {
+		params["codec"] = c.codecName
+	}
+	paramsBytes, err := l.wire.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal params: %w", err)
+	}
+
+	l.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer l.conn.SetDeadline(time.Time{})
+
+	req := BrokerRequest{
+		ID:     fmt.Sprintf("req_%d", atomic.AddInt64(&c.reqID, 1)),
+		Method: "connect",
+		Params: paramsBytes,
+	}
+	if err := l.encoder.Encode(req); err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
 	}
 
+	var resp BrokerResponse
+	if err := l.decoder.Decode(&resp); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("broker error: %w", resp.Error)
+	}
+	if c.codecName == codec.JSON {
+		return nil
+	}
+
+	var result struct {
+		Codec string `json:"codec"`
+	}
+	if err := l.wire.Unmarshal(resp.Result, &result); err != nil || result.Codec == "" {
+		if c.debug {
+			log.Printf("Broker does not negotiate codecs, staying with JSON")
+		}
+		return nil
+	}
+	wire, err := codec.Lookup(result.Codec)
+	if err != nil {
+		return fmt.Errorf("broker chose %w", err)
+	}
+	if wire.Name() == codec.JSON {
+		if c.debug {
+			log.Printf("Broker declined codec %s, staying with JSON", c.codecName)
+		}
+		return nil
+	}
+
+	l.encoder = wire.NewEncoder(l.conn)
+	l.decoder = wire.NewDecoder(codec.Unread(l.decoder, l.conn))
+	l.wire = wire
 	return nil
 }
 
@@ -201,12 +548,15 @@ func (c *BrokerClient) Connect() error {
 // the message listener and clearing all connection state.
 //
 // Cleanup includes:
+// - Stopping a running reconnect loop and dropping buffered sends
 // - Closing TCP connection (triggers message listener shutdown)
+// - Failing calls still waiting for a response
 // - Clearing encoder/decoder references
 // - Resetting connection state for potential reconnection
 //
 // The method is idempotent - calling it multiple times or on an already
-// disconnected client will return nil without error.
+// disconnected client will return nil without error. A later Connect starts
+// a new session: subscriptions and pipe roles are not restored.
 //
 // Returns:
 //   - error: Connection close error or nil on success
@@ -216,13 +566,24 @@ func (c *BrokerClient) Disconnect() error {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
+	c.closed = true
+	c.endReconnect()
+	c.buffered = nil
+	clear(c.subscriptions)
+	clear(c.pipeRoles)
+	c.prefetch = 0
+	c.flowControl.Store(false)
+
+	c.sendMux.Lock()
+	conn := c.conn
+	c.conn, c.encoder, c.decoder = nil, nil, nil
+	c.sendMux.Unlock()
+
 	// Close connection if it exists
-	if c.conn != nil {
-		err := c.conn.Close() // This will cause messageListener to exit
-		// Clear connection state to allow future reconnection
-		c.conn = nil
-		c.encoder = nil
-		c.decoder = nil
+	if conn != nil {
+		err := conn.Close() // This will cause messageListener to exit
+		c.failPending()
+		c.resetChunks()
 		return err
 	}
 	return nil
@@ -248,26 +609,45 @@ func (c *BrokerClient) Disconnect() error {
 //   - params: Method parameters (will be JSON-marshaled)
 //
 // Returns:
-//   - json.RawMessage: Raw JSON response data for method-specific parsing
+//   - codec.Raw: Raw response data for method-specific parsing with c.wire
 //   - error: Connection error, marshaling error, broker error, or timeout
 //
 // Called by: All public broker communication methods
-func (c *BrokerClient) call(method string, params interface{}) (json.RawMessage, error) {
-	// Verify connection is established
-	if c.conn == nil {
-		return nil, fmt.Errorf("not connected to broker")
+func (c *BrokerClient) call(method string, params interface{}) (codec.Raw, error) {
+	resp, err := c.roundTrip(method, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check for broker-level errors
+	if resp.Error != nil {
+		return nil, fmt.Errorf("broker error: %w", resp.Error)
 	}
 
+	return resp.Result, nil
+}
+
+// roundTrip sends a JSON-RPC request and waits for the correlated response.
+// Unlike call, broker errors are returned inside the response, so callers can
+// also read the slow-down signal attached to rejected sends.
+func (c *BrokerClient) roundTrip(method string, params interface{}) (*BrokerResponse, error) {
 	// Generate unique request ID for response correlation
-	c.reqID++
-	reqID := fmt.Sprintf("req_%d", c.reqID)
+	reqID := fmt.Sprintf("req_%d", atomic.AddInt64(&c.reqID, 1))
 
-	// Marshal parameters to JSON if provided
-	var paramsBytes json.RawMessage
+	// Verify connection is established; it cannot change until the request is sent
+	c.sendMux.Lock()
+	if c.encoder == nil {
+		c.sendMux.Unlock()
+		return nil, ErrNotConnected
+	}
+
+	// Marshal parameters with the connection's codec if provided
+	var paramsBytes codec.Raw
 	if params != nil {
 		var err error
-		paramsBytes, err = json.Marshal(params)
+		paramsBytes, err = c.wire.Marshal(params)
 		if err != nil {
+			c.sendMux.Unlock()
 			return nil, fmt.Errorf("failed to marshal params: %w", err)
 		}
 	}
@@ -287,7 +667,9 @@ func (c *BrokerClient) call(method string, params interface{}) (json.RawMessage,
 	c.responseChMux.Unlock()
 
 	// Send JSON-RPC request to broker
-	if err := c.encoder.Encode(req); err != nil {
+	err := c.encoder.Encode(req)
+	c.sendMux.Unlock()
+	if err != nil {
 		// Clean up response channel on send failure
 		c.responseChMux.Lock()
 		delete(c.responseChans, reqID)
@@ -305,15 +687,10 @@ func (c *BrokerClient) call(method string, params interface{}) (json.RawMessage,
 
 		// Handle closed channel (connection lost during request)
 		if resp == nil {
-			return nil, fmt.Errorf("response channel closed")
+			return nil, ErrConnectionLost
 		}
 
-		// Check for broker-level errors
-		if resp.Error != nil {
-			return nil, fmt.Errorf("broker error: %s (code: %d)", resp.Error.Message, resp.Error.Code)
-		}
-
-		return resp.Result, nil
+		return resp, nil
 	case <-time.After(30 * time.Second):
 		// Clean up response channel on timeout
 		c.responseChMux.Lock()
@@ -335,45 +712,41 @@ func (c *BrokerClient) call(method string, params interface{}) (json.RawMessage,
 // - Envelopes: Have source, destination, and message_type fields
 // - Regular messages: Have type and target fields
 //
-// The listener runs until the connection is closed, at which point it exits
-// gracefully. Any panics are caught and logged for debugging.
+// The listener runs until the connection is closed. Unless Disconnect closed
+// it, the client then reconnects (see SetReconnect). Any panics are caught
+// and logged for debugging.
 //
-// Called by: Connect() method as a background goroutine
-func (c *BrokerClient) messageListener() {
-	// Catch and log any panics to prevent client crashes
+// Called by: attach() as a background goroutine per connection
+func (c *BrokerClient) messageListener(l *link) {
+	var cause error
 	defer func() {
+		// Catch and log any panics to prevent client crashes
 		if r := recover(); r != nil {
 			if c.debug {
 				log.Printf("Broker message listener panic: %v", r)
 			}
+			cause = fmt.Errorf("message listener panic: %v", r)
 		}
+		c.connectionLost(l, cause)
 	}()
 
 	for {
-		// Note: decoder is set once during Connect() and only cleared during Disconnect()
-		// Since messageListener is only running between Connect() and Disconnect(),
-		// it's safe to read decoder without mutex
-		decoder := c.decoder
-
-		if decoder == nil {
-			return // Connection closed
-		}
-
-		// Read raw JSON to determine message type
-		var rawMsg json.RawMessage
-		if err := decoder.Decode(&rawMsg); err != nil {
+		// Read the raw message to determine its type
+		var rawMsg codec.Raw
+		if err := l.decoder.Decode(&rawMsg); err != nil {
 			if c.debug {
 				log.Printf("Broker message decode error: %v", err)
 			}
+			cause = err
 			return
 		}
 
 		// Try to determine message type: envelope, regular message, or response
 		var msgType struct {
 			// Response fields
-			ID     string          `json:"id"`
-			Result json.RawMessage `json:"result,omitempty"`
-			Error  *BrokerError    `json:"error,omitempty"`
+			ID     string       `json:"id"`
+			Result codec.Raw    `json:"result,omitempty"`
+			Error  *BrokerError `json:"error,omitempty"`
 			// Envelope fields
 			Source      string `json:"source"`
 			Destination string `json:"destination"`
@@ -383,7 +756,7 @@ func (c *BrokerClient) messageListener() {
 			Target string `json:"target"`
 		}
 
-		if err := json.Unmarshal(rawMsg, &msgType); err != nil {
+		if err := l.wire.Unmarshal(rawMsg, &msgType); err != nil {
 			if c.debug {
 				log.Printf("Failed to parse message type: %v", err)
 			}
@@ -394,7 +767,7 @@ func (c *BrokerClient) messageListener() {
 		if msgType.ID != "" && (msgType.Result != nil || msgType.Error != nil) {
 			// This is a response message - route it to the waiting call
 			var resp BrokerResponse
-			if err := json.Unmarshal(rawMsg, &resp); err != nil {
+			if err := l.wire.Unmarshal(rawMsg, &resp); err != nil {
 				if c.debug {
 					log.Printf("Failed to decode response: %v", err)
 				}
@@ -417,10 +790,11 @@ func (c *BrokerClient) messageListener() {
 		} else if msgType.Source != "" && msgType.Destination != "" && msgType.MessageType != "" {
 			// This is an envelope
 			var env envelope.Envelope
-			if err := json.Unmarshal(rawMsg, &env); err != nil {
+			if err := l.wire.Unmarshal(rawMsg, &env); err != nil {
 				if c.debug {
 					log.Printf("Failed to decode envelope: %v", err)
 				}
+				c.discardDelivery()
 				continue
 			}
 
@@ -428,26 +802,75 @@ func (c *BrokerClient) messageListener() {
 				log.Printf("Received envelope: %s -> %s (%s)", env.Source, env.Destination, env.MessageType)
 			}
 
-			// Route envelope to appropriate listener
+			// Chunks are held back until their envelope is complete
+			merged, err := c.collectEnvelope(&env, "")
+			if err != nil {
+				c.chunkError(err)
+				c.discardDelivery()
+				continue
+			}
+			if merged == nil {
+				c.discardDelivery() // Each chunk took a credit, the whole envelope is credited once
+				continue
+			}
+			env = *merged
+
+			// Replies to pending requests bypass the subscriptions
+			if c.deliverReply(&env) {
+				continue
+			}
+
+			// Route envelope to every subscription matching its topic
+			topic := topicOf(env.Destination)
+			taken := 0
 			c.listenersMux.RLock()
-			if listener, exists := c.envListeners[env.Destination]; exists {
+			for pattern, listener := range c.envListeners {
+				if !wildcard.Match(pattern, topic) {
+					continue
+				}
+				delivered := &env
+				if pattern != topic {
+					delivered = env.Clone() // Separate copy per matching subscription
+				}
 				select {
-				case listener <- &env:
-					// Envelope delivered
+				case listener <- delivered:
+					taken++
 				default:
 					if c.debug {
-						log.Printf("Warning: envelope listener channel full for target %s", env.Destination)
+						log.Printf("Warning: envelope listener channel full for subscription %s", pattern)
+					}
+				}
+			}
+			// Requests reach message subscriptions too, so agents built on
+			// messages can answer them (see IsRequest)
+			if request := requestMessage(&env); taken == 0 && request != nil {
+				for pattern, listener := range c.listeners {
+					if !wildcard.Match(pattern, topic) {
+						continue
+					}
+					delivered := *request // Separate copy per matching subscription
+					select {
+					case listener <- &delivered:
+						taken++
+					default:
+						if c.debug {
+							log.Printf("Warning: listener channel full for subscription %s", pattern)
+						}
 					}
 				}
 			}
 			c.listenersMux.RUnlock()
+			if taken == 0 {
+				c.discardDelivery()
+			}
 		} else if msgType.Type != "" && msgType.Target != "" {
 			// This is a regular message
 			var msg BrokerMessage
-			if err := json.Unmarshal(rawMsg, &msg); err != nil {
+			if err := l.wire.Unmarshal(rawMsg, &msg); err != nil {
 				if c.debug {
 					log.Printf("Failed to decode regular message: %v", err)
 				}
+				c.discardDelivery()
 				continue
 			}
 
@@ -455,38 +878,86 @@ func (c *BrokerClient) messageListener() {
 				log.Printf("Received message: ID=%s, Target=%s, Type=%s, Meta=%+v", msg.ID, msg.Target, msg.Type, msg.Meta)
 			}
 
-			// Route message to appropriate listener
+			// Chunks are held back until their message is complete
+			merged, err := c.collectMessage(&msg, "")
+			if err != nil {
+				c.chunkError(err)
+				c.discardDelivery()
+				continue
+			}
+			if merged == nil {
+				c.discardDelivery() // Each chunk took a credit, the whole message is credited once
+				continue
+			}
+			msg = *merged
+
+			// Route message to every subscription matching its topic
+			topic := topicOf(msg.Target)
+			taken := 0
 			c.listenersMux.RLock()
-			if listener, exists := c.listeners[msg.Target]; exists {
+			for pattern, listener := range c.listeners {
+				if !wildcard.Match(pattern, topic) {
+					continue
+				}
+				delivered := msg // Separate copy per matching subscription
 				select {
-				case listener <- &msg:
-					// Message delivered
+				case listener <- &delivered:
+					taken++
 				default:
 					if c.debug {
-						log.Printf("Warning: listener channel full for target %s", msg.Target)
+						log.Printf("Warning: listener channel full for subscription %s", pattern)
 					}
 				}
 			}
 			c.listenersMux.RUnlock()
+			if taken == 0 {
+				c.discardDelivery()
+			}
 		} else {
 			if c.debug {
-				log.Printf("Unknown message format received: %s", string(rawMsg))
+				log.Printf("Unknown message format received: %q", []byte(rawMsg))
 			}
 		}
 	}
 }
 
+// dial opens a connection to a cellorg service, over TLS if configured.
+func dial(address string, config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		return net.Dial("tcp", address)
+	}
+	return tls.Dial("tcp", address, config)
+}
+
+// topicOf extracts the topic name from a delivery target ("pub:<topic>" for
+// messages, the envelope destination "pub:<topic>" or "sub:<topic>" for envelopes).
+func topicOf(target string) string {
+	for _, prefix := range []string{"pub:", "sub:"} {
+		if strings.HasPrefix(target, prefix) {
+			return strings.TrimPrefix(target, prefix)
+		}
+	}
+	return target
+}
+
 func (c *BrokerClient) Publish(topic string, message BrokerMessage) error {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
-	params := map[string]interface{}{
-		"topic":   topic,
-		"message": message,
+	chunks, err := c.messageChunks(fmt.Sprintf("pub:%s", topic), message)
+	if err != nil {
+		return err
 	}
-
-	_, err := c.call("publish", params)
-	return err
+	for i, chunk := range chunks {
+		params := map[string]interface{}{
+			"topic":   topic,
+			"message": chunk,
+		}
+		if err := c.sendWithFlowControl("publish", params); err != nil {
+			return chunkSendError(err, i, len(chunks))
+		}
+	}
+	return nil
 }
 
 // Subscribe registers for message delivery on a specific topic.
@@ -503,8 +974,13 @@ func (c *BrokerClient) Publish(topic string, message BrokerMessage) error {
 // by other agents. Messages are delivered asynchronously via the background
 // message listener goroutine.
 //
+// The topic may be an MQTT-style wildcard pattern: "*" matches one
+// dot-separated level, "#" all remaining levels. The channel of
+// "project-42.*" receives messages of "project-42.ocr" and "project-42.nlp";
+// msg.Target tells the concrete topic.
+//
 // Parameters:
-//   - topic: Topic name to subscribe to (e.g., "new-files")
+//   - topic: Topic name or pattern to subscribe to (e.g., "new-files", "extracted-text.#")
 //
 // Returns:
 //   - <-chan *BrokerMessage: Read-only channel for receiving messages
@@ -512,70 +988,147 @@ func (c *BrokerClient) Publish(topic string, message BrokerMessage) error {
 //
 // Called by: Agents that need to receive event notifications
 func (c *BrokerClient) Subscribe(topic string) (<-chan *BrokerMessage, error) {
-	c.mux.Lock()
-	defer c.mux.Unlock()
+	return c.SubscribeWithOptions(topic, SubscribeOptions{})
+}
 
-	// Send subscription request to broker
+// SubscribeOptions tunes a topic subscription.
+type SubscribeOptions struct {
+	// Group makes the subscription part of a consumer group: subscribers that
+	// name the same group share the topic's stream (each message goes to one
+	// member) while other groups and plain subscribers still get every message.
+	Group string
+
+	// Strategy selects the group member for each message: "round_robin"
+	// (default) or "least_loaded" (member with the shortest broker outbox).
+	Strategy string
+
+	// FromOffset replays the topic's retained history from this offset on
+	// before live delivery continues; an offset older than the retained
+	// history starts at the oldest entry. Resume after a restart with the
+	// last processed offset + 1. Not valid for wildcard patterns.
+	FromOffset uint64
+
+	// FromTimestamp replays the entries published at or after this time,
+	// on every topic a wildcard pattern matches.
+	FromTimestamp time.Time
+
+	// Filter makes the broker deliver only the publications it matches,
+	// written like a URL query over message_type, source, headers.<name>
+	// and properties.<name>: "message_type=chunk&headers.lang=de". Use "!="
+	// to exclude and "|" for alternatives ("headers.lang=de|en"). Simple
+	// messages match message_type against their type and the other fields
+	// against their meta.
+	Filter string
+}
+
+// params builds the subscribe request parameters for a topic
+func (o SubscribeOptions) params(topic string) map[string]interface{} {
 	params := map[string]interface{}{
 		"topic": topic,
 	}
-
-	if _, err := c.call("subscribe", params); err != nil {
-		return nil, err
+	if o.Group != "" {
+		params["group"] = o.Group
+	}
+	if o.Strategy != "" {
+		params["strategy"] = o.Strategy
+	}
+	if o.Filter != "" {
+		params["filter"] = o.Filter
 	}
+	if o.FromOffset > 0 {
+		params["from_offset"] = o.FromOffset
+	}
+	if !o.FromTimestamp.IsZero() {
+		params["from_timestamp"] = o.FromTimestamp
+	}
+	return params
+}
+
+// SubscribeWithOptions is Subscribe with consumer group and replay settings.
+// Used to scale a cell stage horizontally: replicas subscribing with the same
+// Group each receive a share of the topic's messages instead of all of them.
+func (c *BrokerClient) SubscribeWithOptions(topic string, opts SubscribeOptions) (<-chan *BrokerMessage, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
 
 	// Create buffered message channel for this subscription
-	// Buffer size of 100 provides reasonable backpressure handling
-	target := fmt.Sprintf("pub:%s", topic)
-	msgChan := make(chan *BrokerMessage, 100)
+	msgChan := make(chan *BrokerMessage, subscriptionBuffer)
 
-	// Register channel with message router for automatic delivery
+	// Register channel with message router before subscribing, since the
+	// broker may deliver held-back messages as soon as the subscription exists
 	c.listenersMux.Lock()
-	c.listeners[target] = msgChan
+	c.listeners[topic] = msgChan
 	c.listenersMux.Unlock()
 
+	// Send subscription request to broker
+	if _, err := c.call("subscribe", opts.params(topic)); err != nil {
+		c.listenersMux.Lock()
+		delete(c.listeners, topic)
+		c.listenersMux.Unlock()
+		return nil, err
+	}
+	c.subscriptions[topic] = SubscribeOptions{Group: opts.Group, Strategy: opts.Strategy, Filter: opts.Filter}
+
 	if c.debug {
-		log.Printf("Subscribed to topic: %s", topic)
+		if opts.Group != "" {
+			log.Printf("Subscribed to topic: %s (group %s)", topic, opts.Group)
+		} else {
+			log.Printf("Subscribed to topic: %s", topic)
+		}
 	}
 
 	return msgChan, nil
 }
 
-// Envelope-based publish method
+// Envelope-based publish method. Large envelopes are sent in chunks as
+// configured with SetChunking.
 func (c *BrokerClient) PublishEnvelope(topic string, env *envelope.Envelope) error {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
-	params := map[string]interface{}{
-		"topic":    topic,
-		"envelope": env,
+	chunks, err := c.envelopeChunks(env)
+	if err != nil {
+		return err
 	}
-
-	_, err := c.call("publish_envelope", params)
-	return err
+	for i, chunk := range chunks {
+		params := map[string]interface{}{
+			"topic":    topic,
+			"envelope": chunk,
+		}
+		if err := c.sendWithFlowControl("publish_envelope", params); err != nil {
+			return chunkSendError(err, i, len(chunks))
+		}
+	}
+	return nil
 }
 
-// Subscribe to envelopes on a topic
+// Subscribe to envelopes on a topic or wildcard pattern (see Subscribe).
+// Envelopes are matched by the topic in their destination ("pub:<topic>").
 func (c *BrokerClient) SubscribeEnvelopes(topic string) (<-chan *envelope.Envelope, error) {
+	return c.SubscribeEnvelopesWithOptions(topic, SubscribeOptions{})
+}
+
+// SubscribeEnvelopesWithOptions is SubscribeEnvelopes with consumer group and replay settings.
+func (c *BrokerClient) SubscribeEnvelopesWithOptions(topic string, opts SubscribeOptions) (<-chan *envelope.Envelope, error) {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
-	params := map[string]interface{}{
-		"topic": topic,
-	}
-
-	if _, err := c.call("subscribe", params); err != nil {
-		return nil, err
-	}
-
-	// Create envelope channel for this subscription
-	target := fmt.Sprintf("sub:%s", topic)
-	envChan := make(chan *envelope.Envelope, 100)
+	// Create envelope channel for this subscription and register it before
+	// subscribing so persistent envelopes held by the broker are not missed
+	envChan := make(chan *envelope.Envelope, subscriptionBuffer)
 
 	c.listenersMux.Lock()
-	c.envListeners[target] = envChan
+	c.envListeners[topic] = envChan
 	c.listenersMux.Unlock()
 
+	if _, err := c.call("subscribe", opts.params(topic)); err != nil {
+		c.listenersMux.Lock()
+		delete(c.envListeners, topic)
+		c.listenersMux.Unlock()
+		return nil, err
+	}
+	c.subscriptions[topic] = SubscribeOptions{Group: opts.Group, Strategy: opts.Strategy, Filter: opts.Filter}
+
 	if c.debug {
 		log.Printf("Subscribed to topic for envelopes: %s", topic)
 	}
@@ -583,49 +1136,185 @@ func (c *BrokerClient) SubscribeEnvelopes(topic string) (<-chan *envelope.Envelo
 	return envChan, nil
 }
 
-// Send envelope via pipe
+// Send envelope via pipe. Large envelopes are sent in chunks as configured
+// with SetChunking.
 func (c *BrokerClient) SendPipeEnvelope(pipeName string, env *envelope.Envelope) error {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
-	params := map[string]interface{}{
-		"pipe":     pipeName,
-		"envelope": env,
+	chunks, err := c.envelopeChunks(env)
+	if err != nil {
+		return err
 	}
-
-	_, err := c.call("send_pipe_envelope", params)
-	return err
+	for i, chunk := range chunks {
+		params := map[string]interface{}{
+			"pipe":     pipeName,
+			"envelope": chunk,
+		}
+		if err := c.sendWithFlowControl("send_pipe_envelope", params); err != nil {
+			return chunkSendError(err, i, len(chunks))
+		}
+	}
+	return nil
 }
 
-// Receive message or envelope from pipe
+// Receive message or envelope from pipe.
+// Does not hold the client lock while waiting, so other calls (sends, acks)
+// are not blocked by the long poll. Chunked items are received until
+// complete within the timeout; chunks still missing then are picked up by
+// the next call.
 func (c *BrokerClient) ReceivePipe(pipeName string, timeoutMs int) (interface{}, error) {
-	c.mux.Lock()
-	defer c.mux.Unlock()
+	start := time.Now()
+	for {
+		params := map[string]interface{}{
+			"pipe": pipeName,
+		}
+		if timeoutMs > 0 {
+			params["timeout_ms"] = remainingMs(start, timeoutMs)
+		}
 
-	params := map[string]interface{}{
-		"pipe": pipeName,
-	}
-	if timeoutMs > 0 {
-		params["timeout_ms"] = timeoutMs
-	}
+		result, err := c.call("receive_pipe", params)
+		if err != nil {
+			return nil, err
+		}
 
-	result, err := c.call("receive_pipe", params)
-	if err != nil {
-		return nil, err
-	}
+		// Try to unmarshal as envelope first, then as regular message
+		var env envelope.Envelope
+		if err := c.wire.Unmarshal(result, &env); err == nil && env.Source != "" {
+			merged, err := c.collectEnvelope(&env, "")
+			if err != nil {
+				return nil, err
+			}
+			if merged != nil {
+				return merged, nil
+			}
+			continue
+		}
+
+		var msg BrokerMessage
+		if err := c.wire.Unmarshal(result, &msg); err == nil {
+			merged, err := c.collectMessage(&msg, "")
+			if err != nil {
+				return nil, err
+			}
+			if merged != nil {
+				return merged, nil
+			}
+			continue
+		}
 
-	// Try to unmarshal as envelope first, then as regular message
-	var env envelope.Envelope
-	if err := json.Unmarshal(result, &env); err == nil && env.Source != "" {
-		return &env, nil
+		return result, nil
 	}
+}
 
-	var msg BrokerMessage
-	if err := json.Unmarshal(result, &msg); err == nil {
-		return &msg, nil
+// remainingMs returns what is left of a receive timeout that started at
+// start, at least 1ms so the broker still answers with a timeout.
+func remainingMs(start time.Time, timeoutMs int) int {
+	remaining := timeoutMs - int(time.Since(start)/time.Millisecond)
+	return max(remaining, 1)
+}
+
+// ReceivePipeWithAck receives the next pipe item in manual-ack mode.
+// The item stays in flight on the broker until Ack or Nack is called with the
+// delivery tag. If neither happens within visibilityTimeoutMs (0 = broker
+// default), or this client disconnects, the broker redelivers the item to the
+// next consumer, giving at-least-once delivery.
+//
+// Parameters:
+//   - pipeName: Pipe to receive from
+//   - timeoutMs: How long to wait for an item (0 = broker default)
+//   - visibilityTimeoutMs: How long the item may stay unacknowledged (0 = broker default)
+//
+// Returns:
+//   - *Delivery: Received item with its delivery tag and attempt count
+//   - error: Timeout, broker error, or decoding error
+//
+// Called by: PipeIngressHandler and agents that acknowledge after processing
+func (c *BrokerClient) ReceivePipeWithAck(pipeName string, timeoutMs, visibilityTimeoutMs int) (*Delivery, error) {
+	start := time.Now()
+	for {
+		params := map[string]interface{}{
+			"pipe": pipeName,
+			"ack":  true,
+		}
+		if timeoutMs > 0 {
+			params["timeout_ms"] = remainingMs(start, timeoutMs)
+		}
+		if visibilityTimeoutMs > 0 {
+			params["visibility_timeout_ms"] = visibilityTimeoutMs
+		}
+
+		result, err := c.call("receive_pipe", params)
+		if err != nil {
+			return nil, err
+		}
+
+		var delivery Delivery
+		if err := c.wire.Unmarshal(result, &delivery); err != nil {
+			return nil, fmt.Errorf("failed to decode delivery: %w", err)
+		}
+
+		// Chunks stay in flight until the reassembled item is acked; the
+		// delivery of the last chunk stands for all of them
+		switch {
+		case delivery.Message != nil:
+			delivery.Message.DeliveryTag = delivery.Tag
+			delivery.Message.DeliveryAttempt = delivery.Attempt
+			delivery.Message, err = c.collectMessage(delivery.Message, delivery.Tag)
+			if err != nil {
+				return nil, err
+			}
+			if delivery.Message == nil {
+				continue
+			}
+		case delivery.Envelope != nil:
+			delivery.Envelope, err = c.collectEnvelope(delivery.Envelope, delivery.Tag)
+			if err != nil {
+				return nil, err
+			}
+			if delivery.Envelope == nil {
+				continue
+			}
+		}
+		return &delivery, nil
 	}
+}
 
-	return result, nil
+// Ack confirms that a manual-ack delivery was fully processed.
+// The broker forgets the item (and removes persistent envelopes from its log).
+// For a reassembled chunked item all its chunks are acked.
+func (c *BrokerClient) Ack(deliveryTag string) error {
+	return c.settle(deliveryTag, func(tag string) error {
+		_, err := c.call("ack", map[string]interface{}{
+			"delivery_tag": tag,
+		})
+		return err
+	})
+}
+
+// Nack rejects a manual-ack delivery. With requeue the broker redelivers it
+// to the next consumer right away; without, the item is discarded.
+// For a reassembled chunked item all its chunks are nacked.
+func (c *BrokerClient) Nack(deliveryTag string, requeue bool) error {
+	return c.settle(deliveryTag, func(tag string) error {
+		_, err := c.call("nack", map[string]interface{}{
+			"delivery_tag": tag,
+			"requeue":      requeue,
+		})
+		return err
+	})
+}
+
+// settle acks or nacks a delivery and the chunk deliveries it stands for.
+// Returns the first error.
+func (c *BrokerClient) settle(deliveryTag string, settle func(tag string) error) error {
+	err := settle(deliveryTag)
+	for _, tag := range c.chunkTags(deliveryTag) {
+		if chunkErr := settle(tag); chunkErr != nil && err == nil {
+			err = chunkErr
+		}
+	}
+	return err
 }
 
 // Convenience method to create and publish an envelope
@@ -638,12 +1327,76 @@ func (c *BrokerClient) PublishMessage(topic, messageType string, payload interfa
 	return c.PublishEnvelope(topic, env)
 }
 
+// PipeConsumerOptions selects how a pipe hands its items to the consumers
+// receiving from it.
+type PipeConsumerOptions struct {
+	// Policy is "round_robin" (default; waiting consumers take turns),
+	// "least_in_flight" (the waiting consumer with the fewest unacknowledged
+	// deliveries) or "sticky" (items with the same key go to the same
+	// consumer). The first consumer that sets a policy decides it.
+	Policy string
+
+	// Key is the sticky key: "correlation_id" (default) or "header:<name>".
+	// Simple messages carry either in their meta. Chunks without the key
+	// stay together by their chunk group.
+	Key string
+}
+
 // Pipe methods using the proper pipe functionality
+
+// ConnectPipe registers with a pipe as "consumer" or "producer". Consumers
+// share the pipe's items round-robin unless a consumer chose another policy
+// with ConnectPipeConsumer.
 func (c *BrokerClient) ConnectPipe(pipeName, role string) error {
+	return c.connectPipe(pipeName, role, PipeConsumerOptions{})
+}
+
+// ConnectPipeConsumer registers as consumer of a pipe with a balancing policy.
+func (c *BrokerClient) ConnectPipeConsumer(pipeName string, opts PipeConsumerOptions) error {
+	return c.connectPipe(pipeName, "consumer", opts)
+}
+
+func (c *BrokerClient) connectPipe(pipeName, role string, opts PipeConsumerOptions) error {
 	if c.debug {
 		log.Printf("ConnectPipe: %s as %s", pipeName, role)
 	}
-	// Pipes are created automatically when first used
+	if _, err := c.call("connect_pipe", opts.params(pipeName, role)); err != nil {
+		return err
+	}
+
+	c.mux.Lock()
+	c.pipeRoles[pipeRole{pipe: pipeName, role: role}] = opts
+	c.mux.Unlock()
+	return nil
+}
+
+// params builds the connect_pipe request parameters for a pipe role
+func (o PipeConsumerOptions) params(pipeName, role string) map[string]interface{} {
+	params := map[string]interface{}{
+		"pipe": pipeName,
+		"role": role,
+	}
+	if o.Policy != "" {
+		params["policy"] = o.Policy
+	}
+	if o.Key != "" {
+		params["key"] = o.Key
+	}
+	return params
+}
+
+// DisconnectPipe stops consuming a pipe and releases the sticky keys this
+// client owned, so their items go to the other consumers.
+func (c *BrokerClient) DisconnectPipe(pipeName string) error {
+	if _, err := c.call("disconnect_pipe", map[string]interface{}{
+		"pipe": pipeName,
+	}); err != nil {
+		return err
+	}
+
+	c.mux.Lock()
+	delete(c.pipeRoles, pipeRole{pipe: pipeName, role: "consumer"})
+	c.mux.Unlock()
 	return nil
 }
 
@@ -651,11 +1404,233 @@ func (c *BrokerClient) SendPipe(pipeName string, message BrokerMessage) error {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
-	params := map[string]interface{}{
-		"pipe":    pipeName,
-		"message": message,
+	chunks, err := c.messageChunks(fmt.Sprintf("pipe:%s", pipeName), message)
+	if err != nil {
+		return err
+	}
+	for i, chunk := range chunks {
+		params := map[string]interface{}{
+			"pipe":    pipeName,
+			"message": chunk,
+		}
+		if err := c.sendWithFlowControl("send_pipe", params); err != nil {
+			return chunkSendError(err, i, len(chunks))
+		}
 	}
+	return nil
+}
+
+// SetPublishTimeout makes publishes and pipe sends wait up to timeout for
+// room when the target pipe or a subscriber outbox is full, instead of
+// failing (pipes) or dropping the copy (topics) right away. Zero restores
+// fail-fast behavior. The timeout is capped at 20 seconds.
+func (c *BrokerClient) SetPublishTimeout(timeout time.Duration) {
+	if timeout > maxPublishTimeout {
+		timeout = maxPublishTimeout
+	}
+
+	c.flowMux.Lock()
+	c.publishTimeout = timeout
+	c.flowMux.Unlock()
+}
+
+// OnSlowDown sets the handler for slow-down signals returned with publishes
+// and pipe sends. The handler runs before the publish returns, so blocking in
+// it throttles the publisher. The default, PauseOnSlowDown, sleeps for the
+// suggested time; nil ignores the signals.
+func (c *BrokerClient) OnSlowDown(handler func(*SlowDown)) {
+	c.flowMux.Lock()
+	c.onSlowDown = handler
+	c.flowMux.Unlock()
+}
+
+// PauseOnSlowDown is the default slow-down handler: it pauses for the time
+// suggested by the broker.
+func PauseOnSlowDown(signal *SlowDown) {
+	time.Sleep(time.Duration(signal.RetryAfterMs) * time.Millisecond)
+}
+
+// sendWithFlowControl issues a publish or pipe send with the configured
+// publish timeout and passes a slow-down signal in the response, also on a
+// "Pipe buffer full" error, to the slow-down handler.
+//
+// While the client reconnects, the send is buffered or fails according to
+// the publish policy (see ReconnectConfig). The caller must hold c.mux.
+func (c *BrokerClient) sendWithFlowControl(method string, params map[string]interface{}) error {
+	if c.reconnecting {
+		return c.offlineSend(method, params)
+	}
+	_, err := c.callWithFlowControl(method, params)
+	return err
+}
+
+// callWithFlowControl is sendWithFlowControl returning the call's result.
+func (c *BrokerClient) callWithFlowControl(method string, params map[string]interface{}) (codec.Raw, error) {
+	c.flowMux.RLock()
+	timeout, handler := c.publishTimeout, c.onSlowDown
+	c.flowMux.RUnlock()
+
+	if timeout > 0 {
+		params["block_timeout_ms"] = int(timeout / time.Millisecond)
+	}
+
+	resp, err := c.roundTrip(method, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.SlowDown != nil && handler != nil {
+		if c.debug {
+			log.Printf("Broker asked to slow down: %s at %d/%d, pausing %dms",
+				resp.SlowDown.Queue, resp.SlowDown.Depth, resp.SlowDown.Capacity, resp.SlowDown.RetryAfterMs)
+		}
+		handler(resp.SlowDown)
+	}
+
+	if resp.Error != nil {
+		return nil, fmt.Errorf("broker error: %w", resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// SetPrefetch advertises how many topic deliveries the broker may write to
+// this client before it grants credits back with Credit. Further deliveries
+// wait in the broker, where they show up as the subscriber's outbox depth
+// instead of overflowing the subscription channels (100 messages each), so
+// larger windows are capped at 100. Zero turns flow control off, the default.
+//
+// Deliveries the client consumes itself return their credit as they are
+// read: chunks before the last one of a chunked message, and deliveries it
+// drops because they fail to decode or no subscription channel takes them.
+// Only deliveries handed to a subscription wait for Credit, once per
+// message however many chunks it took.
+func (c *BrokerClient) SetPrefetch(prefetch int) error {
+	prefetch = min(prefetch, subscriptionBuffer)
+	if _, err := c.call("prefetch", map[string]interface{}{
+		"prefetch": prefetch,
+	}); err != nil {
+		return err
+	}
+
+	c.mux.Lock()
+	c.prefetch = prefetch
+	c.flowControl.Store(prefetch > 0)
+	c.mux.Unlock()
+	return nil
+}
+
+// Credit tells the broker that n topic deliveries have been processed, so
+// it may write n more. Only meaningful after SetPrefetch.
+func (c *BrokerClient) Credit(n int) error {
+	_, err := c.call("credit", map[string]interface{}{
+		"credit": n,
+	})
+	return err
+}
+
+// discardDelivery returns the credit of a topic delivery the message
+// listener read but did not hand to a subscription, as a held-back chunk or
+// dropped. The grant is sent from
+// its own goroutine, since the listener reads the response.
+func (c *BrokerClient) discardDelivery() {
+	if !c.flowControl.Load() {
+		return
+	}
+	go func() {
+		if err := c.Credit(1); err != nil && c.debug {
+			log.Printf("Failed to return credit of a dropped delivery: %v", err)
+		}
+	}()
+}
+
+// Stats retrieves the current queue depths of all broker pipes and subscriber
+// outboxes, broken down by priority. Useful for spotting bulk backlogs that
+// urgent (high-priority) messages are overtaking.
+func (c *BrokerClient) Stats() (*BrokerStats, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	result, err := c.call("stats", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats BrokerStats
+	if err := c.wire.Unmarshal(result, &stats); err != nil {
+		return nil, fmt.Errorf("failed to decode stats: %w", err)
+	}
+	return &stats, nil
+}
+
+// SendDeadLetter stores a failed message in a broker dead-letter queue.
+// Returns the ID the broker assigned to the record.
+func (c *BrokerClient) SendDeadLetter(queue string, dl *DeadLetter) (string, error) {
+	result, err := c.call("dead_letter", map[string]interface{}{
+		"queue":       queue,
+		"dead_letter": dl,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var id string
+	if err := c.wire.Unmarshal(result, &id); err != nil {
+		return "", fmt.Errorf("failed to decode dead letter id: %w", err)
+	}
+	return id, nil
+}
+
+// ListDeadLetters returns the dead letters of a queue, oldest first.
+// An empty queue name lists the dead letters of all queues.
+func (c *BrokerClient) ListDeadLetters(queue string) ([]*DeadLetter, error) {
+	result, err := c.call("list_dead_letters", map[string]interface{}{
+		"queue": queue,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var letters []*DeadLetter
+	if err := c.wire.Unmarshal(result, &letters); err != nil {
+		return nil, fmt.Errorf("failed to decode dead letters: %w", err)
+	}
+	return letters, nil
+}
+
+// GetDeadLetter returns a single dead letter for inspection.
+func (c *BrokerClient) GetDeadLetter(queue, id string) (*DeadLetter, error) {
+	result, err := c.call("get_dead_letter", map[string]interface{}{
+		"queue": queue,
+		"id":    id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var dl DeadLetter
+	if err := c.wire.Unmarshal(result, &dl); err != nil {
+		return nil, fmt.Errorf("failed to decode dead letter: %w", err)
+	}
+	return &dl, nil
+}
+
+// ReinjectDeadLetter sends the original message of a dead letter back for
+// processing and removes the record. An empty destination returns it to the
+// ingress it came from; otherwise use "pipe:<name>" or "pub:<topic>".
+func (c *BrokerClient) ReinjectDeadLetter(queue, id, destination string) error {
+	_, err := c.call("reinject_dead_letter", map[string]interface{}{
+		"queue":       queue,
+		"id":          id,
+		"destination": destination,
+	})
+	return err
+}
 
-	_, err := c.call("send_pipe", params)
+// DeleteDeadLetter discards a dead letter for good.
+func (c *BrokerClient) DeleteDeadLetter(queue, id string) error {
+	_, err := c.call("delete_dead_letter", map[string]interface{}{
+		"queue": queue,
+		"id":    id,
+	})
 	return err
 }
@@ -0,0 +1,448 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tenzoki/agen/cellorg/internal/broker"
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+	"github.com/tenzoki/agen/omni/tokencount"
+)
+
+// Meta keys of chunked simple messages, matching the envelope chunk headers.
+const (
+	MetaChunkID         = "chunk_id"          // Group ID of the chunks
+	MetaChunkIndex      = "chunk_index"       // Position of the chunk, from 0
+	MetaChunkTotal      = "chunk_total"       // Number of chunks
+	MetaChunkOriginalID = "chunk_original_id" // ID of the chunked message
+)
+
+// DefaultChunkTimeout is how long received chunks wait for the rest of their
+// message unless ChunkingConfig.Timeout says otherwise.
+const DefaultChunkTimeout = 5 * time.Minute
+
+// ErrChunkTimeout is matched by the errors reported for chunked messages
+// that did not arrive completely in time.
+var ErrChunkTimeout = errors.New("chunked message incomplete")
+
+// ChunkTimeoutError reports a chunked message whose chunks did not all arrive
+// within the chunk timeout. The chunks received so far are discarded.
+type ChunkTimeoutError struct {
+	ChunkID    string // Group ID of the chunks
+	OriginalID string // ID of the chunked envelope or message
+	Target     string // Destination of the chunks
+	Received   int    // Chunks received
+	Total      int    // Chunks the message was split into
+}
+
+func (e *ChunkTimeoutError) Error() string {
+	return fmt.Sprintf("%v: %s to %s got %d of %d chunks", ErrChunkTimeout, e.OriginalID, e.Target, e.Received, e.Total)
+}
+
+func (e *ChunkTimeoutError) Unwrap() error {
+	return ErrChunkTimeout
+}
+
+// ChunkingConfig controls transport-level chunking. Envelopes and messages
+// whose payload exceeds MaxBytes, or the token budget of the counter for
+// their destination, are sent as several chunks; receiving clients put them
+// back together before delivering them, so the chunks never reach agent
+// code. Chunks of one message must reach the same client: consumer groups
+// and competing pipe consumers may take them apart.
+type ChunkingConfig struct {
+	MaxBytes  int                    // Split payloads larger than this many bytes (0 = no byte limit)
+	Providers *broker.ProviderConfig // Token counters per destination
+	Counter   tokencount.Counter     // Token counter for destinations without a provider (nil = no token limit)
+	Timeout   time.Duration          // How long received chunks wait for the rest (0 = DefaultChunkTimeout)
+}
+
+// SetChunking makes publishes and pipe sends split large payloads according
+// to cfg. Reassembly of received chunks does not depend on it; only the
+// chunk timeout is taken from cfg.
+func (c *BrokerClient) SetChunking(cfg ChunkingConfig) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultChunkTimeout
+	}
+
+	c.chunks.mux.Lock()
+	defer c.chunks.mux.Unlock()
+	c.chunks.config = cfg
+}
+
+// OnChunkError sets the handler for chunked messages that cannot be
+// delivered: incomplete ones (*ChunkTimeoutError) and ones whose chunks do
+// not merge. Without a handler the errors are logged.
+func (c *BrokerClient) OnChunkError(handler func(error)) {
+	c.chunks.mux.Lock()
+	defer c.chunks.mux.Unlock()
+	c.chunks.onError = handler
+}
+
+// chunkState holds the chunking configuration and the chunks received so far.
+type chunkState struct {
+	config  ChunkingConfig
+	onError func(error)
+	groups  map[string]*chunkGroup // Chunk ID -> chunks received so far
+	settles map[string][]string    // Delivery tag of a reassembled pipe item -> tags of its other chunks
+	mux     sync.Mutex
+}
+
+// chunkGroup collects the chunks of one envelope or message.
+type chunkGroup struct {
+	originalID string
+	target     string
+	total      int
+	envelopes  map[int]*envelope.Envelope
+	messages   map[int]*BrokerMessage
+	tags       []string // Delivery tags of chunks received in manual-ack mode
+	timer      *time.Timer
+}
+
+func newChunkState() *chunkState {
+	return &chunkState{
+		config:  ChunkingConfig{Timeout: DefaultChunkTimeout},
+		groups:  make(map[string]*chunkGroup),
+		settles: make(map[string][]string),
+	}
+}
+
+// received returns the number of chunks collected.
+func (g *chunkGroup) received() int {
+	return len(g.envelopes) + len(g.messages)
+}
+
+// chunkCount returns how many chunks a payload for destination is split
+// into, 1 if it is sent whole. Token counting failures send it whole, like
+// broker.ChunkingHelper does.
+func (cfg ChunkingConfig) chunkCount(destination string, env *envelope.Envelope) int {
+	n := 1
+	if cfg.MaxBytes > 0 && len(env.Payload) > cfg.MaxBytes {
+		n = (len(env.Payload) + cfg.MaxBytes - 1) / cfg.MaxBytes
+	}
+
+	counter := cfg.Counter
+	if cfg.Providers != nil {
+		if provider := cfg.Providers.GetCounter(destination); provider != nil {
+			counter = provider
+		}
+	}
+	if counter != nil {
+		if budget, err := envelope.CalculateBudget(env, counter); err == nil && budget.NeedsSplitting {
+			n = max(n, budget.SuggestedChunks)
+		}
+	}
+	return n
+}
+
+// envelopeChunks returns the envelopes to send for env: its chunks, or env
+// itself when it fits. Envelopes that are already chunks are sent as is.
+func (c *BrokerClient) envelopeChunks(env *envelope.Envelope) ([]*envelope.Envelope, error) {
+	c.chunks.mux.Lock()
+	cfg := c.chunks.config
+	c.chunks.mux.Unlock()
+
+	if env.Headers[envelope.HeaderChunkID] != "" {
+		return []*envelope.Envelope{env}, nil
+	}
+	n := cfg.chunkCount(env.Destination, env)
+	if n < 2 {
+		return []*envelope.Envelope{env}, nil
+	}
+
+	chunks, err := envelope.SplitEnvelope(env, n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to chunk envelope: %w", err)
+	}
+	if c.debug {
+		log.Printf("Chunking envelope %s to %s into %d chunks", env.ID, env.Destination, len(chunks))
+	}
+	return chunks, nil
+}
+
+// messageChunks returns the messages to send for msg, like envelopeChunks.
+// Chunks carry byte ranges of the JSON-encoded payload as base64 strings.
+func (c *BrokerClient) messageChunks(destination string, msg BrokerMessage) ([]BrokerMessage, error) {
+	c.chunks.mux.Lock()
+	cfg := c.chunks.config
+	c.chunks.mux.Unlock()
+
+	if cfg.MaxBytes <= 0 && cfg.Counter == nil && cfg.Providers == nil {
+		return []BrokerMessage{msg}, nil
+	}
+	if _, chunked := msg.Meta[MetaChunkID]; chunked {
+		return []BrokerMessage{msg}, nil
+	}
+	if msg.Target != "" {
+		destination = msg.Target
+	}
+
+	data, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode payload: %w", err)
+	}
+	n := cfg.chunkCount(destination, &envelope.Envelope{Destination: destination, Payload: data})
+	if n < 2 || len(data) < n {
+		return []BrokerMessage{msg}, nil
+	}
+
+	groupID := uuid.New().String()
+	size := (len(data) + n - 1) / n
+	var chunks []BrokerMessage
+	for start := 0; start < len(data); start += size {
+		end := min(start+size, len(data))
+
+		chunk := msg
+		chunk.ID = uuid.New().String()
+		chunk.Payload = base64.StdEncoding.EncodeToString(data[start:end])
+		chunk.Meta = make(map[string]interface{}, len(msg.Meta)+4)
+		for k, v := range msg.Meta {
+			chunk.Meta[k] = v
+		}
+		chunk.Meta[MetaChunkID] = groupID
+		chunk.Meta[MetaChunkIndex] = strconv.Itoa(len(chunks))
+		chunk.Meta[MetaChunkOriginalID] = msg.ID
+		chunks = append(chunks, chunk)
+	}
+	for i := range chunks {
+		chunks[i].Meta[MetaChunkTotal] = strconv.Itoa(len(chunks))
+	}
+
+	if c.debug {
+		log.Printf("Chunking message %s to %s into %d chunks", msg.ID, destination, len(chunks))
+	}
+	return chunks, nil
+}
+
+// chunkSendError reports a failed send of chunk i of n. Sends of whole
+// payloads fail with the broker's error as is.
+func chunkSendError(err error, i, n int) error {
+	if n == 1 {
+		return err
+	}
+	return fmt.Errorf("failed to send chunk %d of %d: %w", i+1, n, err)
+}
+
+// collectEnvelope adds a received envelope to its chunk group. Returns the
+// envelope itself if it is not a chunk, the merged envelope once the last
+// chunk arrived, or nil while chunks are missing. tag is the delivery tag of
+// a manual-ack pipe delivery (empty otherwise); acking the tag of the last
+// chunk acks all of them.
+func (c *BrokerClient) collectEnvelope(env *envelope.Envelope, tag string) (*envelope.Envelope, error) {
+	chunkID := env.Headers[envelope.HeaderChunkID]
+	if chunkID == "" {
+		return env, nil
+	}
+	index, _ := strconv.Atoi(env.Headers[envelope.HeaderChunkIndex])
+	total, _ := strconv.Atoi(env.Headers[envelope.HeaderChunkTotal])
+
+	c.chunks.mux.Lock()
+	group := c.chunkGroup(chunkID, env.Headers[envelope.HeaderChunkOriginalID], env.Destination, total)
+	if group.envelopes == nil {
+		group.envelopes = make(map[int]*envelope.Envelope)
+	}
+	group.envelopes[index] = env
+	complete := c.completeGroup(chunkID, group, tag)
+	c.chunks.mux.Unlock()
+	if !complete {
+		return nil, nil
+	}
+
+	chunks := make([]*envelope.Envelope, 0, len(group.envelopes))
+	for _, chunk := range group.envelopes {
+		chunks = append(chunks, chunk)
+	}
+	merged, err := envelope.MergeChunks(chunks)
+	if err != nil {
+		c.discardChunks(group.tags)
+		return nil, fmt.Errorf("failed to merge chunks of envelope %s: %w", group.originalID, err)
+	}
+	return merged, nil
+}
+
+// collectMessage is collectEnvelope for simple messages.
+func (c *BrokerClient) collectMessage(msg *BrokerMessage, tag string) (*BrokerMessage, error) {
+	chunkID := metaString(msg.Meta, MetaChunkID)
+	if chunkID == "" {
+		return msg, nil
+	}
+	index, _ := strconv.Atoi(metaString(msg.Meta, MetaChunkIndex))
+	total, _ := strconv.Atoi(metaString(msg.Meta, MetaChunkTotal))
+
+	c.chunks.mux.Lock()
+	group := c.chunkGroup(chunkID, metaString(msg.Meta, MetaChunkOriginalID), msg.Target, total)
+	if group.messages == nil {
+		group.messages = make(map[int]*BrokerMessage)
+	}
+	group.messages[index] = msg
+	complete := c.completeGroup(chunkID, group, tag)
+	c.chunks.mux.Unlock()
+	if !complete {
+		return nil, nil
+	}
+
+	merged, err := mergeMessages(group)
+	if err != nil {
+		c.discardChunks(group.tags)
+		return nil, fmt.Errorf("failed to merge chunks of message %s: %w", group.originalID, err)
+	}
+	merged.DeliveryTag = tag
+	merged.DeliveryAttempt = msg.DeliveryAttempt
+	return merged, nil
+}
+
+// chunkGroup returns the group of a chunk, starting it and its timeout with
+// the first chunk. Caller holds chunks.mux.
+func (c *BrokerClient) chunkGroup(chunkID, originalID, target string, total int) *chunkGroup {
+	group, ok := c.chunks.groups[chunkID]
+	if !ok {
+		group = &chunkGroup{originalID: originalID, target: target, total: total}
+		group.timer = time.AfterFunc(c.chunks.config.Timeout, func() { c.expireChunks(chunkID) })
+		c.chunks.groups[chunkID] = group
+	}
+	return group
+}
+
+// completeGroup records the delivery tag of the chunk just added and reports
+// whether the group is complete, in which case it is removed. Caller holds
+// chunks.mux.
+func (c *BrokerClient) completeGroup(chunkID string, group *chunkGroup, tag string) bool {
+	if tag != "" {
+		group.tags = append(group.tags, tag)
+	}
+	if group.received() < group.total {
+		return false
+	}
+
+	group.timer.Stop()
+	delete(c.chunks.groups, chunkID)
+	if tag != "" && len(group.tags) > 1 {
+		c.chunks.settles[tag] = group.tags[:len(group.tags)-1]
+	}
+	return true
+}
+
+// expireChunks drops a chunk group that did not complete in time and
+// reports it.
+func (c *BrokerClient) expireChunks(chunkID string) {
+	c.chunks.mux.Lock()
+	group, ok := c.chunks.groups[chunkID]
+	delete(c.chunks.groups, chunkID)
+	c.chunks.mux.Unlock()
+	if !ok {
+		return
+	}
+
+	c.discardChunks(group.tags)
+	c.chunkError(&ChunkTimeoutError{
+		ChunkID:    chunkID,
+		OriginalID: group.originalID,
+		Target:     group.target,
+		Received:   group.received(),
+		Total:      group.total,
+	})
+}
+
+// discardChunks rejects the pipe deliveries of chunks that cannot be
+// delivered, so the broker does not redeliver them forever.
+func (c *BrokerClient) discardChunks(tags []string) {
+	for _, tag := range tags {
+		if _, err := c.call("nack", map[string]interface{}{"delivery_tag": tag, "requeue": false}); err != nil && c.debug {
+			log.Printf("Failed to discard chunk delivery %s: %v", tag, err)
+		}
+	}
+}
+
+// chunkTags returns and forgets the delivery tags settled together with tag.
+func (c *BrokerClient) chunkTags(tag string) []string {
+	c.chunks.mux.Lock()
+	defer c.chunks.mux.Unlock()
+
+	tags := c.chunks.settles[tag]
+	delete(c.chunks.settles, tag)
+	return tags
+}
+
+// chunkError passes an undeliverable chunked message to the OnChunkError
+// handler, or logs it.
+func (c *BrokerClient) chunkError(err error) {
+	c.chunks.mux.Lock()
+	handler := c.chunks.onError
+	c.chunks.mux.Unlock()
+
+	if handler != nil {
+		handler(err)
+		return
+	}
+	log.Printf("Broker client: %v", err)
+}
+
+// resetChunks drops all partially received messages, e.g. on disconnect.
+func (c *BrokerClient) resetChunks() {
+	c.chunks.mux.Lock()
+	defer c.chunks.mux.Unlock()
+
+	for chunkID, group := range c.chunks.groups {
+		group.timer.Stop()
+		delete(c.chunks.groups, chunkID)
+	}
+	c.chunks.settles = make(map[string][]string)
+}
+
+// mergeMessages rebuilds the message whose chunks a complete group holds.
+func mergeMessages(group *chunkGroup) (*BrokerMessage, error) {
+	indexes := make([]int, 0, len(group.messages))
+	for index := range group.messages {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var data []byte
+	for i, index := range indexes {
+		if index != i {
+			return nil, fmt.Errorf("missing chunk %d", i)
+		}
+		encoded, ok := group.messages[index].Payload.(string)
+		if !ok {
+			return nil, fmt.Errorf("chunk %d: payload is not a string", index)
+		}
+		part, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d: invalid payload: %w", index, err)
+		}
+		data = append(data, part...)
+	}
+
+	merged := *group.messages[indexes[0]]
+	merged.ID = group.originalID
+	if err := json.Unmarshal(data, &merged.Payload); err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+	merged.Meta = make(map[string]interface{}, len(merged.Meta))
+	for k, v := range group.messages[indexes[0]].Meta {
+		merged.Meta[k] = v
+	}
+	for _, key := range []string{MetaChunkID, MetaChunkIndex, MetaChunkTotal, MetaChunkOriginalID} {
+		delete(merged.Meta, key)
+	}
+	return &merged, nil
+}
+
+// metaString returns a meta value as a string.
+func metaString(meta map[string]interface{}, key string) string {
+	switch v := meta[key].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// Test that large messages are split by the byte limit and reassembled in any order
+func TestMessageChunking(t *testing.T) {
+	c := NewBrokerClient("localhost:0", "chunker", false)
+	c.SetChunking(ChunkingConfig{MaxBytes: 500})
+
+	text := strings.Repeat("Grüße aus Köln. ", 200)
+	msg := BrokerMessage{ID: "msg-1", Type: "document", Target: "pub:documents",
+		Payload: map[string]interface{}{"text": text}, Meta: map[string]interface{}{"filename": "a.txt"}}
+	chunks, err := c.messageChunks("pub:documents", msg)
+	if err != nil {
+		t.Fatalf("messageChunks failed: %v", err)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("Expected several chunks, got %d", len(chunks))
+	}
+
+	var merged *BrokerMessage
+	for i := len(chunks) - 1; i >= 0; i-- {
+		if merged != nil {
+			t.Fatalf("Message complete before chunk %d", i)
+		}
+		if merged, err = c.collectMessage(&chunks[i], ""); err != nil {
+			t.Fatalf("collectMessage failed: %v", err)
+		}
+	}
+	if merged == nil || merged.ID != "msg-1" || merged.Payload.(map[string]interface{})["text"] != text {
+		t.Fatalf("Unexpected merged message: %+v", merged)
+	}
+	if len(merged.Meta) != 1 || merged.Meta["filename"] != "a.txt" {
+		t.Errorf("Expected chunk meta to be removed, got %v", merged.Meta)
+	}
+
+	// Small messages are sent whole
+	msg.Payload = "short"
+	if chunks, _ := c.messageChunks("pub:documents", msg); len(chunks) != 1 || chunks[0].Payload != "short" {
+		t.Errorf("Expected the message itself, got %+v", chunks)
+	}
+}
+
+// Test that incomplete envelopes are reported once the chunk timeout passes
+func TestChunkTimeout(t *testing.T) {
+	c := NewBrokerClient("localhost:0", "chunker", false)
+	c.SetChunking(ChunkingConfig{Timeout: 50 * time.Millisecond})
+	errs := make(chan error, 1)
+	c.OnChunkError(func(err error) { errs <- err })
+
+	env, _ := envelope.NewEnvelope("producer", "pub:documents", "document", strings.Repeat("x", 100))
+	chunks, _ := envelope.SplitEnvelope(env, 3)
+	for _, chunk := range chunks[:2] {
+		if merged, err := c.collectEnvelope(chunk, ""); merged != nil || err != nil {
+			t.Fatalf("Expected chunk to be held, got %v %v", merged, err)
+		}
+	}
+
+	select {
+	case err := <-errs:
+		var timeout *ChunkTimeoutError
+		if !errors.Is(err, ErrChunkTimeout) || !errors.As(err, &timeout) || timeout.OriginalID != env.ID || timeout.Received != 2 || timeout.Total != 3 {
+			t.Errorf("Unexpected chunk error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a chunk timeout error")
+	}
+
+	// The late chunk starts a new group instead of completing the old one
+	if merged, _ := c.collectEnvelope(chunks[2], ""); merged != nil {
+		t.Error("Expected late chunk to be held")
+	}
+	c.resetChunks()
+}
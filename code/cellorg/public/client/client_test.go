@@ -1,5 +1,98 @@
 package client
 
-import "testing"
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
 
 func TestStub(t *testing.T) {}
+
+// Test that deliveries no subscription takes return their credit, so a
+// prefetch window of one keeps the subscription going
+func TestDroppedDeliveryReturnsCredit(t *testing.T) {
+	_, stop := startBroker(t, ":39563")
+	defer stop()
+
+	c := NewBrokerClient("localhost:39563", "consumer", false)
+	connectWithRetry(t, c)
+	defer c.Disconnect()
+	if err := c.SetPrefetch(1); err != nil {
+		t.Fatalf("SetPrefetch failed: %v", err)
+	}
+	news, err := c.Subscribe("news")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	publisher := NewBrokerClient("localhost:39563", "publisher", false)
+	connectWithRetry(t, publisher)
+	defer publisher.Disconnect()
+
+	// The subscription takes messages only, so the envelope is dropped
+	env, _ := envelope.NewEnvelope("publisher", "pub:news", "headline", "dropped")
+	if err := publisher.PublishEnvelope("news", env); err != nil {
+		t.Fatalf("PublishEnvelope failed: %v", err)
+	}
+	for _, id := range []string{"first", "second"} {
+		if err := publisher.Publish("news", BrokerMessage{ID: id, Type: "headline", Target: "pub:news"}); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+		select {
+		case msg := <-news:
+			if msg.ID != id {
+				t.Fatalf("Expected %s, got %s", id, msg.ID)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected %s despite the dropped envelope", id)
+		}
+		if err := c.Credit(1); err != nil {
+			t.Fatalf("Credit failed: %v", err)
+		}
+	}
+}
+
+// Test that chunked messages are credited once, so a prefetch window smaller
+// than their chunk count does not drain
+func TestChunkedDeliveriesWithPrefetch(t *testing.T) {
+	_, stop := startBroker(t, ":39564")
+	defer stop()
+
+	c := NewBrokerClient("localhost:39564", "consumer", false)
+	connectWithRetry(t, c)
+	defer c.Disconnect()
+	if err := c.SetPrefetch(2); err != nil {
+		t.Fatalf("SetPrefetch failed: %v", err)
+	}
+	docs, err := c.Subscribe("documents")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	publisher := NewBrokerClient("localhost:39564", "publisher", false)
+	publisher.SetChunking(ChunkingConfig{MaxBytes: 500})
+	connectWithRetry(t, publisher)
+	defer publisher.Disconnect()
+
+	text := strings.Repeat("chunked ", 300)
+	for i := 0; i < 3; i++ {
+		msg := BrokerMessage{ID: fmt.Sprintf("doc-%d", i), Type: "document", Target: "pub:documents", Payload: text}
+		if err := publisher.Publish("documents", msg); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+		select {
+		case got := <-docs:
+			if got.ID != msg.ID || got.Payload != text {
+				t.Fatalf("Expected %s merged, got %s", msg.ID, got.ID)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected %s within the prefetch window", msg.ID)
+		}
+		if err := c.Credit(1); err != nil {
+			t.Fatalf("Credit failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"time"
+)
+
+// Publish policies decide what publishes and pipe sends do while the client
+// reconnects.
+const (
+	PublishFail   = "fail"   // Return ErrNotConnected (default)
+	PublishBuffer = "buffer" // Queue them and send them once reconnected
+)
+
+// Reconnect defaults, used for zero ReconnectConfig fields.
+const (
+	defaultReconnectDelay    = 250 * time.Millisecond
+	defaultReconnectMaxDelay = 30 * time.Second
+	defaultPublishBuffer     = 1000
+)
+
+// ErrNotConnected is returned by calls made while the client has no broker
+// connection, including publishes while reconnecting under PublishFail.
+var ErrNotConnected = errors.New("not connected to broker")
+
+// ErrConnectionLost is returned by calls whose connection dropped before the
+// broker answered. The broker may or may not have processed them.
+var ErrConnectionLost = errors.New("connection to broker lost")
+
+// ErrPublishBufferFull is returned by publishes and pipe sends under
+// PublishBuffer once ReconnectConfig.BufferSize sends are waiting.
+var ErrPublishBufferFull = errors.New("publish buffer full")
+
+// ReconnectConfig controls what the client does when its broker connection
+// drops. The zero value reconnects forever with exponential backoff from
+// 250ms up to 30s and fails publishes while disconnected.
+type ReconnectConfig struct {
+	Disabled     bool          // Stay disconnected when the connection drops
+	InitialDelay time.Duration // Wait before the first attempt (0 = 250ms), doubled per failed attempt
+	MaxDelay     time.Duration // Longest wait between attempts (0 = 30s)
+	MaxAttempts  int           // Give up after this many failed attempts (0 = never)
+	Publish      string        // PublishFail (default) or PublishBuffer
+	BufferSize   int           // Sends kept under PublishBuffer (0 = 1000)
+}
+
+// ConnectionState is the kind of a ConnectionEvent.
+type ConnectionState string
+
+const (
+	ConnectionLost     ConnectionState = "lost"     // The connection dropped; reconnecting unless disabled
+	ConnectionRetrying ConnectionState = "retrying" // A reconnect attempt failed; the next follows after Delay
+	ConnectionRestored ConnectionState = "restored" // Reconnected with subscriptions and pipe roles re-established
+	ConnectionFailed   ConnectionState = "failed"   // Gave up after ReconnectConfig.MaxAttempts
+)
+
+// ConnectionEvent reports a change of the broker connection (see
+// OnConnectionEvent).
+type ConnectionEvent struct {
+	State   ConnectionState
+	Attempt int           // Reconnect attempt (retrying, restored, failed)
+	Delay   time.Duration // Wait before the next attempt (retrying)
+	Err     error         // Why the connection dropped or the attempt failed; for restored, what could not be re-established
+	Time    time.Time
+}
+
+// pipeRole identifies a connect_pipe registration replayed after a reconnect.
+type pipeRole struct {
+	pipe string
+	role string // "consumer" or "producer"
+}
+
+// bufferedSend is a publish or pipe send waiting for the reconnect.
+type bufferedSend struct {
+	method string
+	params map[string]interface{}
+}
+
+// SetReconnect configures reconnection after a dropped connection.
+func (c *BrokerClient) SetReconnect(config ReconnectConfig) error {
+	switch config.Publish {
+	case "", PublishFail, PublishBuffer:
+	default:
+		return fmt.Errorf("unknown publish policy %q (expected %s or %s)", config.Publish, PublishFail, PublishBuffer)
+	}
+
+	c.mux.Lock()
+	c.reconnect = config
+	c.mux.Unlock()
+	return nil
+}
+
+// OnConnectionEvent sets the handler for connection events. Events reach it
+// one at a time and in order, on a goroutine of their own.
+func (c *BrokerClient) OnConnectionEvent(handler func(ConnectionEvent)) {
+	c.mux.Lock()
+	c.onConnEvent = handler
+	c.mux.Unlock()
+}
+
+// Connected reports whether the client currently has a broker connection.
+func (c *BrokerClient) Connected() bool {
+	c.sendMux.Lock()
+	defer c.sendMux.Unlock()
+	return c.conn != nil
+}
+
+// emit queues an event for the connection event handler. Queuing under
+// c.mux keeps the events in the order the changes happened, while the
+// handler runs outside the lock and may call the client. The caller must
+// hold c.mux.
+func (c *BrokerClient) emit(event ConnectionEvent) {
+	event.Time = time.Now()
+	if c.debug {
+		log.Printf("Broker connection %s (attempt %d): %v", event.State, event.Attempt, event.Err)
+	}
+
+	c.events = append(c.events, event)
+	if !c.dispatching {
+		c.dispatching = true
+		go c.dispatchEvents()
+	}
+}
+
+// dispatchEvents passes queued events to the handler until none are left.
+func (c *BrokerClient) dispatchEvents() {
+	for {
+		c.mux.Lock()
+		if len(c.events) == 0 {
+			c.dispatching = false
+			c.mux.Unlock()
+			return
+		}
+		event, handler := c.events[0], c.onConnEvent
+		c.events = c.events[1:]
+		c.mux.Unlock()
+
+		if handler != nil {
+			handler(event)
+		}
+	}
+}
+
+// connectionLost handles the end of a connection's message listener. Unless
+// the connection was closed by Disconnect, pending calls fail with
+// ErrConnectionLost and reconnecting starts.
+//
+// Called by: messageListener() when it exits
+func (c *BrokerClient) connectionLost(l *link, cause error) {
+	c.sendMux.Lock()
+	current := c.conn == l.conn
+	if current {
+		c.conn, c.encoder, c.decoder = nil, nil, nil
+	}
+	c.sendMux.Unlock()
+	if !current {
+		return // Closed by Disconnect or already replaced
+	}
+	l.conn.Close()
+	c.failPending()
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return
+	}
+
+	c.resetChunks()
+	if cause == nil {
+		cause = ErrConnectionLost
+	}
+	c.emit(ConnectionEvent{State: ConnectionLost, Err: cause})
+	if !c.reconnect.Disabled {
+		c.reconnecting = true
+		c.stop = make(chan struct{})
+		go c.reconnectLoop(c.reconnect, c.stop)
+	}
+}
+
+// failPending ends the calls and requests waiting for answers on a
+// connection that is gone.
+func (c *BrokerClient) failPending() {
+	c.responseChMux.Lock()
+	for id, ch := range c.responseChans {
+		close(ch)
+		delete(c.responseChans, id)
+	}
+	c.responseChMux.Unlock()
+
+	// Replies go to the inbox of the old connection and can no longer arrive.
+	// A nil reply tells Request; the channel stays open since a reply still
+	// being routed may be sent on it.
+	c.requestsMux.Lock()
+	for id, replies := range c.requests {
+		select {
+		case replies <- nil:
+		default: // A reply is already waiting
+		}
+		delete(c.requests, id)
+	}
+	c.requestsMux.Unlock()
+}
+
+// reconnectLoop dials the broker with exponential backoff until it is back,
+// stop is closed, or config.MaxAttempts attempts failed.
+func (c *BrokerClient) reconnectLoop(config ReconnectConfig, stop chan struct{}) {
+	for attempt := 1; ; attempt++ {
+		delay := config.backoff(attempt)
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+
+		c.mux.Lock()
+		select {
+		case <-stop:
+			c.mux.Unlock()
+			return // Disconnect or Connect took over
+		default:
+		}
+		l, err := c.open()
+		if err == nil {
+			c.attach(l)
+			c.endReconnect()
+			c.emit(ConnectionEvent{State: ConnectionRestored, Attempt: attempt, Err: c.restore()})
+			c.mux.Unlock()
+			return
+		}
+
+		if config.MaxAttempts > 0 && attempt >= config.MaxAttempts {
+			if len(c.buffered) > 0 {
+				err = fmt.Errorf("%w (%d buffered sends dropped)", err, len(c.buffered))
+			}
+			c.endReconnect()
+			c.buffered = nil
+			c.emit(ConnectionEvent{State: ConnectionFailed, Attempt: attempt, Err: err})
+			c.mux.Unlock()
+			return
+		}
+		c.emit(ConnectionEvent{State: ConnectionRetrying, Attempt: attempt, Delay: config.backoff(attempt + 1), Err: err})
+		c.mux.Unlock()
+	}
+}
+
+// endReconnect stops a running reconnect loop. The caller must hold c.mux.
+func (c *BrokerClient) endReconnect() {
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	c.reconnecting = false
+}
+
+// backoff returns the wait before an attempt: the initial delay doubled per
+// earlier attempt up to the maximum, varied by up to 20% so that agents
+// dropped together do not reconnect in lockstep.
+func (config ReconnectConfig) backoff(attempt int) time.Duration {
+	delay, maxDelay := config.InitialDelay, config.MaxDelay
+	if delay <= 0 {
+		delay = defaultReconnectDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultReconnectMaxDelay
+	}
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxDelay)
+	jitter := time.Duration(rand.Int64N(int64(delay)/5 + 1))
+	return delay - delay/10 + jitter
+}
+
+// restore re-establishes the prefetch window, subscriptions and pipe roles
+// on a new connection, then sends what was buffered while disconnected.
+// Returns what could not be restored. The caller must hold c.mux.
+func (c *BrokerClient) restore() error {
+	var errs []error
+	if c.prefetch > 0 {
+		if _, err := c.call("prefetch", map[string]interface{}{"prefetch": c.prefetch}); err != nil {
+			errs = append(errs, fmt.Errorf("prefetch: %w", err))
+		}
+	}
+
+	topics := make([]string, 0, len(c.subscriptions))
+	for topic := range c.subscriptions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		if _, err := c.call("subscribe", c.subscriptions[topic].params(topic)); err != nil {
+			errs = append(errs, fmt.Errorf("subscribe %s: %w", topic, err))
+		}
+	}
+
+	roles := make([]pipeRole, 0, len(c.pipeRoles))
+	for role := range c.pipeRoles {
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool {
+		if roles[i].pipe != roles[j].pipe {
+			return roles[i].pipe < roles[j].pipe
+		}
+		return roles[i].role < roles[j].role
+	})
+	for _, role := range roles {
+		if _, err := c.call("connect_pipe", c.pipeRoles[role].params(role.pipe, role.role)); err != nil {
+			errs = append(errs, fmt.Errorf("connect pipe %s as %s: %w", role.pipe, role.role, err))
+		}
+	}
+
+	buffered := c.buffered
+	c.buffered = nil
+	for i, send := range buffered {
+		err := c.sendWithFlowControl(send.method, send.params)
+		if errors.Is(err, ErrNotConnected) || errors.Is(err, ErrConnectionLost) {
+			// Dropped again: keep the rest for the next reconnect
+			c.buffered = append(buffered[i:], c.buffered...)
+			errs = append(errs, fmt.Errorf("buffered sends: %w", err))
+			break
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("buffered %s: %w", send.method, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// offlineSend applies the publish policy to a publish or pipe send made while
+// reconnecting. The caller must hold c.mux.
+func (c *BrokerClient) offlineSend(method string, params map[string]interface{}) error {
+	if c.reconnect.Publish != PublishBuffer {
+		return fmt.Errorf("%s while reconnecting: %w", method, ErrNotConnected)
+	}
+	size := c.reconnect.BufferSize
+	if size <= 0 {
+		size = defaultPublishBuffer
+	}
+	if len(c.buffered) >= size {
+		return fmt.Errorf("%s while reconnecting: %w (%d sends)", method, ErrPublishBufferFull, size)
+	}
+	c.buffered = append(c.buffered, bufferedSend{method: method, params: params})
+	return nil
+}
@@ -0,0 +1,180 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/broker"
+)
+
+// startBroker runs a broker on port until the returned stop function is
+// called; stop returns once the port is closed.
+func startBroker(t *testing.T, port string) (*broker.Service, func()) {
+	t.Helper()
+
+	s := broker.NewService(broker.BrokerConfig{Port: port, Protocol: "tcp", Codec: "json"})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Start(ctx)
+		close(done)
+	}()
+	return s, func() {
+		cancel()
+		<-done
+	}
+}
+
+// connectWithRetry connects a client once the broker listens
+func connectWithRetry(t *testing.T, c *BrokerClient) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		err := c.Connect()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// dropConnection closes the client's connection as a network failure would
+func dropConnection(c *BrokerClient) {
+	c.sendMux.Lock()
+	c.conn.Close()
+	c.sendMux.Unlock()
+}
+
+// awaitEvent returns the next connection event of the given state, failing
+// on events that are neither that state nor retrying
+func awaitEvent(t *testing.T, events <-chan ConnectionEvent, state ConnectionState) ConnectionEvent {
+	t.Helper()
+
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.State == state {
+				return event
+			}
+			if event.State != ConnectionRetrying {
+				t.Fatalf("Expected %s event, got %+v", state, event)
+			}
+		case <-timeout:
+			t.Fatalf("Expected %s event", state)
+		}
+	}
+}
+
+// Test that a client restores its subscriptions and pipe roles on a restarted
+// broker and sends what it buffered meanwhile
+func TestReconnectRestoresSession(t *testing.T) {
+	_, stop := startBroker(t, ":39561")
+
+	c := NewBrokerClient("localhost:39561", "reconnecting", false)
+	c.SetReconnect(ReconnectConfig{InitialDelay: 20 * time.Millisecond, MaxDelay: 50 * time.Millisecond, Publish: PublishBuffer})
+	events := make(chan ConnectionEvent, 100)
+	c.OnConnectionEvent(func(event ConnectionEvent) { events <- event })
+	connectWithRetry(t, c)
+	defer c.Disconnect()
+
+	news, err := c.Subscribe("news")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if err := c.ConnectPipeConsumer("work", PipeConsumerOptions{Policy: "least_in_flight"}); err != nil {
+		t.Fatalf("ConnectPipeConsumer failed: %v", err)
+	}
+
+	stop()
+	dropConnection(c)
+	if event := awaitEvent(t, events, ConnectionLost); event.Err == nil {
+		t.Error("Expected lost event to carry the cause")
+	}
+	if err := c.SendPipe("work", BrokerMessage{ID: "while-offline", Type: "task", Target: "pipe:work", Payload: "offline"}); err != nil {
+		t.Fatalf("Expected send to be buffered, got %v", err)
+	}
+	if event := awaitEvent(t, events, ConnectionRetrying); event.Delay <= 0 || event.Err == nil {
+		t.Errorf("Unexpected retrying event: %+v", event)
+	}
+
+	restarted, stop := startBroker(t, ":39561")
+	defer stop()
+	if event := awaitEvent(t, events, ConnectionRestored); event.Err != nil {
+		t.Fatalf("Session not restored: %v", event.Err)
+	}
+
+	pipe := restarted.Stats().PipeConsumers["work"]
+	if len(pipe.Consumers) != 1 || pipe.Policy != "least_in_flight" {
+		t.Errorf("Expected pipe role to be restored, got %+v", pipe)
+	}
+
+	// The buffered send was made once the session was restored
+	item, err := c.ReceivePipe("work", 1000)
+	if msg, ok := item.(*BrokerMessage); err != nil || !ok || msg.ID != "while-offline" {
+		t.Errorf("Expected buffered message, got %v %v", item, err)
+	}
+
+	// The subscription is back without subscribing again
+	publisher := NewBrokerClient("localhost:39561", "publisher", false)
+	connectWithRetry(t, publisher)
+	defer publisher.Disconnect()
+	if err := publisher.Publish("news", BrokerMessage{ID: "after-restart", Type: "headline", Target: "pub:news"}); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	select {
+	case msg := <-news:
+		if msg.ID != "after-restart" {
+			t.Errorf("Expected after-restart, got %s", msg.ID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected message on the restored subscription")
+	}
+}
+
+// Test that a client fails publishes while reconnecting and gives up after
+// the configured attempts
+func TestReconnectGivesUp(t *testing.T) {
+	_, stop := startBroker(t, ":39562")
+
+	c := NewBrokerClient("localhost:39562", "giving-up", false)
+	c.SetReconnect(ReconnectConfig{InitialDelay: 10 * time.Millisecond, MaxAttempts: 3})
+	events := make(chan ConnectionEvent, 100)
+	c.OnConnectionEvent(func(event ConnectionEvent) { events <- event })
+	connectWithRetry(t, c)
+	defer c.Disconnect()
+
+	stop()
+	dropConnection(c)
+	awaitEvent(t, events, ConnectionLost)
+	if err := c.Publish("news", BrokerMessage{ID: "lost", Type: "headline", Target: "pub:news"}); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Expected ErrNotConnected, got %v", err)
+	}
+	if _, err := c.Stats(); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Expected ErrNotConnected, got %v", err)
+	}
+
+	if event := awaitEvent(t, events, ConnectionFailed); event.Attempt != 3 {
+		t.Errorf("Expected to give up after 3 attempts, got %d", event.Attempt)
+	}
+	if c.Connected() {
+		t.Error("Expected client to stay disconnected")
+	}
+}
+
+// Test that the backoff doubles up to the maximum with bounded jitter
+func TestReconnectBackoff(t *testing.T) {
+	config := ReconnectConfig{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, want := range map[int]time.Duration{1: 100, 2: 200, 4: 800, 5: 1000, 20: 1000} {
+		want *= time.Millisecond
+		if delay := config.backoff(attempt); delay < want*9/10 || delay > want*11/10 {
+			t.Errorf("Attempt %d: expected about %v, got %v", attempt, want, delay)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// HeaderReplyTo is the envelope header in which the broker delivers the
+// requester's reply inbox with a request. Reply passes it back.
+const HeaderReplyTo = envelope.HeaderReplyTo
+
+// ReplyMessageType is the message type of replies built with
+// envelope.NewReplyEnvelope. Request only accepts envelopes of this type.
+const ReplyMessageType = "reply"
+
+// MetaRequestSource holds the requester's source in the meta of requests
+// handed to message subscriptions (see IsRequest).
+const MetaRequestSource = "request_source"
+
+// ErrNoResponders is returned by Request when no agent subscribes to the
+// request topic, so no reply can come.
+var ErrNoResponders = errors.New("no subscribers for request")
+
+// requestResult is the broker's answer to "request".
+type requestResult struct {
+	Inbox      string `json:"inbox"`      // Reply inbox of this connection
+	Recipients int    `json:"recipients"` // Subscribers and consumer groups that got the request
+}
+
+// Request publishes env on a topic and waits for the reply, which the
+// responder builds with envelope.NewReplyEnvelope and sends with Reply.
+//
+// Each call sends a copy of env with a fresh ID and leaves env unchanged, so
+// callers can retry with the same envelope. Replies carry the copy's ID as
+// their correlation ID, so concurrent requests on the same topic never
+// receive each other's replies. The broker routes replies to this connection's reply inbox, not
+// through a topic, and they never reach the subscription channels.
+// Timeouts and cancellation come from ctx.
+//
+// Returns ErrNoResponders right away when nobody subscribes to the topic
+// (unless env is persistent and waits in the broker for a subscriber).
+//
+// Called by: Agents and orchestrators querying other agents
+func (c *BrokerClient) Request(ctx context.Context, topic string, env *envelope.Envelope) (*envelope.Envelope, error) {
+	request := env.Clone()
+	request.ID = uuid.New().String()
+
+	replies := make(chan *envelope.Envelope, 1)
+	c.requestsMux.Lock()
+	c.requests[request.ID] = replies
+	c.requestsMux.Unlock()
+	defer func() {
+		c.requestsMux.Lock()
+		delete(c.requests, request.ID)
+		c.requestsMux.Unlock()
+	}()
+
+	c.mux.Lock()
+	raw, err := c.callWithFlowControl("request", map[string]interface{}{
+		"topic":    topic,
+		"envelope": request,
+	})
+	var result requestResult
+	if err == nil {
+		if decodeErr := c.wire.Unmarshal(raw, &result); decodeErr != nil {
+			// Envelopes past their TTL are routed to the expiry topic instead
+			var status string
+			if c.wire.Unmarshal(raw, &status) == nil && status == "expired" {
+				err = fmt.Errorf("request %s expired before delivery", request.ID)
+			} else {
+				err = fmt.Errorf("failed to decode request result: %w", decodeErr)
+			}
+		}
+	}
+	c.mux.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Recipients == 0 && !request.Persistent {
+		return nil, fmt.Errorf("%w on topic %s", ErrNoResponders, topic)
+	}
+
+	select {
+	case reply := <-replies:
+		if reply == nil {
+			return nil, fmt.Errorf("request %s on topic %s: %w", request.ID, topic, ErrConnectionLost)
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("request %s on topic %s: %w", request.ID, topic, ctx.Err())
+	}
+}
+
+// Reply sends a reply to a request received from a topic. The reply must be
+// built with envelope.NewReplyEnvelope from the request, which links both by
+// the correlation ID.
+func (c *BrokerClient) Reply(request, reply *envelope.Envelope) error {
+	inbox := request.Headers[HeaderReplyTo]
+	if inbox == "" {
+		return fmt.Errorf("envelope %s is not a request: no reply inbox", request.ID)
+	}
+	if reply.CorrelationID != request.ID || reply.MessageType != ReplyMessageType {
+		return fmt.Errorf("envelope %s is not a reply to %s", reply.ID, request.ID)
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	_, err := c.call("reply", map[string]interface{}{
+		"inbox":    inbox,
+		"envelope": reply,
+	})
+	return err
+}
+
+// IsRequest reports whether a message subscription received msg as a
+// request, which the requester waits on: its reply goes back with
+// ReplyMessage instead of being published. The message carries the
+// request's ID, type and payload, and its headers as meta.
+func IsRequest(msg *BrokerMessage) bool {
+	inbox, _ := msg.Meta[HeaderReplyTo].(string)
+	return inbox != ""
+}
+
+// ReplyMessage replies to a request received on a message subscription
+// (see IsRequest) with payload. A []byte payload holding JSON is sent as
+// that JSON.
+func (c *BrokerClient) ReplyMessage(request *BrokerMessage, payload interface{}) error {
+	inbox, _ := request.Meta[HeaderReplyTo].(string)
+	source, _ := request.Meta[MetaRequestSource].(string)
+	if raw, ok := payload.([]byte); ok && json.Valid(raw) {
+		payload = json.RawMessage(raw)
+	}
+
+	env := &envelope.Envelope{ID: request.ID, Source: source, Headers: map[string]string{HeaderReplyTo: inbox}}
+	reply, err := envelope.NewReplyEnvelope(env, c.agentID, payload)
+	if err != nil {
+		return fmt.Errorf("failed to create reply to %s: %w", request.ID, err)
+	}
+	return c.Reply(env, reply)
+}
+
+// requestMessage presents a request envelope to message subscriptions,
+// which would not see it otherwise. Returns nil for other envelopes.
+func requestMessage(env *envelope.Envelope) *BrokerMessage {
+	if env.Headers[HeaderReplyTo] == "" {
+		return nil
+	}
+
+	var payload interface{}
+	if err := json.Unmarshal(env.Payload, &payload); err != nil {
+		return nil
+	}
+	meta := make(map[string]interface{}, len(env.Headers)+1)
+	for name, value := range env.Headers {
+		meta[name] = value
+	}
+	meta[MetaRequestSource] = env.Source
+	return &BrokerMessage{
+		ID:        env.ID,
+		Type:      env.MessageType,
+		Target:    env.Destination,
+		Payload:   payload,
+		Meta:      meta,
+		Timestamp: env.Timestamp,
+	}
+}
+
+// deliverReply hands a reply to the Request waiting for it. Returns false for
+// envelopes that are not replies to a pending request.
+func (c *BrokerClient) deliverReply(env *envelope.Envelope) bool {
+	if env.MessageType != ReplyMessageType || env.CorrelationID == "" {
+		return false
+	}
+
+	c.requestsMux.Lock()
+	replies, pending := c.requests[env.CorrelationID]
+	c.requestsMux.Unlock()
+	if !pending {
+		return false
+	}
+
+	select {
+	case replies <- env:
+		// Reply delivered
+	default:
+		if c.debug {
+			log.Printf("Warning: duplicate reply for request %s dropped", env.CorrelationID)
+		}
+	}
+	return true
+}
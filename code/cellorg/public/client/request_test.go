@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// Test that concurrent requests on one connection each receive the reply to
+// their own request, even when the responder answers them out of order
+func TestConcurrentRequests(t *testing.T) {
+	_, stop := startBroker(t, ":39565")
+	defer stop()
+
+	responder := NewBrokerClient("localhost:39565", "responder", false)
+	connectWithRetry(t, responder)
+	defer responder.Disconnect()
+	requests, err := responder.SubscribeEnvelopes("lookup")
+	if err != nil {
+		t.Fatalf("SubscribeEnvelopes failed: %v", err)
+	}
+
+	// Answer both requests in reverse order, echoing their payload
+	go func() {
+		var received []*envelope.Envelope
+		for len(received) < 2 {
+			received = append(received, <-requests)
+		}
+		for i := len(received) - 1; i >= 0; i-- {
+			request := received[i]
+			var key string
+			json.Unmarshal(request.Payload, &key)
+			reply, _ := envelope.NewReplyEnvelope(request, "responder", "value of "+key)
+			if err := responder.Reply(request, reply); err != nil {
+				t.Errorf("Reply failed: %v", err)
+			}
+		}
+	}()
+
+	c := NewBrokerClient("localhost:39565", "requester", false)
+	connectWithRetry(t, c)
+	defer c.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	keys := []string{"a", "b"}
+	answers := make([]chan string, len(keys))
+	for i, key := range keys {
+		answers[i] = make(chan string, 1)
+		go func(key string, answer chan<- string) {
+			env, _ := envelope.NewEnvelope("requester", "pub:lookup", "lookup", key)
+			reply, err := c.Request(ctx, "lookup", env)
+			if err != nil {
+				answer <- "error: " + err.Error()
+				return
+			}
+			var value string
+			json.Unmarshal(reply.Payload, &value)
+			answer <- value
+		}(key, answers[i])
+	}
+
+	for i, key := range keys {
+		if value := <-answers[i]; value != "value of "+key {
+			t.Errorf("Expected the reply to %s, got %q", key, value)
+		}
+	}
+}
+
+// Test that message subscriptions receive requests and answer them with ReplyMessage
+func TestReplyMessage(t *testing.T) {
+	_, stop := startBroker(t, ":39566")
+	defer stop()
+
+	responder := NewBrokerClient("localhost:39566", "responder", false)
+	connectWithRetry(t, responder)
+	defer responder.Disconnect()
+	messages, err := responder.Subscribe("lookup")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	go func() {
+		msg := <-messages
+		if !IsRequest(msg) {
+			t.Errorf("Expected a request, got %+v", msg)
+			return
+		}
+		payload, _ := json.Marshal(map[string]interface{}{"echo": msg.Payload})
+		if err := responder.ReplyMessage(msg, payload); err != nil {
+			t.Errorf("ReplyMessage failed: %v", err)
+		}
+	}()
+
+	c := NewBrokerClient("localhost:39566", "requester", false)
+	connectWithRetry(t, c)
+	defer c.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	env, _ := envelope.NewEnvelope("requester", "pub:lookup", "lookup", map[string]string{"key": "a"})
+	reply, err := c.Request(ctx, "lookup", env)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	var result struct {
+		Echo map[string]string `json:"echo"`
+	}
+	if err := json.Unmarshal(reply.Payload, &result); err != nil || result.Echo["key"] != "a" {
+		t.Errorf("Expected the request echoed, got %s (%v)", reply.Payload, err)
+	}
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"time"
+
+	"github.com/tenzoki/agen/cellorg/internal/codec"
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+)
+
+// HeaderScheduledFor is set by the broker on envelopes delivered through a
+// schedule, holding the RFC3339 time they were due.
+const HeaderScheduledFor = "X-Scheduled-For"
+
+// Schedule says when the broker delivers an envelope: at a point in time or
+// after a delay. Set one of the two; a schedule that is not in the future
+// delivers right away.
+type Schedule struct {
+	At    time.Time     // Deliver at this time
+	Delay time.Duration // Deliver after this delay
+}
+
+// ScheduledDelivery is the broker's confirmation of a scheduled envelope.
+type ScheduledDelivery struct {
+	ID        string    `json:"scheduled_id"` // Pass to CancelScheduled
+	DeliverAt time.Time `json:"deliver_at"`   // When the envelope will be delivered
+}
+
+// PublishEnvelopeAt publishes an envelope to a topic once the schedule is
+// due. The broker holds the envelope (persisted when it has a data
+// directory), so the publisher does not need to stay connected. Returns nil
+// when the envelope was delivered right away.
+func (c *BrokerClient) PublishEnvelopeAt(topic string, env *envelope.Envelope, schedule Schedule) (*ScheduledDelivery, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	params := schedule.params(map[string]interface{}{
+		"topic":    topic,
+		"envelope": env,
+	})
+	return c.scheduled(c.callWithFlowControl("publish_envelope", params))
+}
+
+// SendPipeEnvelopeAt sends an envelope to a pipe once the schedule is due
+// (see PublishEnvelopeAt).
+func (c *BrokerClient) SendPipeEnvelopeAt(pipeName string, env *envelope.Envelope, schedule Schedule) (*ScheduledDelivery, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	params := schedule.params(map[string]interface{}{
+		"pipe":     pipeName,
+		"envelope": env,
+	})
+	return c.scheduled(c.callWithFlowControl("send_pipe_envelope", params))
+}
+
+// CancelScheduled discards an envelope scheduled by this agent before it is
+// due.
+func (c *BrokerClient) CancelScheduled(id string) error {
+	_, err := c.call("cancel_scheduled", map[string]interface{}{
+		"scheduled_id": id,
+	})
+	return err
+}
+
+// params adds the schedule to publish or send parameters.
+func (s Schedule) params(params map[string]interface{}) map[string]interface{} {
+	if !s.At.IsZero() {
+		params["deliver_at"] = s.At
+	}
+	if s.Delay > 0 {
+		params["delay_ms"] = s.Delay.Milliseconds()
+	}
+	return params
+}
+
+// scheduled decodes the result of a scheduling publish or send. Immediate
+// deliveries return a plain status instead of a ScheduledDelivery.
+func (c *BrokerClient) scheduled(result codec.Raw, err error) (*ScheduledDelivery, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	var delivery ScheduledDelivery
+	if c.wire.Unmarshal(result, &delivery) != nil || delivery.ID == "" {
+		return nil, nil
+	}
+	return &delivery, nil
+}
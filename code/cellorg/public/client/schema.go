@@ -0,0 +1,42 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Schema version stamps the broker sets on validated payloads. Set them
+// before publishing to pin the schema version a payload follows.
+const (
+	HeaderSchemaVersion = "X-Schema-Version" // Envelope header
+	MetaSchemaVersion   = "schema_version"   // BrokerMessage meta key
+)
+
+// SchemaDefinition is one version of a payload schema registered with the
+// broker, applying to a topic, a message type, or both.
+type SchemaDefinition struct {
+	Topic       string          `json:"topic,omitempty"`
+	MessageType string          `json:"message_type,omitempty"`
+	Version     int             `json:"version"`
+	Schema      json.RawMessage `json:"schema"` // The JSON Schema document
+}
+
+// Schemas returns the payload schemas the broker enforces, oldest version
+// first per topic and message type. With a topic or message type only the
+// versions applying to them are returned, i.e. the versions a payload
+// published there may follow; an empty result means it is not checked.
+func (c *BrokerClient) Schemas(topic, messageType string) ([]SchemaDefinition, error) {
+	result, err := c.call("schemas", map[string]interface{}{
+		"topic":        topic,
+		"message_type": messageType,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var definitions []SchemaDefinition
+	if err := c.wire.Unmarshal(result, &definitions); err != nil {
+		return nil, fmt.Errorf("failed to decode schemas: %w", err)
+	}
+	return definitions, nil
+}
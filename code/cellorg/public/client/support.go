@@ -1,16 +1,20 @@
 package client
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 type SupportClient struct {
 	address string
 	debug   bool
+	tls     *tls.Config // TLS settings (nil = plain TCP)
 	conn    net.Conn
 	encoder *json.Encoder
 	decoder *json.Decoder
@@ -30,11 +34,26 @@ type SupportResponse struct {
 	Error  *SupportError   `json:"error,omitempty"`
 }
 
+// ErrCodeUnknownAgent is returned for heartbeats of agents the support
+// service has no registration for, e.g. after it restarted without a
+// persistent registry. The agent should register again.
+const ErrCodeUnknownAgent = -32004
+
+// ErrSupportUnavailable wraps the errors of requests that did not reach the
+// support service or got no response from it.
+var ErrSupportUnavailable = errors.New("support service unavailable")
+
 type SupportError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 }
 
+// Error implements the error interface so callers can inspect support
+// service error codes with errors.As on errors returned by client methods.
+func (e *SupportError) Error() string {
+	return fmt.Sprintf("%s (code: %d)", e.Message, e.Code)
+}
+
 type AgentRegistration struct {
 	ID           string   `json:"agent_id"`
 	AgentType    string   `json:"agent_type"`
@@ -42,6 +61,7 @@ type AgentRegistration struct {
 	Address      string   `json:"address"`
 	Port         string   `json:"port"`
 	Codec        string   `json:"codec"`
+	Token        string   `json:"token,omitempty"` // Credential when cellorg requires authentication
 	Capabilities []string `json:"capabilities"`
 }
 
@@ -50,6 +70,7 @@ type AgentCellConfig struct {
 	AgentType    string                 `json:"agent_type"`
 	Ingress      string                 `json:"ingress"`
 	Egress       string                 `json:"egress"`
+	DeadLetter   string                 `json:"dead_letter"`
 	Dependencies []string               `json:"dependencies"`
 	Config       map[string]interface{} `json:"config"`
 }
@@ -68,6 +89,13 @@ func NewSupportClient(address string, debug bool) *SupportClient {
 	}
 }
 
+// SetTLS makes the next Connect use TLS with the given settings.
+func (c *SupportClient) SetTLS(config *tls.Config) {
+	c.mux.Lock()
+	c.tls = config
+	c.mux.Unlock()
+}
+
 func (c *SupportClient) Connect() error {
 	c.mux.Lock()
 	defer c.mux.Unlock()
@@ -76,7 +104,7 @@ func (c *SupportClient) Connect() error {
 		return nil // Already connected
 	}
 
-	conn, err := net.Dial("tcp", c.address)
+	conn, err := dial(c.address, c.tls)
 	if err != nil {
 		return fmt.Errorf("failed to connect to support service at %s: %w", c.address, err)
 	}
@@ -111,7 +139,7 @@ func (c *SupportClient) call(method string, params interface{}) (json.RawMessage
 	defer c.mux.Unlock()
 
 	if c.conn == nil {
-		return nil, fmt.Errorf("not connected to support service")
+		return nil, fmt.Errorf("%w: not connected", ErrSupportUnavailable)
 	}
 
 	c.reqID++
@@ -133,16 +161,16 @@ func (c *SupportClient) call(method string, params interface{}) (json.RawMessage
 	}
 
 	if err := c.encoder.Encode(req); err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, fmt.Errorf("%w: failed to send request: %w", ErrSupportUnavailable, err)
 	}
 
 	var resp SupportResponse
 	if err := c.decoder.Decode(&resp); err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return nil, fmt.Errorf("%w: failed to read response: %w", ErrSupportUnavailable, err)
 	}
 
 	if resp.Error != nil {
-		return nil, fmt.Errorf("support service error: %s (code: %d)", resp.Error.Message, resp.Error.Code)
+		return nil, fmt.Errorf("support service error: %w", resp.Error)
 	}
 
 	return resp.Result, nil
@@ -195,6 +223,35 @@ func (c *SupportClient) ReportStateChange(agentID, state string) error {
 	return err
 }
 
+// Heartbeat tells the support service the agent is alive, along with the
+// result of its health probe (detail says why it failed). An unhealthy
+// agent is moved to the error state, a healthy one the support service had
+// failed returns to its previous state. Returns how often the support
+// service expects heartbeats.
+func (c *SupportClient) Heartbeat(agentID string, healthy bool, detail string) (time.Duration, error) {
+	params := map[string]interface{}{
+		"agent_id": agentID,
+		"healthy":  healthy,
+	}
+	if detail != "" {
+		params["detail"] = detail
+	}
+
+	result, err := c.call("heartbeat", params)
+	if err != nil {
+		return 0, err
+	}
+
+	var response struct {
+		IntervalMs int64 `json:"interval_ms"`
+	}
+	if err := json.Unmarshal(result, &response); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal heartbeat response: %w", err)
+	}
+
+	return time.Duration(response.IntervalMs) * time.Millisecond, nil
+}
+
 func (c *SupportClient) GetPipelineDependencies(cellID string) ([]DependencyInfo, error) {
 	params := map[string]interface{}{}
 	if cellID != "" {
@@ -8,9 +8,13 @@ import (
 	"sync"
 	"time"
 
+	"github.com/tenzoki/agen/cellorg/internal/auth"
 	"github.com/tenzoki/agen/cellorg/internal/broker"
 	"github.com/tenzoki/agen/cellorg/internal/config"
 	"github.com/tenzoki/agen/cellorg/internal/deployer"
+	"github.com/tenzoki/agen/cellorg/internal/envelope"
+	"github.com/tenzoki/agen/cellorg/internal/federation"
+	"github.com/tenzoki/agen/cellorg/internal/schema"
 	"github.com/tenzoki/agen/cellorg/internal/support"
 	"github.com/tenzoki/agen/cellorg/public/client"
 )
@@ -143,10 +147,35 @@ func NewEmbedded(cfg Config) (*EmbeddedOrchestrator, error) {
 	// Start embedded services (Phase 3)
 	eo.servicesReady = make(chan struct{})
 
+	// TLS, agent credentials and topic ACLs shared by support and broker
+	security := cellorgConfig.Security
+	guard, err := auth.NewGuard(security)
+	if err != nil {
+		return nil, fmt.Errorf("invalid security configuration: %w", err)
+	}
+
 	// Create support service
 	eo.supportService = support.NewService(support.SupportConfig{
-		Port:  cfg.SupportPort,
-		Debug: cfg.Debug,
+		Port:        cfg.SupportPort,
+		Debug:       cfg.Debug,
+		MetricsPort: cellorgConfig.Support.MetricsPort,
+		DataDir:     cellorgConfig.Support.DataDir,
+	})
+	eo.supportService.SetGuard(guard)
+	if cellsConfig != nil {
+		eo.supportService.SetHealthChecks(cellsConfig)
+	}
+
+	// Agent state changes, including agents failed for missed heartbeats,
+	// reach the host application as "agents:state" events
+	eo.supportService.OnStateChange(func(agentID string, event support.StateChangeEvent) {
+		eo.eventBridge.Publish("agents:state", map[string]interface{}{
+			"agent_id":   agentID,
+			"from_state": event.FromState,
+			"to_state":   event.ToState,
+			"reason":     event.Reason,
+			"timestamp":  event.Timestamp,
+		})
 	})
 
 	// Load agent types into support service
@@ -158,16 +187,43 @@ func NewEmbedded(cfg Config) (*EmbeddedOrchestrator, error) {
 		}
 	}
 
-	// Create broker service
-	eo.brokerService = broker.NewService(struct {
-		Port, Protocol, Codec string
-		Debug                 bool
-	}{
+	// Create broker service (persistence settings come from cellorg.yaml)
+	eo.brokerService = broker.NewService(broker.BrokerConfig{
 		Port:     cfg.BrokerPort,
 		Protocol: "tcp",
-		Codec:    "json",
+		Codec:    cellorgConfig.Broker.Codec,
 		Debug:    cfg.Debug,
+		DataDir:  cellorgConfig.Broker.DataDir,
+
+		PriorityAging: time.Duration(cellorgConfig.Broker.PriorityAgingSeconds) * time.Second,
+		ExpiredPrefix: cellorgConfig.Broker.ExpiredPrefix,
+
+		VisibilityTimeout: time.Duration(cellorgConfig.Broker.VisibilityTimeoutSeconds) * time.Second,
+		MaxDeliveries:     cellorgConfig.Broker.MaxDeliveries,
+
+		PipeCapacity:   cellorgConfig.Broker.PipeCapacity,
+		OutboxCapacity: cellorgConfig.Broker.OutboxCapacity,
+		HighWatermark:  cellorgConfig.Broker.HighWatermark,
+
+		RetentionMessages: cellorgConfig.Broker.RetentionMessages,
+		RetentionAge:      time.Duration(cellorgConfig.Broker.RetentionAgeSeconds) * time.Second,
+		RetentionBytes:    cellorgConfig.Broker.RetentionBytes,
+
+		DedupWindow:   time.Duration(cellorgConfig.Broker.DedupWindowSeconds) * time.Second,
+		DedupCapacity: cellorgConfig.Broker.DedupCapacity,
+
+		RateLimits: cellorgConfig.Broker.RateLimits,
+
+		MetricsPort: cellorgConfig.Broker.MetricsPort,
 	})
+	eo.brokerService.SetGuard(guard)
+
+	// Payload schemas declared in the cells are enforced on publish
+	schemas, err := schema.FromConfig(cellorgConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema configuration: %w", err)
+	}
+	eo.brokerService.SetSchemas(schemas)
 
 	// Start services as goroutines
 	go func() {
@@ -202,7 +258,7 @@ func NewEmbedded(cfg Config) (*EmbeddedOrchestrator, error) {
 		Protocol: "tcp",
 		Address:  "localhost",
 		Port:     cfg.BrokerPort,
-		Codec:    "json",
+		Codec:    cellorgConfig.Broker.Codec,
 	}
 	if err := eo.supportService.SetBrokerAddress(brokerInfo); err != nil {
 		return nil, fmt.Errorf("failed to register broker with support: %w", err)
@@ -217,6 +273,14 @@ func NewEmbedded(cfg Config) (*EmbeddedOrchestrator, error) {
 	// Create broker client for alfa to communicate with agents
 	brokerAddress := "localhost" + cfg.BrokerPort
 	eo.brokerClient = client.NewBrokerClient(brokerAddress, "alfa-orchestrator", cfg.Debug)
+	eo.brokerClient.SetToken(security.AgentToken("alfa-orchestrator"))
+	if security.TLSEnabled {
+		tlsConfig, err := auth.ClientTLS(security.CAFile, security.ClientCertFile, security.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load broker client TLS settings: %w", err)
+		}
+		eo.brokerClient.SetTLS(tlsConfig)
+	}
 	if err := eo.brokerClient.Connect(); err != nil {
 		return nil, fmt.Errorf("failed to connect broker client: %w", err)
 	}
@@ -225,11 +289,18 @@ func NewEmbedded(cfg Config) (*EmbeddedOrchestrator, error) {
 		fmt.Printf("[Cellorg Embedded] Broker client connected to %s\n", brokerAddress)
 	}
 
+	// Bridge selected topics to the brokers of other cellorg instances
+	if _, err := federation.Start(eo.ctx, cellorgConfig, brokerAddress); err != nil {
+		return nil, fmt.Errorf("failed to start federation: %w", err)
+	}
+
 	// Create agent deployer (connects to embedded services)
 	supportAddress := "localhost" + cfg.SupportPort
 	// Determine framework root from ConfigPath (ConfigPath is workbench/config)
 	frameworkRoot := filepath.Dir(filepath.Dir(cfg.ConfigPath))
 	eo.agentDeployer = deployer.NewAgentDeployer(supportAddress, frameworkRoot, cfg.Debug)
+	eo.agentDeployer.SetSecurity(security)
+	eo.agentDeployer.SetTracing(cellorgConfig.Tracing)
 
 	// Load pool config into deployer
 	if poolConfig != nil {
@@ -509,6 +580,10 @@ func (eo *EmbeddedOrchestrator) Publish(topic string, data interface{}) error {
 }
 
 // PublishAndWait publishes a request and waits for a response
+//
+// The first event on the response topic is returned, whoever it answers;
+// concurrent callers on the same topics may swap responses. Use Request
+// with agents that reply via BrokerClient.Reply, as the agent framework does.
 func (eo *EmbeddedOrchestrator) PublishAndWait(
 	requestTopic string,
 	responseTopic string,
@@ -533,6 +608,21 @@ func (eo *EmbeddedOrchestrator) PublishAndWait(
 	}
 }
 
+// Request publishes data as an envelope of the given message type and waits
+// for the correlated reply (see BrokerClient.Request). Agents built on the
+// agent framework answer with their result.
+func (eo *EmbeddedOrchestrator) Request(ctx context.Context, topic string, messageType string, data interface{}) (*envelope.Envelope, error) {
+	if eo.brokerClient == nil {
+		return nil, fmt.Errorf("broker client not initialized")
+	}
+
+	env, err := envelope.NewEnvelope("alfa-orchestrator", fmt.Sprintf("pub:%s", topic), messageType, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	return eo.brokerClient.Request(ctx, topic, env)
+}
+
 // ListCells returns information about all running cells
 func (eo *EmbeddedOrchestrator) ListCells() []CellInfo {
 	eo.cellsMutex.RLock()
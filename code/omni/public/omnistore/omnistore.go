@@ -126,6 +126,7 @@ type PerformanceConfig struct {
 	QueryTimeout      time.Duration `json:"query_timeout"`
 	CacheSize         int64         `json:"cache_size"`
 	WorkerPoolSize    int           `json:"worker_pool_size"`
+	SyncWrites        bool          `json:"sync_writes"` // Flush each write to disk before it returns
 }
 
 type SecurityConfig struct {
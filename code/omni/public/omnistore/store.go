@@ -35,6 +35,9 @@ func NewOmniStore(config *Config) (*OmniStoreImpl, error) {
 
 	// Initialize underlying storage
 	storageConfig := storage.DefaultConfig(config.DataDir)
+	if config.Performance != nil {
+		storageConfig.SyncWrites = config.Performance.SyncWrites
+	}
 	backingStore, err := storage.NewBadgerStore(storageConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize backing store: %w", err)